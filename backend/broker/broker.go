@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Broker types
+const (
+	TypeMemory   = "memory"
+	TypePostgres = "postgres"
+	TypeRedis    = "redis"
+)
+
+// ErrClosed is returned when publishing on a closed broker
+var ErrClosed = errors.New("broker is closed")
+
+// Handler receives a message published on the broker
+type Handler func(topic string, payload []byte)
+
+// Broker fans messages out to every node of the backend, including the one
+// that published them. Each node subscribes once and picks the topics it
+// cares about. Messages are delivered to a handler in the order they were
+// published by a given node, but delivery is best effort: a node that loses
+// its connection to the backbone misses what was published meanwhile.
+type Broker interface {
+	Publish(topic string, payload []byte) error
+	Subscribe(handler Handler)
+	Close() error
+}
+
+// Config selects and configures a broker
+type Config struct {
+	Type    string // "memory", "postgres" or "redis"
+	Channel string // NOTIFY channel or Redis channel shared by all nodes
+
+	PostgresDSN string
+
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+}
+
+// New creates the broker described by the config
+func New(config Config) (Broker, error) {
+	switch config.Type {
+	case TypeMemory, "":
+		return NewMemoryBroker(), nil
+	case TypePostgres:
+		return NewPostgresBroker(config.PostgresDSN, config.Channel)
+	case TypeRedis:
+		return NewRedisBroker(config.RedisAddr, config.RedisPassword, config.RedisDB, config.Channel)
+	default:
+		return nil, fmt.Errorf("unsupported broker type: %s", config.Type)
+	}
+}
+
+// NodeID returns the configured node ID, or one made of the host name and
+// process ID so that replicas on one host stay distinct
+func NodeID(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "node"
+	}
+	return hostname + "-" + strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(time.Now().UnixNano()%100000, 10)
+}
+
+// handlerList is the set of handlers of a broker that receives messages on a
+// single goroutine
+type handlerList struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func (l *handlerList) add(handler Handler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handlers = append(l.handlers, handler)
+}
+
+func (l *handlerList) dispatch(topic string, payload []byte) {
+	l.mu.RLock()
+	handlers := l.handlers
+	l.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+}
+
+// encodeMessage packs a topic and payload into one wire message
+func encodeMessage(topic string, payload []byte) []byte {
+	message := make([]byte, 0, len(topic)+1+len(payload))
+	message = append(message, topic...)
+	message = append(message, '\n')
+	return append(message, payload...)
+}
+
+// decodeMessage unpacks a wire message built by encodeMessage
+func decodeMessage(message []byte) (string, []byte, error) {
+	i := bytes.IndexByte(message, '\n')
+	if i < 0 {
+		return "", nil, errors.New("malformed broker message")
+	}
+	return string(message[:i]), message[i+1:], nil
+}
@@ -0,0 +1,198 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+// testBroker creates the broker of one node, connected to the nodes given
+// the same channel
+type testBroker func(t *testing.T, channel string) Broker
+
+// testBrokers returns the brokers to test: the in-memory broker always, and
+// PostgreSQL and Redis when CHATAPP_TEST_POSTGRES_DSN or
+// CHATAPP_TEST_REDIS_ADDR point at a server
+func testBrokers(t *testing.T) map[string]testBroker {
+	brokers := map[string]testBroker{}
+
+	// Nodes in one process share a single in-memory broker
+	brokers[TypeMemory] = func(t *testing.T, channel string) Broker {
+		shared := NewMemoryBroker()
+		t.Cleanup(func() { shared.Close() })
+		return shared
+	}
+
+	if dsn := os.Getenv("CHATAPP_TEST_POSTGRES_DSN"); dsn != "" {
+		brokers[TypePostgres] = func(t *testing.T, channel string) Broker {
+			b, err := NewPostgresBroker(dsn, channel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { b.Close() })
+			return b
+		}
+	}
+	if addr := os.Getenv("CHATAPP_TEST_REDIS_ADDR"); addr != "" {
+		brokers[TypeRedis] = func(t *testing.T, channel string) Broker {
+			b, err := NewRedisBroker(addr, os.Getenv("CHATAPP_TEST_REDIS_PASSWORD"), 0, channel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { b.Close() })
+			return b
+		}
+	}
+	return brokers
+}
+
+// testChannel returns a channel of its own for each test, so that tests and
+// runs sharing a server do not see each other's messages
+func testChannel() string {
+	return "chatapp_test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// testNodes returns the brokers of two nodes
+func testNodes(t *testing.T, brokerType string, newBroker testBroker) (Broker, Broker) {
+	channel := testChannel()
+	first := newBroker(t, channel)
+	if brokerType == TypeMemory {
+		return first, first
+	}
+	return first, newBroker(t, channel)
+}
+
+type received struct {
+	topic   string
+	payload []byte
+}
+
+// subscribe collects what a node receives
+func subscribe(b Broker) <-chan received {
+	messages := make(chan received, 1024)
+	b.Subscribe(func(topic string, payload []byte) {
+		messages <- received{topic: topic, payload: append([]byte(nil), payload...)}
+	})
+	return messages
+}
+
+// expect waits for the next message a node receives and compares it
+func expect(t *testing.T, name string, messages <-chan received, topic string, payload []byte) {
+	t.Helper()
+	select {
+	case m := <-messages:
+		if m.topic != topic || !bytes.Equal(m.payload, payload) {
+			t.Fatalf("%s received %q with %d bytes, want %q with %d bytes", name, m.topic, len(m.payload), topic, len(payload))
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("%s received nothing, want %q", name, topic)
+	}
+}
+
+func TestBrokers(t *testing.T) {
+	for brokerType, newBroker := range testBrokers(t) {
+		newBroker := newBroker
+		t.Run(brokerType, func(t *testing.T) {
+			t.Run("every node receives what any node publishes", func(t *testing.T) {
+				a, b := testNodes(t, brokerType, newBroker)
+				atA, atB := subscribe(a), subscribe(b)
+
+				if err := a.Publish("room:1", []byte("from a")); err != nil {
+					t.Fatal(err)
+				}
+				expect(t, "a", atA, "room:1", []byte("from a"))
+				expect(t, "b", atB, "room:1", []byte("from a"))
+
+				if err := b.Publish("user:2", []byte("from b")); err != nil {
+					t.Fatal(err)
+				}
+				expect(t, "a", atA, "user:2", []byte("from b"))
+				expect(t, "b", atB, "user:2", []byte("from b"))
+			})
+
+			t.Run("messages of a node arrive in the order it published them", func(t *testing.T) {
+				a, b := testNodes(t, brokerType, newBroker)
+				atB := subscribe(b)
+				const count = 200
+				for i := 0; i < count; i++ {
+					if err := a.Publish("room:1", []byte(strconv.Itoa(i))); err != nil {
+						t.Fatal(err)
+					}
+				}
+				for i := 0; i < count; i++ {
+					expect(t, "b", atB, "room:1", []byte(strconv.Itoa(i)))
+				}
+			})
+
+			t.Run("binary and large payloads arrive intact", func(t *testing.T) {
+				a, b := testNodes(t, brokerType, newBroker)
+				atB := subscribe(b)
+
+				binary := []byte("line\nbreaks\x00and zero bytes\xff")
+				// Larger than a PostgreSQL NOTIFY payload may be
+				large := bytes.Repeat([]byte("0123456789abcdef"), 4<<10)
+				for _, payload := range [][]byte{binary, {}, large} {
+					if err := a.Publish("room:1", payload); err != nil {
+						t.Fatal(err)
+					}
+					expect(t, "b", atB, "room:1", payload)
+				}
+			})
+
+			t.Run("a handler may publish in turn", func(t *testing.T) {
+				a, b := testNodes(t, brokerType, newBroker)
+				atA := subscribe(a)
+				b.Subscribe(func(topic string, payload []byte) {
+					if topic == "ping" {
+						b.Publish("pong", payload)
+					}
+				})
+
+				if err := a.Publish("ping", []byte("1")); err != nil {
+					t.Fatal(err)
+				}
+				expect(t, "a", atA, "ping", []byte("1"))
+				expect(t, "a", atA, "pong", []byte("1"))
+			})
+
+			t.Run("a closed broker refuses to publish", func(t *testing.T) {
+				b := newBroker(t, testChannel())
+				if err := b.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if err := b.Publish("room:1", []byte("late")); !errors.Is(err, ErrClosed) {
+					t.Fatalf("publishing after close returned %v, want %v", err, ErrClosed)
+				}
+			})
+		})
+	}
+}
+
+func TestMessageEncoding(t *testing.T) {
+	tests := []struct {
+		topic   string
+		payload []byte
+	}{
+		{"room:1", []byte(`{"v":1}`)},
+		{"user:42", []byte("with\nnewlines\n")},
+		{"presence", nil},
+	}
+	for _, tt := range tests {
+		topic, payload, err := decodeMessage(encodeMessage(tt.topic, tt.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if topic != tt.topic || !bytes.Equal(payload, tt.payload) {
+			t.Errorf("decoded %q %q, want %q %q", topic, payload, tt.topic, tt.payload)
+		}
+	}
+
+	if _, _, err := decodeMessage([]byte("no topic")); err == nil {
+		t.Error("decoding a message without a topic succeeded")
+	}
+}
@@ -0,0 +1,115 @@
+package broker
+
+import "sync"
+
+type memoryMessage struct {
+	topic   string
+	payload []byte
+}
+
+// memorySubscriber delivers messages to one handler on its own goroutine. Its
+// queue is unbounded so that a handler publishing in turn never deadlocks.
+type memorySubscriber struct {
+	handler Handler
+
+	mu      sync.Mutex
+	pending []memoryMessage
+	closed  bool
+	wake    chan struct{}
+}
+
+func (s *memorySubscriber) push(message memoryMessage) {
+	s.mu.Lock()
+	s.pending = append(s.pending, message)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *memorySubscriber) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *memorySubscriber) run() {
+	for range s.wake {
+		s.mu.Lock()
+		pending, closed := s.pending, s.closed
+		s.pending = nil
+		s.mu.Unlock()
+
+		for _, message := range pending {
+			s.handler(message.topic, message.payload)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// MemoryBroker is a broker within one process. A single node uses it when
+// there is nothing to scale out to; several hubs sharing one instance behave
+// like nodes sharing a real backbone, which is how multi-node setups are
+// exercised without external services.
+type MemoryBroker struct {
+	mu          sync.RWMutex
+	subscribers []*memorySubscriber
+	closed      bool
+}
+
+// NewMemoryBroker creates an in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+func (b *MemoryBroker) Publish(topic string, payload []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	// Subscribers must not see later changes made by the publisher
+	message := memoryMessage{topic: topic, payload: append([]byte(nil), payload...)}
+	for _, subscriber := range b.subscribers {
+		subscriber.push(message)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(handler Handler) {
+	subscriber := &memorySubscriber{handler: handler, wake: make(chan struct{}, 1)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.subscribers = append(b.subscribers, subscriber)
+	go subscriber.run()
+}
+
+// Close stops delivery once the messages already published are handled
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for _, subscriber := range b.subscribers {
+		subscriber.close()
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// NOTIFY payloads must stay under 8000 bytes; larger messages are stored
+	// in a table and only their ID is notified
+	maxNotifyPayload = 7900
+
+	// Stored messages are kept long enough for every listener to fetch them
+	storedMessageTTL = time.Minute
+
+	// Publishing and reading stored messages use at most this many
+	// connections, each statement bounded by queryTimeout
+	maxConns     = 4
+	queryTimeout = 5 * time.Second
+)
+
+// PostgresBroker shares messages between nodes with LISTEN/NOTIFY on the
+// application database, so scaling out needs no extra infrastructure.
+type PostgresBroker struct {
+	dsn     string
+	channel string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Connections for NOTIFY and reads of stored messages. A connection is
+	// used by one caller at a time, so slots holds a token per open
+	// connection and idle the ones not in use; mu only orders returning a
+	// connection against Close and is never held during a round trip.
+	slots  chan struct{}
+	idle   chan *pgx.Conn
+	mu     sync.Mutex
+	closed bool
+
+	handlers handlerList
+}
+
+// NewPostgresBroker connects to PostgreSQL and listens on the channel
+func NewPostgresBroker(dsn, channel string) (*PostgresBroker, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &PostgresBroker{
+		dsn:     dsn,
+		channel: channel,
+		ctx:     ctx,
+		cancel:  cancel,
+		slots:   make(chan struct{}, maxConns),
+		idle:    make(chan *pgx.Conn, maxConns),
+	}
+
+	err := b.withConn(func(ctx context.Context, conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, `CREATE UNLOGGED TABLE IF NOT EXISTS broker_messages (
+			id BIGSERIAL PRIMARY KEY,
+			message BYTEA NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+		return err
+	})
+	if err != nil {
+		b.Close()
+		return nil, fmt.Errorf("failed to create broker_messages table: %w", err)
+	}
+
+	listener, err := b.connectListener()
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	go b.listen(listener)
+	go b.pruneStoredMessages()
+	return b, nil
+}
+
+func (b *PostgresBroker) connectListener() (*pgx.Conn, error) {
+	conn, err := pgx.Connect(b.ctx, b.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if _, err := conn.Exec(b.ctx, "LISTEN "+pgx.Identifier{b.channel}.Sanitize()); err != nil {
+		conn.Close(context.Background())
+		return nil, fmt.Errorf("failed to listen on channel %s: %w", b.channel, err)
+	}
+	return conn, nil
+}
+
+// listen delivers notifications, reconnecting the listener until the broker
+// is closed
+func (b *PostgresBroker) listen(conn *pgx.Conn) {
+	for {
+		for conn != nil {
+			notification, err := conn.WaitForNotification(b.ctx)
+			if err != nil {
+				conn.Close(context.Background())
+				conn = nil
+				if b.ctx.Err() == nil {
+					log.Printf("Broker listener disconnected: %v", err)
+				}
+				break
+			}
+			b.handle(notification.Payload)
+		}
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		var err error
+		if conn, err = b.connectListener(); err != nil {
+			log.Printf("Failed to reconnect broker listener: %v", err)
+		}
+	}
+}
+
+func (b *PostgresBroker) handle(notifyPayload string) {
+	var message []byte
+	var err error
+	if id, ok := strings.CutPrefix(notifyPayload, "#"); ok {
+		message, err = b.loadStoredMessage(id)
+	} else {
+		message, err = base64.StdEncoding.DecodeString(notifyPayload)
+	}
+	if err != nil {
+		log.Printf("Dropping broker message: %v", err)
+		return
+	}
+
+	topic, payload, err := decodeMessage(message)
+	if err != nil {
+		log.Printf("Dropping broker message: %v", err)
+		return
+	}
+	b.handlers.dispatch(topic, payload)
+}
+
+func (b *PostgresBroker) loadStoredMessage(id string) ([]byte, error) {
+	messageID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stored message id %q", id)
+	}
+
+	var message []byte
+	err = b.withConn(func(ctx context.Context, conn *pgx.Conn) error {
+		return conn.QueryRow(ctx, "SELECT message FROM broker_messages WHERE id = $1", messageID).Scan(&message)
+	})
+	return message, err
+}
+
+func (b *PostgresBroker) Publish(topic string, payload []byte) error {
+	message := encodeMessage(topic, payload)
+	notifyPayload := base64.StdEncoding.EncodeToString(message)
+
+	return b.withConn(func(ctx context.Context, conn *pgx.Conn) error {
+		if len(notifyPayload) > maxNotifyPayload {
+			var id int64
+			err := conn.QueryRow(ctx, "INSERT INTO broker_messages (message) VALUES ($1) RETURNING id", message).Scan(&id)
+			if err != nil {
+				return err
+			}
+			notifyPayload = "#" + strconv.FormatInt(id, 10)
+		}
+		_, err := conn.Exec(ctx, "SELECT pg_notify($1, $2)", b.channel, notifyPayload)
+		return err
+	})
+}
+
+// withConn runs f on a connection of its own, within queryTimeout. A lost
+// connection, or one whose statement timed out, is dropped and replaced by
+// the next caller.
+func (b *PostgresBroker) withConn(f func(ctx context.Context, conn *pgx.Conn) error) error {
+	if b.ctx.Err() != nil {
+		return ErrClosed
+	}
+	ctx, cancel := context.WithTimeout(b.ctx, queryTimeout)
+	defer cancel()
+
+	conn, err := b.acquire(ctx)
+	if err != nil {
+		if b.ctx.Err() != nil {
+			return ErrClosed
+		}
+		return err
+	}
+	err = f(ctx, conn)
+	b.release(conn)
+	return err
+}
+
+// acquire takes an idle connection, or opens one while fewer than maxConns
+// are open, waiting for either until ctx is done
+func (b *PostgresBroker) acquire(ctx context.Context) (*pgx.Conn, error) {
+	select {
+	case conn := <-b.idle:
+		return conn, nil
+	default:
+	}
+
+	select {
+	case conn := <-b.idle:
+		return conn, nil
+	case b.slots <- struct{}{}:
+		conn, err := pgx.Connect(ctx, b.dsn)
+		if err != nil {
+			<-b.slots
+			return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+		}
+		return conn, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no postgres connection available: %w", ctx.Err())
+	}
+}
+
+// release returns a connection to the idle ones, or closes it if it was
+// lost or the broker is closed
+func (b *PostgresBroker) release(conn *pgx.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed || conn.IsClosed() {
+		conn.Close(context.Background())
+		<-b.slots
+		return
+	}
+	b.idle <- conn
+}
+
+func (b *PostgresBroker) pruneStoredMessages() {
+	ticker := time.NewTicker(storedMessageTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := b.withConn(func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, "DELETE FROM broker_messages WHERE created_at < $1", time.Now().Add(-storedMessageTTL))
+			return err
+		})
+		if err != nil && err != ErrClosed {
+			log.Printf("Failed to prune broker messages: %v", err)
+		}
+	}
+}
+
+func (b *PostgresBroker) Subscribe(handler Handler) {
+	b.handlers.add(handler)
+}
+
+func (b *PostgresBroker) Close() error {
+	b.cancel()
+
+	// Connections in use are closed as they are released
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	for {
+		select {
+		case conn := <-b.idle:
+			conn.Close(context.Background())
+			<-b.slots
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBroker shares messages between nodes over Redis pub/sub. The client
+// reconnects and resubscribes on its own after a connection loss.
+type RedisBroker struct {
+	client   *redis.Client
+	pubsub   *redis.PubSub
+	channel  string
+	handlers handlerList
+}
+
+// NewRedisBroker connects to Redis and subscribes to the channel
+func NewRedisBroker(addr, password string, db int, channel string) (*RedisBroker, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr, Password: password, DB: db})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	pubsub := client.Subscribe(ctx, channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		client.Close()
+		return nil, fmt.Errorf("failed to subscribe to redis channel %s: %w", channel, err)
+	}
+
+	b := &RedisBroker{client: client, pubsub: pubsub, channel: channel}
+	go b.listen()
+	return b, nil
+}
+
+func (b *RedisBroker) listen() {
+	for message := range b.pubsub.Channel() {
+		topic, payload, err := decodeMessage([]byte(message.Payload))
+		if err != nil {
+			log.Printf("Dropping broker message: %v", err)
+			continue
+		}
+		b.handlers.dispatch(topic, payload)
+	}
+}
+
+func (b *RedisBroker) Publish(topic string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := b.client.Publish(ctx, b.channel, encodeMessage(topic, payload)).Err()
+	if errors.Is(err, redis.ErrClosed) {
+		return ErrClosed
+	}
+	return err
+}
+
+func (b *RedisBroker) Subscribe(handler Handler) {
+	b.handlers.add(handler)
+}
+
+func (b *RedisBroker) Close() error {
+	b.pubsub.Close()
+	return b.client.Close()
+}
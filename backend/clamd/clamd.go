@@ -0,0 +1,151 @@
+// Package clamd is a client of the ClamAV daemon. Content is scanned with
+// the INSTREAM command, which streams it over the connection so the daemon
+// needs no access to where it is stored.
+package clamd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ChunkSize is the size of the chunks content is streamed in
+const ChunkSize = 64 << 10
+
+// ErrUnavailable is returned when the daemon cannot be reached or stops
+// answering; scanning again later may succeed
+var ErrUnavailable = errors.New("clamd is unavailable")
+
+// ErrReadContent is returned when the content being scanned cannot be read,
+// which is no fault of the daemon
+var ErrReadContent = errors.New("failed to read content")
+
+// Result is the verdict on scanned content
+type Result struct {
+	Infected bool
+	// Signature names what was found in infected content
+	Signature string
+}
+
+// Client talks to a clamd daemon, one connection per command
+type Client struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// New creates a client of the daemon at address: "tcp://host:port",
+// "unix:///path/to/clamd.sock", or a bare host:port or socket path. timeout
+// bounds every command, including streaming the content.
+func New(address string, timeout time.Duration) *Client {
+	network := "tcp"
+	switch {
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "unix://"):
+		network, address = "unix", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "/"):
+		network = "unix"
+	}
+	return &Client{network: network, address: address, timeout: timeout}
+}
+
+// Ping checks that the daemon answers
+func (c *Client) Ping() error {
+	reply, err := c.command("PING", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+	return nil
+}
+
+// Scan streams content to the daemon and returns its verdict. Content the
+// daemon refuses, such as content over its StreamMaxLength, is an error
+// other than ErrUnavailable.
+func (c *Client) Scan(content io.Reader) (*Result, error) {
+	reply, err := c.command("INSTREAM", content)
+	if err != nil {
+		return nil, err
+	}
+
+	// "stream: OK", "stream: <signature> FOUND" or "<reason> ERROR"
+	switch {
+	case strings.HasSuffix(reply, " ERROR"):
+		return nil, fmt.Errorf("clamd: %s", strings.TrimSuffix(reply, " ERROR"))
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(reply, " FOUND")
+		if i := strings.LastIndex(signature, ": "); i >= 0 {
+			signature = signature[i+2:]
+		}
+		return &Result{Infected: true, Signature: signature}, nil
+	case strings.HasSuffix(reply, ": OK"):
+		return &Result{}, nil
+	default:
+		return nil, fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+}
+
+// command sends a null-terminated command, streams content after it if
+// given, and returns the reply
+func (c *Client) command(name string, content io.Reader) (string, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer conn.Close()
+	if c.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	writeErr := c.send(conn, name, content)
+	if errors.Is(writeErr, ErrReadContent) {
+		return "", writeErr
+	}
+
+	// The daemon answers and closes the connection when it refuses content,
+	// which fails the write; its reply says why
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (reply == "" || !errors.Is(err, io.EOF)) {
+		if writeErr != nil {
+			err = writeErr
+		}
+		return "", fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+func (c *Client) send(conn net.Conn, name string, content io.Reader) error {
+	writer := bufio.NewWriterSize(conn, ChunkSize+4)
+	writer.WriteString("z" + name + "\x00")
+	if content != nil {
+		chunk := make([]byte, ChunkSize)
+		size := make([]byte, 4)
+		for {
+			n, err := io.ReadFull(content, chunk)
+			if n > 0 {
+				binary.BigEndian.PutUint32(size, uint32(n))
+				writer.Write(size)
+				if _, err := writer.Write(chunk[:n]); err != nil {
+					return err
+				}
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrReadContent, err)
+			}
+		}
+		// A zero-length chunk ends the stream
+		writer.Write(make([]byte, 4))
+	}
+	return writer.Flush()
+}
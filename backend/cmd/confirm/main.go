@@ -0,0 +1,409 @@
+// Command confirm checks uploads made with presigned URLs and confirmed into
+// files, against the local storage with in-memory stand-ins for the
+// database: confirmed content is copied to its content's path under blobs/,
+// which no upload URL points at, so writing to the presigned URL again cannot
+// change the file; identical content is stored once; uploads that fail their
+// checks can be retried or are discarded; and content recorded at other
+// paths is relocated.
+//
+//	go run ./cmd/confirm
+package main
+
+import (
+	"bytes"
+	"chatapp/config"
+	"chatapp/models"
+	"chatapp/repository"
+	"chatapp/service"
+	"chatapp/storage"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// pendingStore stands in for the pending_uploads table
+type pendingStore struct {
+	mu      sync.Mutex
+	uploads map[string]*models.PendingUpload
+	nextID  uint
+}
+
+var _ repository.PendingUploadRepository = (*pendingStore)(nil)
+
+func (r *pendingStore) Create(upload *models.PendingUpload) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	upload.ID = r.nextID
+	stored := *upload
+	r.uploads[upload.ObjectPath] = &stored
+	return nil
+}
+
+func (r *pendingStore) GetByObjectPath(objectPath string) (*models.PendingUpload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	upload, ok := r.uploads[objectPath]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+	found := *upload
+	return &found, nil
+}
+
+func (r *pendingStore) Delete(id uint) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for objectPath, upload := range r.uploads {
+		if upload.ID == id {
+			delete(r.uploads, objectPath)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *pendingStore) GetExpired(now time.Time, limit int) ([]models.PendingUpload, error) {
+	return nil, nil
+}
+
+// blobStore stands in for the blobs table
+type blobStore struct {
+	mu    sync.Mutex
+	blobs map[string]*models.Blob
+}
+
+var _ repository.BlobRepository = (*blobStore)(nil)
+
+func (r *blobStore) GetBySHA256(sum string) (*models.Blob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	blob, ok := r.blobs[sum]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+	found := *blob
+	return &found, nil
+}
+
+func (r *blobStore) Acquire(blob *models.Blob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.blobs[blob.SHA256]
+	if !ok {
+		stored = blob
+		stored.ID = uint(len(r.blobs) + 1)
+		r.blobs[blob.SHA256] = stored
+	}
+	stored.RefCount++
+	*blob = *stored
+	return nil
+}
+
+func (r *blobStore) AddRef(id uint) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, blob := range r.blobs {
+		if blob.ID == id && blob.RefCount > 0 {
+			blob.RefCount++
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *blobStore) Release(id uint) (*models.Blob, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for sum, blob := range r.blobs {
+		if blob.ID == id {
+			blob.RefCount--
+			if blob.RefCount > 0 {
+				return blob, false, nil
+			}
+			delete(r.blobs, sum)
+			return blob, true, nil
+		}
+	}
+	return nil, false, errors.New("record not found")
+}
+
+func (r *blobStore) GetOutside(prefix string, afterID uint, limit int) ([]models.Blob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var blobs []models.Blob
+	for _, blob := range r.blobs {
+		if blob.ID > afterID && !strings.HasPrefix(blob.ObjectPath, prefix) && len(blobs) < limit {
+			blobs = append(blobs, *blob)
+		}
+	}
+	return blobs, nil
+}
+
+func (r *blobStore) Move(id uint, from, to string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, blob := range r.blobs {
+		if blob.ID == id && blob.ObjectPath == from {
+			blob.ObjectPath = to
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rooms stands in for the chat_rooms table: room 1 takes files up to 1 KB
+type rooms struct{ repository.ChatRoomRepository }
+
+func (rooms) GetByID(id uint) (*models.ChatRoom, error) {
+	if id != 1 {
+		return nil, errors.New("record not found")
+	}
+	return &models.ChatRoom{ID: id, MaxFileSize: 1 << 10}, nil
+}
+
+// env is a file service over the local storage
+type env struct {
+	files   *service.FileService
+	storage storage.Storage
+}
+
+// put writes content to a presigned upload's object, as its uploader does
+func (e *env) put(pending *models.PendingUpload, content string) error {
+	_, err := e.storage.Upload(pending.ObjectPath, strings.NewReader(content), storage.UploadOptions{ContentType: "text/plain"})
+	return err
+}
+
+// expectContent checks that an object holds the given content
+func (e *env) expectContent(objectPath, content string) error {
+	reader, err := storage.OpenObject(e.storage, objectPath)
+	if err != nil {
+		return fmt.Errorf("object %s: %v", objectPath, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("object %s: %v", objectPath, err)
+	}
+	if !bytes.Equal(data, []byte(content)) {
+		return fmt.Errorf("object %s holds %q, want %q", objectPath, data, content)
+	}
+	return nil
+}
+
+// expectGone checks that an object was deleted
+func (e *env) expectGone(objectPath string) error {
+	if exists, _ := e.storage.Exists(objectPath); exists {
+		return fmt.Errorf("object %s was not deleted", objectPath)
+	}
+	return nil
+}
+
+func md5Hex(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func main() {
+	dir, err := os.MkdirTemp("", "chatapp-confirm-")
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+
+	config.GlobalConfig = &config.Config{Storage: config.StorageConfig{Type: storage.StorageTypeLocal}}
+	viper.Set("local.dir", dir)
+	viper.Set("local.base_url", "http://localhost:8080")
+	viper.Set("local.signing_key", "confirm-check")
+	pending := &pendingStore{uploads: make(map[string]*models.PendingUpload)}
+	files := service.NewFileService(nil, rooms{}, pending, &blobStore{blobs: make(map[string]*models.Blob)}, 50<<20)
+	e := &env{files: files, storage: files.Storage()}
+
+	failed := false
+	check := func(name string, f func() error) {
+		if err := f(); err != nil {
+			fmt.Printf("❌ %s: %v\n", name, err)
+			failed = true
+			return
+		}
+		fmt.Printf("✅ %s\n", name)
+	}
+
+	check("a confirmed upload is copied away from its presigned path", func() error {
+		_, upload, err := files.GetUploadURL("notes.txt", 1, 5, 0, "text/plain", "")
+		if err != nil {
+			return err
+		}
+		if err := e.put(upload, "first draft"); err != nil {
+			return err
+		}
+		record, err := files.ConfirmUpload(upload.ObjectPath, 5, md5Hex("first draft"))
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(record.FilePath, "blobs/") || record.FileSize != int64(len("first draft")) || record.BlobID == nil {
+			return fmt.Errorf("file %+v", record)
+		}
+		if err := e.expectGone(upload.ObjectPath); err != nil {
+			return err
+		}
+
+		// The presigned URL is still valid; writing to it again must not
+		// reach the confirmed file
+		if err := e.put(upload, "<script>alert(1)</script>"); err != nil {
+			return err
+		}
+		if err := e.expectContent(record.FilePath, "first draft"); err != nil {
+			return err
+		}
+		if _, err := files.ConfirmUpload(upload.ObjectPath, 5, ""); err == nil || err.Error() != "pending upload not found" {
+			return fmt.Errorf("confirming again: %v", err)
+		}
+		return nil
+	})
+
+	check("identical confirmed content is stored once", func() error {
+		var paths []string
+		for i := 0; i < 2; i++ {
+			_, upload, err := files.GetUploadURL("same.txt", 1, 5, 0, "", "")
+			if err != nil {
+				return err
+			}
+			if err := e.put(upload, "same content"); err != nil {
+				return err
+			}
+			record, err := files.ConfirmUpload(upload.ObjectPath, 5, "")
+			if err != nil {
+				return err
+			}
+			if err := e.expectGone(upload.ObjectPath); err != nil {
+				return err
+			}
+			paths = append(paths, record.FilePath)
+		}
+		if paths[0] != paths[1] {
+			return fmt.Errorf("stored at %s and %s", paths[0], paths[1])
+		}
+		return e.expectContent(paths[0], "same content")
+	})
+
+	check("an upload that fails its checksum can be uploaded again", func() error {
+		_, upload, err := files.GetUploadURL("retry.txt", 1, 5, 0, "", md5Hex("expected"))
+		if err != nil {
+			return err
+		}
+		if err := e.put(upload, "corrupted"); err != nil {
+			return err
+		}
+		if _, err := files.ConfirmUpload(upload.ObjectPath, 5, ""); err == nil || err.Error() != "checksum mismatch" {
+			return fmt.Errorf("confirming corrupted content: %v", err)
+		}
+		if _, err := files.ConfirmUpload(upload.ObjectPath, 6, ""); err == nil || err.Error() != "pending upload not found" {
+			return fmt.Errorf("confirming someone else's upload: %v", err)
+		}
+		if err := e.put(upload, "expected"); err != nil {
+			return err
+		}
+		record, err := files.ConfirmUpload(upload.ObjectPath, 5, "")
+		if err != nil {
+			return err
+		}
+		return e.expectContent(record.FilePath, "expected")
+	})
+
+	check("an upload over the room's limit is discarded", func() error {
+		_, upload, err := files.GetUploadURL("large.bin", 1, 5, 0, "", "")
+		if err != nil {
+			return err
+		}
+		if err := e.put(upload, strings.Repeat("x", 2<<10)); err != nil {
+			return err
+		}
+		if _, err := files.ConfirmUpload(upload.ObjectPath, 5, ""); err == nil || err.Error() != "file is too large" {
+			return fmt.Errorf("confirming a large upload: %v", err)
+		}
+		if _, err := pending.GetByObjectPath(upload.ObjectPath); err == nil {
+			return fmt.Errorf("pending upload was kept")
+		}
+		return e.expectGone(upload.ObjectPath)
+	})
+
+	check("content recorded at an upload path is relocated under blobs/", func() error {
+		blobs := &blobStore{blobs: make(map[string]*models.Blob)}
+		relocating := service.NewFileService(nil, rooms{}, pending, blobs, 50<<20)
+		legacy := func(objectPath, recorded, stored string) error {
+			if _, err := e.storage.Upload(objectPath, strings.NewReader(stored), storage.UploadOptions{}); err != nil {
+				return err
+			}
+			return blobs.Acquire(&models.Blob{SHA256: sha256Hex(recorded), ObjectPath: objectPath, Size: int64(len(recorded))})
+		}
+		if err := legacy("chatroom-1/1-kept.txt", "kept", "kept"); err != nil {
+			return err
+		}
+		if err := legacy("chatroom-1/2-overwritten.txt", "original", "overwritten"); err != nil {
+			return err
+		}
+
+		misplaced, err := relocating.MisplacedBlobs(0, 10)
+		if err != nil {
+			return err
+		}
+		if len(misplaced) != 2 {
+			return fmt.Errorf("%d blobs to relocate, want 2", len(misplaced))
+		}
+		for i := range misplaced {
+			err := relocating.RelocateBlob(&misplaced[i])
+			if misplaced[i].ObjectPath == "chatroom-1/2-overwritten.txt" {
+				if err == nil {
+					return fmt.Errorf("relocated content that no longer matches its SHA-256")
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := e.expectGone("chatroom-1/1-kept.txt"); err != nil {
+			return err
+		}
+		blob, err := blobs.GetBySHA256(sha256Hex("kept"))
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(blob.ObjectPath, "blobs/") {
+			return fmt.Errorf("content relocated to %s", blob.ObjectPath)
+		}
+		if err := e.expectContent(blob.ObjectPath, "kept"); err != nil {
+			return err
+		}
+		misplaced, err = relocating.MisplacedBlobs(0, 10)
+		if err != nil {
+			return err
+		}
+		if len(misplaced) != 1 || misplaced[0].ObjectPath != "chatroom-1/2-overwritten.txt" {
+			return fmt.Errorf("left to relocate: %+v", misplaced)
+		}
+		return nil
+	})
+
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Println("🎉 All confirm checks passed")
+}
@@ -0,0 +1,96 @@
+// Command dedupe backfills the content of files uploaded before files with
+// the same content shared one stored object: each file is hashed (SHA-256)
+// from its object, recorded, and pointed at the object already holding the
+// same content when there is one, or at a copy under blobs/. Objects no file
+// uses any more are deleted. Content recorded before it was kept under blobs/
+// is then moved there. Files and content already done are skipped, so the
+// command can be stopped and run again; run it while no files are uploaded.
+//
+//	go run ./cmd/dedupe [-batch 100]
+package main
+
+import (
+	"chatapp/config"
+	"chatapp/repository"
+	"chatapp/service"
+	"flag"
+	"log"
+)
+
+func main() {
+	batch := flag.Int("batch", 100, "files loaded per query")
+	flag.Parse()
+
+	if _, err := config.LoadConfig(); err != nil {
+		log.Fatal("Failed to load configuration:", err)
+	}
+	config.ConnectDatabase()
+	defer config.CloseDatabase()
+	config.MigrateDatabase()
+
+	fileService := service.NewFileService(
+		repository.NewFileRepository(config.DB),
+		repository.NewChatRoomRepository(config.DB),
+		repository.NewPendingUploadRepository(config.DB),
+		repository.NewBlobRepository(config.DB),
+		config.GlobalConfig.Upload.MaxFileSize,
+	)
+
+	var hashed, merged, failed int
+	var saved int64
+	var afterID uint
+	for {
+		files, err := fileService.FilesWithoutBlob(afterID, *batch)
+		if err != nil {
+			log.Fatalf("Failed to list files: %v", err)
+		}
+		if len(files) == 0 {
+			break
+		}
+		for i := range files {
+			file := &files[i]
+			afterID = file.ID
+
+			ok, err := fileService.BackfillBlob(file)
+			if err != nil {
+				// Files that failed stay unrecorded and are retried by the next run
+				log.Printf("File %d (%s): %v", file.ID, file.FilePath, err)
+				failed++
+				continue
+			}
+			hashed++
+			if ok {
+				merged++
+				saved += file.FileSize
+			}
+		}
+		log.Printf("Processed files up to %d: %d hashed, %d merged, %d failed", afterID, hashed, merged, failed)
+	}
+
+	log.Printf("Done: %d files hashed, %d merged into existing content (%d bytes freed), %d failed", hashed, merged, saved, failed)
+
+	var relocated, relocateFailed int
+	var afterBlobID uint
+	for {
+		blobs, err := fileService.MisplacedBlobs(afterBlobID, *batch)
+		if err != nil {
+			log.Fatalf("Failed to list content: %v", err)
+		}
+		if len(blobs) == 0 {
+			break
+		}
+		for i := range blobs {
+			blob := &blobs[i]
+			afterBlobID = blob.ID
+
+			if err := fileService.RelocateBlob(blob); err != nil {
+				log.Printf("Content %d (%s): %v", blob.ID, blob.ObjectPath, err)
+				relocateFailed++
+				continue
+			}
+			relocated++
+		}
+	}
+
+	log.Printf("Done: %d contents moved under blobs/, %d failed", relocated, relocateFailed)
+}
@@ -0,0 +1,263 @@
+// Command localstorage checks the local filesystem storage backend through
+// the routes that serve it: files uploaded and downloaded with signed URLs,
+// signatures that expire and cannot be reused for another object or method,
+// object paths that cannot escape the storage directory, and uploads other
+// than images that are never rendered in the browser.
+//
+//	go run ./cmd/localstorage
+package main
+
+import (
+	"bytes"
+	"chatapp/controllers"
+	"chatapp/storage"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const objectPath = "chatroom-1/1700000000-报告 final.txt"
+
+// do sends a request and returns its status and body
+func do(method, rawURL string, body []byte, header http.Header) (int, []byte, error) {
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// expectStatus sends a request and checks its status
+func expectStatus(method, rawURL string, body []byte, want int) error {
+	status, data, err := do(method, rawURL, body, nil)
+	if err != nil {
+		return err
+	}
+	if status != want {
+		return fmt.Errorf("%s %s returned %d (%s), want %d", method, rawURL, status, data, want)
+	}
+	return nil
+}
+
+func main() {
+	gin.SetMode(gin.ReleaseMode)
+
+	dir, err := os.MkdirTemp("", "chatapp-localstorage-")
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "objects")
+
+	engine := gin.New()
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	local, err := storage.NewStorageFactory().CreateStorage(storage.StorageTypeLocal, storage.LocalStorageConfig{
+		Dir:        root,
+		BaseURL:    server.URL,
+		SigningKey: "localstorage-check",
+	})
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+	storageController := controllers.NewStorageController(local.(*storage.LocalStorage), 50<<20)
+	engine.GET("/api/storage/local/*path", storageController.ServeObject)
+	engine.HEAD("/api/storage/local/*path", storageController.ServeObject)
+	engine.PUT("/api/storage/local/*path", storageController.PutObject)
+
+	failed := false
+	check := func(name string, f func() error) {
+		if err := f(); err != nil {
+			fmt.Printf("❌ %s: %v\n", name, err)
+			failed = true
+			return
+		}
+		fmt.Printf("✅ %s\n", name)
+	}
+
+	content := []byte(strings.Repeat("chatapp local storage\n", 100))
+
+	check("a file uploaded with a signed PUT URL downloads with a signed GET URL", func() error {
+		uploadURL, err := local.GetUploadURL(objectPath, time.Minute)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(http.MethodPut, uploadURL, content, http.StatusOK); err != nil {
+			return err
+		}
+
+		downloadURL, err := local.Download(objectPath, time.Minute)
+		if err != nil {
+			return err
+		}
+		status, data, err := do(http.MethodGet, downloadURL, nil, nil)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK || !bytes.Equal(data, content) {
+			return fmt.Errorf("download returned %d with %d bytes, want %d bytes", status, len(data), len(content))
+		}
+
+		status, data, err = do(http.MethodGet, downloadURL, nil, http.Header{"Range": {"bytes=0-6"}})
+		if err != nil {
+			return err
+		}
+		if status != http.StatusPartialContent || string(data) != "chatapp" {
+			return fmt.Errorf("range request returned %d %q", status, data)
+		}
+
+		info, err := local.GetFileInfo(objectPath)
+		if err != nil {
+			return err
+		}
+		if info.Size != int64(len(content)) || !strings.HasPrefix(info.ContentType, "text/plain") {
+			return fmt.Errorf("file info %+v", info)
+		}
+		return nil
+	})
+
+	check("only images are served inline, anything else as a sandboxed attachment", func() error {
+		for _, c := range []struct {
+			path        string
+			contentType string
+			inline      bool
+		}{
+			{"chatroom-1/page.html", "application/octet-stream", false},
+			{"chatroom-1/drawing.svg", "application/octet-stream", false},
+			{"chatroom-1/noext", "application/octet-stream", false},
+			{"chatroom-1/photo.png", "image/png", true},
+		} {
+			if _, err := local.Upload(c.path, strings.NewReader("<script>alert(1)</script>"), storage.UploadOptions{}); err != nil {
+				return err
+			}
+			downloadURL, err := local.Download(c.path, time.Minute)
+			if err != nil {
+				return err
+			}
+			resp, err := http.Get(downloadURL)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+
+			header := resp.Header
+			if header.Get("Content-Type") != c.contentType || header.Get("X-Content-Type-Options") != "nosniff" {
+				return fmt.Errorf("%s served as %q, nosniff %q", c.path, header.Get("Content-Type"), header.Get("X-Content-Type-Options"))
+			}
+			attachment := strings.HasPrefix(header.Get("Content-Disposition"), "attachment")
+			sandboxed := header.Get("Content-Security-Policy") == "sandbox"
+			if attachment == c.inline || sandboxed == c.inline {
+				return fmt.Errorf("%s: Content-Disposition %q, Content-Security-Policy %q", c.path, header.Get("Content-Disposition"), header.Get("Content-Security-Policy"))
+			}
+		}
+		return nil
+	})
+
+	check("signatures only authorize their own object, method and time", func() error {
+		downloadURL, err := local.Download(objectPath, time.Minute)
+		if err != nil {
+			return err
+		}
+		parsed, err := url.Parse(downloadURL)
+		if err != nil {
+			return err
+		}
+
+		tampered := *parsed
+		query := tampered.Query()
+		query.Set("signature", strings.Repeat("0", 64))
+		tampered.RawQuery = query.Encode()
+		if err := expectStatus(http.MethodGet, tampered.String(), nil, http.StatusForbidden); err != nil {
+			return err
+		}
+
+		otherObject := *parsed
+		otherObject.Path = strings.Replace(parsed.Path, "chatroom-1", "chatroom-2", 1)
+		otherObject.RawPath = ""
+		if err := expectStatus(http.MethodGet, otherObject.String(), nil, http.StatusForbidden); err != nil {
+			return err
+		}
+
+		if err := expectStatus(http.MethodPut, downloadURL, []byte("overwrite"), http.StatusForbidden); err != nil {
+			return err
+		}
+
+		expiredURL, err := local.Download(objectPath, -time.Minute)
+		if err != nil {
+			return err
+		}
+		return expectStatus(http.MethodGet, expiredURL, nil, http.StatusForbidden)
+	})
+
+	check("object paths cannot leave the storage directory", func() error {
+		secret := filepath.Join(dir, "secret.txt")
+		if err := os.WriteFile(secret, []byte("secret"), 0o600); err != nil {
+			return err
+		}
+		for _, p := range []string{"../secret.txt", "chatroom-1/../../secret.txt", "/etc/passwd", "chatroom-1/.upload-1", "chatroom-1//x", ""} {
+			if _, err := local.Upload(p, strings.NewReader("x"), storage.UploadOptions{}); err == nil {
+				return fmt.Errorf("upload to %q succeeded", p)
+			}
+			if _, err := local.Download(p, time.Minute); err == nil {
+				return fmt.Errorf("signed a download of %q", p)
+			}
+		}
+		for _, p := range []string{"..%2fsecret.txt", "chatroom-1/..%2f..%2fsecret.txt", "%2e%2e/secret.txt"} {
+			status, _, err := do(http.MethodGet, server.URL+storage.LocalRoutePrefix+p+"?expires=9999999999&signature=00", nil, nil)
+			if err != nil {
+				return err
+			}
+			if status != http.StatusBadRequest && status != http.StatusForbidden && status != http.StatusNotFound {
+				return fmt.Errorf("GET %s returned %d", p, status)
+			}
+		}
+		data, err := os.ReadFile(secret)
+		if err != nil || string(data) != "secret" {
+			return fmt.Errorf("file outside the storage directory changed")
+		}
+		return nil
+	})
+
+	check("deleted files are gone", func() error {
+		downloadURL, err := local.Download(objectPath, time.Minute)
+		if err != nil {
+			return err
+		}
+		if err := local.Delete(objectPath); err != nil {
+			return err
+		}
+		if err := local.Delete(objectPath); err != nil {
+			return fmt.Errorf("deleting a missing file: %v", err)
+		}
+		exists, err := local.Exists(objectPath)
+		if err != nil || exists {
+			return fmt.Errorf("exists=%v err=%v after delete", exists, err)
+		}
+		return expectStatus(http.MethodGet, downloadURL, nil, http.StatusNotFound)
+	})
+
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Println("🎉 All local storage checks passed")
+}
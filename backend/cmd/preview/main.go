@@ -0,0 +1,463 @@
+// Command preview checks image previews against the in-memory storage with an
+// in-memory stand-in for the database: dimensions, BlurHash placeholders and
+// smaller variants generated in the background, photos turned as their EXIF
+// orientation asks, transparency kept, content previewed once for every file
+// sharing it, and files that are not images marked as failed.
+//
+//	go run ./cmd/preview
+package main
+
+import (
+	"bytes"
+	"chatapp/models"
+	"chatapp/repository"
+	"chatapp/service"
+	"chatapp/storage"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// previewStore stands in for the files, file_variants and
+// message_attachments tables
+type previewStore struct {
+	mu        sync.Mutex
+	files     map[uint]*models.File
+	variants  map[uint][]models.FileVariant
+	messages  map[uint][]uint
+	refreshed map[uint][]uint
+}
+
+var _ repository.PreviewRepository = (*previewStore)(nil)
+
+func (r *previewStore) GetPending(limit int) ([]models.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var files []models.File
+	for id := uint(1); id <= uint(len(r.files)) && len(files) < limit; id++ {
+		if file := r.files[id]; file.PreviewStatus == models.PreviewPending && file.BlobID != nil && !file.Quarantined() {
+			files = append(files, *file)
+		}
+	}
+	return files, nil
+}
+
+func (r *previewStore) GetReadyByBlobID(blobID uint) (*models.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, file := range r.files {
+		if file.BlobID != nil && *file.BlobID == blobID && file.PreviewStatus == models.PreviewReady {
+			ready := *file
+			ready.Variants = append([]models.FileVariant(nil), r.variants[file.ID]...)
+			return &ready, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (r *previewStore) Complete(file *models.File, variants []models.FileVariant) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := r.files[file.ID]
+	if stored.PreviewStatus != models.PreviewPending {
+		return false, nil
+	}
+	stored.Width, stored.Height, stored.Blurhash = file.Width, file.Height, file.Blurhash
+	stored.PreviewStatus = models.PreviewReady
+	for i := range variants {
+		variants[i].FileID = file.ID
+	}
+	r.variants[file.ID] = variants
+	return true, nil
+}
+
+func (r *previewStore) Fail(fileID uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if file := r.files[fileID]; file.PreviewStatus == models.PreviewPending {
+		file.PreviewStatus = models.PreviewFailed
+	}
+	return nil
+}
+
+func (r *previewStore) GetMessageIDs(fileID uint) ([]uint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.messages[fileID], nil
+}
+
+func (r *previewStore) refresh(chatRoomID uint, messageIDs []uint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refreshed[chatRoomID] = append(r.refreshed[chatRoomID], messageIDs...)
+}
+
+// add records a file waiting for previews, attached to the given messages
+func (r *previewStore) add(blobID uint, objectPath string, messageIDs ...uint) uint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := uint(len(r.files) + 1)
+	r.files[id] = &models.File{
+		ID:            id,
+		FilePath:      objectPath,
+		ChatRoomID:    7,
+		BlobID:        &blobID,
+		PreviewStatus: models.PreviewPending,
+	}
+	r.messages[id] = messageIDs
+	return id
+}
+
+// get returns a file with its variants
+func (r *previewStore) get(id uint) models.File {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file := *r.files[id]
+	file.Variants = append([]models.FileVariant(nil), r.variants[id]...)
+	return file
+}
+
+// countingStorage counts the objects uploaded to the in-memory storage
+type countingStorage struct {
+	*storage.MemoryStorage
+	mu      sync.Mutex
+	uploads int
+}
+
+func (s *countingStorage) Upload(objectPath string, reader io.Reader, options storage.UploadOptions) (*storage.UploadResult, error) {
+	s.mu.Lock()
+	s.uploads++
+	s.mu.Unlock()
+	return s.MemoryStorage.Upload(objectPath, reader, options)
+}
+
+func (s *countingStorage) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads
+}
+
+// gradient draws a width×height image whose colour follows its position, so
+// turning it shows; alpha below 255 makes it transparent
+func gradient(width, height int, alpha uint8) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: alpha})
+		}
+	}
+	return img
+}
+
+func encodeJPEG(img image.Image) []byte {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	return buf.Bytes()
+}
+
+func encodePNG(img image.Image) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// withOrientation inserts an EXIF block with the given orientation after the
+// start of a JPEG, as cameras write it
+func withOrientation(data []byte, orientation uint16) []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1}
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(append(tiff, entry...), 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	header := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, header...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+// decode83 decodes part of a BlurHash
+func decode83(s string) int {
+	const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+	value := 0
+	for _, c := range s {
+		value = value*83 + strings.IndexRune(base83, c)
+	}
+	return value
+}
+
+type env struct {
+	store   *previewStore
+	storage *countingStorage
+}
+
+// upload stores content and records a file waiting for its previews
+func (e *env) upload(blobID uint, data []byte, messageIDs ...uint) (uint, error) {
+	objectPath := fmt.Sprintf("files/blob-%d", blobID)
+	if _, err := e.storage.MemoryStorage.Upload(objectPath, bytes.NewReader(data), storage.UploadOptions{Size: int64(len(data))}); err != nil {
+		return 0, err
+	}
+	return e.store.add(blobID, objectPath, messageIDs...), nil
+}
+
+// wait waits until the file's previews are no longer pending
+func (e *env) wait(id uint) (models.File, error) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if file := e.store.get(id); file.PreviewStatus != models.PreviewPending {
+			return file, nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return models.File{}, fmt.Errorf("previews of file %d still pending", id)
+}
+
+// expectVariants checks the variants of a file by name, size and type, and
+// that they were stored
+func (e *env) expectVariants(file models.File, contentType string, sizes map[string][2]int) error {
+	if len(file.Variants) != len(sizes) {
+		return fmt.Errorf("%d variants, want %d", len(file.Variants), len(sizes))
+	}
+	for _, variant := range file.Variants {
+		size, ok := sizes[variant.Name]
+		if !ok {
+			return fmt.Errorf("unexpected %s variant", variant.Name)
+		}
+		if variant.Width != size[0] || variant.Height != size[1] {
+			return fmt.Errorf("%s variant is %dx%d, want %dx%d", variant.Name, variant.Width, variant.Height, size[0], size[1])
+		}
+		if variant.ContentType != contentType {
+			return fmt.Errorf("%s variant is %s, want %s", variant.Name, variant.ContentType, contentType)
+		}
+		data, err := e.storage.Read(variant.ObjectPath)
+		if err != nil {
+			return fmt.Errorf("%s variant: %w", variant.Name, err)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%s variant: %w", variant.Name, err)
+		}
+		if config.Width != size[0] || config.Height != size[1] || int64(len(data)) != variant.Size {
+			return fmt.Errorf("stored %s variant is %dx%d of %d bytes", variant.Name, config.Width, config.Height, len(data))
+		}
+	}
+	return nil
+}
+
+func main() {
+	e := &env{
+		store: &previewStore{
+			files:     make(map[uint]*models.File),
+			variants:  make(map[uint][]models.FileVariant),
+			messages:  make(map[uint][]uint),
+			refreshed: make(map[uint][]uint),
+		},
+		storage: &countingStorage{MemoryStorage: storage.NewMemoryStorage()},
+	}
+	go service.NewPreviewService(e.store, e.storage, 2, e.store.refresh).Run()
+
+	failed := false
+	check := func(name string, f func() error) {
+		if err := f(); err != nil {
+			fmt.Printf("❌ %s: %v\n", name, err)
+			failed = true
+			return
+		}
+		fmt.Printf("✅ %s\n", name)
+	}
+
+	photo := encodeJPEG(gradient(2000, 1000, 255))
+
+	check("photos get their size, a placeholder and every smaller variant", func() error {
+		id, err := e.upload(1, photo, 11, 12)
+		if err != nil {
+			return err
+		}
+		file, err := e.wait(id)
+		if err != nil {
+			return err
+		}
+		if file.PreviewStatus != models.PreviewReady {
+			return fmt.Errorf("status %q", file.PreviewStatus)
+		}
+		if file.Width != 2000 || file.Height != 1000 {
+			return fmt.Errorf("size %dx%d", file.Width, file.Height)
+		}
+		// Four by three components: size, maximum, DC and eleven AC values
+		if len(file.Blurhash) != 1+1+4+11*2 {
+			return fmt.Errorf("blurhash %q", file.Blurhash)
+		}
+		return e.expectVariants(file, "image/jpeg", map[string][2]int{
+			"large": {1600, 800},
+			"small": {640, 320},
+			"thumb": {256, 128},
+		})
+	})
+
+	check("the messages of a previewed file are refreshed", func() error {
+		e.store.mu.Lock()
+		defer e.store.mu.Unlock()
+		if got := e.store.refreshed[7]; len(got) != 2 || got[0] != 11 || got[1] != 12 {
+			return fmt.Errorf("refreshed messages %v", got)
+		}
+		return nil
+	})
+
+	check("photos are turned as their EXIF orientation asks", func() error {
+		id, err := e.upload(2, withOrientation(encodeJPEG(gradient(1000, 500, 255)), 6))
+		if err != nil {
+			return err
+		}
+		file, err := e.wait(id)
+		if err != nil {
+			return err
+		}
+		if file.Width != 500 || file.Height != 1000 {
+			return fmt.Errorf("size %dx%d, want 500x1000", file.Width, file.Height)
+		}
+		// Portrait placeholders have three by four components
+		if decode83(file.Blurhash[:1]) != 2+3*9 {
+			return fmt.Errorf("blurhash %q", file.Blurhash)
+		}
+		if err := e.expectVariants(file, "image/jpeg", map[string][2]int{
+			"small": {320, 640},
+			"thumb": {128, 256},
+		}); err != nil {
+			return err
+		}
+
+		// Turned clockwise, the stored left edge (no red) is shown at the top
+		var thumb models.FileVariant
+		for _, variant := range file.Variants {
+			if variant.Name == "thumb" {
+				thumb = variant
+			}
+		}
+		data, _ := e.storage.Read(thumb.ObjectPath)
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		top, _, _, _ := img.At(64, 2).RGBA()
+		bottom, _, _, _ := img.At(64, 253).RGBA()
+		if top > 0x2000 || bottom < 0xd000 {
+			return fmt.Errorf("red is %#x at the top and %#x at the bottom", top, bottom)
+		}
+		return nil
+	})
+
+	check("transparent images keep their transparency", func() error {
+		id, err := e.upload(3, encodePNG(gradient(800, 800, 128)))
+		if err != nil {
+			return err
+		}
+		file, err := e.wait(id)
+		if err != nil {
+			return err
+		}
+		return e.expectVariants(file, "image/png", map[string][2]int{
+			"small": {640, 640},
+			"thumb": {256, 256},
+		})
+	})
+
+	check("small images get a placeholder but no variants", func() error {
+		solid := image.NewRGBA(image.Rect(0, 0, 100, 60))
+		for i := 0; i < len(solid.Pix); i += 4 {
+			solid.Pix[i], solid.Pix[i+3] = 255, 255
+		}
+		id, err := e.upload(4, encodePNG(solid))
+		if err != nil {
+			return err
+		}
+		file, err := e.wait(id)
+		if err != nil {
+			return err
+		}
+		if file.PreviewStatus != models.PreviewReady || len(file.Variants) != 0 {
+			return fmt.Errorf("status %q with %d variants", file.PreviewStatus, len(file.Variants))
+		}
+		if file.Width != 100 || file.Height != 60 {
+			return fmt.Errorf("size %dx%d", file.Width, file.Height)
+		}
+		if dc := decode83(file.Blurhash[2:6]); dc != 0xff0000 {
+			return fmt.Errorf("placeholder colour %#06x, want red", dc)
+		}
+		return nil
+	})
+
+	check("content previewed already is not rendered again", func() error {
+		before := e.storage.count()
+		id, err := e.upload(1, photo)
+		if err != nil {
+			return err
+		}
+		file, err := e.wait(id)
+		if err != nil {
+			return err
+		}
+		first := e.store.get(1)
+		if file.Width != first.Width || file.Height != first.Height || file.Blurhash != first.Blurhash {
+			return fmt.Errorf("previews differ from the first file's")
+		}
+		if len(file.Variants) != len(first.Variants) {
+			return fmt.Errorf("%d variants, want %d", len(file.Variants), len(first.Variants))
+		}
+		for i, variant := range file.Variants {
+			if variant.ObjectPath != first.Variants[i].ObjectPath {
+				return fmt.Errorf("%s variant stored at %s, not shared", variant.Name, variant.ObjectPath)
+			}
+		}
+		if uploaded := e.storage.count() - before; uploaded != 0 {
+			return fmt.Errorf("%d variants stored again", uploaded)
+		}
+		return nil
+	})
+
+	check("files that are not images are marked as failed", func() error {
+		id, err := e.upload(5, []byte("not an image at all"))
+		if err != nil {
+			return err
+		}
+		file, err := e.wait(id)
+		if err != nil {
+			return err
+		}
+		if file.PreviewStatus != models.PreviewFailed || len(file.Variants) != 0 {
+			return fmt.Errorf("status %q with %d variants", file.PreviewStatus, len(file.Variants))
+		}
+		return nil
+	})
+
+	check("variant URLs in payloads are signed by the storage", func() error {
+		file := e.store.get(1)
+		variant := file.Variants[0]
+		if err := variant.AfterFind(nil); err != nil {
+			return err
+		}
+		if !strings.Contains(variant.URL, variant.ObjectPath) {
+			return fmt.Errorf("URL %q", variant.URL)
+		}
+		return nil
+	})
+
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Println("🎉 All image preview checks passed")
+}
@@ -0,0 +1,676 @@
+// Command tus checks resumable uploads (tus protocol) through their routes,
+// against the in-memory storage with in-memory stand-ins for the database:
+// uploads streamed to the storage in parts, resumed after a dropped
+// connection, hashed across their parts so identical content is stored once,
+// refused when they conflict or exceed their room's limit, terminated, and
+// removed once they expire.
+//
+//	go run ./cmd/tus
+package main
+
+import (
+	"bytes"
+	"chatapp/config"
+	"chatapp/controllers"
+	"chatapp/middleware"
+	"chatapp/models"
+	"chatapp/service"
+	"chatapp/storage"
+	"chatapp/utils"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadStore stands in for the uploads table
+type uploadStore struct {
+	mu      sync.Mutex
+	uploads map[string]models.Upload
+}
+
+func (r *uploadStore) Create(upload *models.Upload) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uploads[upload.ID] = *upload
+	return nil
+}
+
+func (r *uploadStore) GetByID(id string) (*models.Upload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	upload, ok := r.uploads[id]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+	return &upload, nil
+}
+
+func (r *uploadStore) Update(upload *models.Upload) error {
+	return r.Create(upload)
+}
+
+func (r *uploadStore) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.uploads, id)
+	return nil
+}
+
+func (r *uploadStore) GetExpired(now time.Time, limit int) ([]models.Upload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var expired []models.Upload
+	for _, upload := range r.uploads {
+		if !upload.ExpiresAt.After(now) && len(expired) < limit {
+			expired = append(expired, upload)
+		}
+	}
+	return expired, nil
+}
+
+// byFileID returns the upload that created a file
+func (r *uploadStore) byFileID(fileID uint) (models.Upload, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, upload := range r.uploads {
+		if upload.FileID != nil && *upload.FileID == fileID {
+			return upload, true
+		}
+	}
+	return models.Upload{}, false
+}
+
+func (r *uploadStore) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.uploads)
+}
+
+// fileStore stands in for the file service: room 1 has the default limit,
+// room 2 a smaller one of its own, other rooms do not exist
+type fileStore struct {
+	storage storage.Storage
+
+	mu    sync.Mutex
+	files map[uint]models.File
+	blobs map[string]*models.Blob
+}
+
+func (f *fileStore) Storage() storage.Storage {
+	return f.storage
+}
+
+func (f *fileStore) MaxFileSize(chatRoomID uint) (int64, error) {
+	switch chatRoomID {
+	case 1:
+		return 50 << 20, nil
+	case 2:
+		return 1 << 20, nil
+	}
+	return 0, errors.New("chat room not found")
+}
+
+func (f *fileStore) CreateFile(record *models.File) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	record.ID = uint(len(f.files) + 1)
+	f.files[record.ID] = *record
+	return nil
+}
+
+// StoreContent stores content the way the file service does: once per
+// content, at a path of its own that no upload writes to
+func (f *fileStore) StoreContent(record *models.File, content io.Reader, size int64, sum string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	blob, ok := f.blobs[sum]
+	if !ok {
+		result, err := f.storage.Upload("blobs/"+sum, content, storage.UploadOptions{ContentType: record.ContentType, Size: size})
+		if err != nil {
+			return false, err
+		}
+		blob = &models.Blob{ID: uint(len(f.blobs) + 1), SHA256: sum, ObjectPath: result.ObjectPath, Size: result.Size}
+		f.blobs[sum] = blob
+	}
+	blob.RefCount++
+	record.BlobID = &blob.ID
+	record.FilePath = blob.ObjectPath
+	record.FileSize = blob.Size
+	return ok, nil
+}
+
+func (f *fileStore) RemoveObjects(files []*models.File) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, file := range files {
+		for sum, blob := range f.blobs {
+			if file.BlobID != nil && blob.ID == *file.BlobID {
+				if blob.RefCount--; blob.RefCount == 0 {
+					f.storage.Delete(blob.ObjectPath)
+					delete(f.blobs, sum)
+				}
+			}
+		}
+	}
+}
+
+// blob returns the content a file points at
+func (f *fileStore) blob(file models.File) (models.Blob, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, blob := range f.blobs {
+		if file.BlobID != nil && blob.ID == *file.BlobID {
+			return *blob, true
+		}
+	}
+	return models.Blob{}, false
+}
+
+func (f *fileStore) get(id uint) (models.File, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, ok := f.files[id]
+	return file, ok
+}
+
+// env is a server with the upload routes
+type env struct {
+	server     *httptest.Server
+	uploads    *uploadStore
+	files      *fileStore
+	stagingDir string
+}
+
+func newEnv(s storage.Storage, expiry time.Duration) (*env, error) {
+	stagingDir, err := os.MkdirTemp("", "chatapp-tus-")
+	if err != nil {
+		return nil, err
+	}
+	e := &env{
+		uploads:    &uploadStore{uploads: make(map[string]models.Upload)},
+		files:      &fileStore{storage: s, files: make(map[uint]models.File), blobs: make(map[string]*models.Blob)},
+		stagingDir: stagingDir,
+	}
+	uploadService, err := service.NewUploadService(e.uploads, e.files, stagingDir, storage.MinPartSize, expiry, 100<<20)
+	if err != nil {
+		return nil, err
+	}
+	go uploadService.Run()
+
+	engine := gin.New()
+	uploadController := controllers.NewUploadController(uploadService, 5*time.Second, 5*time.Second)
+	engine.OPTIONS("/api/files/uploads", uploadController.Options)
+	protected := engine.Group("/api", middleware.AuthMiddleware())
+	protected.POST("/files/uploads", uploadController.CreateUpload)
+	protected.HEAD("/files/uploads/:id", uploadController.GetUpload)
+	protected.PATCH("/files/uploads/:id", uploadController.AppendUpload)
+	protected.DELETE("/files/uploads/:id", uploadController.DeleteUpload)
+	e.server = httptest.NewServer(engine)
+	return e, nil
+}
+
+func (e *env) close() {
+	e.server.Close()
+	os.RemoveAll(e.stagingDir)
+}
+
+// staged returns the number of files in the staging directory
+func (e *env) staged() int {
+	entries, _ := os.ReadDir(e.stagingDir)
+	return len(entries)
+}
+
+var tokens = map[uint]string{}
+
+// do sends a tus request as a user and returns the response, body drained
+func (e *env) do(method, path string, userID uint, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, e.server.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Authorization", "Bearer "+tokens[userID])
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+// create starts an upload and returns its path
+func (e *env) create(chatRoomID uint, fileName string, length int64) (string, *http.Response, error) {
+	metadata := fmt.Sprintf("filename %s,filetype %s,chatroom_id %s",
+		base64.StdEncoding.EncodeToString([]byte(fileName)),
+		base64.StdEncoding.EncodeToString([]byte("application/octet-stream")),
+		base64.StdEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(chatRoomID), 10))))
+	resp, err := e.do(http.MethodPost, "/api/files/uploads", 1, http.Header{
+		"Upload-Length":   {strconv.FormatInt(length, 10)},
+		"Upload-Metadata": {metadata},
+	}, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.Header.Get("Location"), resp, nil
+}
+
+// patch sends content at offset
+func (e *env) patch(location string, offset int64, content io.Reader) (*http.Response, error) {
+	return e.do(http.MethodPatch, location, 1, http.Header{
+		"Content-Type":  {"application/offset+octet-stream"},
+		"Upload-Offset": {strconv.FormatInt(offset, 10)},
+	}, content)
+}
+
+// offset asks for the offset of an upload
+func (e *env) offset(location string) (int64, *http.Response, error) {
+	resp, err := e.do(http.MethodHead, location, 1, nil, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, resp, fmt.Errorf("HEAD returned %d", resp.StatusCode)
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	return offset, resp, err
+}
+
+// dropPatch announces a PATCH of content but sends only its first sent bytes,
+// then drops the connection
+func (e *env) dropPatch(location string, offset int64, content []byte, sent int) error {
+	conn, err := net.Dial("tcp", e.server.Listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "PATCH %s HTTP/1.1\r\nHost: %s\r\nTus-Resumable: 1.0.0\r\nAuthorization: Bearer %s\r\n"+
+		"Content-Type: application/offset+octet-stream\r\nUpload-Offset: %d\r\nContent-Length: %d\r\n\r\n",
+		location, e.server.Listener.Addr(), tokens[1], offset, len(content))
+	_, err = conn.Write(content[:sent])
+	return err
+}
+
+// waitFor polls until f reports true
+func waitFor(f func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if f() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+// expectStatus checks the status of a response
+func expectStatus(what string, resp *http.Response, err error, want int) error {
+	if err != nil {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	if resp.StatusCode != want {
+		return fmt.Errorf("%s returned %d, want %d", what, resp.StatusCode, want)
+	}
+	return nil
+}
+
+// expectFile checks that a completed upload created a file with content,
+// recorded under the SHA-256 of content, and returns the file
+func (e *env) expectFile(resp *http.Response, content []byte, read func(string) ([]byte, error)) (models.File, error) {
+	fileID, err := strconv.ParseUint(resp.Header.Get("X-File-ID"), 10, 32)
+	if err != nil {
+		return models.File{}, fmt.Errorf("no file ID in the completing response")
+	}
+	file, ok := e.files.get(uint(fileID))
+	if !ok || file.FileSize != int64(len(content)) || file.ChatRoomID != 1 {
+		return file, fmt.Errorf("file %d recorded as %+v", fileID, file)
+	}
+	data, err := read(file.FilePath)
+	if err != nil {
+		return file, err
+	}
+	if !bytes.Equal(data, content) {
+		return file, fmt.Errorf("stored %d bytes that differ from the %d uploaded", len(data), len(content))
+	}
+	sum := sha256.Sum256(content)
+	if blob, ok := e.files.blob(file); !ok || blob.SHA256 != hex.EncodeToString(sum[:]) || blob.ObjectPath != file.FilePath {
+		return file, fmt.Errorf("file content recorded as %+v", blob)
+	}
+	if e.staged() != 0 {
+		return file, fmt.Errorf("%d files left in the staging directory", e.staged())
+	}
+	// Content is kept at its own path; parts assembled elsewhere are deleted
+	upload, ok := e.uploads.byFileID(file.ID)
+	if !ok {
+		return file, fmt.Errorf("no upload recorded file %d", file.ID)
+	}
+	if exists, _ := e.files.storage.Exists(upload.ObjectPath); exists {
+		return file, fmt.Errorf("upload left an object at %s", upload.ObjectPath)
+	}
+	return file, nil
+}
+
+func main() {
+	gin.SetMode(gin.ReleaseMode)
+	config.GlobalConfig = &config.Config{JWT: config.JWTConfig{Secret: "tus-check", ExpireHours: 1, Issuer: "chatapp"}}
+	for _, userID := range []uint{1, 2} {
+		token, err := utils.GenerateToken(userID, fmt.Sprintf("user%d", userID))
+		if err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
+		}
+		tokens[userID] = token
+	}
+
+	memory := storage.NewMemoryStorage()
+	e, err := newEnv(memory, time.Hour)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+	defer e.close()
+
+	failed := false
+	check := func(name string, f func() error) {
+		if err := f(); err != nil {
+			fmt.Printf("❌ %s: %v\n", name, err)
+			failed = true
+			return
+		}
+		fmt.Printf("✅ %s\n", name)
+	}
+
+	content := make([]byte, 12<<20+321)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	check("OPTIONS advertises the version, extensions and largest size", func() error {
+		req, _ := http.NewRequest(http.MethodOptions, e.server.URL+"/api/files/uploads", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err := expectStatus("OPTIONS", resp, err, http.StatusNoContent); err != nil {
+			return err
+		}
+		if resp.Header.Get("Tus-Version") != "1.0.0" || resp.Header.Get("Tus-Max-Size") != strconv.Itoa(100<<20) ||
+			!strings.Contains(resp.Header.Get("Tus-Extension"), "creation") {
+			return fmt.Errorf("headers %v", resp.Header)
+		}
+		return nil
+	})
+
+	check("requests without a supported Tus-Resumable are refused", func() error {
+		req, _ := http.NewRequest(http.MethodPost, e.server.URL+"/api/files/uploads", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens[1])
+		req.Header.Set("Upload-Length", "10")
+		resp, err := http.DefaultClient.Do(req)
+		if err := expectStatus("POST", resp, err, http.StatusPreconditionFailed); err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.Header.Get("Tus-Version") != "1.0.0" {
+			return fmt.Errorf("no Tus-Version in the refusal")
+		}
+		return nil
+	})
+
+	check("uploads over the room's limit or to missing rooms are refused", func() error {
+		_, resp, err := e.create(2, "big.bin", 2<<20)
+		if err := expectStatus("upload over the room's limit", resp, err, http.StatusRequestEntityTooLarge); err != nil {
+			return err
+		}
+		_, resp, err = e.create(1, "huge.bin", 200<<20)
+		if err := expectStatus("upload over Tus-Max-Size", resp, err, http.StatusRequestEntityTooLarge); err != nil {
+			return err
+		}
+		_, resp, err = e.create(99, "lost.bin", 10)
+		return expectStatus("upload to a missing room", resp, err, http.StatusNotFound)
+	})
+
+	var location string
+	check("an upload is created and receives a first chunk", func() error {
+		var resp *http.Response
+		location, resp, err = e.create(1, "video.bin", int64(len(content)))
+		if err := expectStatus("POST", resp, err, http.StatusCreated); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(location, "/api/files/uploads/") || resp.Header.Get("Upload-Expires") == "" {
+			return fmt.Errorf("created at %q with headers %v", location, resp.Header)
+		}
+		resp, err = e.patch(location, 0, bytes.NewReader(content[:3<<20]))
+		if err := expectStatus("PATCH", resp, err, http.StatusNoContent); err != nil {
+			return err
+		}
+		if resp.Header.Get("Upload-Offset") != strconv.Itoa(3<<20) {
+			return fmt.Errorf("offset %s after the first chunk", resp.Header.Get("Upload-Offset"))
+		}
+		offset, _, err := e.offset(location)
+		if err != nil || offset != 3<<20 {
+			return fmt.Errorf("HEAD reports offset %d (%v)", offset, err)
+		}
+		return nil
+	})
+
+	check("chunks at the wrong offset or of the wrong type are refused", func() error {
+		resp, err := e.patch(location, 0, bytes.NewReader(content[:10]))
+		if err := expectStatus("PATCH at a stale offset", resp, err, http.StatusConflict); err != nil {
+			return err
+		}
+		resp, err = e.do(http.MethodPatch, location, 1, http.Header{
+			"Content-Type":  {"application/octet-stream"},
+			"Upload-Offset": {strconv.Itoa(3 << 20)},
+		}, bytes.NewReader(content[3<<20:3<<20+10]))
+		if err := expectStatus("PATCH of the wrong type", resp, err, http.StatusUnsupportedMediaType); err != nil {
+			return err
+		}
+		resp, err = e.do(http.MethodHead, location, 2, nil, nil)
+		return expectStatus("HEAD by another user", resp, err, http.StatusNotFound)
+	})
+
+	check("bytes received before a dropped connection are kept", func() error {
+		rest := content[3<<20:]
+		if err := e.dropPatch(location, 3<<20, rest, 4<<20); err != nil {
+			return err
+		}
+		// The part boundary at 5MB was crossed, so one part is in the storage
+		if !waitFor(func() bool {
+			offset, _, _ := e.offset(location)
+			return offset == 7<<20
+		}) {
+			offset, _, err := e.offset(location)
+			return fmt.Errorf("offset %d (%v) after the drop, want %d", offset, err, 7<<20)
+		}
+		if memory.MultipartUploads() != 1 {
+			return fmt.Errorf("%d multipart uploads in progress, want 1", memory.MultipartUploads())
+		}
+		return nil
+	})
+
+	var first models.File
+	check("a second request to an upload in progress is refused, then the upload completes", func() error {
+		reader, writer := io.Pipe()
+		done := make(chan *http.Response, 1)
+		go func() {
+			resp, err := e.patch(location, 7<<20, reader)
+			if err != nil {
+				reader.CloseWithError(err)
+			}
+			done <- resp
+		}()
+		if _, err := writer.Write(content[7<<20 : 8<<20]); err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		resp, err := e.patch(location, 7<<20, bytes.NewReader(content[7<<20:]))
+		if err := expectStatus("concurrent PATCH", resp, err, http.StatusLocked); err != nil {
+			writer.Close()
+			return err
+		}
+
+		if _, err := writer.Write(content[8<<20:]); err != nil {
+			return err
+		}
+		writer.Close()
+		resp = <-done
+		if resp == nil {
+			return fmt.Errorf("resumed PATCH failed")
+		}
+		if err := expectStatus("resumed PATCH", resp, nil, http.StatusNoContent); err != nil {
+			return err
+		}
+		if resp.Header.Get("Upload-Offset") != strconv.Itoa(len(content)) {
+			return fmt.Errorf("offset %s after the last chunk", resp.Header.Get("Upload-Offset"))
+		}
+		if first, err = e.expectFile(resp, content, memory.Read); err != nil {
+			return err
+		}
+		if memory.MultipartUploads() != 0 {
+			return fmt.Errorf("%d multipart uploads left in progress", memory.MultipartUploads())
+		}
+
+		_, resp, err = e.offset(location)
+		if err != nil || resp.Header.Get("X-File-ID") == "" {
+			return fmt.Errorf("HEAD of the completed upload: %v %v", err, resp.Header)
+		}
+		return nil
+	})
+
+	check("an empty file completes when it is created", func() error {
+		_, resp, err := e.create(1, "empty.txt", 0)
+		if err := expectStatus("POST", resp, err, http.StatusCreated); err != nil {
+			return err
+		}
+		_, err = e.expectFile(resp, []byte{}, memory.Read)
+		return err
+	})
+
+	check("the same content uploaded again shares the stored object", func() error {
+		location, resp, err := e.create(1, "copy.bin", int64(len(content)))
+		if err := expectStatus("POST", resp, err, http.StatusCreated); err != nil {
+			return err
+		}
+		resp, err = e.patch(location, 0, bytes.NewReader(content))
+		if err := expectStatus("PATCH", resp, err, http.StatusNoContent); err != nil {
+			return err
+		}
+		second, err := e.expectFile(resp, content, memory.Read)
+		if err != nil {
+			return err
+		}
+		if second.FilePath != first.FilePath {
+			return fmt.Errorf("copy stored at %s, apart from %s", second.FilePath, first.FilePath)
+		}
+		if blob, _ := e.files.blob(second); blob.RefCount != 2 {
+			return fmt.Errorf("content referenced %d times, want 2", blob.RefCount)
+		}
+
+		// The object stays until the last file using it goes
+		e.files.RemoveObjects([]*models.File{&first})
+		if _, err := memory.Read(second.FilePath); err != nil {
+			return fmt.Errorf("object gone while a file still uses it: %w", err)
+		}
+		e.files.RemoveObjects([]*models.File{&second})
+		if _, err := memory.Read(second.FilePath); !errors.Is(err, storage.ErrObjectNotFound) {
+			return fmt.Errorf("object left after its last file went: %v", err)
+		}
+		return nil
+	})
+
+	check("a terminated upload is gone with its parts", func() error {
+		location, resp, err := e.create(1, "abandoned.bin", int64(len(content)))
+		if err := expectStatus("POST", resp, err, http.StatusCreated); err != nil {
+			return err
+		}
+		resp, err = e.patch(location, 0, bytes.NewReader(content[:6<<20]))
+		if err := expectStatus("PATCH", resp, err, http.StatusNoContent); err != nil {
+			return err
+		}
+		resp, err = e.do(http.MethodDelete, location, 1, nil, nil)
+		if err := expectStatus("DELETE", resp, err, http.StatusNoContent); err != nil {
+			return err
+		}
+		resp, err = e.do(http.MethodHead, location, 1, nil, nil)
+		if err := expectStatus("HEAD after DELETE", resp, err, http.StatusNotFound); err != nil {
+			return err
+		}
+		if memory.MultipartUploads() != 0 || e.staged() != 0 {
+			return fmt.Errorf("%d multipart uploads and %d staged files left", memory.MultipartUploads(), e.staged())
+		}
+		return nil
+	})
+
+	check("storage without multipart uploads receives the file whole", func() error {
+		whole := storage.NewMemoryStorage()
+		e, err := newEnv(struct{ storage.Storage }{whole}, time.Hour)
+		if err != nil {
+			return err
+		}
+		defer e.close()
+
+		location, resp, err := e.create(1, "whole.bin", int64(len(content)))
+		if err := expectStatus("POST", resp, err, http.StatusCreated); err != nil {
+			return err
+		}
+		resp, err = e.patch(location, 0, bytes.NewReader(content[:6<<20]))
+		if err := expectStatus("first PATCH", resp, err, http.StatusNoContent); err != nil {
+			return err
+		}
+		if whole.MultipartUploads() != 0 {
+			return fmt.Errorf("multipart upload started")
+		}
+		resp, err = e.patch(location, 6<<20, bytes.NewReader(content[6<<20:]))
+		if err := expectStatus("last PATCH", resp, err, http.StatusNoContent); err != nil {
+			return err
+		}
+		_, err = e.expectFile(resp, content, whole.Read)
+		return err
+	})
+
+	check("expired uploads are removed with their parts", func() error {
+		expiring := storage.NewMemoryStorage()
+		e, err := newEnv(expiring, time.Second)
+		if err != nil {
+			return err
+		}
+		defer e.close()
+
+		location, resp, err := e.create(1, "expiring.bin", int64(len(content)))
+		if err := expectStatus("POST", resp, err, http.StatusCreated); err != nil {
+			return err
+		}
+		resp, err = e.patch(location, 0, bytes.NewReader(content[:6<<20]))
+		if err := expectStatus("PATCH", resp, err, http.StatusNoContent); err != nil {
+			return err
+		}
+		if expiring.MultipartUploads() != 1 {
+			return fmt.Errorf("%d multipart uploads in progress, want 1", expiring.MultipartUploads())
+		}
+		if !waitFor(func() bool {
+			return e.uploads.count() == 0 && expiring.MultipartUploads() == 0 && e.staged() == 0
+		}) {
+			return fmt.Errorf("%d uploads, %d multipart uploads and %d staged files left",
+				e.uploads.count(), expiring.MultipartUploads(), e.staged())
+		}
+		return nil
+	})
+
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Println("🎉 All resumable upload checks passed")
+}
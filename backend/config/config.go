@@ -1,13 +1,21 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"time"
 
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/hkdf"
 )
 
+// localSigningKeyLabel separates the key derived for local storage URLs from
+// every other use of the JWT secret
+const localSigningKeyLabel = "chatapp local storage url signing v1"
+
 type Config struct {
 	Server    ServerConfig    `mapstructure:"server"`
 	Database  DatabaseConfig  `mapstructure:"database"`
@@ -17,8 +25,12 @@ type Config struct {
 	Logging   LoggingConfig   `mapstructure:"logging"`
 	App       App             `mapstructure:"app"`
 	Storage   StorageConfig   `mapstructure:"storage"`
-	Minio     MinioConfig     `mapstructure:"minio"`
-	Qiniu     QiniuConfig     `mapstructure:"qiniu"`
+	Upload    UploadConfig    `mapstructure:"upload"`
+	Scan      ScanConfig      `mapstructure:"scan"`
+	Presence  PresenceConfig  `mapstructure:"presence"`
+	Chat      ChatConfig      `mapstructure:"chat"`
+	Broker    BrokerConfig    `mapstructure:"broker"`
+	Redis     RedisConfig     `mapstructure:"redis"`
 }
 
 type ServerConfig struct {
@@ -26,6 +38,8 @@ type ServerConfig struct {
 	Host         string        `mapstructure:"host"`
 	ReadTimeout  time.Duration `mapstructure:"read_timeout"`
 	WriteTimeout time.Duration `mapstructure:"write_timeout"`
+	// Time given to connections and in-flight requests to finish on shutdown
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
 }
 
 type DatabaseConfig struct {
@@ -53,12 +67,47 @@ type WebSocketConfig struct {
 	ReadDeadline    time.Duration `mapstructure:"read_deadline"`
 	WriteDeadline   time.Duration `mapstructure:"write_deadline"`
 	PingPeriod      time.Duration `mapstructure:"ping_period"`
+	// Largest frame accepted from a client, in bytes, and longest message
+	// content accepted over WebSocket or REST, in characters
+	MaxFrameSize     int64 `mapstructure:"max_frame_size"`
+	MaxContentLength int   `mapstructure:"max_content_length"`
+	// permessage-deflate is offered to clients when enabled; frames shorter
+	// than CompressionThreshold bytes are sent uncompressed
+	EnableCompression    bool `mapstructure:"enable_compression"`
+	CompressionThreshold int  `mapstructure:"compression_threshold"`
+	CompressionLevel     int  `mapstructure:"compression_level"`
+	// Connections must authenticate within AuthTimeout, in-band or at the
+	// handshake with a token or a ticket valid for TicketTTL; an IP may hold
+	// at most MaxConnectionsPerIP connections to one server (0 for no limit)
+	AuthTimeout         time.Duration `mapstructure:"auth_timeout"`
+	TicketTTL           time.Duration `mapstructure:"ticket_ttl"`
+	MaxConnectionsPerIP int           `mapstructure:"max_connections_per_ip"`
+	// Ephemeral events (typing, recording) are relayed at most once per
+	// EphemeralThrottle and auto-expire after EphemeralTTL without a refresh
+	EphemeralThrottle time.Duration `mapstructure:"ephemeral_throttle"`
+	EphemeralTTL      time.Duration `mapstructure:"ephemeral_ttl"`
+	// Room events are kept for ReplayRetention so resuming clients can catch
+	// up; a client missing more than ReplayLimit events must refetch instead
+	ReplayLimit     int           `mapstructure:"replay_limit"`
+	ReplayRetention time.Duration `mapstructure:"replay_retention"`
+	// Frames buffered per client; SlowConsumer decides what happens to the
+	// frames that don't fit
+	SendBufferSize int                `mapstructure:"send_buffer_size"`
+	SlowConsumer   SlowConsumerConfig `mapstructure:"slow_consumer"`
+}
+
+type SlowConsumerConfig struct {
+	Ephemeral   string        `mapstructure:"ephemeral"`    // "drop" or "disconnect"
+	Presence    string        `mapstructure:"presence"`     // "coalesce", "drop" or "disconnect"
+	Events      string        `mapstructure:"events"`       // "resync" or "disconnect"
+	GracePeriod time.Duration `mapstructure:"grace_period"` // how long a client may stay backed up before it is disconnected
 }
 
 type CORSConfig struct {
 	AllowedOrigins []string `mapstructure:"allowed_origins"`
 	AllowedMethods []string `mapstructure:"allowed_methods"`
 	AllowedHeaders []string `mapstructure:"allowed_headers"`
+	ExposedHeaders []string `mapstructure:"exposed_headers"`
 }
 
 type LoggingConfig struct {
@@ -74,26 +123,67 @@ type App struct {
 	Environment string `mapstructure:"environment"`
 }
 
+// StorageConfig selects the storage backend. Each backend reads its own
+// section named after its type ("minio", "qiniu", "local", "s3", ...), decoded
+// by the backend itself (see UnmarshalSection), so backends registered with
+// the storage package need no fields here.
 type StorageConfig struct {
-	Type string `mapstructure:"type"` // "minio" or "qiniu"
+	Type string `mapstructure:"type"` // "minio", "qiniu", "local" or "s3"
+}
+
+// UploadConfig limits file uploads and configures resumable (tus) uploads.
+// Rooms use MaxFileSize unless their creator sets a limit of their own, which
+// may not exceed MaxRoomFileSize.
+type UploadConfig struct {
+	MaxFileSize     int64 `mapstructure:"max_file_size"`      // bytes
+	MaxRoomFileSize int64 `mapstructure:"max_room_file_size"` // bytes
+	// Unfinished resumable uploads are kept in StagingDir, which all replicas
+	// must share unless clients stick to one; empty uses the system temp dir
+	StagingDir string        `mapstructure:"staging_dir"`
+	PartSize   int64         `mapstructure:"part_size"` // bytes sent to storage per multipart part
+	Expiry     time.Duration `mapstructure:"expiry"`    // unfinished uploads idle this long are removed
+	// Images get thumbnails and other sizes generated by this many workers
+	// per replica; 0 turns previews off
+	PreviewWorkers int `mapstructure:"preview_workers"`
+}
+
+// ScanConfig sets up malware scanning of uploads by a clamd daemon. Files
+// cannot be downloaded until they are found clean.
+type ScanConfig struct {
+	// "tcp://host:3310" or "unix:///path/to/clamd.sock"; empty turns
+	// scanning off
+	Address string        `mapstructure:"address"`
+	Timeout time.Duration `mapstructure:"timeout"`  // bounds the scan of one file
+	MaxSize int64         `mapstructure:"max_size"` // bytes; larger files are not sent, keep at clamd's StreamMaxLength
+	Workers int           `mapstructure:"workers"`  // files scanned at once per replica
+	// What happens to files that cannot be scanned, because clamd is down or
+	// refuses them: "fail_closed" keeps them quarantined, retrying while clamd
+	// is down; "fail_open" lets them be downloaded unscanned
+	Policy string `mapstructure:"policy"`
+}
+
+type PresenceConfig struct {
+	IdleTimeout   time.Duration `mapstructure:"idle_timeout"`   // no active heartbeat for this long means "away"
+	SweepInterval time.Duration `mapstructure:"sweep_interval"` // how often idle connections and expired statuses are checked
+}
+
+type ChatConfig struct {
+	MaxPinsPerRoom int           `mapstructure:"max_pins_per_room"`
+	DedupeWindow   time.Duration `mapstructure:"dedupe_window"`
 }
 
-type MinioConfig struct {
-	Endpoint   string `mapstructure:"endpoint"`
-	AccessKey  string `mapstructure:"access_key"`
-	SecretKey  string `mapstructure:"secret_key"`
-	BucketName string `mapstructure:"bucket_name"`
-	UseSSL     bool   `mapstructure:"use_ssl"`
-	Region     string `mapstructure:"region"`
+// BrokerConfig selects the pub/sub backbone that carries WebSocket events
+// between backend replicas. "memory" only reaches clients of this process.
+type BrokerConfig struct {
+	Type    string `mapstructure:"type"`    // "memory", "postgres" or "redis"
+	Channel string `mapstructure:"channel"` // NOTIFY or Redis channel shared by all replicas
+	NodeID  string `mapstructure:"node_id"` // unique per replica; generated when empty
 }
 
-type QiniuConfig struct {
-	AccessKey string `mapstructure:"access_key"`
-	SecretKey string `mapstructure:"secret_key"`
-	Bucket    string `mapstructure:"bucket"`
-	Domain    string `mapstructure:"domain"`
-	Region    string `mapstructure:"region"`
-	UseHTTPS  bool   `mapstructure:"use_https"`
+type RedisConfig struct {
+	Addr     string `mapstructure:"addr"`
+	Password string `mapstructure:"password"`
+	DB       int    `mapstructure:"db"`
 }
 
 var GlobalConfig *Config
@@ -121,6 +211,19 @@ func LoadConfig(configPath ...string) (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	// Without a key of its own, the local storage signs its URLs with a key
+	// derived from the JWT secret, never with the secret itself
+	if viper.GetString("local.signing_key") == "" {
+		key, err := deriveKey(viper.GetString("jwt.secret"), localSigningKeyLabel)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive local.signing_key: %w", err)
+		}
+		viper.Set("local.signing_key", key)
+		if viper.GetString("storage.type") == "local" {
+			log.Printf("Warning: local.signing_key is not set, signing local storage URLs with a key derived from jwt.secret")
+		}
+	}
+
 	var config Config
 	if err := viper.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
@@ -131,12 +234,27 @@ func LoadConfig(configPath ...string) (*Config, error) {
 	return &config, nil
 }
 
+// UnmarshalSection decodes the configuration section under key, with its
+// defaults and environment overrides, into target
+func UnmarshalSection(key string, target interface{}) error {
+	settings, _ := viper.AllSettings()[key].(map[string]interface{})
+	section := viper.New()
+	if err := section.MergeConfigMap(settings); err != nil {
+		return fmt.Errorf("failed to read %s config: %w", key, err)
+	}
+	if err := section.Unmarshal(target); err != nil {
+		return fmt.Errorf("failed to unmarshal %s config: %w", key, err)
+	}
+	return nil
+}
+
 // setDefaults sets default configuration values
 func setDefaults() {
 	viper.SetDefault("server.port", ":8080")
 	viper.SetDefault("server.host", "localhost")
 	viper.SetDefault("server.read_timeout", "30s")
 	viper.SetDefault("server.write_timeout", "30s")
+	viper.SetDefault("server.shutdown_timeout", "30s")
 
 	viper.SetDefault("database.host", "localhost")
 	viper.SetDefault("database.port", 5432)
@@ -156,10 +274,30 @@ func setDefaults() {
 	viper.SetDefault("websocket.read_deadline", "60s")
 	viper.SetDefault("websocket.write_deadline", "10s")
 	viper.SetDefault("websocket.ping_period", "54s")
+	viper.SetDefault("websocket.max_frame_size", 65536)
+	viper.SetDefault("websocket.max_content_length", 4000)
+	viper.SetDefault("websocket.enable_compression", true)
+	viper.SetDefault("websocket.compression_threshold", 1024)
+	viper.SetDefault("websocket.compression_level", 1)
+	viper.SetDefault("websocket.auth_timeout", "10s")
+	viper.SetDefault("websocket.ticket_ttl", "30s")
+	viper.SetDefault("websocket.max_connections_per_ip", 20)
+	viper.SetDefault("websocket.ephemeral_throttle", "3s")
+	viper.SetDefault("websocket.ephemeral_ttl", "8s")
+	viper.SetDefault("websocket.replay_limit", 100)
+	viper.SetDefault("websocket.replay_retention", "24h")
+	viper.SetDefault("websocket.send_buffer_size", 256)
+	viper.SetDefault("websocket.slow_consumer.ephemeral", "drop")
+	viper.SetDefault("websocket.slow_consumer.presence", "coalesce")
+	viper.SetDefault("websocket.slow_consumer.events", "resync")
+	viper.SetDefault("websocket.slow_consumer.grace_period", "30s")
 
 	viper.SetDefault("cors.allowed_origins", []string{"*"})
-	viper.SetDefault("cors.allowed_methods", []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
-	viper.SetDefault("cors.allowed_headers", []string{"Origin", "Content-Type", "Authorization"})
+	viper.SetDefault("cors.allowed_methods", []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"})
+	viper.SetDefault("cors.allowed_headers", []string{"Origin", "Content-Type", "Authorization",
+		"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"})
+	viper.SetDefault("cors.exposed_headers", []string{"Location", "Tus-Resumable", "Tus-Version",
+		"Tus-Extension", "Tus-Max-Size", "Upload-Length", "Upload-Offset", "Upload-Expires", "X-File-ID"})
 
 	viper.SetDefault("logging.level", "info")
 	viper.SetDefault("logging.format", "json")
@@ -184,6 +322,54 @@ func setDefaults() {
 	viper.SetDefault("qiniu.domain", "")
 	viper.SetDefault("qiniu.region", "south-china")
 	viper.SetDefault("qiniu.use_https", true)
+
+	viper.SetDefault("local.dir", "./uploads")
+	viper.SetDefault("local.base_url", "http://localhost:8080")
+	viper.SetDefault("local.signing_key", "")
+
+	viper.SetDefault("s3.endpoint", "s3.amazonaws.com")
+	viper.SetDefault("s3.region", "us-east-1")
+	viper.SetDefault("s3.bucket", "")
+	viper.SetDefault("s3.use_ssl", true)
+	viper.SetDefault("s3.addressing_style", "auto")
+	viper.SetDefault("s3.create_bucket", false)
+	viper.SetDefault("s3.credentials", "static")
+	viper.SetDefault("s3.access_key", "")
+	viper.SetDefault("s3.secret_key", "")
+	viper.SetDefault("s3.session_token", "")
+	viper.SetDefault("s3.sts_endpoint", "")
+	viper.SetDefault("s3.role_arn", "")
+	viper.SetDefault("s3.role_session_name", "chatapp")
+	viper.SetDefault("s3.web_identity_token_file", "")
+	viper.SetDefault("s3.sse", "")
+	viper.SetDefault("s3.kms_key_id", "")
+
+	viper.SetDefault("upload.max_file_size", 50<<20)
+	viper.SetDefault("upload.max_room_file_size", 5<<30)
+	viper.SetDefault("upload.staging_dir", "")
+	viper.SetDefault("upload.part_size", 8<<20)
+	viper.SetDefault("upload.expiry", "24h")
+	viper.SetDefault("upload.preview_workers", 2)
+
+	viper.SetDefault("scan.address", "")
+	viper.SetDefault("scan.timeout", "60s")
+	viper.SetDefault("scan.max_size", 25<<20)
+	viper.SetDefault("scan.workers", 2)
+	viper.SetDefault("scan.policy", "fail_closed")
+
+	viper.SetDefault("presence.idle_timeout", "5m")
+	viper.SetDefault("presence.sweep_interval", "30s")
+
+	viper.SetDefault("chat.max_pins_per_room", 50)
+	viper.SetDefault("chat.dedupe_window", "24h")
+
+	viper.SetDefault("broker.type", "memory")
+	viper.SetDefault("broker.channel", "chatapp_events")
+	viper.SetDefault("broker.node_id", "")
+
+	viper.SetDefault("redis.addr", "127.0.0.1:6379")
+	viper.SetDefault("redis.password", "")
+	viper.SetDefault("redis.db", 0)
 }
 
 // GetDatabaseDSN returns the database connection string
@@ -198,3 +384,13 @@ func (c *Config) GetDatabaseDSN() string {
 		c.Database.Timezone,
 	)
 }
+
+// deriveKey derives a hex-encoded 256-bit key for one purpose from a secret
+// with HKDF-SHA256, the label naming the purpose
+func deriveKey(secret, label string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(label)), key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
@@ -37,12 +37,32 @@ func ConnectDatabase() {
 	log.Println("Database connected successfully")
 }
 
+// CloseDatabase closes the connection pool once the server has stopped
+func CloseDatabase() {
+	if DB == nil {
+		return
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		log.Printf("Failed to get underlying sql.DB: %v", err)
+		return
+	}
+	if err := sqlDB.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+		return
+	}
+	log.Println("Database connection closed")
+}
+
 func MigrateDatabase() {
 	if DB == nil {
 		log.Fatal("Database not connected. Please call ConnectDatabase first.")
 	}
 
-	err := DB.AutoMigrate(&models.User{}, &models.ChatRoom{}, &models.Message{}, &models.File{})
+	err := DB.AutoMigrate(&models.User{}, &models.ChatRoom{}, &models.Message{}, &models.File{}, &models.UserStatus{},
+		&models.Mention{}, &models.Notification{}, &models.NotificationPreference{},
+		&models.MessageAttachment{}, &models.PinnedMessage{}, &models.ChatRoomModerator{},
+		&models.RoomEvent{}, &models.RoomSequence{}, &models.WSTicket{}, &models.Upload{}, &models.PendingUpload{}, &models.Blob{}, &models.FileVariant{})
 	if err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
@@ -21,6 +21,14 @@ func NewChatRoomController(chatRoomService service.ChatRoomService, messageServi
 	}
 }
 
+type AddModeratorRequest struct {
+	UserID uint `json:"user_id" binding:"required"`
+}
+
+type SetMaxFileSizeRequest struct {
+	MaxFileSize *int64 `json:"max_file_size" binding:"required"` // bytes; 0 restores the default
+}
+
 type CreateChatRoomRequest struct {
 	Name        string `json:"name" binding:"required"`
 	Description string `json:"description"`
@@ -98,3 +106,107 @@ func (ctrl *ChatRoomController) GetChatRoomMessages(c *gin.Context) {
 
 	utils.SuccessResponse(c, messages)
 }
+
+// GetModerators returns the moderators of a chat room
+func (ctrl *ChatRoomController) GetModerators(c *gin.Context) {
+	id := c.Param("id")
+	chatRoomID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid chat room ID")
+		return
+	}
+
+	moderators, err := ctrl.chatRoomService.GetModerators(uint(chatRoomID))
+	if err != nil {
+		utils.NotFoundResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, moderators)
+}
+
+// AddModerator makes a user a moderator of a chat room, creator only
+func (ctrl *ChatRoomController) AddModerator(c *gin.Context) {
+	id := c.Param("id")
+	chatRoomID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid chat room ID")
+		return
+	}
+
+	var req AddModeratorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(c, err.Error())
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	if err := ctrl.chatRoomService.AddModerator(uint(chatRoomID), req.UserID, userID.(uint)); err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, nil)
+}
+
+// RemoveModerator revokes a user's moderator rights in a chat room, creator only
+func (ctrl *ChatRoomController) RemoveModerator(c *gin.Context) {
+	id := c.Param("id")
+	chatRoomID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid chat room ID")
+		return
+	}
+
+	moderatorID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid user ID")
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	if err := ctrl.chatRoomService.RemoveModerator(uint(chatRoomID), uint(moderatorID), userID.(uint)); err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, nil)
+}
+
+// SetMaxFileSize sets the largest file that can be uploaded to a chat room,
+// creator only
+func (ctrl *ChatRoomController) SetMaxFileSize(c *gin.Context) {
+	id := c.Param("id")
+	chatRoomID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid chat room ID")
+		return
+	}
+
+	var req SetMaxFileSizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(c, err.Error())
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	chatRoom, err := ctrl.chatRoomService.SetMaxFileSize(uint(chatRoomID), *req.MaxFileSize, userID.(uint))
+	if err != nil {
+		switch err.Error() {
+		case "chat room not found":
+			utils.NotFoundResponse(c, err.Error())
+		case "only the creator can change the file size limit":
+			utils.ForbiddenResponse(c, err.Error())
+		case "file size limit is out of range":
+			utils.ValidationErrorResponse(c, err.Error())
+		default:
+			utils.InternalErrorResponse(c, err.Error())
+		}
+		return
+	}
+
+	utils.SuccessResponse(c, chatRoom)
+}
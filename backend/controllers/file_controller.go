@@ -1,20 +1,42 @@
 package controllers
 
 import (
+	"chatapp/handlers"
+	"chatapp/models"
 	"chatapp/service"
 	"chatapp/utils"
+	"fmt"
+	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
+// formatFileSize 将文件大小格式化为 "50MB" 这样的形式，用于提示信息
+func formatFileSize(size int64) string {
+	switch {
+	case size >= 1<<30 && size%(1<<30) == 0:
+		return fmt.Sprintf("%dGB", size>>30)
+	case size >= 1<<20:
+		return fmt.Sprintf("%.4gMB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.4gKB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
+
 type FileController struct {
-	fileService *service.FileService
+	fileService    *service.FileService
+	messageService service.MessageService
+	hub            *handlers.Hub
 }
 
-func NewFileController(fileService *service.FileService) *FileController {
+func NewFileController(fileService *service.FileService, messageService service.MessageService, hub *handlers.Hub) *FileController {
 	return &FileController{
-		fileService: fileService,
+		fileService:    fileService,
+		messageService: messageService,
+		hub:            hub,
 	}
 }
 
@@ -58,10 +80,14 @@ func (c *FileController) UploadFile(ctx *gin.Context) {
 		return
 	}
 
-	// 检查文件大小（限制50MB）
-	const maxFileSize = 50 * 1024 * 1024 // 50MB
+	// 检查文件大小（聊天室的限制）
+	maxFileSize, err := c.fileService.MaxFileSize(uint(chatRoomID))
+	if err != nil {
+		utils.NotFoundResponse(ctx, "聊天室不存在")
+		return
+	}
 	if file.Size > maxFileSize {
-		utils.BadRequestResponse(ctx, "文件大小不能超过50MB")
+		utils.BadRequestResponse(ctx, "文件大小不能超过"+formatFileSize(maxFileSize))
 		return
 	}
 
@@ -82,6 +108,7 @@ func (c *FileController) UploadFile(ctx *gin.Context) {
 // @Produce json
 // @Param id path int true "文件ID"
 // @Success 200 {object} utils.Response{data=map[string]interface{}}
+// @Failure 403 {object} utils.Response
 // @Failure 404 {object} utils.Response
 // @Failure 500 {object} utils.Response
 // @Router /api/files/download/{id} [get]
@@ -97,7 +124,14 @@ func (c *FileController) DownloadFile(ctx *gin.Context) {
 	// 获取下载链接
 	downloadURL, fileInfo, err := c.fileService.DownloadFile(uint(fileID))
 	if err != nil {
-		utils.NotFoundResponse(ctx, "文件不存在或获取失败: "+err.Error())
+		switch err.Error() {
+		case "file is being scanned":
+			utils.ForbiddenResponse(ctx, "文件正在进行安全扫描，请稍后再下载")
+		case "file is quarantined":
+			utils.ForbiddenResponse(ctx, "文件未通过安全扫描，已被隔离")
+		default:
+			utils.NotFoundResponse(ctx, "文件不存在或获取失败: "+err.Error())
+		}
 		return
 	}
 
@@ -202,8 +236,15 @@ func (c *FileController) DeleteFile(ctx *gin.Context) {
 		return
 	}
 
+	// 获取文件所属聊天室，用于通知引用该文件的消息变更
+	fileInfo, err := c.fileService.GetFileInfo(uint(fileID))
+	if err != nil {
+		utils.NotFoundResponse(ctx, "文件不存在: "+err.Error())
+		return
+	}
+
 	// 删除文件
-	err = c.fileService.DeleteFile(uint(fileID), userID.(uint))
+	messageIDs, err := c.fileService.DeleteFile(uint(fileID), userID.(uint))
 	if err != nil {
 		if err.Error() == "permission denied: only uploader can delete the file" {
 			utils.ForbiddenResponse(ctx, "权限不足：只有上传者可以删除文件")
@@ -213,6 +254,9 @@ func (c *FileController) DeleteFile(ctx *gin.Context) {
 		return
 	}
 
+	// 通知聊天室附件已被移除的消息
+	c.hub.RefreshMessages(fileInfo.ChatRoomID, messageIDs)
+
 	utils.SuccessResponseWithMessage(ctx, "文件删除成功", nil)
 }
 
@@ -247,16 +291,22 @@ func (c *FileController) GetFileInfo(ctx *gin.Context) {
 
 // GetUploadURL 获取文件上传预签名URL（可选功能）
 // @Summary 获取上传预签名URL
-// @Description 获取文件上传的预签名URL，用于前端直接上传到Minio
+// @Description 获取文件上传的预签名URL，用于前端直接上传到存储；上传后须调用确认接口，否则文件在1小时后被删除
 // @Tags files
 // @Produce json
 // @Param filename query string true "文件名"
 // @Param chatroom_id query int true "聊天室ID"
-// @Success 200 {object} utils.Response{data=map[string]string}
+// @Param size query int false "文件大小（字节），确认时核对"
+// @Param content_type query string false "文件类型，确认时核对"
+// @Param checksum query string false "文件内容的MD5（十六进制），确认时核对"
+// @Success 200 {object} utils.Response{data=map[string]interface{}}
 // @Failure 400 {object} utils.Response
+// @Failure 404 {object} utils.Response
 // @Failure 500 {object} utils.Response
 // @Router /api/files/upload-url [get]
 func (c *FileController) GetUploadURL(ctx *gin.Context) {
+	userID, _ := ctx.Get("user_id")
+
 	// 获取参数
 	fileName := ctx.Query("filename")
 	chatRoomIDStr := ctx.Query("chatroom_id")
@@ -272,15 +322,123 @@ func (c *FileController) GetUploadURL(ctx *gin.Context) {
 		return
 	}
 
+	var size int64
+	if sizeStr := ctx.Query("size"); sizeStr != "" {
+		size, err = strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil {
+			utils.BadRequestResponse(ctx, "无效的文件大小")
+			return
+		}
+	}
+
 	// 获取预签名上传URL
-	uploadURL, objectPath, err := c.fileService.GetUploadURL(fileName, uint(chatRoomID))
+	uploadURL, pending, err := c.fileService.GetUploadURL(fileName, uint(chatRoomID), userID.(uint), size, ctx.Query("content_type"), ctx.Query("checksum"))
 	if err != nil {
-		utils.InternalErrorResponse(ctx, "获取上传URL失败: "+err.Error())
+		switch err.Error() {
+		case "chat room not found":
+			utils.NotFoundResponse(ctx, "聊天室不存在")
+		case "file is too large":
+			maxFileSize, _ := c.fileService.MaxFileSize(uint(chatRoomID))
+			utils.BadRequestResponse(ctx, "文件大小不能超过"+formatFileSize(maxFileSize))
+		case "invalid file size":
+			utils.BadRequestResponse(ctx, "无效的文件大小")
+		case "invalid checksum":
+			utils.BadRequestResponse(ctx, "校验和须为十六进制的MD5")
+		default:
+			utils.InternalErrorResponse(ctx, "获取上传URL失败: "+err.Error())
+		}
 		return
 	}
 
 	utils.SuccessResponseWithMessage(ctx, "获取上传URL成功", gin.H{
 		"upload_url":  uploadURL,
-		"object_path": objectPath,
+		"object_path": pending.ObjectPath,
+		"expires_at":  pending.ExpiresAt,
 	})
+}
+
+// ConfirmUploadRequest 确认直传文件的请求
+type ConfirmUploadRequest struct {
+	ObjectPath string `json:"object_path" binding:"required"`
+	Checksum   string `json:"checksum"` // 文件内容的MD5（十六进制），未在获取上传URL时声明时可在此提供
+	// Message 不为空时，文件作为附件随消息发送到聊天室
+	Message *struct {
+		Content     string `json:"content"`
+		ClientNonce string `json:"client_nonce"`
+	} `json:"message"`
+}
+
+// ConfirmUpload 确认通过预签名URL上传的文件
+// @Summary 确认直传文件
+// @Description 核对存储中的对象（大小、类型、校验和）后创建文件记录，可同时作为附件发送消息
+// @Tags files
+// @Accept json
+// @Produce json
+// @Param request body ConfirmUploadRequest true "确认请求"
+// @Success 200 {object} utils.Response{data=map[string]interface{}}
+// @Failure 400 {object} utils.Response
+// @Failure 404 {object} utils.Response
+// @Failure 409 {object} utils.Response
+// @Failure 413 {object} utils.Response
+// @Router /api/files/confirm [post]
+func (c *FileController) ConfirmUpload(ctx *gin.Context) {
+	userID, _ := ctx.Get("user_id")
+
+	var req ConfirmUploadRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err.Error())
+		return
+	}
+
+	record, err := c.fileService.ConfirmUpload(req.ObjectPath, userID.(uint), req.Checksum)
+	if err != nil {
+		switch err.Error() {
+		case "pending upload not found":
+			utils.NotFoundResponse(ctx, "待确认的上传不存在或已过期")
+		case "chat room not found":
+			utils.NotFoundResponse(ctx, "聊天室不存在")
+		case "file has not been uploaded":
+			utils.ErrorResponse(ctx, http.StatusConflict, utils.CODE_BAD_REQUEST, "文件尚未上传")
+		case "file is too large":
+			utils.ErrorResponse(ctx, http.StatusRequestEntityTooLarge, utils.CODE_BAD_REQUEST, "文件超过聊天室的大小上限，已删除")
+		case "file size mismatch", "content type mismatch", "checksum mismatch":
+			utils.ValidationErrorResponse(ctx, err.Error())
+		default:
+			utils.InternalErrorResponse(ctx, "确认上传失败: "+err.Error())
+		}
+		return
+	}
+
+	if req.Message == nil {
+		if err := c.fileService.CreateFile(record); err != nil {
+			c.fileService.RemoveObjects([]*models.File{record})
+			utils.InternalErrorResponse(ctx, "创建文件记录失败: "+err.Error())
+			return
+		}
+		utils.SuccessResponseWithMessage(ctx, "文件上传成功", gin.H{"file": record})
+		return
+	}
+
+	message, created, err := c.messageService.CreateMessageWithAttachments(req.Message.Content, userID.(uint), record.ChatRoomID, []*models.File{record}, req.Message.ClientNonce)
+	if err != nil {
+		c.fileService.RemoveObjects([]*models.File{record})
+		switch err.Error() {
+		case "message content is too long", "client nonce is too long":
+			utils.ValidationErrorResponse(ctx, err.Error())
+		case "attachment was uploaded by another user", "attachment belongs to another chat room":
+			utils.ForbiddenResponse(ctx, err.Error())
+		default:
+			utils.InternalErrorResponse(ctx, err.Error())
+		}
+		return
+	}
+
+	if created {
+		c.hub.BroadcastMessage(message)
+	} else {
+		// 重试已发送过的消息，该消息已带有自己的附件
+		c.fileService.RemoveObjects([]*models.File{record})
+	}
+
+	utils.SuccessResponseWithMessage(ctx, "文件上传成功", gin.H{"message": message})
 }
\ No newline at end of file
@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"chatapp/handlers"
+	"chatapp/service"
+	"chatapp/utils"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxAttachmentsPerMessage limits how many files can be posted in one message
+const maxAttachmentsPerMessage = 10
+
+type MessageController struct {
+	messageService service.MessageService
+	fileService    *service.FileService
+	pinService     service.PinService
+	hub            *handlers.Hub
+}
+
+// NewMessageController creates a new message controller
+func NewMessageController(messageService service.MessageService, fileService *service.FileService, pinService service.PinService, hub *handlers.Hub) *MessageController {
+	return &MessageController{
+		messageService: messageService,
+		fileService:    fileService,
+		pinService:     pinService,
+		hub:            hub,
+	}
+}
+
+type SendMessageRequest struct {
+	Content     string `json:"content" binding:"required"`
+	ClientNonce string `json:"client_nonce" binding:"max=64"`
+}
+
+// parseMessagePath parses the :id (chat room) and :message_id parameters
+func parseMessagePath(c *gin.Context) (chatRoomID, messageID uint, ok bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid chat room ID")
+		return 0, 0, false
+	}
+
+	msgID, err := strconv.ParseUint(c.Param("message_id"), 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid message ID")
+		return 0, 0, false
+	}
+
+	return uint(id), uint(msgID), true
+}
+
+// SendMessage posts a text message. Resending the same client_nonce returns
+// the original message instead of creating another one.
+func (ctrl *MessageController) SendMessage(c *gin.Context) {
+	chatRoomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid chat room ID")
+		return
+	}
+
+	var req SendMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(c, err.Error())
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	message, created, err := ctrl.messageService.CreateMessage(req.Content, userID.(uint), uint(chatRoomID), req.ClientNonce)
+	if err != nil {
+		switch err.Error() {
+		case "chat room not found":
+			utils.NotFoundResponse(c, err.Error())
+		case "message content is too long", "client nonce is too long":
+			utils.ValidationErrorResponse(c, err.Error())
+		default:
+			utils.InternalErrorResponse(c, err.Error())
+		}
+		return
+	}
+
+	if created {
+		ctrl.hub.BroadcastMessage(message)
+	}
+
+	utils.SuccessResponse(c, message)
+}
+
+// PostWithAttachments uploads files and posts them as one message. Either the
+// message and all of its attachments are created, or none of them.
+func (ctrl *MessageController) PostWithAttachments(c *gin.Context) {
+	chatRoomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid chat room ID")
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		utils.BadRequestResponse(c, "Failed to read files: "+err.Error())
+		return
+	}
+
+	files := form.File["files"]
+	if len(files) == 0 {
+		utils.BadRequestResponse(c, "At least one file is required")
+		return
+	}
+	if len(files) > maxAttachmentsPerMessage {
+		utils.BadRequestResponse(c, fmt.Sprintf("At most %d files can be attached", maxAttachmentsPerMessage))
+		return
+	}
+	maxFileSize, err := ctrl.fileService.MaxFileSize(uint(chatRoomID))
+	if err != nil {
+		utils.NotFoundResponse(c, "Chat room not found")
+		return
+	}
+	for _, file := range files {
+		if file.Size > maxFileSize {
+			utils.BadRequestResponse(c, "File exceeds the "+formatFileSize(maxFileSize)+" limit: "+file.Filename)
+			return
+		}
+	}
+
+	records, err := ctrl.fileService.StoreAttachments(files, uint(chatRoomID), userID.(uint))
+	if err != nil {
+		utils.InternalErrorResponse(c, "Failed to upload files: "+err.Error())
+		return
+	}
+
+	message, created, err := ctrl.messageService.CreateMessageWithAttachments(c.PostForm("content"), userID.(uint), uint(chatRoomID), records, c.PostForm("client_nonce"))
+	if err != nil {
+		// Don't leave objects behind for a message that was never created
+		ctrl.fileService.RemoveObjects(records)
+		switch err.Error() {
+		case "message content is too long", "client nonce is too long":
+			utils.ValidationErrorResponse(c, err.Error())
+		case "attachment was uploaded by another user", "attachment belongs to another chat room":
+			utils.ForbiddenResponse(c, err.Error())
+		default:
+			utils.InternalErrorResponse(c, err.Error())
+		}
+		return
+	}
+
+	if created {
+		ctrl.hub.BroadcastMessage(message)
+	} else {
+		// A retry of a message that was already posted, with its own copies
+		// of the files; drop the ones stored for this attempt
+		ctrl.fileService.RemoveObjects(records)
+	}
+
+	utils.SuccessResponse(c, message)
+}
+
+// DeleteMessage deletes a message and the attachments only it referenced
+func (ctrl *MessageController) DeleteMessage(c *gin.Context) {
+	chatRoomID, messageID, ok := parseMessagePath(c)
+	if !ok {
+		return
+	}
+
+	message, err := ctrl.messageService.GetMessage(messageID)
+	if err != nil || message.ChatRoomID != chatRoomID {
+		utils.NotFoundResponse(c, "message not found")
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	if err := ctrl.messageService.DeleteMessage(messageID, userID.(uint)); err != nil {
+		if err.Error() == "only the author can delete this message" {
+			utils.ForbiddenResponse(c, err.Error())
+			return
+		}
+		utils.InternalErrorResponse(c, err.Error())
+		return
+	}
+
+	ctrl.hub.BroadcastMessageDeleted(message.ChatRoomID, message.ID)
+
+	utils.SuccessResponse(c, nil)
+}
+
+// GetPinnedMessages returns the pinned messages of a chat room with their authors
+func (ctrl *MessageController) GetPinnedMessages(c *gin.Context) {
+	chatRoomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid chat room ID")
+		return
+	}
+
+	pins, err := ctrl.pinService.GetPinnedMessages(uint(chatRoomID))
+	if err != nil {
+		utils.NotFoundResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, pins)
+}
+
+// PinMessage pins a message, moderators only
+func (ctrl *MessageController) PinMessage(c *gin.Context) {
+	chatRoomID, messageID, ok := parseMessagePath(c)
+	if !ok {
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	pin, err := ctrl.pinService.PinMessage(chatRoomID, messageID, userID.(uint))
+	if err != nil {
+		if errors.Is(err, service.ErrNotModerator) {
+			utils.ForbiddenResponse(c, err.Error())
+			return
+		}
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	ctrl.hub.BroadcastPinned(pin)
+
+	utils.SuccessResponse(c, pin)
+}
+
+// UnpinMessage unpins a message, moderators only
+func (ctrl *MessageController) UnpinMessage(c *gin.Context) {
+	chatRoomID, messageID, ok := parseMessagePath(c)
+	if !ok {
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	username, _ := c.Get("username")
+
+	if err := ctrl.pinService.UnpinMessage(chatRoomID, messageID, userID.(uint)); err != nil {
+		if errors.Is(err, service.ErrNotModerator) {
+			utils.ForbiddenResponse(c, err.Error())
+			return
+		}
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	ctrl.hub.BroadcastUnpinned(chatRoomID, messageID, userID.(uint), username.(string))
+
+	utils.SuccessResponse(c, nil)
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"chatapp/service"
+	"chatapp/utils"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type NotificationController struct {
+	notificationService service.NotificationService
+}
+
+// NewNotificationController creates a new notification controller
+func NewNotificationController(notificationService service.NotificationService) *NotificationController {
+	return &NotificationController{
+		notificationService: notificationService,
+	}
+}
+
+type SetNotificationPreferenceRequest struct {
+	Level string `json:"level" binding:"required,oneof=all mentions mute"`
+}
+
+// GetNotifications returns the current user's notifications inbox
+func (ctrl *NotificationController) GetNotifications(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	// Parse optional query parameters
+	unreadOnly := c.Query("unread") == "true"
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	notifications, err := ctrl.notificationService.GetNotifications(userID.(uint), unreadOnly, limit, offset)
+	if err != nil {
+		utils.InternalErrorResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, notifications)
+}
+
+// GetUnreadCount returns the number of unread notifications
+func (ctrl *NotificationController) GetUnreadCount(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	count, err := ctrl.notificationService.GetUnreadCount(userID.(uint))
+	if err != nil {
+		utils.InternalErrorResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, gin.H{"unread": count})
+}
+
+// MarkAsRead marks one notification as read
+func (ctrl *NotificationController) MarkAsRead(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid notification ID")
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	if err := ctrl.notificationService.MarkAsRead(uint(id), userID.(uint)); err != nil {
+		utils.NotFoundResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, nil)
+}
+
+// MarkAllAsRead marks all of the current user's notifications as read
+func (ctrl *NotificationController) MarkAllAsRead(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	if err := ctrl.notificationService.MarkAllAsRead(userID.(uint)); err != nil {
+		utils.InternalErrorResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, nil)
+}
+
+// GetPreference returns the current user's notification level for a chat room
+func (ctrl *NotificationController) GetPreference(c *gin.Context) {
+	chatRoomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid chat room ID")
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	preference, err := ctrl.notificationService.GetPreference(userID.(uint), uint(chatRoomID))
+	if err != nil {
+		utils.NotFoundResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, preference)
+}
+
+// SetPreference sets the current user's notification level for a chat room
+func (ctrl *NotificationController) SetPreference(c *gin.Context) {
+	chatRoomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid chat room ID")
+		return
+	}
+
+	var req SetNotificationPreferenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(c, err.Error())
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	preference, err := ctrl.notificationService.SetPreference(userID.(uint), uint(chatRoomID), req.Level)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, preference)
+}
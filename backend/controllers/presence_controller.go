@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"chatapp/service"
+	"chatapp/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxPresenceQueryUsers caps how many users can be queried at once
+const maxPresenceQueryUsers = 200
+
+type PresenceController struct {
+	presenceService service.PresenceService
+}
+
+// NewPresenceController creates a new presence controller
+func NewPresenceController(presenceService service.PresenceService) *PresenceController {
+	return &PresenceController{
+		presenceService: presenceService,
+	}
+}
+
+type SetStatusRequest struct {
+	Text      string `json:"text" binding:"required"`
+	ExpiresIn int    `json:"expires_in"` // seconds, 0 means never
+}
+
+// GetPresence returns the presence of a comma-separated list of users
+func (ctrl *PresenceController) GetPresence(c *gin.Context) {
+	userIDsStr := c.Query("user_ids")
+	if userIDsStr == "" {
+		utils.BadRequestResponse(c, "user_ids is required")
+		return
+	}
+
+	parts := strings.Split(userIDsStr, ",")
+	if len(parts) > maxPresenceQueryUsers {
+		utils.BadRequestResponse(c, "Too many user IDs")
+		return
+	}
+
+	userIDs := make([]uint, 0, len(parts))
+	for _, part := range parts {
+		userID, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			utils.BadRequestResponse(c, "Invalid user ID: "+part)
+			return
+		}
+		userIDs = append(userIDs, uint(userID))
+	}
+
+	presences, err := ctrl.presenceService.GetPresence(userIDs)
+	if err != nil {
+		utils.InternalErrorResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, presences)
+}
+
+// SetStatus sets the current user's custom status text
+func (ctrl *PresenceController) SetStatus(c *gin.Context) {
+	var req SetStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(c, err.Error())
+		return
+	}
+	if req.ExpiresIn < 0 {
+		utils.ValidationErrorResponse(c, "expires_in must not be negative")
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+
+	presence, err := ctrl.presenceService.SetStatusText(userID.(uint), req.Text, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, presence)
+}
+
+// ClearStatus removes the current user's custom status text
+func (ctrl *PresenceController) ClearStatus(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	presence, err := ctrl.presenceService.ClearStatusText(userID.(uint))
+	if err != nil {
+		utils.InternalErrorResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, presence)
+}
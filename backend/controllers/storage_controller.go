@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"chatapp/storage"
+	"chatapp/utils"
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inlineContentTypes 是可以在浏览器中直接显示的图片类型，它们不能执行脚本；
+// SVG 可以携带脚本，不在其中
+var inlineContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+}
+
+// StorageController 处理本地存储的签名URL，签名本身即是授权，不需要JWT
+type StorageController struct {
+	local       *storage.LocalStorage
+	maxFileSize int64
+}
+
+// NewStorageController 创建本地存储控制器
+// 签名URL不携带聊天室，上传大小以聊天室可设置的最大限制 maxFileSize 为上限
+func NewStorageController(local *storage.LocalStorage, maxFileSize int64) *StorageController {
+	return &StorageController{
+		local:       local,
+		maxFileSize: maxFileSize,
+	}
+}
+
+// verify 校验请求的签名，返回对象路径和签名中的下载选项；失败时写入错误响应并返回空路径
+func (c *StorageController) verify(ctx *gin.Context, method string) (string, storage.DownloadOptions) {
+	objectPath := strings.TrimPrefix(ctx.Param("path"), "/")
+	options, err := c.local.Verify(method, objectPath, ctx.Request.URL.Query())
+	if err != nil {
+		switch err.Error() {
+		case "invalid object path":
+			utils.BadRequestResponse(ctx, "无效的对象路径")
+		case "signature expired":
+			utils.ForbiddenResponse(ctx, "链接已过期")
+		default:
+			utils.ForbiddenResponse(ctx, "签名无效")
+		}
+		return "", options
+	}
+	return objectPath, options
+}
+
+// ServeObject 下载本地存储的文件
+// @Summary 下载本地存储的文件
+// @Description 通过签名URL下载文件，支持 Range 和条件请求；图片以外的文件作为附件下载。文件名和内容类型取自链接中签名的 name、type 参数，没有时由对象路径得出
+// @Tags files
+// @Produce octet-stream
+// @Param path path string true "对象路径"
+// @Param expires query int true "过期时间（Unix秒）"
+// @Param signature query string true "签名"
+// @Success 200 {file} file
+// @Failure 403 {object} utils.Response
+// @Failure 404 {object} utils.Response
+// @Router /api/storage/local/{path} [get]
+func (c *StorageController) ServeObject(ctx *gin.Context) {
+	// HEAD 请求使用下载链接的签名
+	objectPath, options := c.verify(ctx, http.MethodGet)
+	if objectPath == "" {
+		return
+	}
+
+	file, info, err := c.local.Open(objectPath)
+	if err != nil {
+		if err.Error() == "object not found" {
+			utils.NotFoundResponse(ctx, "文件不存在")
+			return
+		}
+		utils.InternalErrorResponse(ctx, "读取文件失败: "+err.Error())
+		return
+	}
+	defer file.Close()
+
+	// 签名URL可以被缓存到过期为止，但不能被共享缓存保存
+	ctx.Header("Cache-Control", "private")
+	ctx.Header("X-Content-Type-Options", "nosniff")
+	// 去重后的内容对象由多个文件共用，文件名和类型以链接中签名的为准
+	fileName := options.FileName
+	if fileName == "" {
+		fileName = info.Name()
+	}
+	contentType := options.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(objectPath))
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	// 文件由用户上传，且与应用同源：只有图片内联显示，其他文件（HTML、SVG 等）
+	// 一律作为附件下载并放入沙箱，防止其中的脚本在本站执行
+	if inlineContentTypes[contentType] {
+		ctx.Header("Content-Type", contentType)
+		ctx.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": fileName}))
+	} else {
+		ctx.Header("Content-Type", "application/octet-stream")
+		ctx.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+		ctx.Header("Content-Security-Policy", "sandbox")
+	}
+	http.ServeContent(ctx.Writer, ctx.Request, info.Name(), info.ModTime(), file)
+}
+
+// PutObject 通过预签名URL上传文件
+// @Summary 通过预签名URL上传文件
+// @Description 以请求体作为文件内容，上传到 /api/files/upload-url 返回的地址
+// @Tags files
+// @Accept octet-stream
+// @Produce json
+// @Param path path string true "对象路径"
+// @Param expires query int true "过期时间（Unix秒）"
+// @Param signature query string true "签名"
+// @Success 200 {object} utils.Response
+// @Failure 403 {object} utils.Response
+// @Failure 413 {object} utils.Response
+// @Router /api/storage/local/{path} [put]
+func (c *StorageController) PutObject(ctx *gin.Context) {
+	objectPath, _ := c.verify(ctx, http.MethodPut)
+	if objectPath == "" {
+		return
+	}
+
+	if ctx.Request.ContentLength > c.maxFileSize {
+		utils.ErrorResponse(ctx, http.StatusRequestEntityTooLarge, utils.CODE_BAD_REQUEST, "文件大小不能超过"+formatFileSize(c.maxFileSize))
+		return
+	}
+	body := http.MaxBytesReader(ctx.Writer, ctx.Request.Body, c.maxFileSize)
+
+	result, err := c.local.Upload(objectPath, body, storage.UploadOptions{
+		ContentType: ctx.ContentType(),
+		Size:        ctx.Request.ContentLength,
+	})
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			utils.ErrorResponse(ctx, http.StatusRequestEntityTooLarge, utils.CODE_BAD_REQUEST, "文件大小不能超过"+formatFileSize(c.maxFileSize))
+			return
+		}
+		utils.InternalErrorResponse(ctx, "文件上传失败: "+err.Error())
+		return
+	}
+
+	ctx.Header("ETag", `"`+result.ETag+`"`)
+	utils.SuccessResponseWithMessage(ctx, "文件上传成功", gin.H{
+		"object_path": result.ObjectPath,
+		"size":        result.Size,
+	})
+}
@@ -0,0 +1,241 @@
+package controllers
+
+import (
+	"bytes"
+	"chatapp/config"
+	"chatapp/models"
+	"chatapp/repository"
+	"chatapp/service"
+	"chatapp/storage"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// blobTable 在内存中登记内容及其引用数
+type blobTable struct {
+	repository.BlobRepository
+	blobs []*models.Blob
+}
+
+func (r *blobTable) GetBySHA256(sum string) (*models.Blob, error) {
+	for _, blob := range r.blobs {
+		if blob.SHA256 == sum {
+			found := *blob
+			return &found, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *blobTable) Acquire(blob *models.Blob) error {
+	for _, stored := range r.blobs {
+		if stored.SHA256 == blob.SHA256 {
+			stored.RefCount++
+			*blob = *stored
+			return nil
+		}
+	}
+	blob.ID = uint(len(r.blobs) + 1)
+	blob.RefCount = 1
+	stored := *blob
+	r.blobs = append(r.blobs, &stored)
+	return nil
+}
+
+func (r *blobTable) AddRef(id uint) (bool, error) {
+	for _, blob := range r.blobs {
+		if blob.ID == id && blob.RefCount > 0 {
+			blob.RefCount++
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// newLocalFileService 创建使用本地存储的文件服务，本地存储的签名URL由测试服务器像服务端一样处理
+func newLocalFileService(t *testing.T) *service.FileService {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	server := httptest.NewServer(engine)
+	t.Cleanup(server.Close)
+
+	previousConfig, previousLocal := config.GlobalConfig, viper.Get(storage.StorageTypeLocal)
+	t.Cleanup(func() {
+		config.GlobalConfig = previousConfig
+		viper.Set(storage.StorageTypeLocal, previousLocal)
+	})
+	config.GlobalConfig = &config.Config{Storage: config.StorageConfig{Type: storage.StorageTypeLocal}}
+	viper.Set(storage.StorageTypeLocal, map[string]interface{}{
+		"dir":         t.TempDir(),
+		"base_url":    server.URL,
+		"signing_key": "storage-controller-test",
+	})
+
+	fileService := service.NewFileService(nil, nil, nil, &blobTable{}, 50<<20)
+	storageController := NewStorageController(fileService.LocalStorage(), 50<<20)
+	engine.GET("/api/storage/local/*path", storageController.ServeObject)
+	return fileService
+}
+
+// pngImage 返回一张小的 PNG 图片
+func pngImage(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// storeFile 像上传一样保存内容，返回文件记录和是否使用了已有的内容
+func storeFile(t *testing.T, fileService *service.FileService, fileName, contentType string, content []byte) (*models.File, bool) {
+	t.Helper()
+	sum := sha256.Sum256(content)
+	record := &models.File{FileName: fileName, ContentType: contentType, ChatRoomID: 1, UploaderID: 1}
+	merged, err := fileService.StoreContent(record, bytes.NewReader(content), int64(len(content)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record, merged
+}
+
+// download 请求文件的下载URL
+func download(t *testing.T, fileService *service.FileService, record *models.File) *http.Response {
+	t.Helper()
+	downloadURL, err := fileService.DownloadURL(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(downloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// expectDisposition 检查 Content-Disposition 的类型和文件名
+func expectDisposition(t *testing.T, resp *http.Response, disposition, fileName string) {
+	t.Helper()
+	got, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil || got != disposition || params["filename"] != fileName {
+		t.Fatalf("Content-Disposition %q, want %s with filename %q", resp.Header.Get("Content-Disposition"), disposition, fileName)
+	}
+}
+
+func TestServeDedupedObject(t *testing.T) {
+	fileService := newLocalFileService(t)
+
+	t.Run("a deduped image downloads inline with its own name", func(t *testing.T) {
+		content := pngImage(t)
+		first, _ := storeFile(t, fileService, "first.png", "image/png", content)
+		second, merged := storeFile(t, fileService, "holiday photo.PNG", "image/png", content)
+		if !merged || second.FilePath != first.FilePath {
+			t.Fatalf("second upload stored at %s, want it to share %s", second.FilePath, first.FilePath)
+		}
+		if path.Ext(first.FilePath) != ".png" {
+			t.Fatalf("content stored at %s, want the .png extension kept", first.FilePath)
+		}
+		info, err := fileService.Storage().GetFileInfo(first.FilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentType != "image/png" {
+			t.Fatalf("stored content type %q, want image/png", info.ContentType)
+		}
+
+		resp := download(t, fileService, second)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("download returned %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Content-Type"); got != "image/png" {
+			t.Fatalf("Content-Type %q, want image/png", got)
+		}
+		expectDisposition(t, resp, "inline", "holiday photo.PNG")
+		body, _ := io.ReadAll(resp.Body)
+		if !bytes.Equal(body, content) {
+			t.Fatal("downloaded content differs")
+		}
+	})
+
+	t.Run("other deduped files download as attachments with their own name", func(t *testing.T) {
+		content := []byte("<html><script>alert(1)</script></html>")
+		first, _ := storeFile(t, fileService, "page.html", "text/html", content)
+		second, merged := storeFile(t, fileService, "报告 final.html", "text/html", content)
+		if !merged || second.FilePath != first.FilePath {
+			t.Fatalf("second upload stored at %s, want it to share %s", second.FilePath, first.FilePath)
+		}
+
+		resp := download(t, fileService, second)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("download returned %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Content-Type"); got != "application/octet-stream" {
+			t.Fatalf("Content-Type %q, want application/octet-stream", got)
+		}
+		if got := resp.Header.Get("Content-Security-Policy"); got != "sandbox" {
+			t.Fatalf("Content-Security-Policy %q, want sandbox", got)
+		}
+		expectDisposition(t, resp, "attachment", "报告 final.html")
+	})
+
+	t.Run("an image type can't be claimed by editing the link", func(t *testing.T) {
+		record, _ := storeFile(t, fileService, "page.html", "text/html", []byte("<svg onload=alert(1)>"))
+		downloadURL, err := fileService.DownloadURL(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(downloadURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := u.Query()
+		query.Set("type", "image/png")
+		u.RawQuery = query.Encode()
+
+		resp, err := http.Get(u.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("edited link returned %d, want 403", resp.StatusCode)
+		}
+	})
+
+	t.Run("content paths keep extensions that fit an object path", func(t *testing.T) {
+		tests := []struct {
+			fileName string
+			ext      string
+		}{
+			{"Photo.JPEG", ".jpeg"},
+			{"archive.tar.gz", ".gz"},
+			{"no extension", ""},
+			{"odd.gz#1", ""},
+			{"notes.verylongextension", ""},
+			{"文件.文档", ""},
+		}
+		for _, tt := range tests {
+			record, _ := storeFile(t, fileService, tt.fileName, "application/octet-stream", []byte("content of "+tt.fileName))
+			if !strings.HasPrefix(record.FilePath, "blobs/") || path.Ext(record.FilePath) != tt.ext {
+				t.Errorf("%q stored at %s, want a path under blobs/ ending in %q", tt.fileName, record.FilePath, tt.ext)
+			}
+		}
+	})
+}
@@ -0,0 +1,273 @@
+package controllers
+
+import (
+	"chatapp/service"
+	"chatapp/utils"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tus 协议版本与支持的扩展
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+)
+
+// UploadController 处理可续传上传（tus 协议）
+// 客户端先以 POST 声明文件大小和元数据，再以 PATCH 分段发送内容；
+// 连接中断后以 HEAD 查询已接收的字节数，从该位置继续
+type UploadController struct {
+	uploadService service.UploadService
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+}
+
+// NewUploadController 创建上传控制器
+// readTimeout 和 writeTimeout 为服务器的读写超时，PATCH 持续接收内容期间会不断延长
+func NewUploadController(uploadService service.UploadService, readTimeout, writeTimeout time.Duration) *UploadController {
+	return &UploadController{
+		uploadService: uploadService,
+		readTimeout:   readTimeout,
+		writeTimeout:  writeTimeout,
+	}
+}
+
+// tusHeaders 写入每个响应都带的协议头，请求未声明支持的版本时返回 false
+func (c *UploadController) tusHeaders(ctx *gin.Context) bool {
+	ctx.Header("Tus-Resumable", tusVersion)
+	if ctx.GetHeader("Tus-Resumable") != tusVersion {
+		ctx.Header("Tus-Version", tusVersion)
+		utils.ErrorResponse(ctx, http.StatusPreconditionFailed, utils.CODE_BAD_REQUEST, "不支持的 tus 协议版本")
+		return false
+	}
+	return true
+}
+
+// uploadHeaders 写入上传的进度和过期时间
+func uploadHeaders(ctx *gin.Context, offset, length int64, expiresAt time.Time, fileID *uint) {
+	ctx.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	ctx.Header("Upload-Length", strconv.FormatInt(length, 10))
+	ctx.Header("Upload-Expires", expiresAt.UTC().Format(http.TimeFormat))
+	ctx.Header("Cache-Control", "no-store")
+	if fileID != nil {
+		ctx.Header("X-File-ID", strconv.FormatUint(uint64(*fileID), 10))
+	}
+}
+
+// uploadError 将服务返回的错误转换为响应
+func uploadError(ctx *gin.Context, err error) {
+	switch err.Error() {
+	case "upload not found", "chat room not found":
+		utils.NotFoundResponse(ctx, err.Error())
+	case "upload is no longer available":
+		utils.ErrorResponse(ctx, http.StatusGone, utils.CODE_NOT_FOUND, err.Error())
+	case "upload offset mismatch":
+		utils.ErrorResponse(ctx, http.StatusConflict, utils.CODE_BAD_REQUEST, err.Error())
+	case "upload is locked":
+		utils.ErrorResponse(ctx, http.StatusLocked, utils.CODE_BAD_REQUEST, err.Error())
+	case "file is too large", "upload exceeds its length":
+		utils.ErrorResponse(ctx, http.StatusRequestEntityTooLarge, utils.CODE_BAD_REQUEST, err.Error())
+	case "file name is required", "invalid upload length":
+		utils.BadRequestResponse(ctx, err.Error())
+	default:
+		utils.InternalErrorResponse(ctx, err.Error())
+	}
+}
+
+// parseMetadata 解析 Upload-Metadata 头：以逗号分隔的 "键 base64值"
+func parseMetadata(header string) (map[string]string, bool) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, true
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, false
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, false
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, true
+}
+
+// Options 返回服务器支持的 tus 版本和扩展，不需要认证
+// @Summary 查询可续传上传的能力
+// @Tags files
+// @Success 204
+// @Router /api/files/uploads [options]
+func (c *UploadController) Options(ctx *gin.Context) {
+	ctx.Header("Tus-Resumable", tusVersion)
+	ctx.Header("Tus-Version", tusVersion)
+	ctx.Header("Tus-Extension", tusExtensions)
+	ctx.Header("Tus-Max-Size", strconv.FormatInt(c.uploadService.MaxSize(), 10))
+	ctx.Status(http.StatusNoContent)
+}
+
+// CreateUpload 创建可续传上传
+// @Summary 创建可续传上传
+// @Description 声明文件大小和元数据（filename、filetype、chatroom_id，值为 base64），返回上传地址
+// @Tags files
+// @Param Tus-Resumable header string true "1.0.0"
+// @Param Upload-Length header int true "文件大小（字节）"
+// @Param Upload-Metadata header string true "filename <base64>,filetype <base64>,chatroom_id <base64>"
+// @Success 201
+// @Failure 400 {object} utils.Response
+// @Failure 404 {object} utils.Response
+// @Failure 413 {object} utils.Response
+// @Router /api/files/uploads [post]
+func (c *UploadController) CreateUpload(ctx *gin.Context) {
+	if !c.tusHeaders(ctx) {
+		return
+	}
+	userID, _ := ctx.Get("user_id")
+
+	length, err := strconv.ParseInt(ctx.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		utils.BadRequestResponse(ctx, "无效的 Upload-Length")
+		return
+	}
+	if length > c.uploadService.MaxSize() {
+		utils.ErrorResponse(ctx, http.StatusRequestEntityTooLarge, utils.CODE_BAD_REQUEST, "文件大小不能超过"+formatFileSize(c.uploadService.MaxSize()))
+		return
+	}
+
+	metadata, ok := parseMetadata(ctx.GetHeader("Upload-Metadata"))
+	if !ok {
+		utils.BadRequestResponse(ctx, "无效的 Upload-Metadata")
+		return
+	}
+	chatRoomID, err := strconv.ParseUint(metadata["chatroom_id"], 10, 32)
+	if err != nil {
+		utils.BadRequestResponse(ctx, "无效的聊天室ID")
+		return
+	}
+
+	upload, err := c.uploadService.Create(uint(chatRoomID), userID.(uint), metadata["filename"], metadata["filetype"], length)
+	if err != nil {
+		uploadError(ctx, err)
+		return
+	}
+
+	// 相对地址，客户端根据创建请求的URL解析
+	ctx.Header("Location", strings.TrimSuffix(ctx.Request.URL.Path, "/")+"/"+upload.ID)
+	uploadHeaders(ctx, upload.Offset, upload.Length, upload.ExpiresAt, upload.FileID)
+	ctx.Status(http.StatusCreated)
+}
+
+// GetUpload 查询上传已接收的字节数
+// @Summary 查询可续传上传的进度
+// @Tags files
+// @Param id path string true "上传ID"
+// @Param Tus-Resumable header string true "1.0.0"
+// @Success 200
+// @Failure 404 {object} utils.Response
+// @Router /api/files/uploads/{id} [head]
+func (c *UploadController) GetUpload(ctx *gin.Context) {
+	if !c.tusHeaders(ctx) {
+		return
+	}
+	userID, _ := ctx.Get("user_id")
+
+	upload, err := c.uploadService.Get(ctx.Param("id"), userID.(uint))
+	if err != nil {
+		uploadError(ctx, err)
+		return
+	}
+
+	uploadHeaders(ctx, upload.Offset, upload.Length, upload.ExpiresAt, upload.FileID)
+	ctx.Status(http.StatusOK)
+}
+
+// deadlineReader 每次读取前延长连接的读超时，
+// 大文件只要持续发送就不会因服务器的读超时而中断
+type deadlineReader struct {
+	body       io.Reader
+	controller *http.ResponseController
+	timeout    time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.timeout > 0 {
+		r.controller.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	return r.body.Read(p)
+}
+
+// AppendUpload 从 Upload-Offset 处继续写入上传内容，全部接收后创建文件
+// @Summary 发送可续传上传的内容
+// @Description 请求体为文件从 Upload-Offset 开始的内容；上传完成时响应头 X-File-ID 为创建的文件ID
+// @Tags files
+// @Accept application/offset+octet-stream
+// @Param id path string true "上传ID"
+// @Param Tus-Resumable header string true "1.0.0"
+// @Param Upload-Offset header int true "内容在文件中的起始位置"
+// @Success 204
+// @Failure 404 {object} utils.Response
+// @Failure 409 {object} utils.Response
+// @Failure 415 {object} utils.Response
+// @Failure 423 {object} utils.Response
+// @Router /api/files/uploads/{id} [patch]
+func (c *UploadController) AppendUpload(ctx *gin.Context) {
+	if !c.tusHeaders(ctx) {
+		return
+	}
+	userID, _ := ctx.Get("user_id")
+
+	if ctx.ContentType() != "application/offset+octet-stream" {
+		utils.ErrorResponse(ctx, http.StatusUnsupportedMediaType, utils.CODE_BAD_REQUEST, "Content-Type 必须为 application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(ctx.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		utils.BadRequestResponse(ctx, "无效的 Upload-Offset")
+		return
+	}
+
+	controller := http.NewResponseController(ctx.Writer)
+	body := &deadlineReader{body: ctx.Request.Body, controller: controller, timeout: c.readTimeout}
+	upload, err := c.uploadService.Append(ctx.Param("id"), userID.(uint), offset, body)
+
+	// 接收内容可能超过了写超时，从现在起重新计算
+	if c.writeTimeout > 0 {
+		controller.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if err != nil {
+		uploadError(ctx, err)
+		return
+	}
+
+	uploadHeaders(ctx, upload.Offset, upload.Length, upload.ExpiresAt, upload.FileID)
+	ctx.Status(http.StatusNoContent)
+}
+
+// DeleteUpload 放弃未完成的上传；已完成上传创建的文件不受影响
+// @Summary 终止可续传上传
+// @Tags files
+// @Param id path string true "上传ID"
+// @Param Tus-Resumable header string true "1.0.0"
+// @Success 204
+// @Failure 404 {object} utils.Response
+// @Router /api/files/uploads/{id} [delete]
+func (c *UploadController) DeleteUpload(ctx *gin.Context) {
+	if !c.tusHeaders(ctx) {
+		return
+	}
+	userID, _ := ctx.Get("user_id")
+
+	if err := c.uploadService.Terminate(ctx.Param("id"), userID.(uint)); err != nil {
+		uploadError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,349 @@
+package handlers
+
+import (
+	"chatapp/config"
+	"chatapp/models"
+	"chatapp/utils"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// frameClass tells how a frame may be treated when a client falls behind
+type frameClass byte
+
+const (
+	// Room events, which the client must not miss without being told
+	classEvent frameClass = iota
+	// Typing/recording activity, worthless once late
+	classEphemeral
+	// Presence snapshots, where only the latest per user matters
+	classPresence
+	// Frames for a user, such as notifications
+	classUser
+)
+
+// Slow-consumer policies
+const (
+	PolicyDrop       = "drop"
+	PolicyCoalesce   = "coalesce"
+	PolicyResync     = "resync"
+	PolicyDisconnect = "disconnect"
+)
+
+const defaultSlowConsumerGrace = 30 * time.Second
+
+// slowConsumerPolicy decides what happens to frames for a client whose send
+// buffer is full
+type slowConsumerPolicy struct {
+	ephemeral string
+	presence  string
+	events    string
+	// A client backed up for longer than this is disconnected
+	gracePeriod time.Duration
+}
+
+func newSlowConsumerPolicy() slowConsumerPolicy {
+	policy := slowConsumerPolicy{
+		ephemeral:   PolicyDrop,
+		presence:    PolicyCoalesce,
+		events:      PolicyResync,
+		gracePeriod: defaultSlowConsumerGrace,
+	}
+	if config.GlobalConfig == nil {
+		return policy
+	}
+
+	cfg := config.GlobalConfig.WebSocket.SlowConsumer
+	switch cfg.Ephemeral {
+	case PolicyDrop, PolicyDisconnect:
+		policy.ephemeral = cfg.Ephemeral
+	}
+	switch cfg.Presence {
+	case PolicyCoalesce, PolicyDrop, PolicyDisconnect:
+		policy.presence = cfg.Presence
+	}
+	switch cfg.Events {
+	case PolicyResync, PolicyDisconnect:
+		policy.events = cfg.Events
+	}
+	if cfg.GracePeriod >= 0 {
+		policy.gracePeriod = cfg.GracePeriod
+	}
+	return policy
+}
+
+func (p slowConsumerPolicy) forClass(class frameClass) string {
+	switch class {
+	case classEphemeral:
+		return p.ephemeral
+	case classPresence:
+		return p.presence
+	}
+	return p.events
+}
+
+// delivery is a frame on its way to a client, with what the policies need
+// to know about it
+type delivery struct {
+	class      frameClass
+	chatRoomID uint
+	seq        uint64
+	key        uint64 // coalescing key of presence frames
+	frame      *wireFrame
+}
+
+// presenceKey identifies the presence of a user in a room
+func presenceKey(chatRoomID, userID uint) uint64 {
+	return uint64(chatRoomID)<<32 | uint64(userID)
+}
+
+// clientStats counts what happened to the frames of a client
+type clientStats struct {
+	queued    atomic.Uint64
+	written   atomic.Uint64
+	dropped   atomic.Uint64
+	coalesced atomic.Uint64
+	resyncs   atomic.Uint64
+	maxQueue  atomic.Int64
+}
+
+// ClientStats describes the outbound queue of a connection
+type ClientStats struct {
+	ID             uint64     `json:"id"`
+	UserID         uint       `json:"user_id"`
+	Rooms          int        `json:"rooms"`
+	QueueLength    int        `json:"queue_length"`
+	QueueCapacity  int        `json:"queue_capacity"`
+	MaxQueueLength int64      `json:"max_queue_length"`
+	Queued         uint64     `json:"queued"`
+	Written        uint64     `json:"written"`
+	Dropped        uint64     `json:"dropped"`
+	Coalesced      uint64     `json:"coalesced"`
+	Resyncs        uint64     `json:"resyncs"`
+	CongestedSince *time.Time `json:"congested_since,omitempty"`
+}
+
+// Stats returns the outbound queue metrics of the client
+func (c *Client) Stats() ClientStats {
+	c.mu.Lock()
+	stats := ClientStats{ID: c.id, UserID: c.userID, Rooms: len(c.subscriptions)}
+	if !c.congestedSince.IsZero() {
+		since := c.congestedSince
+		stats.CongestedSince = &since
+	}
+	c.mu.Unlock()
+
+	stats.QueueLength = len(c.send)
+	stats.QueueCapacity = cap(c.send)
+	stats.MaxQueueLength = c.stats.maxQueue.Load()
+	stats.Queued = c.stats.queued.Load()
+	stats.Written = c.stats.written.Load()
+	stats.Dropped = c.stats.dropped.Load()
+	stats.Coalesced = c.stats.coalesced.Load()
+	stats.Resyncs = c.stats.resyncs.Load()
+	return stats
+}
+
+// HubStats describes the connections of this node and those of the caller
+type HubStats struct {
+	Connections int           `json:"connections"`
+	Congested   int           `json:"congested"`
+	Clients     []ClientStats `json:"clients"`
+}
+
+// Stats returns the queue metrics of this node, with the per-connection
+// detail of one user
+func (h *Hub) Stats(userID uint) HubStats {
+	stats := HubStats{Clients: []ClientStats{}}
+	for _, shard := range h.shards {
+		shard.mu.RLock()
+		for _, clients := range shard.users {
+			for client := range clients {
+				stats.Connections++
+				client.mu.Lock()
+				if !client.congestedSince.IsZero() {
+					stats.Congested++
+				}
+				client.mu.Unlock()
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	for _, client := range h.userClients(userID) {
+		stats.Clients = append(stats.Clients, client.Stats())
+	}
+	return stats
+}
+
+// HandleWebSocketStats serves the outbound queue metrics of the node the
+// request lands on, with those of the caller's own connections
+func HandleWebSocketStats(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		utils.UnauthorizedResponse(c, "User not authenticated")
+		return
+	}
+
+	utils.SuccessResponse(c, GlobalHub.Stats(userID.(uint)))
+}
+
+// push queues a frame delivered by the hub. When the client is not keeping
+// up, the policy of the frame's class decides whether it is dropped, merged
+// with the next one, replaced by a resync signal, or the client disconnected.
+func (c *Client) push(d delivery) {
+	if d.frame == nil {
+		return
+	}
+	select {
+	case <-c.quit:
+		// Already disconnecting
+		return
+	default:
+	}
+
+	// Frames following ones held back must wait for them to keep their order
+	c.mu.Lock()
+	held := true
+	switch {
+	case d.class == classPresence && c.pendingPresence[d.key] != nil:
+		c.pendingPresence[d.key] = d.frame
+		c.stats.coalesced.Add(1)
+	case d.class == classEvent && c.missedRoom(d.chatRoomID):
+		if d.seq > 0 {
+			c.missedRooms[d.chatRoomID] = d.seq
+		}
+		c.stats.dropped.Add(1)
+	case d.class == classUser && c.missedUserFrames:
+		c.stats.dropped.Add(1)
+	default:
+		held = false
+	}
+	expired := held && c.congestionExpired(time.Now())
+	c.mu.Unlock()
+	if expired {
+		c.disconnectSlow()
+	}
+	if held {
+		return
+	}
+
+	select {
+	case c.send <- d.frame:
+		c.stats.queued.Add(1)
+		depth := int64(len(c.send))
+		for max := c.stats.maxQueue.Load(); depth > max; max = c.stats.maxQueue.Load() {
+			if c.stats.maxQueue.CompareAndSwap(max, depth) {
+				break
+			}
+		}
+		return
+	default:
+	}
+	c.overflow(d)
+}
+
+// missedRoom reports whether events of a room are held back behind a
+// resync signal; c.mu must be held
+func (c *Client) missedRoom(chatRoomID uint) bool {
+	_, missed := c.missedRooms[chatRoomID]
+	return missed
+}
+
+// overflow applies the slow-consumer policy to a frame that did not fit
+func (c *Client) overflow(d delivery) {
+	policy := c.hub.slowConsumer
+	now := time.Now()
+
+	c.mu.Lock()
+	if c.congestedSince.IsZero() {
+		c.congestedSince = now
+	}
+	disconnect := c.congestionExpired(now)
+
+	switch policy.forClass(d.class) {
+	case PolicyDrop:
+		c.stats.dropped.Add(1)
+	case PolicyCoalesce:
+		c.pendingPresence[d.key] = d.frame
+		c.stats.coalesced.Add(1)
+	case PolicyResync:
+		c.stats.dropped.Add(1)
+		switch {
+		case d.class == classUser:
+			c.missedUserFrames = true
+		case d.chatRoomID != 0:
+			seq := d.seq
+			if seq == 0 {
+				seq = c.seqs[d.chatRoomID]
+			}
+			c.missedRooms[d.chatRoomID] = seq
+		}
+	case PolicyDisconnect:
+		disconnect = true
+	}
+	c.mu.Unlock()
+
+	if disconnect {
+		c.disconnectSlow()
+		return
+	}
+
+	// Have the write pump pick up what was held back once it catches up
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// congestionExpired reports whether the client has been backed up for longer
+// than the grace period; c.mu must be held
+func (c *Client) congestionExpired(now time.Time) bool {
+	return !c.congestedSince.IsZero() && now.Sub(c.congestedSince) >= c.hub.slowConsumer.gracePeriod
+}
+
+// disconnectSlow closes a client that is not keeping up, without waiting
+// for its queue to drain
+func (c *Client) disconnectSlow() {
+	log.Printf("Disconnecting slow client %s", c.username)
+	c.close(CloseSlowConsumer, "Client too slow", false)
+}
+
+// flushPending writes what was held back while the client was behind: a
+// resync signal for each room and for user frames it missed, then the latest
+// presence of each user. It is called by the write pump once the send
+// buffer is empty.
+func (c *Client) flushPending() error {
+	c.mu.Lock()
+	c.congestedSince = time.Time{}
+	if len(c.missedRooms) == 0 && !c.missedUserFrames && len(c.pendingPresence) == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+
+	var frames []*wireFrame
+	for chatRoomID, seq := range c.missedRooms {
+		frames = append(frames, encodeEvent(models.EventResyncRequired, models.ResyncEvent{ChatRoomID: chatRoomID, Seq: seq}))
+		c.stats.resyncs.Add(1)
+	}
+	if c.missedUserFrames {
+		frames = append(frames, encodeEvent(models.EventResyncRequired, models.ResyncEvent{Notifications: true}))
+		c.stats.resyncs.Add(1)
+	}
+	for _, frame := range c.pendingPresence {
+		frames = append(frames, frame)
+	}
+	c.missedRooms = make(map[uint]uint64)
+	c.missedUserFrames = false
+	c.pendingPresence = make(map[uint64]*wireFrame)
+	c.mu.Unlock()
+
+	for _, frame := range frames {
+		if err := c.write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"bytes"
+	"chatapp/models"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// frameCodec is a wire format of the protocol, selected by subprotocol.
+// Frames are built, passed through the broker and kept in the room event log
+// as JSON; other codecs translate them on the way in and out, so every codec
+// carries exactly the same frames.
+type frameCodec interface {
+	// subprotocol is the Sec-WebSocket-Protocol selecting the codec
+	subprotocol() string
+	// messageType is the WebSocket message type frames are sent as
+	messageType() int
+	// encode translates a server frame from JSON
+	encode(frame []byte) ([]byte, error)
+	// decode translates a client frame to JSON
+	decode(data []byte) ([]byte, error)
+}
+
+// codecs lists the supported wire formats. The first is the default for
+// clients that don't ask for one.
+var codecs = []frameCodec{jsonCodec{}, msgpackCodec{}}
+
+// selectCodec picks the first codec the client offers as a subprotocol. It
+// returns the header answering the offer, nil if the client offered none and
+// gets the default.
+func selectCodec(r *http.Request) (frameCodec, http.Header) {
+	for _, protocol := range websocket.Subprotocols(r) {
+		for _, codec := range codecs {
+			if codec.subprotocol() == protocol {
+				return codec, http.Header{"Sec-WebSocket-Protocol": {protocol}}
+			}
+		}
+	}
+	return codecs[0], nil
+}
+
+// errMalformedFrame is returned for client frames that cannot be decoded
+var errMalformedFrame = errors.New("malformed frame")
+
+// jsonCodec sends frames as JSON text, as they are built
+type jsonCodec struct{}
+
+func (jsonCodec) subprotocol() string                 { return models.WSSubprotocol }
+func (jsonCodec) messageType() int                    { return websocket.TextMessage }
+func (jsonCodec) encode(frame []byte) ([]byte, error) { return frame, nil }
+func (jsonCodec) decode(data []byte) ([]byte, error)  { return data, nil }
+
+// msgpackCodec sends frames as MessagePack, with the same structure and
+// field names as the JSON frames. Integers stay integers; timestamps are
+// the same RFC 3339 strings.
+type msgpackCodec struct{}
+
+func (msgpackCodec) subprotocol() string { return models.WSSubprotocolMsgpack }
+func (msgpackCodec) messageType() int    { return websocket.BinaryMessage }
+
+func (msgpackCodec) encode(frame []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(frame))
+	decoder.UseNumber()
+	return appendJSONAsMsgpack(make([]byte, 0, len(frame)), decoder)
+}
+
+func (msgpackCodec) decode(data []byte) ([]byte, error) {
+	var frame bytes.Buffer
+	rest, err := msgp.UnmarshalAsJSON(&frame, data)
+	if err != nil || len(rest) > 0 {
+		return nil, errMalformedFrame
+	}
+	return frame.Bytes(), nil
+}
+
+// appendJSONAsMsgpack translates the next JSON value of decoder to
+// MessagePack, keeping the order of object keys
+func appendJSONAsMsgpack(b []byte, decoder *json.Decoder) ([]byte, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := token.(type) {
+	case json.Delim:
+		// Sizes come first in MessagePack, so the elements are
+		// translated before the header is written
+		var elements []byte
+		var count uint32
+		for decoder.More() {
+			if value == '{' {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				elements = msgp.AppendString(elements, key.(string))
+			}
+			if elements, err = appendJSONAsMsgpack(elements, decoder); err != nil {
+				return nil, err
+			}
+			count++
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		if value == '{' {
+			b = msgp.AppendMapHeader(b, count)
+		} else {
+			b = msgp.AppendArrayHeader(b, count)
+		}
+		return append(b, elements...), nil
+	case string:
+		return msgp.AppendString(b, value), nil
+	case json.Number:
+		if i, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			return msgp.AppendInt64(b, i), nil
+		}
+		if u, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return msgp.AppendUint64(b, u), nil
+		}
+		f, err := value.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return msgp.AppendFloat64(b, f), nil
+	case bool:
+		return msgp.AppendBool(b, value), nil
+	case nil:
+		return msgp.AppendNil(b), nil
+	}
+	return nil, errors.New("unexpected JSON token")
+}
+
+// wireFrame is a server frame on its way to clients. A broadcast shares one
+// wireFrame among all local clients, so it is translated once per codec in
+// use rather than once per client.
+type wireFrame struct {
+	json []byte
+
+	mu        sync.Mutex
+	encodings map[frameCodec][]byte
+}
+
+// newWireFrame wraps a frame encoded as JSON; nil stays nil
+func newWireFrame(frame []byte) *wireFrame {
+	if frame == nil {
+		return nil
+	}
+	return &wireFrame{json: frame}
+}
+
+// encoded returns the frame in a codec, translating it the first time
+func (f *wireFrame) encoded(codec frameCodec) ([]byte, error) {
+	if _, ok := codec.(jsonCodec); ok {
+		return f.json, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if data, ok := f.encodings[codec]; ok {
+		return data, nil
+	}
+	data, err := codec.encode(f.json)
+	if err != nil {
+		log.Printf("Failed to encode frame as %s: %v", codec.subprotocol(), err)
+		return nil, err
+	}
+	if f.encodings == nil {
+		f.encodings = make(map[frameCodec][]byte, 1)
+	}
+	f.encodings[codec] = data
+	return data, nil
+}
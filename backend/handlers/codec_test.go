@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"bytes"
+	"chatapp/models"
+	"chatapp/utils"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// connectOffering opens an authenticated connection offering subprotocols in
+// order, closed when the test ends
+func connectOffering(t *testing.T, node *testNode, userID uint, username string, subprotocols ...string) *testClient {
+	t.Helper()
+	c, _ := mustDial(t, &websocket.Dialer{Subprotocols: subprotocols}, node, "/api/ws", nil)
+	c.name = username + "@" + node.name
+	token, err := utils.GenerateToken(userID, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.request(models.OpAuth, "auth", models.AuthRequest{Token: token}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// nextMessage waits for the next message event and returns it as JSON
+func nextMessage(c *testClient) ([]byte, error) {
+	f, err := c.waitFor(func(f serverFrame) bool { return f.Op == models.OpEvent && f.Type == models.EventMessage })
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(f)
+}
+
+// TestCodecs checks the wire formats of the WebSocket protocol: a client
+// choosing MessagePack by subprotocol gets the same frames as a JSON client,
+// in binary, and can send them the same way
+func TestCodecs(t *testing.T) {
+	const chatRoomID = 1
+	cl := newCluster(t)
+	nodeA := cl.startNode(t, "node-a")
+	nodeB := cl.startNode(t, "node-b")
+
+	// The server selects the first codec a client offers
+	alice := connectOffering(t, nodeA, 1, "alice")
+	bob := connectOffering(t, nodeB, 2, "bob", models.WSSubprotocolMsgpack, models.WSSubprotocol)
+	carol := connectOffering(t, nodeB, 3, "carol", models.WSSubprotocol, models.WSSubprotocolMsgpack)
+	dave := connectOffering(t, nodeA, 4, "dave", models.WSSubprotocolMsgpack)
+	if alice.msgpack || !bob.msgpack || carol.msgpack || !dave.msgpack {
+		t.Fatalf("MessagePack selected for alice=%v bob=%v carol=%v dave=%v, want bob and dave", alice.msgpack, bob.msgpack, carol.msgpack, dave.msgpack)
+	}
+
+	t.Run("MessagePack and JSON clients get the same events", func(t *testing.T) {
+		for _, c := range []*testClient{alice, bob, carol, dave} {
+			if err := c.request(models.OpSubscribe, "sub", models.SubscribeRequest{ChatRoomID: chatRoomID}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 3; i++ {
+			sender := alice
+			if i%2 == 1 {
+				sender = bob
+			}
+			if err := sender.request(models.OpSend, "m"+strconv.Itoa(i), models.SendRequest{ChatRoomID: chatRoomID, Content: "hello " + strconv.Itoa(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Senders skip their own messages while waiting for acks, so
+		// compare the two readers
+		for i := 0; i < 3; i++ {
+			want, err := nextMessage(carol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := nextMessage(dave)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("MessagePack client got %s, want %s", got, want)
+			}
+		}
+	})
+
+	t.Run("a malformed binary frame is rejected without closing the connection", func(t *testing.T) {
+		if err := bob.conn.WriteMessage(websocket.BinaryMessage, []byte{0xc1}); err != nil {
+			t.Fatal(err)
+		}
+		f, err := bob.waitFor(func(f serverFrame) bool { return false })
+		if f.Op != models.OpError || f.Error.Code != models.ErrCodeBadRequest {
+			t.Fatalf("got %v, want a bad_request error", err)
+		}
+		if err := bob.request(models.OpHeartbeat, "hb", models.HeartbeatRequest{State: "active"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"chatapp/models"
+	"encoding/binary"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Broker topics carrying frames for the clients of a room or of a user
+const (
+	roomTopicPrefix = "room:"
+	userTopicPrefix = "user:"
+)
+
+// Size of the header before the frame in broker payloads: the frame class,
+// its sequence number and its coalescing key
+const deliveryHeaderSize = 1 + 8 + 8
+
+func roomTopic(chatRoomID uint) string {
+	return roomTopicPrefix + strconv.FormatUint(uint64(chatRoomID), 10)
+}
+
+func userTopic(userID uint) string {
+	return userTopicPrefix + strconv.FormatUint(uint64(userID), 10)
+}
+
+// encodeDelivery packs a delivery into a broker payload; the room or user it
+// is for is the topic
+func encodeDelivery(d delivery) []byte {
+	payload := make([]byte, deliveryHeaderSize, deliveryHeaderSize+len(d.frame.json))
+	payload[0] = byte(d.class)
+	binary.BigEndian.PutUint64(payload[1:9], d.seq)
+	binary.BigEndian.PutUint64(payload[9:17], d.key)
+	return append(payload, d.frame.json...)
+}
+
+// publishDelivery hands a delivery to the broker
+func (h *Hub) publishDelivery(topic string, d delivery) {
+	if d.frame == nil {
+		return
+	}
+	if err := h.broker.Publish(topic, encodeDelivery(d)); err != nil {
+		log.Printf("Failed to publish to %s: %v", topic, err)
+	}
+}
+
+// deliver routes a frame received from the broker to the local clients it
+// is meant for
+func (h *Hub) deliver(topic string, payload []byte) {
+	var prefix string
+	switch {
+	case strings.HasPrefix(topic, roomTopicPrefix):
+		prefix = roomTopicPrefix
+	case strings.HasPrefix(topic, userTopicPrefix):
+		prefix = userTopicPrefix
+	default:
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(topic, prefix), 10, 32)
+	if err != nil || len(payload) < deliveryHeaderSize {
+		log.Printf("Dropping malformed frame for %s", topic)
+		return
+	}
+
+	d := delivery{
+		class: frameClass(payload[0]),
+		seq:   binary.BigEndian.Uint64(payload[1:9]),
+		key:   binary.BigEndian.Uint64(payload[9:17]),
+		frame: newWireFrame(payload[deliveryHeaderSize:]),
+	}
+	if prefix == userTopicPrefix {
+		h.deliverToUser(uint(id), d)
+		return
+	}
+	d.chatRoomID = uint(id)
+	h.deliverToRoom(d)
+}
+
+// deliverToRoom sends a room frame to the local clients of the room. Sequenced
+// events are delivered in order exactly once: events that arrive ahead of
+// one still in flight are preceded by the missing ones read from the log,
+// and the late one is then skipped.
+func (h *Hub) deliverToRoom(d delivery) {
+	lock := h.roomLock(d.chatRoomID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if d.seq == 0 {
+		h.sendToRoom(d)
+		return
+	}
+
+	value, tracked := h.nextSeqs.Load(d.chatRoomID)
+	if !tracked {
+		h.sendToRoom(d)
+		return
+	}
+	next := value.(uint64)
+	if d.seq < next {
+		return
+	}
+	if d.seq > next {
+		h.fillGap(d.chatRoomID, next, d.seq)
+	}
+	h.sendToRoom(d)
+	h.nextSeqs.Store(d.chatRoomID, d.seq+1)
+}
+
+// fillGap delivers the events of a room from next up to (not including) seq
+// from the log. An event can only be in the log once the ones before it are,
+// so they are all there, unless pruned or too many to replay, in which case
+// the clients are told to resync.
+func (h *Hub) fillGap(chatRoomID uint, next, seq uint64) {
+	events, _, complete, err := h.roomEventService.Replay(chatRoomID, next-1, h.replayLimit)
+	if err != nil || !complete {
+		log.Printf("Cannot fill events %d-%d of chat room %d, asking clients to resync", next, seq-1, chatRoomID)
+		resync := encodeEvent(models.EventResyncRequired, models.ResyncEvent{ChatRoomID: chatRoomID, Seq: seq - 1})
+		h.sendToRoom(delivery{class: classEvent, chatRoomID: chatRoomID, frame: resync})
+		return
+	}
+	for i := range events {
+		if events[i].Seq >= seq {
+			break
+		}
+		h.sendToRoom(delivery{class: classEvent, chatRoomID: chatRoomID, seq: events[i].Seq, frame: encodeRoomEvent(&events[i])})
+	}
+}
+
+// sendToRoom queues a frame for every local client of a room that has not
+// received it yet
+func (h *Hub) sendToRoom(d delivery) {
+	if d.frame == nil {
+		return
+	}
+	for _, client := range h.roomClients(d.chatRoomID) {
+		if d.seq > 0 && !client.advanceSeq(d.chatRoomID, d.seq) {
+			continue
+		}
+		client.push(d)
+	}
+}
+
+// deliverToUser queues a frame for every local connection of a user
+func (h *Hub) deliverToUser(userID uint, d delivery) {
+	for _, client := range h.userClients(userID) {
+		client.push(d)
+	}
+}
+
+// advanceSeq records that the client gets event seq of a room, reporting
+// false if it already got it
+func (c *Client) advanceSeq(chatRoomID uint, seq uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if seq <= c.seqs[chatRoomID] {
+		return false
+	}
+	c.seqs[chatRoomID] = seq
+	return true
+}
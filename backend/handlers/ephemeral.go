@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"chatapp/config"
+	"chatapp/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEphemeralThrottle = 3 * time.Second
+	defaultEphemeralTTL      = 8 * time.Second
+)
+
+// ephemeralKey identifies one ongoing activity (e.g. user 3 typing in room 7)
+type ephemeralKey struct {
+	userID     uint
+	chatRoomID uint
+	activity   string
+}
+
+// ephemeralState is an activity as the room sees it. A user may be typing in
+// several tabs at once; the room is told the activity stopped only once every
+// connection doing it has stopped or expired.
+type ephemeralState struct {
+	username    string
+	lastRelayed time.Time
+	// Expiry of each connection doing the activity
+	clients map[*Client]*ephemeralExpiry
+}
+
+// ephemeralExpiry stops a connection's activity that is not refreshed in time
+type ephemeralExpiry struct {
+	timer *time.Timer
+}
+
+// ephemeralRelay relays typing/recording events to rooms without persisting
+// them. Repeated "start" events are throttled, and an activity that is not
+// refreshed within the TTL is stopped on the client's behalf.
+type ephemeralRelay struct {
+	hub      *Hub
+	throttle time.Duration
+	ttl      time.Duration
+
+	mu     sync.Mutex
+	active map[ephemeralKey]*ephemeralState
+}
+
+func newEphemeralRelay(hub *Hub) *ephemeralRelay {
+	throttle := defaultEphemeralThrottle
+	ttl := defaultEphemeralTTL
+	if config.GlobalConfig != nil {
+		if config.GlobalConfig.WebSocket.EphemeralThrottle > 0 {
+			throttle = config.GlobalConfig.WebSocket.EphemeralThrottle
+		}
+		if config.GlobalConfig.WebSocket.EphemeralTTL > 0 {
+			ttl = config.GlobalConfig.WebSocket.EphemeralTTL
+		}
+	}
+
+	return &ephemeralRelay{
+		hub:      hub,
+		throttle: throttle,
+		ttl:      ttl,
+		active:   make(map[ephemeralKey]*ephemeralState),
+	}
+}
+
+// splitEphemeralType turns "typing_start" into ("typing", true)
+func splitEphemeralType(msgType string) (activity string, start bool) {
+	if strings.HasSuffix(msgType, "_start") {
+		return strings.TrimSuffix(msgType, "_start"), true
+	}
+	return strings.TrimSuffix(msgType, "_stop"), false
+}
+
+// Handle processes an ephemeral event sent by a client
+func (r *ephemeralRelay) Handle(c *Client, chatRoomID uint, msgType string) {
+	activity, start := splitEphemeralType(msgType)
+	key := ephemeralKey{userID: c.userID, chatRoomID: chatRoomID, activity: activity}
+
+	if start {
+		r.start(key, c)
+	} else {
+		r.stop(key, c, nil)
+	}
+}
+
+func (r *ephemeralRelay) start(key ephemeralKey, c *Client) {
+	r.mu.Lock()
+	state, exists := r.active[key]
+	if !exists {
+		state = &ephemeralState{username: c.username, clients: make(map[*Client]*ephemeralExpiry)}
+		r.active[key] = state
+	}
+
+	// Refresh the connection's expiry on every start, even when the relay is
+	// throttled
+	if expiry := state.clients[c]; expiry != nil {
+		expiry.timer.Stop()
+	}
+	expiry := &ephemeralExpiry{}
+	expiry.timer = time.AfterFunc(r.ttl, func() { r.stop(key, c, expiry) })
+	state.clients[c] = expiry
+
+	now := time.Now()
+	if exists && now.Sub(state.lastRelayed) < r.throttle {
+		r.mu.Unlock()
+		return
+	}
+	state.lastRelayed = now
+	r.mu.Unlock()
+
+	r.relay(key, c.username, key.activity+"_start")
+}
+
+// stop ends a connection's part in an activity and tells the room once no
+// connection is left doing it. An expiry passes itself as expired, so that a
+// timer firing after the connection stopped or restarted is ignored.
+//
+// Expiry runs on the timer's own goroutine, so this must not touch the hub's
+// room or user indexes: the stop event is handed to the broker like any
+// other, and the hub's delivery path reads the room's clients under the
+// shard lock.
+func (r *ephemeralRelay) stop(key ephemeralKey, c *Client, expired *ephemeralExpiry) {
+	r.mu.Lock()
+	state, exists := r.active[key]
+	if !exists {
+		// Already stopped or expired, nothing to tell the room
+		r.mu.Unlock()
+		return
+	}
+	expiry, doing := state.clients[c]
+	if !doing || (expired != nil && expiry != expired) {
+		r.mu.Unlock()
+		return
+	}
+	expiry.timer.Stop()
+	delete(state.clients, c)
+	if len(state.clients) > 0 {
+		// Still going on in another tab
+		r.mu.Unlock()
+		return
+	}
+	delete(r.active, key)
+	r.mu.Unlock()
+
+	r.relay(key, state.username, key.activity+"_stop")
+}
+
+// StopAll stops every activity of a connection in a room, e.g. when the
+// client leaves. The user's other connections keep theirs.
+func (r *ephemeralRelay) StopAll(c *Client, chatRoomID uint) {
+	r.mu.Lock()
+	var keys []ephemeralKey
+	for key, state := range r.active {
+		if key.userID == c.userID && key.chatRoomID == chatRoomID && state.clients[c] != nil {
+			keys = append(keys, key)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, key := range keys {
+		r.stop(key, c, nil)
+	}
+}
+
+// relay publishes an event to the room. It is called from client read pumps
+// and expiry timers alike and only goes through publishDelivery.
+func (r *ephemeralRelay) relay(key ephemeralKey, username, eventType string) {
+	event := models.ActivityEvent{
+		ChatRoomID: key.chatRoomID,
+		UserID:     key.userID,
+		Username:   username,
+	}
+	r.hub.publishDelivery(roomTopic(key.chatRoomID), delivery{class: classEphemeral, frame: encodeEvent(eventType, event)})
+}
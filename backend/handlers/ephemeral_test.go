@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"chatapp/config"
+	"chatapp/models"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// isActivity matches the typing and recording events of a room
+func isActivity(f serverFrame) bool {
+	return f.Op == models.OpEvent && models.IsEphemeralEvent(f.Type)
+}
+
+// nextActivity waits for the next typing or recording event a client sees
+// and checks who it is about
+func (c *testClient) nextActivity(eventType string, userID uint) error {
+	f, err := c.waitFor(isActivity)
+	if err != nil {
+		return err
+	}
+	data, _ := f.Data.(map[string]interface{})
+	if f.Type != eventType || data["user_id"] != float64(userID) {
+		return fmt.Errorf("%s: got %s of user %v, want %s of user %d", c.name, f.Type, data["user_id"], eventType, userID)
+	}
+	return nil
+}
+
+// noActivityBefore waits for a message event and fails if a typing or
+// recording event comes first
+func (c *testClient) noActivityBefore(seq uint64) error {
+	f, err := c.waitFor(func(f serverFrame) bool { return isActivity(f) || f.Type == models.EventMessage })
+	if err != nil {
+		return err
+	}
+	if f.Type != models.EventMessage || f.Seq != seq {
+		return fmt.Errorf("%s: got %s with seq %d, want message %d", c.name, f.Type, f.Seq, seq)
+	}
+	return nil
+}
+
+// TestEphemeralEvents checks how typing events are relayed: started, stopped,
+// throttled and expired, for a user who may have the room open in several
+// tabs
+func TestEphemeralEvents(t *testing.T) {
+	const (
+		chatRoomID = 1
+		ttl        = time.Second
+	)
+	cl := newCluster(t)
+	config.GlobalConfig.WebSocket.EphemeralTTL = ttl
+	config.GlobalConfig.WebSocket.EphemeralThrottle = time.Minute
+	node := cl.startNode(t, "node-a")
+
+	// alice types in two tabs, bob watches
+	aliceTab1 := mustConnect(t, node, 1, "alice")
+	aliceTab2 := mustConnect(t, node, 1, "alice")
+	bob := mustConnect(t, node, 2, "bob")
+	for _, c := range []*testClient{aliceTab1, aliceTab2, bob} {
+		if err := c.request(models.OpSubscribe, "sub", models.SubscribeRequest{ChatRoomID: chatRoomID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	typing := func(c *testClient, eventType string) {
+		t.Helper()
+		if err := c.send(eventType, "", models.SendRequest{ChatRoomID: chatRoomID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var seq uint64
+
+	t.Run("starting and stopping reach the room", func(t *testing.T) {
+		typing(aliceTab1, models.EventTypingStart)
+		if err := bob.nextActivity(models.EventTypingStart, 1); err != nil {
+			t.Fatal(err)
+		}
+		typing(aliceTab1, models.EventTypingStop)
+		if err := bob.nextActivity(models.EventTypingStop, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("repeated starts are relayed once", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			typing(aliceTab1, models.EventTypingStart)
+		}
+		typing(aliceTab1, models.EventTypingStop)
+		if err := bob.nextActivity(models.EventTypingStart, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.nextActivity(models.EventTypingStop, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("typing that is not refreshed expires", func(t *testing.T) {
+		started := time.Now()
+		typing(aliceTab1, models.EventTypingStart)
+		if err := bob.nextActivity(models.EventTypingStart, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.nextActivity(models.EventTypingStop, 1); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(started); elapsed < ttl {
+			t.Fatalf("typing stopped after %v, want at least %v", elapsed, ttl)
+		}
+	})
+
+	t.Run("stopping in one tab keeps the other tab typing", func(t *testing.T) {
+		typing(aliceTab1, models.EventTypingStart)
+		typing(aliceTab2, models.EventTypingStart)
+		if err := bob.nextActivity(models.EventTypingStart, 1); err != nil {
+			t.Fatal(err)
+		}
+		typing(aliceTab1, models.EventTypingStop)
+		// Sent after the stop on the same connection, so it arrives after
+		// any stop the room would have been told about
+		seq++
+		if err := aliceTab1.request(models.OpSend, "m", models.SendRequest{ChatRoomID: chatRoomID, Content: "sent"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.noActivityBefore(seq); err != nil {
+			t.Fatal(err)
+		}
+
+		typing(aliceTab2, models.EventTypingStop)
+		if err := bob.nextActivity(models.EventTypingStop, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("closing a tab keeps the other tab typing", func(t *testing.T) {
+		typing(aliceTab1, models.EventTypingStart)
+		typing(aliceTab2, models.EventTypingStart)
+		if err := bob.nextActivity(models.EventTypingStart, 1); err != nil {
+			t.Fatal(err)
+		}
+		// Wait for both starts to be handled before the first tab goes away
+		seq++
+		if err := aliceTab2.request(models.OpSend, "m", models.SendRequest{ChatRoomID: chatRoomID, Content: "sent"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.noActivityBefore(seq); err != nil {
+			t.Fatal(err)
+		}
+
+		aliceTab1.conn.Close()
+		if err := node.waitForClients(2); err != nil {
+			t.Fatal(err)
+		}
+		// Keep the other tab from expiring meanwhile
+		typing(aliceTab2, models.EventTypingStart)
+		seq++
+		if err := aliceTab2.request(models.OpSend, "m", models.SendRequest{ChatRoomID: chatRoomID, Content: "sent"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.noActivityBefore(seq); err != nil {
+			t.Fatal(err)
+		}
+
+		typing(aliceTab2, models.EventTypingStop)
+		if err := bob.nextActivity(models.EventTypingStop, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("leaving the room stops the tab's typing", func(t *testing.T) {
+		typing(aliceTab2, models.EventTypingStart)
+		if err := bob.nextActivity(models.EventTypingStart, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := aliceTab2.request(models.OpUnsubscribe, "unsub", models.SubscribeRequest{ChatRoomID: chatRoomID}); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.nextActivity(models.EventTypingStop, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
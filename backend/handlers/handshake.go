@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"chatapp/config"
+	"chatapp/models"
+	"chatapp/utils"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// checkOrigin accepts handshakes from the server's own origin and from those
+// allowed by the CORS config. Requests without an Origin header don't come
+// from a browser, so they cannot be cross-site; they still have to
+// authenticate.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(originURL.Host, r.Host) {
+		return true
+	}
+
+	if config.GlobalConfig == nil {
+		return false
+	}
+	for _, allowed := range config.GlobalConfig.CORS.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handshakeAuth is who a connection authenticated as during the handshake
+type handshakeAuth struct {
+	userID     uint
+	username   string
+	resumeFrom *uint64
+}
+
+// authenticateHandshake authenticates a handshake by the token offered as a
+// "bearer.<token>" subprotocol, or by the ticket in the query string. It
+// returns nil without an error when the handshake carries neither, leaving
+// authentication to the "auth" frame.
+func (h *Hub) authenticateHandshake(r *http.Request) (*handshakeAuth, error) {
+	var resumeFrom *uint64
+	if value := r.URL.Query().Get("resume_from"); value != "" {
+		seq, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid resume_from")
+		}
+		resumeFrom = &seq
+	}
+
+	var auth *handshakeAuth
+	for _, protocol := range websocket.Subprotocols(r) {
+		if !strings.HasPrefix(protocol, models.WSTokenSubprotocolPrefix) {
+			continue
+		}
+		claims, err := utils.ValidateToken(strings.TrimPrefix(protocol, models.WSTokenSubprotocolPrefix))
+		if err != nil {
+			return nil, errors.New("invalid token")
+		}
+		auth = &handshakeAuth{userID: claims.UserID, username: claims.Username}
+		break
+	}
+
+	if ticket := r.URL.Query().Get("ticket"); auth == nil && ticket != "" {
+		if h.ticketService == nil {
+			return nil, errors.New("tickets are not supported")
+		}
+		record, err := h.ticketService.Redeem(ticket)
+		if err != nil {
+			return nil, errors.New("invalid or expired ticket")
+		}
+		auth = &handshakeAuth{userID: record.UserID, username: record.Username}
+	}
+
+	if auth != nil {
+		auth.resumeFrom = resumeFrom
+	}
+	return auth, nil
+}
+
+// connLimiter caps the connections each client IP holds to this server
+type connLimiter struct {
+	mu    sync.Mutex
+	max   int // 0 for no limit
+	count map[string]int
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, count: make(map[string]int)}
+}
+
+// acquire counts a connection from an IP, reporting false if it has too many
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.count[ip] >= l.max {
+		return false
+	}
+	l.count[ip]++
+	return true
+}
+
+// release forgets a connection from an IP once it is closed
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count[ip]--
+	if l.count[ip] <= 0 {
+		delete(l.count, ip)
+	}
+}
+
+// HandleWebSocketTicket issues a single-use ticket that authenticates one
+// WebSocket handshake, for clients that cannot send their token otherwise
+func HandleWebSocketTicket(c *gin.Context) {
+	GlobalHub.HandleWebSocketTicket(c)
+}
+
+// HandleWebSocketTicket issues a single-use ticket that authenticates one
+// WebSocket handshake, for clients that cannot send their token otherwise
+func (h *Hub) HandleWebSocketTicket(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		utils.UnauthorizedResponse(c, "User not authenticated")
+		return
+	}
+	username, _ := c.Get("username")
+
+	ticket, err := h.ticketService.Issue(userID.(uint), username.(string))
+	if err != nil {
+		utils.InternalErrorResponse(c, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(c, ticket)
+}
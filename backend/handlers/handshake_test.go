@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"chatapp/config"
+	"chatapp/models"
+	"chatapp/utils"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// tokenDialer offers a user's token as a subprotocol, the way browsers
+// authenticate the handshake
+func tokenDialer(t *testing.T, userID uint, username string) *websocket.Dialer {
+	token, err := utils.GenerateToken(userID, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &websocket.Dialer{Subprotocols: []string{models.WSSubprotocol, models.WSTokenSubprotocolPrefix + token}}
+}
+
+// mustDial opens a connection to a path of a node without authenticating it,
+// closed when the test ends
+func mustDial(t *testing.T, dialer *websocket.Dialer, n *testNode, path string, header http.Header) (*testClient, *http.Response) {
+	t.Helper()
+	c, resp, err := dial(dialer, n, path, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.conn.Close() })
+	return c, resp
+}
+
+// waitForAuthenticated waits for the event opening a connection
+// authenticated at the handshake
+func waitForAuthenticated(c *testClient, userID uint) (models.AuthAck, error) {
+	var ack models.AuthAck
+	f, err := c.waitFor(func(f serverFrame) bool { return f.Type == models.EventAuthenticated })
+	if err != nil {
+		return ack, err
+	}
+	data, _ := json.Marshal(f.Data)
+	if err := json.Unmarshal(data, &ack); err != nil {
+		return ack, err
+	}
+	if ack.UserID != userID {
+		return ack, fmt.Errorf("authenticated as user %d, want %d", ack.UserID, userID)
+	}
+	return ack, nil
+}
+
+// waitForClose waits until the server closes a connection with a code
+func waitForClose(c *testClient, code int) error {
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case _, ok := <-c.frames:
+			if ok {
+				continue
+			}
+			if !websocket.IsCloseError(c.err, code) {
+				return fmt.Errorf("connection ended with %v, want close code %d", c.err, code)
+			}
+			return nil
+		case <-deadline:
+			return fmt.Errorf("connection still open")
+		}
+	}
+}
+
+// issueTicket asks a node for a handshake ticket over REST
+func issueTicket(node *testNode, userID uint, username string) (string, error) {
+	token, err := utils.GenerateToken(userID, username)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, node.server.URL+"/api/ws/ticket", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data models.WSTicketResponse `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || body.Data.Ticket == "" {
+		return "", fmt.Errorf("ticket request failed with status %d", resp.StatusCode)
+	}
+	return body.Data.Ticket, nil
+}
+
+// expectRefused dials a node and checks the handshake fails with a status
+func expectRefused(dialer *websocket.Dialer, node *testNode, path string, header http.Header, status int) error {
+	c, resp, err := dial(dialer, node, path, header)
+	if err == nil {
+		c.conn.Close()
+		return fmt.Errorf("handshake to %s succeeded", path)
+	}
+	if resp == nil || resp.StatusCode != status {
+		return fmt.Errorf("handshake to %s failed with %v, want status %d", path, err, status)
+	}
+	return nil
+}
+
+// TestHandshake checks how WebSocket connections are let in: origin checks,
+// authentication at the handshake by token or ticket, the timeout for
+// in-band authentication and the per-IP connection limit
+func TestHandshake(t *testing.T) {
+	const chatRoomID = 1
+	cl := newCluster(t)
+	config.GlobalConfig.WebSocket.AuthTimeout = 300 * time.Millisecond
+	nodeA := cl.startNode(t, "node-a")
+	nodeB := cl.startNode(t, "node-b")
+
+	t.Run("a connection that never authenticates is closed", func(t *testing.T) {
+		c, _ := mustDial(t, websocket.DefaultDialer, nodeA, "/api/ws", nil)
+		if err := waitForClose(c, CloseUnauthorized); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a token offered as a subprotocol authenticates the handshake", func(t *testing.T) {
+		c, resp := mustDial(t, tokenDialer(t, 1, "alice"), nodeA, "/api/ws", nil)
+		if protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol != models.WSSubprotocol {
+			t.Fatalf("server selected subprotocol %q", protocol)
+		}
+		if _, err := waitForAuthenticated(c, 1); err != nil {
+			t.Fatal(err)
+		}
+		// Past the auth timeout, the connection stays open
+		time.Sleep(2 * config.GlobalConfig.WebSocket.AuthTimeout)
+		if err := c.request(models.OpHeartbeat, "hb", models.HeartbeatRequest{State: "active"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a room connection authenticated at the handshake resumes", func(t *testing.T) {
+		alice := mustConnect(t, nodeA, 1, "alice")
+		if err := alice.request(models.OpSubscribe, "sub", models.SubscribeRequest{ChatRoomID: chatRoomID}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := alice.request(models.OpSend, "m", models.SendRequest{ChatRoomID: chatRoomID, Content: strconv.Itoa(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		bob, _ := mustDial(t, tokenDialer(t, 2, "bob"), nodeB, "/api/ws/"+strconv.Itoa(chatRoomID)+"?resume_from=1", nil)
+		ack, err := waitForAuthenticated(bob, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ack.ChatRoomID != chatRoomID || ack.Seq != 3 {
+			t.Fatalf("joined chat room %d at seq %d, want %d at 3", ack.ChatRoomID, ack.Seq, chatRoomID)
+		}
+		if err := bob.collectMessages(2, 2); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("an invalid token is refused before the upgrade", func(t *testing.T) {
+		dialer := &websocket.Dialer{Subprotocols: []string{models.WSSubprotocol, models.WSTokenSubprotocolPrefix + "not-a-token"}}
+		if err := expectRefused(dialer, nodeA, "/api/ws", nil, http.StatusUnauthorized); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a ticket from one node authenticates one handshake on another", func(t *testing.T) {
+		ticket, err := issueTicket(nodeA, 3, "carol")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ := mustDial(t, websocket.DefaultDialer, nodeB, "/api/ws?ticket="+ticket, nil)
+		if _, err := waitForAuthenticated(c, 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := expectRefused(websocket.DefaultDialer, nodeA, "/api/ws?ticket="+ticket, nil, http.StatusUnauthorized); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("handshakes from other origins are refused", func(t *testing.T) {
+		if err := expectRefused(websocket.DefaultDialer, nodeA, "/api/ws", http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden); err != nil {
+			t.Fatal(err)
+		}
+		c, _, err := dial(websocket.DefaultDialer, nodeA, "/api/ws", http.Header{"Origin": {nodeA.server.URL}})
+		if err != nil {
+			t.Fatalf("same-origin handshake: %v", err)
+		}
+		c.conn.Close()
+	})
+
+	t.Run("an IP holds a limited number of connections", func(t *testing.T) {
+		config.GlobalConfig.WebSocket.MaxConnectionsPerIP = 2
+		nodeC := cl.startNode(t, "node-c")
+
+		first := mustConnect(t, nodeC, 10, "dave")
+		mustConnect(t, nodeC, 11, "dave")
+		if err := expectRefused(websocket.DefaultDialer, nodeC, "/api/ws", nil, http.StatusTooManyRequests); err != nil {
+			t.Fatal(err)
+		}
+
+		// A closed connection frees its slot once the server has let go of it
+		first.conn.Close()
+		deadline := time.Now().Add(testTimeout)
+		for {
+			c, err := connect(nodeC, 12, "dave")
+			if err == nil {
+				c.conn.Close()
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+}
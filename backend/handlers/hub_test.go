@@ -0,0 +1,424 @@
+package handlers
+
+import (
+	"bytes"
+	"chatapp/broker"
+	"chatapp/config"
+	"chatapp/middleware"
+	"chatapp/models"
+	"chatapp/service"
+	"chatapp/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// testTimeout bounds every wait for a frame or a presence change
+const testTimeout = 5 * time.Second
+
+// setupConfig configures what the hubs need from the global config and
+// restores the previous config when the test ends
+func setupConfig(t testing.TB) {
+	gin.SetMode(gin.TestMode)
+	previous := config.GlobalConfig
+	config.GlobalConfig = &config.Config{JWT: config.JWTConfig{Secret: "hubtest", ExpireHours: 1, Issuer: "chatapp"}}
+	t.Cleanup(func() { config.GlobalConfig = previous })
+}
+
+// roomEventLog stands in for the room_events table shared by all nodes
+type roomEventLog struct {
+	service.RoomEventService
+
+	mu     sync.Mutex
+	events map[uint][]models.RoomEvent
+}
+
+func newRoomEventLog() *roomEventLog {
+	return &roomEventLog{events: make(map[uint][]models.RoomEvent)}
+}
+
+func (l *roomEventLog) Append(chatRoomID uint, eventType string, data interface{}) (*models.RoomEvent, error) {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	event := models.RoomEvent{
+		ChatRoomID: chatRoomID,
+		Seq:        uint64(len(l.events[chatRoomID]) + 1),
+		Type:       eventType,
+		Data:       string(dataBytes),
+		CreatedAt:  time.Now(),
+	}
+	l.events[chatRoomID] = append(l.events[chatRoomID], event)
+	return &event, nil
+}
+
+func (l *roomEventLog) Replay(chatRoomID uint, afterSeq uint64, limit int) ([]models.RoomEvent, uint64, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := l.events[chatRoomID]
+	lastSeq := uint64(len(events))
+	if afterSeq > lastSeq || int(lastSeq-afterSeq) > limit {
+		return nil, lastSeq, false, nil
+	}
+	return append([]models.RoomEvent(nil), events[afterSeq:]...), lastSeq, true, nil
+}
+
+func (l *roomEventLog) LastSeq(chatRoomID uint) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return uint64(len(l.events[chatRoomID])), nil
+}
+
+// messageStore stands in for the messages table
+type messageStore struct {
+	service.MessageService
+
+	mu     sync.Mutex
+	nextID uint
+}
+
+func (s *messageStore) CreateMessage(content string, userID, chatRoomID uint, clientNonce string) (*models.Message, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	return &models.Message{
+		ID:          s.nextID,
+		Content:     content,
+		UserID:      userID,
+		ChatRoomID:  chatRoomID,
+		Type:        "text",
+		ClientNonce: clientNonce,
+		User:        models.User{ID: userID, Username: fmt.Sprintf("user%d", userID)},
+		CreatedAt:   time.Now(),
+	}, true, nil
+}
+
+type openRooms struct{ service.ChatRoomService }
+
+func (openRooms) CheckExists(id uint) error { return nil }
+
+type noNotifications struct{ service.NotificationService }
+
+func (noNotifications) OnNotify(handler func(models.Notification)) {}
+
+// ticketStore stands in for the ws_tickets table shared by all nodes
+type ticketStore struct {
+	mu      sync.Mutex
+	tickets map[string]models.WSTicket
+}
+
+func (s *ticketStore) Create(ticket *models.WSTicket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tickets[ticket.TokenHash] = *ticket
+	return nil
+}
+
+func (s *ticketStore) Consume(tokenHash string) (*models.WSTicket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ticket, ok := s.tickets[tokenHash]
+	if !ok {
+		return nil, errors.New("no such ticket")
+	}
+	delete(s.tickets, tokenHash)
+	return &ticket, nil
+}
+
+func (s *ticketStore) DeleteExpired(now time.Time) (int64, error) { return 0, nil }
+
+type noStatuses struct{}
+
+func (noStatuses) Upsert(status *models.UserStatus) error                   { return nil }
+func (noStatuses) GetByUserIDs(userIDs []uint) ([]models.UserStatus, error) { return nil, nil }
+func (noStatuses) Delete(userID uint) error                                 { return nil }
+func (noStatuses) DeleteExpired(now time.Time) ([]uint, error)              { return nil, nil }
+
+// cluster is what the replicas of one deployment share: the broker, the
+// room event log, the messages and the handshake tickets
+type cluster struct {
+	broker   broker.Broker
+	events   *roomEventLog
+	messages *messageStore
+	tickets  *ticketStore
+}
+
+// newCluster sets up the config and a cluster connected by an in-memory broker
+func newCluster(t testing.TB) *cluster {
+	setupConfig(t)
+	eventBroker := broker.NewMemoryBroker()
+	t.Cleanup(func() { eventBroker.Close() })
+	return &cluster{
+		broker:   eventBroker,
+		events:   newRoomEventLog(),
+		messages: &messageStore{},
+		tickets:  &ticketStore{tickets: make(map[string]models.WSTicket)},
+	}
+}
+
+// testNode is one backend replica serving /api/ws
+type testNode struct {
+	name     string
+	hub      *Hub
+	presence service.PresenceService
+	server   *httptest.Server
+}
+
+// startNode starts a replica of the cluster, stopped when the test ends
+func (cl *cluster) startNode(t testing.TB, name string) *testNode {
+	presence := service.NewPresenceService(noStatuses{}, cl.broker, name, time.Minute, 100*time.Millisecond)
+	ticketService := service.NewWSTicketService(cl.tickets, time.Minute)
+	hub := NewHub(cl.messages, presence, noNotifications{}, cl.events, openRooms{}, ticketService, cl.broker)
+	go presence.Run()
+
+	r := gin.New()
+	r.GET("/api/ws", hub.HandleUserWebSocket)
+	r.GET("/api/ws/:chatroom_id", hub.HandleWebSocket)
+	r.POST("/api/ws/ticket", middleware.AuthMiddleware(), hub.HandleWebSocketTicket)
+	r.GET("/api/events", middleware.AuthMiddleware(), hub.HandleEventStream)
+	r.GET("/api/events/poll", middleware.AuthMiddleware(), hub.HandleEventPoll)
+
+	// Served with the timeouts of the real server
+	server := httptest.NewUnstartedServer(r)
+	server.Config.ReadTimeout = config.GlobalConfig.Server.ReadTimeout
+	server.Config.WriteTimeout = config.GlobalConfig.Server.WriteTimeout
+	server.Start()
+	t.Cleanup(server.Close)
+	return &testNode{name: name, hub: hub, presence: presence, server: server}
+}
+
+// waitForPresence waits until the node sees a user with a status
+func (n *testNode) waitForPresence(userID uint, status string) error {
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		presences, err := n.presence.GetPresence([]uint{userID})
+		if err != nil {
+			return err
+		}
+		if presences[0].Status == status {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return fmt.Errorf("user %d is not %s on %s", userID, status, n.name)
+}
+
+// waitForClients waits until the node holds count connections, e.g. for
+// closed ones to be unregistered
+func (n *testNode) waitForClients(count int) error {
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		if n.hub.ConnectedClients() == count {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("%s holds %d connections, want %d", n.name, n.hub.ConnectedClients(), count)
+}
+
+// serverFrame is a frame received from the server
+type serverFrame = models.ServerEnvelope
+
+// testClient is a WebSocket connection collecting the frames it receives
+type testClient struct {
+	name   string
+	conn   *websocket.Conn
+	frames chan serverFrame
+	// Why the connection ended, once frames is closed
+	err error
+	// Set when the server selected MessagePack; frames are still collected
+	// and written as serverFrame and ClientEnvelope values
+	msgpack bool
+}
+
+// slowDialer opens connections with a tiny receive buffer, so that a client
+// that stops reading backs up into the hub quickly
+var slowDialer = &websocket.Dialer{
+	NetDial: func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn.(*net.TCPConn).SetReadBuffer(4096)
+		return conn, nil
+	},
+}
+
+// mustConnect opens an authenticated connection to a node, closed when the
+// test ends
+func mustConnect(t testing.TB, n *testNode, userID uint, username string) *testClient {
+	t.Helper()
+	c, err := connect(n, userID, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.conn.Close() })
+	return c
+}
+
+// connect opens an authenticated connection to a node
+func connect(n *testNode, userID uint, username string) (*testClient, error) {
+	return connectWith(websocket.DefaultDialer, n, userID, username)
+}
+
+// connectWith is connect with a custom dialer
+func connectWith(dialer *websocket.Dialer, n *testNode, userID uint, username string) (*testClient, error) {
+	c, _, err := dial(dialer, n, "/api/ws", nil)
+	if err != nil {
+		return nil, err
+	}
+	c.name = username + "@" + n.name
+
+	token, err := utils.GenerateToken(userID, username)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	if err := c.request(models.OpAuth, "auth", models.AuthRequest{Token: token}); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial opens a connection to a path of a node without authenticating it
+func dial(dialer *websocket.Dialer, n *testNode, path string, header http.Header) (*testClient, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(n.server.URL, "http") + path
+	conn, resp, err := dialer.Dial(url, header)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	c := &testClient{name: n.name, conn: conn, frames: make(chan serverFrame, 1024)}
+	c.msgpack = conn.Subprotocol() == models.WSSubprotocolMsgpack
+	go func() {
+		defer close(c.frames)
+		for {
+			f, err := c.read()
+			if err != nil {
+				c.err = err
+				return
+			}
+			c.frames <- f
+		}
+	}()
+	return c, resp, nil
+}
+
+// read reads the next frame in the codec of the connection
+func (c *testClient) read() (serverFrame, error) {
+	var f serverFrame
+	messageType, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return f, err
+	}
+	if c.msgpack {
+		if messageType != websocket.BinaryMessage {
+			return f, fmt.Errorf("%s: got a text frame over MessagePack", c.name)
+		}
+		var frame bytes.Buffer
+		if _, err := msgp.UnmarshalAsJSON(&frame, data); err != nil {
+			return f, err
+		}
+		data = frame.Bytes()
+	}
+	return f, json.Unmarshal(data, &f)
+}
+
+// request sends a frame and waits for the ack answering it
+func (c *testClient) request(op, id string, data interface{}) error {
+	if err := c.write(op, id, data); err != nil {
+		return err
+	}
+	_, err := c.waitFor(func(f serverFrame) bool { return f.ID == id && (f.Op == models.OpAck || f.Op == models.OpError) })
+	return err
+}
+
+// write sends a frame without waiting for an answer
+func (c *testClient) write(op, id string, data interface{}) error {
+	return c.writeEnvelope(models.ClientEnvelope{V: models.WSProtocolVersion, Op: op, ID: id}, data)
+}
+
+// send sends an event of the given type, such as typing_start, without
+// waiting for an answer
+func (c *testClient) send(eventType, id string, data interface{}) error {
+	return c.writeEnvelope(models.ClientEnvelope{V: models.WSProtocolVersion, Op: models.OpSend, Type: eventType, ID: id}, data)
+}
+
+func (c *testClient) writeEnvelope(envelope models.ClientEnvelope, data interface{}) error {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	envelope.Data = dataBytes
+	frame, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	if !c.msgpack {
+		return c.conn.WriteMessage(websocket.TextMessage, frame)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(frame, &value); err != nil {
+		return err
+	}
+	packed, err := msgp.AppendIntf(nil, value)
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(websocket.BinaryMessage, packed)
+}
+
+// waitFor skips frames until one matches
+func (c *testClient) waitFor(match func(serverFrame) bool) (serverFrame, error) {
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case f, ok := <-c.frames:
+			if !ok {
+				return serverFrame{}, fmt.Errorf("%s: connection closed", c.name)
+			}
+			if f.Op == models.OpError {
+				return f, fmt.Errorf("%s: %s", c.name, f.Error.Message)
+			}
+			if match(f) {
+				return f, nil
+			}
+		case <-deadline:
+			return serverFrame{}, fmt.Errorf("%s: timed out", c.name)
+		}
+	}
+}
+
+// collectMessages waits for count message events and checks their sequence
+// numbers follow each other from first
+func (c *testClient) collectMessages(first uint64, count int) error {
+	next := first
+	for received := 0; received < count; received++ {
+		f, err := c.waitFor(func(f serverFrame) bool { return f.Op == models.OpEvent && f.Type == models.EventMessage })
+		if err != nil {
+			return fmt.Errorf("%w after %d of %d messages", err, received, count)
+		}
+		if f.Seq != next {
+			return fmt.Errorf("%s: got seq %d, want %d", c.name, f.Seq, next)
+		}
+		next++
+	}
+	return nil
+}
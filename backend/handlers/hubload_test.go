@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"chatapp/config"
+	"chatapp/models"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// loadProfile sizes a load run
+type loadProfile struct {
+	nodes       int
+	clients     int
+	slowClients int
+	rooms       int
+	duration    time.Duration
+	// How long a backed up client may stay connected; 0 evicts it on the
+	// first overflow
+	grace time.Duration
+}
+
+type loadStats struct {
+	sent       atomic.Int64
+	received   atomic.Int64
+	reconnects atomic.Int64
+	violations atomic.Int64
+}
+
+// watchOrder reads a client's frames until the connection closes, checking
+// that the room events of each room arrive in order and only once
+func watchOrder(t *testing.T, c *testClient, s *loadStats) {
+	lastSeq := make(map[uint]uint64)
+	for f := range c.frames {
+		s.received.Add(1)
+		if f.Op != models.OpEvent || f.Seq == 0 {
+			continue
+		}
+		data, _ := f.Data.(map[string]interface{})
+		chatRoomID := uint(data["chat_room_id"].(float64))
+		if f.Seq <= lastSeq[chatRoomID] {
+			t.Errorf("%s got seq %d of chat room %d after %d", c.name, f.Seq, chatRoomID, lastSeq[chatRoomID])
+			s.violations.Add(1)
+		}
+		lastSeq[chatRoomID] = f.Seq
+	}
+}
+
+// runLoadClient plays one user until the deadline
+func runLoadClient(t *testing.T, nodes []*testNode, userID uint, rooms int, deadline time.Time, s *loadStats) error {
+	rng := rand.New(rand.NewSource(int64(userID)))
+	username := fmt.Sprintf("user%d", userID)
+
+	for time.Now().Before(deadline) {
+		c, err := connect(nodes[rng.Intn(len(nodes))], userID, username)
+		if err != nil {
+			return err
+		}
+		done := make(chan struct{})
+		go func() {
+			watchOrder(t, c, s)
+			close(done)
+		}()
+
+		subscribed := make(map[uint]bool)
+		for i := 0; i < 3; i++ {
+			chatRoomID := uint(rng.Intn(rooms) + 1)
+			if !subscribed[chatRoomID] {
+				subscribed[chatRoomID] = true
+				c.write(models.OpSubscribe, "", models.SubscribeRequest{ChatRoomID: chatRoomID})
+			}
+		}
+
+		for time.Now().Before(deadline) {
+			chatRoomID := uint(rng.Intn(rooms) + 1)
+			switch n := rng.Intn(100); {
+			case n < 60:
+				if subscribed[chatRoomID] {
+					c.write(models.OpSend, "", models.SendRequest{ChatRoomID: chatRoomID, Content: "load"})
+					s.sent.Add(1)
+				}
+			case n < 75:
+				if subscribed[chatRoomID] {
+					c.write(models.OpSend, "", models.SendRequest{ChatRoomID: chatRoomID})
+				}
+			case n < 80:
+				c.write(models.OpHeartbeat, "", models.HeartbeatRequest{State: "active"})
+			case n < 85:
+				// Typing that is mostly left to expire, so expiry timers
+				// fire while the room's clients come and go
+				if subscribed[chatRoomID] {
+					eventType := models.EventTypingStart
+					if rng.Intn(4) == 0 {
+						eventType = models.EventTypingStop
+					}
+					c.send(eventType, "", models.SendRequest{ChatRoomID: chatRoomID})
+				}
+			case n < 95:
+				if subscribed[chatRoomID] {
+					c.write(models.OpUnsubscribe, "", models.SubscribeRequest{ChatRoomID: chatRoomID})
+				} else {
+					c.write(models.OpSubscribe, "", models.SubscribeRequest{ChatRoomID: chatRoomID})
+				}
+				subscribed[chatRoomID] = !subscribed[chatRoomID]
+			}
+			if rng.Intn(200) == 0 {
+				break
+			}
+			time.Sleep(time.Duration(rng.Intn(5)) * time.Millisecond)
+		}
+
+		c.conn.Close()
+		<-done
+		s.reconnects.Add(1)
+	}
+	return nil
+}
+
+// runSlowClient subscribes and then never reads past its frame buffer, so
+// the hub has to evict it
+func runSlowClient(node *testNode, userID uint, rooms int) error {
+	c, err := connectWith(slowDialer, node, userID, fmt.Sprintf("slow%d", userID))
+	if err != nil {
+		return err
+	}
+	for chatRoomID := 1; chatRoomID <= rooms; chatRoomID++ {
+		c.write(models.OpSubscribe, "", models.SubscribeRequest{ChatRoomID: uint(chatRoomID)})
+	}
+	// Frames pile up unread; the connection is closed by the server
+	return nil
+}
+
+// runLoad hammers hubs with clients that subscribe, send, type, resubscribe,
+// reconnect and stop reading, while the server side broadcasts, changes
+// statuses and expires typing concurrently. It is meant to run under the
+// race detector.
+func runLoad(t *testing.T, profile loadProfile) {
+	cl := newCluster(t)
+	config.GlobalConfig.WebSocket.SlowConsumer.GracePeriod = profile.grace
+	// Typing expires and is relayed again quickly, to race with everything else
+	config.GlobalConfig.WebSocket.EphemeralTTL = 20 * time.Millisecond
+	config.GlobalConfig.WebSocket.EphemeralThrottle = 5 * time.Millisecond
+
+	nodes := make([]*testNode, profile.nodes)
+	for i := range nodes {
+		nodes[i] = cl.startNode(t, fmt.Sprintf("node-%d", i))
+	}
+
+	var s loadStats
+	deadline := time.Now().Add(profile.duration)
+	var wg sync.WaitGroup
+	errs := make(chan error, profile.clients+profile.slowClients)
+
+	for i := 0; i < profile.slowClients; i++ {
+		if err := runSlowClient(nodes[i%len(nodes)], uint(10000+i), profile.rooms); err != nil {
+			errs <- err
+		}
+	}
+	for i := 0; i < profile.clients; i++ {
+		wg.Add(1)
+		go func(userID uint) {
+			defer wg.Done()
+			if err := runLoadClient(t, nodes, userID, profile.rooms, deadline, &s); err != nil {
+				errs <- err
+			}
+		}(uint(i + 1))
+	}
+
+	// Server-side traffic, as REST handlers and notifications produce it.
+	// Large notifications fill up the slow clients' socket buffers.
+	notification := []byte(`{"v":1,"op":"event","type":"notification","data":{"content":"` + strings.Repeat("x", 16<<10) + `"}}`)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; time.Now().Before(deadline); i++ {
+			node := nodes[i%len(nodes)]
+			chatRoomID := uint(i%profile.rooms + 1)
+			node.hub.BroadcastMessageDeleted(chatRoomID, uint(i))
+			node.hub.SendToUser(uint(i%profile.clients+1), notification)
+			// Status changes broadcast the user's presence to their rooms
+			// from the request's goroutine, as the presence API does
+			if i%10 == 0 {
+				node.presence.SetStatusText(uint(i%profile.clients+1), "busy", time.Minute)
+			}
+			if profile.slowClients > 0 {
+				node.hub.SendToUser(uint(10000+i%profile.slowClients), notification)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Every connection must be gone once the clients are, including the
+	// slow ones, which are fed until their hubs evict them since a short run
+	// may not have backed them up yet
+	leftover := 0
+	settle := time.Now().Add(testTimeout)
+	for time.Now().Before(settle) {
+		leftover = 0
+		for _, node := range nodes {
+			leftover += node.hub.ConnectedClients()
+		}
+		if leftover == 0 {
+			break
+		}
+		for i := 0; i < profile.slowClients; i++ {
+			for j := 0; j < 64; j++ {
+				nodes[i%len(nodes)].hub.SendToUser(uint(10000+i), notification)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Logf("%d messages sent, %d frames received, %d reconnects", s.sent.Load(), s.received.Load(), s.reconnects.Load())
+	if leftover > 0 {
+		t.Errorf("%d connections still registered", leftover)
+	}
+	if s.violations.Load() > 0 {
+		t.Errorf("%d room events out of order or duplicated", s.violations.Load())
+	}
+}
+
+func TestHubUnderLoad(t *testing.T) {
+	runLoad(t, loadProfile{nodes: 2, clients: 10, slowClients: 1, rooms: 4, duration: 2 * time.Second})
+}
+
+func TestHubUnderHeavyLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("heavy load run skipped in short mode")
+	}
+	runLoad(t, loadProfile{nodes: 2, clients: 50, slowClients: 5, rooms: 8, duration: 5 * time.Second})
+}
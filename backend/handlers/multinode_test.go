@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"chatapp/config"
+	"chatapp/models"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMultipleNodes runs several hubs in one process, connected by a broker
+// the way replicas are connected by PostgreSQL or Redis, and checks that
+// rooms, user frames and presence span all of them
+func TestMultipleNodes(t *testing.T) {
+	const (
+		chatRoomID = 1
+		// Room only the slow reader subscribes to
+		floodRoomID = 2
+	)
+	cl := newCluster(t)
+	nodeA := cl.startNode(t, "node-a")
+	nodeB := cl.startNode(t, "node-b")
+	// A node that lets clients stay backed up, for the slow-consumer check
+	config.GlobalConfig.WebSocket.SlowConsumer.GracePeriod = time.Minute
+	nodeC := cl.startNode(t, "node-c")
+
+	alice := mustConnect(t, nodeA, 1, "alice")
+	bob := mustConnect(t, nodeB, 2, "bob")
+	for _, c := range []*testClient{alice, bob} {
+		if err := c.request(models.OpSubscribe, "sub", models.SubscribeRequest{ChatRoomID: chatRoomID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("presence is shared between nodes", func(t *testing.T) {
+		if err := nodeB.waitForPresence(1, models.PresenceOnline); err != nil {
+			t.Fatal(err)
+		}
+		if err := nodeA.waitForPresence(2, models.PresenceOnline); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a message reaches the room on the other node", func(t *testing.T) {
+		if err := alice.write(models.OpSend, "m1", models.SendRequest{ChatRoomID: chatRoomID, Content: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []*testClient{bob, alice} {
+			if err := c.collectMessages(1, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	const perClient = 50
+	t.Run("concurrent sends from both nodes arrive in order everywhere", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 2)
+		for _, c := range []*testClient{alice, bob} {
+			wg.Add(1)
+			go func(c *testClient) {
+				defer wg.Done()
+				for i := 0; i < perClient; i++ {
+					if err := c.write(models.OpSend, "", models.SendRequest{ChatRoomID: chatRoomID, Content: fmt.Sprint(i)}); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+		close(errs)
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range []*testClient{alice, bob} {
+			if err := c.collectMessages(2, 2*perClient); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("frames for a user reach it on any node", func(t *testing.T) {
+		nodeA.hub.SendToUser(2, []byte(`{"v":1,"op":"event","type":"notification","data":{}}`))
+		if _, err := bob.waitFor(func(f serverFrame) bool { return f.Type == models.EventNotification }); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a client resumes on another node", func(t *testing.T) {
+		lastSeq := uint64(1 + 2*perClient)
+		bob.conn.Close()
+		if err := alice.request(models.OpSend, "m2", models.SendRequest{ChatRoomID: chatRoomID, Content: "missed"}); err != nil {
+			t.Fatal(err)
+		}
+
+		bob = mustConnect(t, nodeA, 2, "bob")
+		resume := lastSeq
+		if err := bob.request(models.OpSubscribe, "sub", models.SubscribeRequest{ChatRoomID: chatRoomID, ResumeFrom: &resume}); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.collectMessages(lastSeq+1, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a client that falls behind is told to resync", func(t *testing.T) {
+		carol := mustConnect(t, nodeC, 3, "carol")
+		if err := carol.request(models.OpSubscribe, "sub", models.SubscribeRequest{ChatRoomID: floodRoomID}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Published far faster than carol's connection drains, and more
+		// than her send buffer holds
+		frame := []byte(`{"v":1,"op":"event","type":"message_deleted","data":{"padding":"` + strings.Repeat("x", 16<<10) + `"}}`)
+		for i := 0; i < 4096; i++ {
+			nodeA.hub.BroadcastToRoom(floodRoomID, frame)
+		}
+
+		_, err := carol.waitFor(func(f serverFrame) bool {
+			data, _ := f.Data.(map[string]interface{})
+			return f.Type == models.EventResyncRequired && data["chat_room_id"] == float64(floodRoomID)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stats := range nodeC.hub.Stats(3).Clients {
+			if stats.Resyncs == 0 || stats.Dropped == 0 {
+				t.Errorf("carol@node-c: %d dropped, %d resyncs", stats.Dropped, stats.Resyncs)
+			}
+		}
+	})
+
+	t.Run("disconnecting shows the user offline on every node", func(t *testing.T) {
+		alice.conn.Close()
+		for _, node := range []*testNode{nodeB, nodeA} {
+			if err := node.waitForPresence(1, models.PresenceOffline); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"chatapp/models"
+	"fmt"
+	"testing"
+)
+
+// nextPresence waits for the next presence event of a user, skipping those
+// of other users and repeats of the previous status, which several nodes may
+// send, and checks its status
+func (c *testClient) nextPresence(userID uint, status, previous string) (serverFrame, error) {
+	f, err := c.waitFor(func(f serverFrame) bool {
+		data, _ := f.Data.(map[string]interface{})
+		return f.Type == models.EventPresence && data["user_id"] == float64(userID) && data["status"] != previous
+	})
+	if err != nil {
+		return f, err
+	}
+	if data := f.Data.(map[string]interface{}); data["status"] != status {
+		return f, fmt.Errorf("%s: user %d is %v, want %s", c.name, userID, data["status"], status)
+	}
+	return f, nil
+}
+
+// noPresenceBefore waits for a message event and fails if a presence event
+// of the user comes first
+func (c *testClient) noPresenceBefore(userID uint, seq uint64) error {
+	f, err := c.waitFor(func(f serverFrame) bool {
+		data, _ := f.Data.(map[string]interface{})
+		return f.Type == models.EventMessage || (f.Type == models.EventPresence && data["user_id"] == float64(userID))
+	})
+	if err != nil {
+		return err
+	}
+	if f.Type != models.EventMessage || f.Seq != seq {
+		return fmt.Errorf("%s: got %s with seq %d, want message %d", c.name, f.Type, f.Seq, seq)
+	}
+	return nil
+}
+
+// TestPresence checks that a user with several tabs on several nodes stays
+// online until the last active one goes, and is announced offline then
+func TestPresence(t *testing.T) {
+	const chatRoomID = 1
+	cl := newCluster(t)
+	nodeA := cl.startNode(t, "node-a")
+	nodeB := cl.startNode(t, "node-b")
+
+	// alice has two tabs on node A and one on node B; bob watches the room
+	// from node B
+	aliceTab1 := mustConnect(t, nodeA, 1, "alice")
+	aliceTab2 := mustConnect(t, nodeA, 1, "alice")
+	aliceTab3 := mustConnect(t, nodeB, 1, "alice")
+	bob := mustConnect(t, nodeB, 2, "bob")
+	for _, c := range []*testClient{aliceTab1, aliceTab2, aliceTab3, bob} {
+		if err := c.request(models.OpSubscribe, "sub", models.SubscribeRequest{ChatRoomID: chatRoomID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var seq uint64
+	// expectUnchanged checks that alice is still online everywhere and that
+	// bob was told nothing about her before his next message
+	expectUnchanged := func(t *testing.T) {
+		t.Helper()
+		for _, node := range []*testNode{nodeA, nodeB} {
+			presences, err := node.presence.GetPresence([]uint{1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if presences[0].Status != models.PresenceOnline {
+				t.Fatalf("alice is %s on %s", presences[0].Status, node.name)
+			}
+		}
+		seq++
+		if err := bob.request(models.OpSend, "m", models.SendRequest{ChatRoomID: chatRoomID, Content: "still there?"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.noPresenceBefore(1, seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("every node sees a user with tabs open online", func(t *testing.T) {
+		for _, node := range []*testNode{nodeA, nodeB} {
+			if err := node.waitForPresence(1, models.PresenceOnline); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("an idle tab does not make the user away while another is active", func(t *testing.T) {
+		if err := aliceTab3.request(models.OpHeartbeat, "hb", models.HeartbeatRequest{State: "idle"}); err != nil {
+			t.Fatal(err)
+		}
+		expectUnchanged(t)
+	})
+
+	t.Run("closing one of the tabs on a node keeps the user online", func(t *testing.T) {
+		aliceTab1.conn.Close()
+		if err := nodeA.waitForClients(1); err != nil {
+			t.Fatal(err)
+		}
+		expectUnchanged(t)
+	})
+
+	t.Run("a user whose remaining tabs are all idle is away", func(t *testing.T) {
+		aliceTab2.conn.Close()
+		if err := nodeA.waitForClients(0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.nextPresence(1, models.PresenceAway, models.PresenceOnline); err != nil {
+			t.Fatal(err)
+		}
+		if err := nodeA.waitForPresence(1, models.PresenceAway); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("closing the last tab makes the user offline", func(t *testing.T) {
+		aliceTab3.conn.Close()
+		f, err := bob.nextPresence(1, models.PresenceOffline, models.PresenceAway)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := f.Data.(map[string]interface{}); data["last_seen_at"] == nil {
+			t.Fatal("offline presence without a last seen time")
+		}
+		for _, node := range []*testNode{nodeA, nodeB} {
+			if err := node.waitForPresence(1, models.PresenceOffline); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
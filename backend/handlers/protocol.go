@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"chatapp/models"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Frames buffered per client before the slow-consumer policy applies
+	defaultSendBufferSize = 256
+
+	defaultReplayLimit = 100
+
+	// Connection deadlines; pings go out often enough to keep the read
+	// deadline of a healthy client from passing
+	defaultReadDeadline  = 60 * time.Second
+	defaultWriteDeadline = 10 * time.Second
+	defaultPingPeriod    = 54 * time.Second
+
+	// Time a client has to authenticate after connecting
+	defaultAuthTimeout = 10 * time.Second
+
+	// Largest frame accepted from a client
+	defaultMaxFrameSize = 64 << 10
+
+	// Frames shorter than this are not worth compressing
+	defaultCompressionThreshold = 1024
+)
+
+// Close codes in the private range (4000-4999) used by the protocol
+const (
+	CloseUnauthorized       = 4001
+	CloseUnsupportedVersion = 4002
+	CloseForbidden          = 4003
+	CloseSlowConsumer       = 4004
+)
+
+// wsSchema is the JSON Schema of every frame in the v1 protocol
+//
+//go:embed ws_schema.json
+var wsSchema []byte
+
+// HandleWebSocketSchema serves the JSON Schema of the WebSocket protocol so
+// clients can generate their types from it
+func HandleWebSocketSchema(c *gin.Context) {
+	c.Data(http.StatusOK, "application/schema+json", wsSchema)
+}
+
+// encodeFrame marshals a server frame, stamping the protocol version
+func encodeFrame(frame models.ServerEnvelope) *wireFrame {
+	frame.V = models.WSProtocolVersion
+	frameBytes, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("Failed to encode %s frame: %v", frame.Op, err)
+		return nil
+	}
+	return newWireFrame(frameBytes)
+}
+
+// encodeRoomEvent marshals an "event" frame for an event from the room log,
+// so live delivery and replay send the same bytes
+func encodeRoomEvent(event *models.RoomEvent) *wireFrame {
+	return encodeFrame(models.ServerEnvelope{
+		Op:   models.OpEvent,
+		Type: event.Type,
+		Seq:  event.Seq,
+		Data: json.RawMessage(event.Data),
+	})
+}
+
+// encodeEvent marshals an "event" frame
+func encodeEvent(eventType string, data interface{}) *wireFrame {
+	return encodeFrame(models.ServerEnvelope{Op: models.OpEvent, Type: eventType, Data: data})
+}
+
+// queue hands a frame to the write pump, dropping it if the client is not
+// keeping up
+func (c *Client) queue(frame *wireFrame) {
+	if frame == nil {
+		return
+	}
+	select {
+	case c.send <- frame:
+	default:
+		log.Printf("Dropping frame for slow client %s", c.username)
+	}
+}
+
+// ack answers a client request that succeeded
+func (c *Client) ack(requestID, eventType string, data interface{}) {
+	c.queue(encodeFrame(models.ServerEnvelope{Op: models.OpAck, Type: eventType, ID: requestID, Data: data}))
+}
+
+// sendError answers a client request that failed
+func (c *Client) sendError(requestID, code, message string) {
+	c.queue(encodeFrame(models.ServerEnvelope{
+		Op:    models.OpError,
+		ID:    requestID,
+		Error: &models.WSError{Code: code, Message: message},
+	}))
+}
+
+// fail answers a request with an error; the read pump then returns, closing
+// the connection once the error frame has been written
+func (c *Client) fail(requestID, code, message string, closeCode int) {
+	c.sendError(requestID, code, message)
+	c.closeCode = closeCode
+	c.closeReason = message
+}
+
+// close stops the write pump, which writes a close frame with the given code
+// (an empty one if 0) and closes the connection. With drain, the frames
+// already queued are written first. Only the first call has any effect.
+func (c *Client) close(code int, reason string, drain bool) {
+	c.closeOnce.Do(func() {
+		c.closeMessage = []byte{}
+		if code != 0 {
+			c.closeMessage = websocket.FormatCloseMessage(code, reason)
+		}
+		c.drain = drain
+		close(c.quit)
+
+		if !drain {
+			// Unblock a write stuck on a client that stopped reading
+			if c.sink != nil {
+				c.sink.setWriteDeadline(time.Now())
+			} else {
+				c.conn.UnderlyingConn().SetWriteDeadline(time.Now())
+			}
+		}
+	})
+}
+
+// isTimeout reports whether a read failed because its deadline passed
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isDecodeError reports whether a readEnvelope error came from a malformed
+// frame rather than from the connection
+func isDecodeError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.Is(err, errMalformedFrame) || errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+// serviceErrorCode maps a service error to a protocol error code
+func serviceErrorCode(err error) string {
+	switch err.Error() {
+	case "chat room not found", "user not found", "message not found":
+		return models.ErrCodeNotFound
+	case "message content is required", "message content is too long", "client nonce is too long":
+		return models.ErrCodeValidation
+	}
+	return models.ErrCodeInternal
+}
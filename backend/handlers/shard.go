@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+)
+
+// hubShards is the number of shards the hub's room and user indexes are
+// split into, so that busy rooms don't contend on one lock
+const hubShards = 64
+
+// hubShard indexes the local clients of the rooms and users whose ID falls
+// in it. Clients are only added and removed by their own read pump, while
+// delivery from any goroutine takes a snapshot under the read lock.
+type hubShard struct {
+	mu    sync.RWMutex
+	rooms map[uint]map[*Client]struct{}
+	users map[uint]map[*Client]struct{}
+}
+
+func newHubShards() [hubShards]*hubShard {
+	var shards [hubShards]*hubShard
+	for i := range shards {
+		shards[i] = &hubShard{
+			rooms: make(map[uint]map[*Client]struct{}),
+			users: make(map[uint]map[*Client]struct{}),
+		}
+	}
+	return shards
+}
+
+func (h *Hub) shard(id uint) *hubShard {
+	return h.shards[id%hubShards]
+}
+
+// register makes an authenticated client reachable by its user ID
+func (h *Hub) register(c *Client) {
+	shard := h.shard(c.userID)
+	shard.mu.Lock()
+	if shard.users[c.userID] == nil {
+		shard.users[c.userID] = make(map[*Client]struct{})
+	}
+	shard.users[c.userID][c] = struct{}{}
+	shard.mu.Unlock()
+
+	log.Printf("Client %s connected", c.username)
+	if !c.polling {
+		h.presenceService.Connect(c.userID, c.id)
+	}
+}
+
+// unregister removes a client from the hub once its read pump is done
+func (h *Hub) unregister(c *Client) {
+	// Announce presence changes while the client is still in its rooms
+	if !c.polling {
+		h.presenceService.Disconnect(c.userID, c.id)
+	}
+
+	for chatRoomID := range c.subscriptions {
+		h.leaveRoom(c, chatRoomID)
+	}
+
+	shard := h.shard(c.userID)
+	shard.mu.Lock()
+	delete(shard.users[c.userID], c)
+	if len(shard.users[c.userID]) == 0 {
+		delete(shard.users, c.userID)
+	}
+	shard.mu.Unlock()
+
+	log.Printf("Client %s disconnected", c.username)
+}
+
+// joinRoom starts delivering a room to a client. It reports whether the
+// client is the room's first local subscriber.
+func (h *Hub) joinRoom(c *Client, chatRoomID uint) bool {
+	c.mu.Lock()
+	c.subscriptions[chatRoomID] = true
+	c.mu.Unlock()
+
+	shard := h.shard(chatRoomID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	first := len(shard.rooms[chatRoomID]) == 0
+	if first {
+		shard.rooms[chatRoomID] = make(map[*Client]struct{})
+	}
+	shard.rooms[chatRoomID][c] = struct{}{}
+	log.Printf("Client %s joined chat room %d", c.username, chatRoomID)
+	return first
+}
+
+// leaveRoom stops delivering a room to a client. The room lock is taken
+// before the shard lock, as subscribe and deliverToRoom take them, so that
+// the room's next sequence number is forgotten together with its last local
+// client and never stored back by a delivery in flight.
+func (h *Hub) leaveRoom(c *Client, chatRoomID uint) {
+	lock := h.roomLock(chatRoomID)
+	lock.Lock()
+	shard := h.shard(chatRoomID)
+	shard.mu.Lock()
+	delete(shard.rooms[chatRoomID], c)
+	if len(shard.rooms[chatRoomID]) == 0 {
+		delete(shard.rooms, chatRoomID)
+		h.nextSeqs.Delete(chatRoomID)
+	}
+	shard.mu.Unlock()
+	lock.Unlock()
+
+	c.mu.Lock()
+	delete(c.subscriptions, chatRoomID)
+	delete(c.seqs, chatRoomID)
+	c.mu.Unlock()
+	log.Printf("Client %s left chat room %d", c.username, chatRoomID)
+
+	// Don't leave "is typing" hanging for a client that left
+	h.ephemeral.StopAll(c, chatRoomID)
+}
+
+// roomClients returns the local clients of a room
+func (h *Hub) roomClients(chatRoomID uint) []*Client {
+	shard := h.shard(chatRoomID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return clientList(shard.rooms[chatRoomID])
+}
+
+// userClients returns the local connections of a user
+func (h *Hub) userClients(userID uint) []*Client {
+	shard := h.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return clientList(shard.users[userID])
+}
+
+func clientList(set map[*Client]struct{}) []*Client {
+	clients := make([]*Client, 0, len(set))
+	for client := range set {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// ConnectedClients returns the number of authenticated connections to this node
+func (h *Hub) ConnectedClients() int {
+	count := 0
+	for _, shard := range h.shards {
+		shard.mu.RLock()
+		for _, clients := range shard.users {
+			count += len(clients)
+		}
+		shard.mu.RUnlock()
+	}
+	return count
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reason sent with the close frame of connections dropped by a shutdown
+const shutdownCloseReason = "Server restarting, reconnect"
+
+// track admits a client whose pumps are starting, counting pumps of them so
+// Shutdown can wait for them. It reports false once the hub is shutting down.
+func (h *Hub) track(c *Client, pumps int) bool {
+	h.clientsMu.Lock()
+	defer h.clientsMu.Unlock()
+
+	if h.closing {
+		return false
+	}
+	h.clients[c] = struct{}{}
+	h.pumps.Add(pumps)
+	return true
+}
+
+// untrack counts one pump of a client as done. A client is forgotten with
+// its first pump done, which only happens once it is closing.
+func (h *Hub) untrack(c *Client) {
+	h.clientsMu.Lock()
+	delete(h.clients, c)
+	h.clientsMu.Unlock()
+	h.pumps.Done()
+}
+
+// isClosing reports whether the hub refuses new clients
+func (h *Hub) isClosing() bool {
+	h.clientsMu.Lock()
+	defer h.clientsMu.Unlock()
+	return h.closing
+}
+
+// Shutdown refuses new clients and closes those connected, telling WebSocket
+// clients to reconnect (to another node) with a Service Restart close frame
+// once their queued frames are written. SSE streams end and long polls
+// return what they have. It waits for the connections to close, or for ctx
+// to be done.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.clientsMu.Lock()
+	h.closing = true
+	clients := make([]*Client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.clientsMu.Unlock()
+
+	log.Printf("Closing %d connections for shutdown", len(clients))
+	for _, c := range clients {
+		c.close(websocket.CloseServiceRestart, shutdownCloseReason, true)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("All connections closed")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
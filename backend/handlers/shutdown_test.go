@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"chatapp/config"
+	"chatapp/models"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitForLine waits for a line of the stream containing s
+func waitForLine(lines <-chan string, s string) error {
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return fmt.Errorf("stream ended before %q", s)
+			}
+			if strings.Contains(line, s) {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for %q", s)
+		}
+	}
+}
+
+// streamLines returns the lines of an SSE stream's raw events
+func streamLines(s *sseStream) <-chan string {
+	lines := make(chan string, 64)
+	go func() {
+		defer close(lines)
+		for event := range s.events {
+			lines <- event.data
+		}
+	}()
+	return lines
+}
+
+// TestShutdown checks how a node lets go of its clients when it shuts down
+// for a deploy: WebSocket clients get their queued frames and a close frame
+// telling them to reconnect, streams end, and no new client gets in. The
+// node serves with short read and write timeouts, which long-lived
+// connections must outlast.
+func TestShutdown(t *testing.T) {
+	const (
+		chatRoomID = 1
+		// The read and write timeout of the node
+		serverTimeout = 500 * time.Millisecond
+	)
+	cl := newCluster(t)
+	config.GlobalConfig.Server.ReadTimeout = serverTimeout
+	config.GlobalConfig.Server.WriteTimeout = serverTimeout
+	nodeA := cl.startNode(t, "node-a")
+	nodeB := cl.startNode(t, "node-b")
+
+	// alice sends from node B; bob and a stream listen on node A
+	alice := mustConnect(t, nodeB, 1, "alice")
+	bob := mustConnect(t, nodeA, 2, "bob")
+	for _, c := range []*testClient{alice, bob} {
+		if err := c.request(models.OpSubscribe, "sub", models.SubscribeRequest{ChatRoomID: chatRoomID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream, err := openSSE(nodeA, 3, "carol", chatRoomID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.resp.Body.Close()
+	lines := streamLines(stream)
+
+	t.Run("connections outlast the server timeouts", func(t *testing.T) {
+		time.Sleep(3 * serverTimeout)
+		if err := alice.request(models.OpSend, "m1", models.SendRequest{ChatRoomID: chatRoomID, Content: "before"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.collectMessages(1, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := waitForLine(lines, `"seq":1`); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	var shutdownErr error
+	shutdownDone := make(chan struct{})
+	t.Run("shutting down closes WebSockets with a reconnect code", func(t *testing.T) {
+		// Frames still queued when the shutdown starts are written first
+		for i := 0; i < 5; i++ {
+			if err := alice.write(models.OpSend, "burst", models.SendRequest{ChatRoomID: chatRoomID, Content: strconv.Itoa(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := bob.waitFor(func(f serverFrame) bool { return f.Type == models.EventMessage && f.Seq == 2 }); err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			shutdownErr = nodeA.hub.Shutdown(ctx)
+			close(shutdownDone)
+		}()
+
+		received := 0
+		for f := range bob.frames {
+			if f.Type == models.EventMessage {
+				received++
+			}
+		}
+		if !websocket.IsCloseError(bob.err, websocket.CloseServiceRestart) {
+			t.Fatalf("connection ended with %v, want close code %d", bob.err, websocket.CloseServiceRestart)
+		}
+		if closeErr := bob.err.(*websocket.CloseError); !strings.Contains(closeErr.Text, "reconnect") {
+			t.Fatalf("close reason %q", closeErr.Text)
+		}
+		if received > 4 {
+			t.Fatalf("received %d more messages, want at most 4", received)
+		}
+	})
+
+	t.Run("shutting down ends event streams", func(t *testing.T) {
+		deadline := time.After(testTimeout)
+		for {
+			select {
+			case _, ok := <-lines:
+				if !ok {
+					return
+				}
+			case <-deadline:
+				t.Fatal("stream still open")
+			}
+		}
+	})
+
+	t.Run("shutdown returns once every connection is closed", func(t *testing.T) {
+		select {
+		case <-shutdownDone:
+			if shutdownErr != nil {
+				t.Fatal(shutdownErr)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("shutdown still waiting")
+		}
+	})
+
+	t.Run("a node shutting down refuses new connections", func(t *testing.T) {
+		_, resp, err := dial(websocket.DefaultDialer, nodeA, "/api/ws", nil)
+		if err == nil {
+			t.Fatal("handshake succeeded")
+		}
+		if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("handshake failed with %v, want status 503", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+	})
+
+	t.Run("clients of other nodes are unaffected", func(t *testing.T) {
+		if err := alice.request(models.OpSend, "m2", models.SendRequest{ChatRoomID: chatRoomID, Content: "after"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,496 @@
+package handlers
+
+import (
+	"chatapp/models"
+	"chatapp/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Comments go out this often on idle SSE streams so proxies don't time
+	// them out
+	streamKeepAlive = 15 * time.Second
+
+	// How long a long poll waits for events, by default and at most
+	defaultPollTimeout = 25 * time.Second
+	maxPollTimeout     = 60 * time.Second
+)
+
+// frameSink is where the frames of a client streamed over plain HTTP go
+// instead of a WebSocket connection
+type frameSink interface {
+	writeFrame(frame []byte) error
+	// keepAlive is called when the stream has been idle for a while
+	keepAlive() error
+	// setWriteDeadline bounds the writes in progress and to come
+	setWriteDeadline(t time.Time) error
+}
+
+// eventCursor is how far a stream client got in each of its rooms: the seq of
+// the last room event delivered. Written as "room:seq" pairs such as
+// "1:57,2:13", it is the SSE event ID, and what clients resume from.
+type eventCursor struct {
+	mu      sync.Mutex
+	seqs    map[uint]uint64
+	changed bool
+}
+
+// parseEventCursor reads a cursor sent back by a client; an empty one
+// resumes nothing
+func parseEventCursor(value string) (*eventCursor, error) {
+	cursor := &eventCursor{seqs: make(map[uint]uint64)}
+	if value == "" {
+		return cursor, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		room, seq, found := strings.Cut(strings.TrimSpace(part), ":")
+		if !found {
+			return nil, errors.New("invalid cursor")
+		}
+		chatRoomID, err := strconv.ParseUint(room, 10, 32)
+		if err != nil || chatRoomID == 0 {
+			return nil, errors.New("invalid cursor")
+		}
+		lastSeq, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		cursor.seqs[uint(chatRoomID)] = lastSeq
+	}
+	return cursor, nil
+}
+
+// String encodes the cursor, rooms in ascending order
+func (c *eventCursor) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.encode()
+}
+
+func (c *eventCursor) encode() string {
+	rooms := make([]uint, 0, len(c.seqs))
+	for chatRoomID := range c.seqs {
+		rooms = append(rooms, chatRoomID)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i] < rooms[j] })
+
+	parts := make([]string, len(rooms))
+	for i, chatRoomID := range rooms {
+		parts[i] = strconv.FormatUint(uint64(chatRoomID), 10) + ":" + strconv.FormatUint(c.seqs[chatRoomID], 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// resumeFrom returns where a room resumes from, nil if the client has not
+// seen it before
+func (c *eventCursor) resumeFrom(chatRoomID uint) *uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seq, ok := c.seqs[chatRoomID]
+	if !ok {
+		return nil
+	}
+	return &seq
+}
+
+// set moves a room's position forward
+func (c *eventCursor) set(chatRoomID uint, seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.seqs[chatRoomID]; ok && last >= seq {
+		return
+	}
+	c.seqs[chatRoomID] = seq
+	c.changed = true
+}
+
+// observe moves the cursor past a frame about to be delivered: a room event
+// with a seq, or the seq live delivery resumes after a resync
+func (c *eventCursor) observe(frame []byte) {
+	var meta struct {
+		Op   string `json:"op"`
+		Type string `json:"type"`
+		Seq  uint64 `json:"seq"`
+		Data struct {
+			ChatRoomID uint   `json:"chat_room_id"`
+			Seq        uint64 `json:"seq"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(frame, &meta) != nil || meta.Op != models.OpEvent || meta.Data.ChatRoomID == 0 {
+		return
+	}
+	switch {
+	case meta.Type == models.EventResyncRequired:
+		c.set(meta.Data.ChatRoomID, meta.Data.Seq)
+	case meta.Seq != 0:
+		c.set(meta.Data.ChatRoomID, meta.Seq)
+	}
+}
+
+// take returns the encoded cursor if it changed since the last call
+func (c *eventCursor) take() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.changed {
+		return "", false
+	}
+	c.changed = false
+	return c.encode(), true
+}
+
+// sseSink writes frames as Server-Sent Events, one "data" line per frame,
+// with the cursor as event ID whenever it moves
+type sseSink struct {
+	w             gin.ResponseWriter
+	controller    *http.ResponseController
+	writeDeadline time.Duration
+	cursor        *eventCursor
+}
+
+func (s *sseSink) writeFrame(frame []byte) error {
+	s.cursor.observe(frame)
+	var event strings.Builder
+	if id, changed := s.cursor.take(); changed {
+		event.WriteString("id: " + id + "\n")
+	}
+	event.WriteString("data: ")
+	event.Write(frame)
+	event.WriteString("\n\n")
+	return s.write(event.String())
+}
+
+// keepAlive sends the cursor if it moved without an event, such as when
+// rooms are first subscribed, and a comment otherwise. An event with only
+// an ID updates the client's Last-Event-ID without dispatching anything.
+func (s *sseSink) keepAlive() error {
+	if id, changed := s.cursor.take(); changed {
+		return s.write("id: " + id + "\n\n")
+	}
+	return s.write(": keepalive\n\n")
+}
+
+func (s *sseSink) write(event string) error {
+	s.controller.SetWriteDeadline(time.Now().Add(s.writeDeadline))
+	if _, err := s.w.WriteString(event); err != nil {
+		return err
+	}
+	return s.controller.Flush()
+}
+
+func (s *sseSink) setWriteDeadline(t time.Time) error {
+	return s.controller.SetWriteDeadline(t)
+}
+
+// pollSink collects the frames answering a long poll, signalling ready once
+// there is at least one
+type pollSink struct {
+	cursor *eventCursor
+	events []json.RawMessage
+	ready  chan struct{}
+}
+
+func (s *pollSink) writeFrame(frame []byte) error {
+	s.cursor.observe(frame)
+	s.events = append(s.events, json.RawMessage(frame))
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *pollSink) keepAlive() error {
+	return nil
+}
+
+func (s *pollSink) setWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// newStreamClient creates an authenticated client delivering to a sink
+func (h *Hub) newStreamClient(userID uint, username, ip string, sink frameSink, polling bool) *Client {
+	return &Client{
+		id:              h.nextClientID.Add(1),
+		hub:             h,
+		ip:              ip,
+		sink:            sink,
+		polling:         polling,
+		codec:           codecs[0],
+		send:            make(chan *wireFrame, h.sendBufferSize),
+		userID:          userID,
+		username:        username,
+		isAuthenticated: true,
+		subscriptions:   make(map[uint]bool),
+		seqs:            make(map[uint]uint64),
+		missedRooms:     make(map[uint]uint64),
+		pendingPresence: make(map[uint64]*wireFrame),
+		wake:            make(chan struct{}, 1),
+		quit:            make(chan struct{}),
+	}
+}
+
+// streamPump is the write pump of a stream client. opened, once closed,
+// prompts a keepalive so the client learns its cursor right away. done is
+// closed when the pump returns.
+func (c *Client) streamPump(opened <-chan struct{}, done chan<- struct{}) {
+	ticker := time.NewTicker(streamKeepAlive)
+	defer func() {
+		ticker.Stop()
+		close(done)
+	}()
+
+	for {
+		select {
+		case message := <-c.send:
+			if err := c.write(message); err != nil {
+				c.close(0, "", false)
+				return
+			}
+			// Caught up: write what was held back meanwhile
+			if len(c.send) == 0 && c.flushPending() != nil {
+				c.close(0, "", false)
+				return
+			}
+
+		case <-c.wake:
+			if len(c.send) == 0 && c.flushPending() != nil {
+				c.close(0, "", false)
+				return
+			}
+
+		case <-opened:
+			opened = nil
+			if err := c.sink.keepAlive(); err != nil {
+				c.close(0, "", false)
+				return
+			}
+
+		case <-c.quit:
+			if c.drain {
+				c.flush()
+			}
+			return
+
+		case <-ticker.C:
+			if err := c.sink.keepAlive(); err != nil {
+				c.close(0, "", false)
+				return
+			}
+		}
+	}
+}
+
+// streamRequest is what an SSE or long-poll request asks for
+type streamRequest struct {
+	userID   uint
+	username string
+	rooms    []uint
+	cursor   *eventCursor
+}
+
+// parseStreamRequest reads the rooms in chat_room_ids and the cursor to
+// resume from, and checks the user may access every room. It answers the
+// request with an error and returns false if any of this fails.
+func (h *Hub) parseStreamRequest(c *gin.Context, cursorValue string) (*streamRequest, bool) {
+	if h.isClosing() {
+		utils.ServiceUnavailableResponse(c, "Server is shutting down")
+		return nil, false
+	}
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		utils.UnauthorizedResponse(c, "User not authenticated")
+		return nil, false
+	}
+	username, _ := c.Get("username")
+
+	chatRoomIDsStr := c.Query("chat_room_ids")
+	if chatRoomIDsStr == "" {
+		utils.BadRequestResponse(c, "chat_room_ids is required")
+		return nil, false
+	}
+	parts := strings.Split(chatRoomIDsStr, ",")
+	if len(parts) > maxSubscriptions {
+		utils.BadRequestResponse(c, "Too many chat room IDs")
+		return nil, false
+	}
+
+	request := &streamRequest{userID: userID.(uint), username: username.(string)}
+	seen := make(map[uint]bool, len(parts))
+	for _, part := range parts {
+		chatRoomID, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+		if err != nil || chatRoomID == 0 {
+			utils.BadRequestResponse(c, "Invalid chat room ID: "+part)
+			return nil, false
+		}
+		if !seen[uint(chatRoomID)] {
+			seen[uint(chatRoomID)] = true
+			request.rooms = append(request.rooms, uint(chatRoomID))
+		}
+	}
+
+	cursor, err := parseEventCursor(cursorValue)
+	if err != nil {
+		utils.BadRequestResponse(c, "Invalid cursor")
+		return nil, false
+	}
+	request.cursor = cursor
+
+	for _, chatRoomID := range request.rooms {
+		if err := h.chatRoomService.CheckExists(chatRoomID); err != nil {
+			if err.Error() == "chat room not found" {
+				utils.NotFoundResponse(c, err.Error())
+			} else {
+				utils.InternalErrorResponse(c, err.Error())
+			}
+			return nil, false
+		}
+	}
+	return request, true
+}
+
+// openStream registers a stream client and subscribes it to the requested
+// rooms, replaying those in the cursor from where it left off. Rooms seen for
+// the first time join the cursor at their latest event.
+func (h *Hub) openStream(c *Client, request *streamRequest) {
+	h.register(c)
+	for _, chatRoomID := range request.rooms {
+		chatRoomID := chatRoomID
+		resumeFrom := request.cursor.resumeFrom(chatRoomID)
+		h.subscribe(c, chatRoomID, resumeFrom, func(lastSeq uint64) {
+			if resumeFrom == nil {
+				request.cursor.set(chatRoomID, lastSeq)
+			}
+		})
+		if !c.polling {
+			h.announcePresence(c.userID, chatRoomID)
+		}
+	}
+}
+
+// HandleEventStream streams room events as Server-Sent Events, for clients
+// that cannot keep a WebSocket open
+func HandleEventStream(c *gin.Context) {
+	GlobalHub.HandleEventStream(c)
+}
+
+// HandleEventStream streams the events of the rooms in chat_room_ids as
+// Server-Sent Events. Each event's data is a server frame, as sent over the
+// WebSocket; reconnecting with Last-Event-ID resumes after the last one.
+func (h *Hub) HandleEventStream(c *gin.Context) {
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	request, ok := h.parseStreamRequest(c, lastEventID)
+	if !ok {
+		return
+	}
+
+	controller := http.NewResponseController(c.Writer)
+	sink := &sseSink{w: c.Writer, controller: controller, writeDeadline: h.conn.writeDeadline, cursor: request.cursor}
+	client := h.newStreamClient(request.userID, request.username, c.ClientIP(), sink, false)
+	if !h.track(client, 1) {
+		utils.ServiceUnavailableResponse(c, "Server is shutting down")
+		return
+	}
+	defer h.untrack(client)
+
+	// The stream outlasts the server's read timeout; writes have their own
+	// deadlines
+	controller.SetReadDeadline(time.Time{})
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	opened := make(chan struct{})
+	done := make(chan struct{})
+	go client.streamPump(opened, done)
+
+	h.openStream(client, request)
+	close(opened)
+
+	select {
+	case <-c.Request.Context().Done():
+	case <-client.quit:
+	}
+	h.unregister(client)
+	client.close(0, "", false)
+	<-done
+}
+
+// HandleEventPoll long-polls for room events, for clients that cannot keep
+// a connection open at all
+func HandleEventPoll(c *gin.Context) {
+	GlobalHub.HandleEventPoll(c)
+}
+
+// HandleEventPoll waits up to timeout seconds for events in the rooms in
+// chat_room_ids after cursor, and returns them with the cursor to pass to the
+// next poll
+func (h *Hub) HandleEventPoll(c *gin.Context) {
+	request, ok := h.parseStreamRequest(c, c.Query("cursor"))
+	if !ok {
+		return
+	}
+
+	timeout := defaultPollTimeout
+	if value := c.Query("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			utils.BadRequestResponse(c, "Invalid timeout")
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+	// The poll may outlast the server's timeouts
+	controller := http.NewResponseController(c.Writer)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Now().Add(timeout + h.conn.writeDeadline))
+
+	sink := &pollSink{cursor: request.cursor, ready: make(chan struct{}, 1)}
+	client := h.newStreamClient(request.userID, request.username, c.ClientIP(), sink, true)
+	if !h.track(client, 1) {
+		utils.ServiceUnavailableResponse(c, "Server is shutting down")
+		return
+	}
+	done := make(chan struct{})
+	go client.streamPump(nil, done)
+
+	h.openStream(client, request)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-sink.ready:
+	case <-timer.C:
+	case <-c.Request.Context().Done():
+	case <-client.quit:
+	}
+	h.unregister(client)
+	client.close(0, "", true)
+	<-done
+	h.untrack(client)
+
+	events := sink.events
+	if events == nil {
+		events = []json.RawMessage{}
+	}
+	utils.SuccessResponse(c, models.EventBatch{Events: events, Cursor: request.cursor.String()})
+}
@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"bufio"
+	"chatapp/models"
+	"chatapp/utils"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one event read off an SSE stream; data is empty for events
+// that only move the ID
+type sseEvent struct {
+	id   string
+	data string
+}
+
+// sseStream is an open SSE response
+type sseStream struct {
+	resp   *http.Response
+	events chan sseEvent
+	lastID string
+}
+
+// authGet sends a GET to a node, authenticated as a user unless userID is 0
+func authGet(node *testNode, userID uint, username, path string, header http.Header) (*http.Response, error) {
+	token, err := utils.GenerateToken(userID, username)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, node.server.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if userID != 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// openSSE opens the SSE stream of a room, resuming from lastEventID if set
+func openSSE(node *testNode, userID uint, username string, chatRoomID uint, lastEventID string) (*sseStream, error) {
+	header := http.Header{}
+	if lastEventID != "" {
+		header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := authGet(node, userID, username, "/api/events?chat_room_ids="+strconv.Itoa(int(chatRoomID)), header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body.Close()
+		return nil, fmt.Errorf("stream opened with status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	s := &sseStream{resp: resp, events: make(chan sseEvent, 64)}
+	go func() {
+		defer close(s.events)
+		scanner := bufio.NewScanner(resp.Body)
+		var event sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event.id != "" || event.data != "" {
+					s.events <- event
+				}
+				event = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return s, nil
+}
+
+// next waits for the next event carrying a frame, tracking the last ID seen
+// the way browsers do
+func (s *sseStream) next() (serverFrame, error) {
+	var frame serverFrame
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				return frame, fmt.Errorf("stream ended")
+			}
+			if event.id != "" {
+				s.lastID = event.id
+			}
+			if event.data == "" {
+				continue
+			}
+			return frame, json.Unmarshal([]byte(event.data), &frame)
+		case <-deadline:
+			return frame, fmt.Errorf("timed out waiting for an event")
+		}
+	}
+}
+
+// waitForID waits until the stream's event ID reaches want
+func (s *sseStream) waitForID(want string) error {
+	deadline := time.After(testTimeout)
+	for s.lastID != want {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				return fmt.Errorf("stream ended at ID %q, want %q", s.lastID, want)
+			}
+			if event.id != "" {
+				s.lastID = event.id
+			}
+		case <-deadline:
+			return fmt.Errorf("event ID is %q, want %q", s.lastID, want)
+		}
+	}
+	return nil
+}
+
+// collectMessages reads message events with consecutive seqs from first
+func (s *sseStream) collectMessages(first uint64, count int) error {
+	for want := first; want < first+uint64(count); {
+		frame, err := s.next()
+		if err != nil {
+			return err
+		}
+		if frame.Type != models.EventMessage {
+			continue
+		}
+		if frame.Seq != want {
+			return fmt.Errorf("got seq %d, want %d", frame.Seq, want)
+		}
+		want++
+	}
+	return nil
+}
+
+// longPoll long-polls a room
+func longPoll(node *testNode, userID uint, username string, chatRoomID uint, cursor string, timeout int) (models.EventBatch, error) {
+	var body struct {
+		Data models.EventBatch `json:"data"`
+	}
+	path := fmt.Sprintf("/api/events/poll?chat_room_ids=%d&cursor=%s&timeout=%d", chatRoomID, cursor, timeout)
+	resp, err := authGet(node, userID, username, path, nil)
+	if err != nil {
+		return body.Data, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return body.Data, fmt.Errorf("poll failed with status %d", resp.StatusCode)
+	}
+	return body.Data, json.NewDecoder(resp.Body).Decode(&body)
+}
+
+// messageSeqs returns the seqs of the message events in a batch
+func messageSeqs(batch models.EventBatch) ([]uint64, error) {
+	var seqs []uint64
+	for _, raw := range batch.Events {
+		var frame serverFrame
+		if err := json.Unmarshal(raw, &frame); err != nil {
+			return nil, err
+		}
+		if frame.Type == models.EventMessage {
+			seqs = append(seqs, frame.Seq)
+		}
+	}
+	return seqs, nil
+}
+
+// TestEventStreams checks the realtime fallbacks for clients that cannot use
+// WebSockets: Server-Sent Events and long polling, each resuming where the
+// client left off
+func TestEventStreams(t *testing.T) {
+	const chatRoomID = 1
+	cl := newCluster(t)
+	nodeA := cl.startNode(t, "node-a")
+	nodeB := cl.startNode(t, "node-b")
+
+	alice := mustConnect(t, nodeA, 1, "alice")
+	if err := alice.request(models.OpSubscribe, "sub", models.SubscribeRequest{ChatRoomID: chatRoomID}); err != nil {
+		t.Fatal(err)
+	}
+	send := func(t *testing.T, content string) {
+		t.Helper()
+		if err := alice.request(models.OpSend, "m-"+content, models.SendRequest{ChatRoomID: chatRoomID, Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("requests without a token are refused", func(t *testing.T) {
+		resp, err := authGet(nodeB, 0, "", "/api/events?chat_room_ids=1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("got status %d", resp.StatusCode)
+		}
+	})
+
+	var stream *sseStream
+	t.Run("an SSE stream delivers room events from another node", func(t *testing.T) {
+		var err error
+		if stream, err = openSSE(nodeB, 2, "bob", chatRoomID, ""); err != nil {
+			t.Fatal(err)
+		}
+		// The cursor arrives before any event, so a reconnect resumes
+		// even if nothing happened
+		if err := stream.waitForID("1:0"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			send(t, strconv.Itoa(i))
+		}
+		if err := stream.collectMessages(1, 3); err != nil {
+			t.Fatal(err)
+		}
+		if stream.lastID != "1:3" {
+			t.Fatalf("event ID is %q, want 1:3", stream.lastID)
+		}
+	})
+	if stream == nil {
+		t.FailNow()
+	}
+
+	t.Run("reconnecting with Last-Event-ID replays what was missed", func(t *testing.T) {
+		stream.resp.Body.Close()
+		for i := 3; i < 5; i++ {
+			send(t, strconv.Itoa(i))
+		}
+		resumed, err := openSSE(nodeA, 2, "bob", chatRoomID, stream.lastID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resumed.resp.Body.Close()
+		if err := resumed.collectMessages(4, 2); err != nil {
+			t.Fatal(err)
+		}
+		send(t, "5")
+		if err := resumed.collectMessages(6, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a long poll returns the events after its cursor", func(t *testing.T) {
+		batch, err := longPoll(nodeB, 3, "carol", chatRoomID, "1:4", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs, err := messageSeqs(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seqs) != 2 || seqs[0] != 5 || seqs[1] != 6 || batch.Cursor != "1:6" {
+			t.Fatalf("got seqs %v and cursor %q, want [5 6] and 1:6", seqs, batch.Cursor)
+		}
+	})
+
+	t.Run("a long poll waits for the next event", func(t *testing.T) {
+		result := make(chan error, 1)
+		go func() {
+			// Other events, such as presence, also end a poll; a client
+			// polls again from the cursor it got
+			cursor := "1:6"
+			for {
+				batch, err := longPoll(nodeB, 3, "carol", chatRoomID, cursor, 10)
+				if err != nil {
+					result <- err
+					return
+				}
+				seqs, err := messageSeqs(batch)
+				if err != nil || len(batch.Events) == 0 {
+					result <- fmt.Errorf("poll ended without events: %v", err)
+					return
+				}
+				if len(seqs) == 0 {
+					cursor = batch.Cursor
+					continue
+				}
+				if len(seqs) != 1 || seqs[0] != 7 || batch.Cursor != "1:7" {
+					err = fmt.Errorf("got seqs %v and cursor %q, want [7] and 1:7", seqs, batch.Cursor)
+				}
+				result <- err
+				return
+			}
+		}()
+		time.Sleep(200 * time.Millisecond)
+		send(t, "7")
+		if err := <-result; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("an idle long poll times out with its cursor unchanged", func(t *testing.T) {
+		batch, err := longPoll(nodeA, 3, "carol", chatRoomID, "1:7", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch.Events) != 0 || batch.Cursor != "1:7" {
+			t.Fatalf("got %d events and cursor %q", len(batch.Events), batch.Cursor)
+		}
+	})
+
+	t.Run("a first long poll starts its cursor at the latest event", func(t *testing.T) {
+		batch, err := longPoll(nodeA, 3, "carol", chatRoomID, "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch.Cursor != "1:7" {
+			t.Fatalf("got cursor %q, want 1:7", batch.Cursor)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"chatapp/models"
+	"encoding/json"
+	"log"
+)
+
+// maxSubscriptions limits how many rooms one connection can subscribe to
+const maxSubscriptions = 100
+
+// subscribe starts delivering a room to a client. ack is called with the
+// room's latest sequence number before the events the client missed since
+// resumeFrom (if set) are replayed. Holding the room lock meanwhile guarantees
+// no event is delivered twice or out of order: events published before are
+// replayed, events published after arrive live.
+func (h *Hub) subscribe(c *Client, chatRoomID uint, resumeFrom *uint64, ack func(lastSeq uint64)) {
+	lock := h.roomLock(chatRoomID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	first := h.joinRoom(c, chatRoomID)
+
+	var lastSeq uint64
+	var err error
+	if resumeFrom == nil {
+		lastSeq, err = h.roomEventService.LastSeq(chatRoomID)
+		if err != nil {
+			log.Printf("Failed to load sequence of chat room %d: %v", chatRoomID, err)
+		}
+		ack(lastSeq)
+	} else {
+		var events []models.RoomEvent
+		var complete bool
+		events, lastSeq, complete, err = h.roomEventService.Replay(chatRoomID, *resumeFrom, h.replayLimit)
+		if err != nil {
+			log.Printf("Failed to replay chat room %d for %s: %v", chatRoomID, c.username, err)
+		}
+		ack(lastSeq)
+
+		if err != nil || !complete {
+			c.queue(encodeEvent(models.EventResyncRequired, models.ResyncEvent{ChatRoomID: chatRoomID, Seq: lastSeq}))
+		} else {
+			for i := range events {
+				c.push(delivery{class: classEvent, chatRoomID: chatRoomID, seq: events[i].Seq, frame: encodeRoomEvent(&events[i])})
+			}
+		}
+	}
+	if err != nil {
+		// Without a known position, live events are delivered as they come
+		return
+	}
+
+	// Live events up to lastSeq may still be on their way from the broker;
+	// the client has them already or never asked for them
+	c.advanceSeq(chatRoomID, lastSeq)
+	if _, tracked := h.nextSeqs.Load(chatRoomID); first || !tracked {
+		h.nextSeqs.Store(chatRoomID, lastSeq+1)
+	}
+}
+
+// announcePresence tells a room about a user who just joined it, since
+// presence changes are only pushed to rooms the user is already in
+func (h *Hub) announcePresence(userID, chatRoomID uint) {
+	presences, err := h.presenceService.GetPresence([]uint{userID})
+	if err != nil {
+		log.Printf("Failed to load presence of user %d: %v", userID, err)
+		return
+	}
+	h.publishPresence(chatRoomID, presences[0])
+}
+
+// join subscribes the client to a room after checking it may access it. ack
+// is called as for Hub.subscribe. It returns false, after answering the
+// request with an error, if the subscription was refused.
+func (c *Client) join(requestID string, chatRoomID uint, resumeFrom *uint64, ack func(lastSeq uint64)) bool {
+	if c.subscriptions[chatRoomID] {
+		c.sendError(requestID, models.ErrCodeBadRequest, "Already subscribed to chat room")
+		return false
+	}
+	if len(c.subscriptions) >= maxSubscriptions {
+		c.sendError(requestID, models.ErrCodeBadRequest, "Too many subscriptions")
+		return false
+	}
+	if err := c.hub.chatRoomService.CheckExists(chatRoomID); err != nil {
+		c.sendError(requestID, serviceErrorCode(err), err.Error())
+		return false
+	}
+
+	c.hub.subscribe(c, chatRoomID, resumeFrom, ack)
+	c.hub.announcePresence(c.userID, chatRoomID)
+	return true
+}
+
+// handleSubscribe processes a "subscribe" frame
+func (c *Client) handleSubscribe(envelope models.ClientEnvelope) {
+	var request models.SubscribeRequest
+	if err := json.Unmarshal(envelope.Data, &request); err != nil || request.ChatRoomID == 0 {
+		c.sendError(envelope.ID, models.ErrCodeBadRequest, "chat_room_id is required")
+		return
+	}
+
+	c.join(envelope.ID, request.ChatRoomID, request.ResumeFrom, func(lastSeq uint64) {
+		c.ack(envelope.ID, "", models.SubscribeAck{ChatRoomID: request.ChatRoomID, Seq: lastSeq})
+	})
+}
+
+// handleUnsubscribe processes an "unsubscribe" frame
+func (c *Client) handleUnsubscribe(envelope models.ClientEnvelope) {
+	var request models.SubscribeRequest
+	if err := json.Unmarshal(envelope.Data, &request); err != nil || request.ChatRoomID == 0 {
+		c.sendError(envelope.ID, models.ErrCodeBadRequest, "chat_room_id is required")
+		return
+	}
+	if !c.subscriptions[request.ChatRoomID] {
+		c.sendError(envelope.ID, models.ErrCodeBadRequest, "Not subscribed to chat room")
+		return
+	}
+
+	c.hub.leaveRoom(c, request.ChatRoomID)
+	c.ack(envelope.ID, "", models.SubscribeAck{ChatRoomID: request.ChatRoomID})
+}
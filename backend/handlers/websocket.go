@@ -1,14 +1,19 @@
 package handlers
 
 import (
+	"chatapp/broker"
 	"chatapp/config"
 	"chatapp/models"
 	"chatapp/service"
 	"chatapp/utils"
+	"compress/flate"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
-	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -18,9 +23,7 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow connections from any origin
-	},
+	CheckOrigin:     checkOrigin,
 }
 
 // InitWebSocketUpgrader initializes the WebSocket upgrader with config values
@@ -28,243 +31,638 @@ func InitWebSocketUpgrader() {
 	if config.GlobalConfig != nil {
 		upgrader.ReadBufferSize = config.GlobalConfig.WebSocket.ReadBufferSize
 		upgrader.WriteBufferSize = config.GlobalConfig.WebSocket.WriteBufferSize
+		upgrader.EnableCompression = config.GlobalConfig.WebSocket.EnableCompression
 	}
 }
 
-type Hub struct {
-	// Registered clients.
-	clients map[*Client]bool
-
-	// Inbound messages from the clients.
-	broadcast chan []byte
+// connSettings are the deadlines and limits applied to every connection
+type connSettings struct {
+	readDeadline  time.Duration
+	writeDeadline time.Duration
+	pingPeriod    time.Duration
+	authTimeout   time.Duration
+	maxFrameSize  int64
+
+	// Used when permessage-deflate was negotiated
+	compressionThreshold int
+	compressionLevel     int
+}
 
-	// Register requests from the clients.
-	register chan *Client
+func newConnSettings() connSettings {
+	settings := connSettings{
+		readDeadline:         defaultReadDeadline,
+		writeDeadline:        defaultWriteDeadline,
+		pingPeriod:           defaultPingPeriod,
+		authTimeout:          defaultAuthTimeout,
+		maxFrameSize:         defaultMaxFrameSize,
+		compressionThreshold: defaultCompressionThreshold,
+		compressionLevel:     flate.BestSpeed,
+	}
+	if config.GlobalConfig == nil {
+		return settings
+	}
 
-	// Unregister requests from clients.
-	unregister chan *Client
+	cfg := config.GlobalConfig.WebSocket
+	if cfg.ReadDeadline > 0 {
+		settings.readDeadline = cfg.ReadDeadline
+	}
+	if cfg.WriteDeadline > 0 {
+		settings.writeDeadline = cfg.WriteDeadline
+	}
+	if cfg.PingPeriod > 0 {
+		settings.pingPeriod = cfg.PingPeriod
+	}
+	// A ping must get an answer in before the read deadline passes
+	if settings.pingPeriod >= settings.readDeadline {
+		settings.pingPeriod = settings.readDeadline * 9 / 10
+	}
+	if cfg.AuthTimeout > 0 {
+		settings.authTimeout = cfg.AuthTimeout
+	}
+	if cfg.MaxFrameSize > 0 {
+		settings.maxFrameSize = cfg.MaxFrameSize
+	}
+	if cfg.CompressionThreshold > 0 {
+		settings.compressionThreshold = cfg.CompressionThreshold
+	}
+	if cfg.CompressionLevel >= flate.BestSpeed && cfg.CompressionLevel <= flate.BestCompression {
+		settings.compressionLevel = cfg.CompressionLevel
+	}
+	return settings
+}
 
-	// Chat room specific clients
-	chatRooms map[uint]map[*Client]bool
+type Hub struct {
+	// Local clients by room and by user
+	shards [hubShards]*hubShard
 
 	// Message service for database operations
 	messageService service.MessageService
+
+	// Relay for typing/recording events that are never persisted
+	ephemeral *ephemeralRelay
+
+	// Presence service fed by client connections and heartbeats
+	presenceService service.PresenceService
+
+	// Chat room service checking access on subscribe
+	chatRoomService service.ChatRoomService
+
+	// Single-use tickets authenticating handshakes
+	ticketService service.WSTicketService
+
+	// Source of Client.id values
+	nextClientID atomic.Uint64
+
+	// Log of sequenced room events, replayed to resuming clients
+	roomEventService service.RoomEventService
+	replayLimit      int
+
+	// Frames buffered per client, and what happens when that is not enough
+	sendBufferSize int
+	slowConsumer   slowConsumerPolicy
+
+	// Deadlines and limits of the connections
+	conn        connSettings
+	connLimiter *connLimiter
+
+	// Backbone carrying room and user frames between nodes; every frame
+	// goes through it, even when the recipients are connected to this node
+	broker broker.Broker
+
+	// Per-room locks (uint -> *sync.Mutex) serializing delivery of a room's
+	// events with the replay of new subscribers
+	roomLocks sync.Map
+
+	// Next sequence number to deliver per room with local subscribers
+	// (uint -> uint64), read and written under the room lock. A room has
+	// an entry only while it has local clients.
+	nextSeqs sync.Map
+
+	// Clients with running pumps, closed on shutdown; none are admitted
+	// once closing is set
+	clientsMu sync.Mutex
+	clients   map[*Client]struct{}
+	closing   bool
+	pumps     sync.WaitGroup
 }
 
 type Client struct {
-	hub             *Hub
-	conn            *websocket.Conn
-	send            chan []byte
+	id   uint64
+	hub  *Hub
+	conn *websocket.Conn
+	ip   string
+	// Clients streamed over plain HTTP have a sink instead of a conn. Long
+	// polls come and go between requests, so they don't count for presence.
+	sink            frameSink
+	polling         bool
+	codec           frameCodec
+	send            chan *wireFrame
 	userID          uint
 	username        string
-	chatRoomID      uint
+	chatRoomID      uint // room from the connection URL, 0 on multiplexed connections
 	isAuthenticated bool
+
+	// mu guards writes to subscriptions, which only the read pump makes (so
+	// it reads them without locking), and seqs
+	mu sync.Mutex
+
+	// Rooms subscribed through this connection
+	subscriptions map[uint]bool
+
+	// Latest sequence number delivered per subscribed room, so nothing
+	// replayed is delivered again
+	seqs map[uint]uint64
+
+	// What was held back while the send buffer was full, written once the
+	// client catches up, guarded by mu
+	congestedSince   time.Time
+	missedRooms      map[uint]uint64 // room -> seq live delivery resumes after
+	missedUserFrames bool
+	pendingPresence  map[uint64]*wireFrame
+	wake             chan struct{}
+
+	stats clientStats
+
+	// Closed to stop the write pump; closeMessage and drain are set before
+	quit         chan struct{}
+	closeOnce    sync.Once
+	closeMessage []byte
+	drain        bool
+
+	// Close frame requested by the read pump when it drops the connection
+	// because of a protocol error
+	closeCode   int
+	closeReason string
 }
 
-func NewHub(messageService service.MessageService) *Hub {
-	return &Hub{
-		broadcast:      make(chan []byte),
-		register:       make(chan *Client),
-		unregister:     make(chan *Client),
-		clients:        make(map[*Client]bool),
-		chatRooms:      make(map[uint]map[*Client]bool),
-		messageService: messageService,
+func NewHub(messageService service.MessageService, presenceService service.PresenceService, notificationService service.NotificationService, roomEventService service.RoomEventService, chatRoomService service.ChatRoomService, ticketService service.WSTicketService, eventBroker broker.Broker) *Hub {
+	sendBufferSize := defaultSendBufferSize
+	replayLimit := defaultReplayLimit
+	maxConnectionsPerIP := 0
+	if config.GlobalConfig != nil {
+		maxConnectionsPerIP = config.GlobalConfig.WebSocket.MaxConnectionsPerIP
+		if config.GlobalConfig.WebSocket.SendBufferSize > 0 {
+			sendBufferSize = config.GlobalConfig.WebSocket.SendBufferSize
+		}
+		if config.GlobalConfig.WebSocket.ReplayLimit > 0 {
+			replayLimit = config.GlobalConfig.WebSocket.ReplayLimit
+		}
+	}
+	// Replayed events are queued at once, leaving the rest of the send
+	// buffer for live events
+	if replayLimit > sendBufferSize/2 {
+		replayLimit = sendBufferSize / 2
 	}
+
+	hub := &Hub{
+		shards:           newHubShards(),
+		messageService:   messageService,
+		presenceService:  presenceService,
+		chatRoomService:  chatRoomService,
+		ticketService:    ticketService,
+		roomEventService: roomEventService,
+		replayLimit:      replayLimit,
+		sendBufferSize:   sendBufferSize,
+		slowConsumer:     newSlowConsumerPolicy(),
+		conn:             newConnSettings(),
+		connLimiter:      newConnLimiter(maxConnectionsPerIP),
+		broker:           eventBroker,
+		clients:          make(map[*Client]struct{}),
+	}
+	hub.ephemeral = newEphemeralRelay(hub)
+	eventBroker.Subscribe(hub.deliver)
+	presenceService.OnChange(hub.broadcastPresence)
+	notificationService.OnNotify(hub.sendNotification)
+	return hub
 }
 
-func (h *Hub) Run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.clients[client] = true
+// BroadcastToRoom sends a frame to everyone in a chat room, on every node
+func (h *Hub) BroadcastToRoom(chatRoomID uint, message []byte) {
+	h.publishDelivery(roomTopic(chatRoomID), delivery{class: classEvent, frame: newWireFrame(message)})
+}
 
-			// Add client to specific chat room
-			if h.chatRooms[client.chatRoomID] == nil {
-				h.chatRooms[client.chatRoomID] = make(map[*Client]bool)
-			}
-			h.chatRooms[client.chatRoomID][client] = true
+// roomLock returns the lock serializing delivery of a room's events
+func (h *Hub) roomLock(chatRoomID uint) *sync.Mutex {
+	lock, _ := h.roomLocks.LoadOrStore(chatRoomID, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
 
-			log.Printf("Client %s joined chat room %d", client.username, client.chatRoomID)
+// publish appends a room event to the replay log and broadcasts it with its
+// sequence number. Nodes may receive events of a room out of order when
+// several nodes publish at once; deliverRoom puts them back in order.
+func (h *Hub) publish(chatRoomID uint, eventType string, data interface{}) {
+	event, err := h.roomEventService.Append(chatRoomID, eventType, data)
+	if err != nil {
+		// Live clients still get the event; only resuming ones will miss it
+		log.Printf("Failed to append %s event to chat room %d: %v", eventType, chatRoomID, err)
+		h.publishDelivery(roomTopic(chatRoomID), delivery{class: classEvent, frame: encodeEvent(eventType, data)})
+		return
+	}
+	h.publishDelivery(roomTopic(chatRoomID), delivery{class: classEvent, seq: event.Seq, frame: encodeRoomEvent(event)})
+}
 
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				delete(h.chatRooms[client.chatRoomID], client)
-				close(client.send)
-				log.Printf("Client %s left chat room %d", client.username, client.chatRoomID)
-			}
+// BroadcastMessage sends a message created outside the WebSocket (e.g. via
+// REST) to everyone in its chat room
+func (h *Hub) BroadcastMessage(message *models.Message) {
+	h.publish(message.ChatRoomID, models.EventMessage, models.NewMessageEvent(message))
+}
 
-		case message := <-h.broadcast:
-			// Broadcast to all clients (this could be modified to be room-specific)
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
-			}
+// BroadcastMessageDeleted tells a chat room that a message is gone
+func (h *Hub) BroadcastMessageDeleted(chatRoomID, messageID uint) {
+	event := models.MessageDeletedEvent{MessageID: messageID, ChatRoomID: chatRoomID}
+	h.publish(chatRoomID, models.EventMessageDeleted, event)
+}
+
+// BroadcastPinned tells a chat room that a message was pinned
+func (h *Hub) BroadcastPinned(pin *models.PinnedMessage) {
+	event := models.PinEvent{
+		MessageID:  pin.MessageID,
+		ChatRoomID: pin.ChatRoomID,
+		UserID:     pin.PinnedBy,
+		Username:   pin.PinnedByUser.Username,
+		Pin:        pin,
+	}
+	h.publish(pin.ChatRoomID, models.EventMessagePinned, event)
+}
+
+// BroadcastUnpinned tells a chat room that a message was unpinned
+func (h *Hub) BroadcastUnpinned(chatRoomID, messageID, userID uint, username string) {
+	event := models.PinEvent{
+		MessageID:  messageID,
+		ChatRoomID: chatRoomID,
+		UserID:     userID,
+		Username:   username,
+	}
+	h.publish(chatRoomID, models.EventMessageUnpinned, event)
+}
+
+// RefreshMessages re-sends messages whose attachments changed, or announces
+// their deletion if they no longer exist
+func (h *Hub) RefreshMessages(chatRoomID uint, messageIDs []uint) {
+	for _, messageID := range messageIDs {
+		message, err := h.messageService.GetMessage(messageID)
+		if err != nil {
+			h.BroadcastMessageDeleted(chatRoomID, messageID)
+			continue
 		}
+		h.publish(chatRoomID, models.EventMessageUpdated, models.NewMessageEvent(message))
 	}
 }
 
-func (h *Hub) BroadcastToRoom(chatRoomID uint, message []byte) {
-	if clients, ok := h.chatRooms[chatRoomID]; ok {
-		for client := range clients {
-			select {
-			case client.send <- message:
-			default:
-				close(client.send)
-				delete(h.clients, client)
-				delete(h.chatRooms[chatRoomID], client)
-			}
+// SendToUser sends a message to every connection of a user, in any room and
+// on any node
+func (h *Hub) SendToUser(userID uint, message []byte) {
+	h.publishDelivery(userTopic(userID), delivery{class: classUser, frame: newWireFrame(message)})
+}
+
+// sendNotification pushes a new notification to the recipient's connections
+func (h *Hub) sendNotification(notification models.Notification) {
+	h.publishDelivery(userTopic(notification.UserID), delivery{class: classUser, frame: encodeEvent(models.EventNotification, notification)})
+}
+
+// broadcastPresence pushes a presence change to every room the user is in.
+// Each node covers the rooms its own clients of the user are in, so a room
+// may get the same presence from several nodes, which is harmless.
+//
+// It is called from presence sweeps and REST handlers as well as client
+// pumps, so it only reads the user's clients from a snapshot taken under the
+// shard lock and their subscriptions under each client's lock.
+func (h *Hub) broadcastPresence(presence models.Presence) {
+	chatRoomIDs := make(map[uint]bool)
+	for _, client := range h.userClients(presence.UserID) {
+		client.mu.Lock()
+		for chatRoomID := range client.subscriptions {
+			chatRoomIDs[chatRoomID] = true
 		}
+		client.mu.Unlock()
+	}
+
+	for chatRoomID := range chatRoomIDs {
+		h.publishPresence(chatRoomID, presence)
 	}
 }
 
-func (c *Client) readPump() {
+// publishPresence sends the presence of a user to a room. A client that
+// falls behind only gets the latest presence of each user.
+func (h *Hub) publishPresence(chatRoomID uint, presence models.Presence) {
+	event := models.PresenceEvent{ChatRoomID: chatRoomID, Presence: presence}
+	h.publishDelivery(roomTopic(chatRoomID), delivery{
+		class: classPresence,
+		key:   presenceKey(chatRoomID, presence.UserID),
+		frame: encodeEvent(models.EventPresence, event),
+	})
+}
+
+// readPump handles the frames of the client. A client that authenticated
+// at the handshake is registered right away; any other has
+// WebSocketConfig.AuthTimeout to send its "auth" frame.
+func (c *Client) readPump(auth *handshakeAuth) {
 	defer func() {
-		c.hub.unregister <- c
-		c.conn.Close()
+		if c.isAuthenticated {
+			c.hub.unregister(c)
+		}
+		c.close(c.closeCode, c.closeReason, true)
+		c.hub.untrack(c)
 	}()
 
-	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	if auth != nil && !c.authenticate("", auth.userID, auth.username, auth.resumeFrom, c.announceAuth) {
+		return
+	}
+
+	settings := c.hub.conn
+	c.conn.SetReadLimit(settings.maxFrameSize)
+	if c.isAuthenticated {
+		c.conn.SetReadDeadline(time.Now().Add(settings.readDeadline))
+	} else {
+		c.conn.SetReadDeadline(time.Now().Add(settings.authTimeout))
+	}
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		// Answering pings doesn't buy time to authenticate
+		if c.isAuthenticated {
+			c.conn.SetReadDeadline(time.Now().Add(settings.readDeadline))
+		}
 		return nil
 	})
 
 	for {
-		var wsMsg models.WSMessage
-		err := c.conn.ReadJSON(&wsMsg)
+		var envelope models.ClientEnvelope
+		err := c.readEnvelope(&envelope)
 		if err != nil {
+			if isDecodeError(err) {
+				c.sendError("", models.ErrCodeBadRequest, "Malformed frame")
+				continue
+			}
+			if errors.Is(err, websocket.ErrReadLimit) {
+				log.Printf("Closing connection of %s: frame larger than %d bytes", c.username, settings.maxFrameSize)
+				c.closeCode = websocket.CloseMessageTooBig
+				c.closeReason = "Frame too large"
+				break
+			}
+			if !c.isAuthenticated && isTimeout(err) {
+				c.closeCode = CloseUnauthorized
+				c.closeReason = "Authentication timeout"
+				break
+			}
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
 			}
 			break
 		}
 
-		// 添加调试日志
-		log.Printf("收到WebSocket消息: Type=%s, Content=%s, ChatRoomID=%d", wsMsg.Type, wsMsg.Content, wsMsg.ChatRoomID)
+		if envelope.V != models.WSProtocolVersion {
+			c.fail(envelope.ID, models.ErrCodeUnsupportedVersion, "Unsupported protocol version", CloseUnsupportedVersion)
+			return
+		}
 
 		// Handle authentication message
-		if wsMsg.Type == "auth" {
-			if err := c.handleAuthMessage(wsMsg); err != nil {
-				log.Printf("Authentication failed for client: %v", err)
-				c.conn.Close()
+		if envelope.Op == models.OpAuth {
+			if c.isAuthenticated {
+				c.sendError(envelope.ID, models.ErrCodeBadRequest, "Already authenticated")
+				continue
+			}
+			if !c.handleAuth(envelope) {
 				return
 			}
-			continue // Don't broadcast or save auth messages
+			c.conn.SetReadDeadline(time.Now().Add(settings.readDeadline))
+			continue
 		}
 
 		// Check if client is authenticated for non-auth messages
 		if !c.isAuthenticated {
-			log.Printf("Unauthenticated client tried to send message")
-			c.conn.Close()
+			c.fail(envelope.ID, models.ErrCodeUnauthorized, "Authentication required", CloseUnauthorized)
 			return
 		}
 
-		// Use chatRoomID from the WebSocket message if provided, otherwise use the one from client context
-		chatRoomID := c.chatRoomID
-		if wsMsg.ChatRoomID != 0 {
-			chatRoomID = wsMsg.ChatRoomID
-		}
-
-		// Save message to database using service layer
-		message, err := c.hub.messageService.CreateMessage(wsMsg.Content, c.userID, chatRoomID)
-		if err != nil {
-			log.Printf("Failed to save message: %v", err)
-			continue
-		}
-
-		// Set message type - default to "message" if not specified in WSMessage
-		messageType := "message"
-		if wsMsg.Type != "" {
-			messageType = wsMsg.Type
-		}
-
-		// Update message type in database
-		message.Type = messageType
-		// We're not updating the database here as it would require a new method
-		// For now, we'll just use the type in the WebSocket response
-
-		// Create response message
-		responseMsg := models.WSMessage{
-			Type:       messageType,
-			Content:    message.Content,
-			UserID:     message.UserID,
-			Username:   message.User.Username,
-			ChatRoomID: message.ChatRoomID,
-			Timestamp:  message.CreatedAt,
+		switch envelope.Op {
+		case models.OpHeartbeat:
+			c.handleHeartbeat(envelope)
+		case models.OpSend:
+			c.handleSend(envelope)
+		case models.OpSubscribe:
+			c.handleSubscribe(envelope)
+		case models.OpUnsubscribe:
+			c.handleUnsubscribe(envelope)
+		default:
+			c.sendError(envelope.ID, models.ErrCodeBadRequest, "Unknown op")
 		}
+	}
+}
 
-		// Broadcast to all clients in the same chat room
-		if msgBytes, err := json.Marshal(responseMsg); err == nil {
-			c.hub.BroadcastToRoom(c.chatRoomID, msgBytes)
-		}
+// readEnvelope reads the next frame from the client in the codec of the
+// connection. The read limit of the connection only bounds the bytes on the
+// wire, so the size of a compressed frame is checked again once inflated.
+func (c *Client) readEnvelope(envelope *models.ClientEnvelope) error {
+	_, reader, err := c.conn.NextReader()
+	if err != nil {
+		return err
+	}
+	limit := c.hub.conn.maxFrameSize
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > limit {
+		return websocket.ErrReadLimit
 	}
+	frame, err := c.codec.decode(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(frame, envelope)
 }
 
-// handleAuthMessage processes authentication messages from WebSocket clients
-func (c *Client) handleAuthMessage(wsMsg models.WSMessage) error {
+// handleAuth validates the token of an "auth" frame and registers the client.
+// Connections bound to a room by their URL are then subscribed to it. It
+// returns false if the connection must be closed.
+func (c *Client) handleAuth(envelope models.ClientEnvelope) bool {
+	var request models.AuthRequest
+	if err := json.Unmarshal(envelope.Data, &request); err != nil {
+		c.fail(envelope.ID, models.ErrCodeUnauthorized, "Authentication failed", CloseUnauthorized)
+		return false
+	}
+
 	// Validate the token
-	claims, err := utils.ValidateToken(wsMsg.Token)
+	claims, err := utils.ValidateToken(request.Token)
 	if err != nil {
-		return err
+		log.Printf("Authentication failed for client: %v", err)
+		c.fail(envelope.ID, models.ErrCodeUnauthorized, "Authentication failed", CloseUnauthorized)
+		return false
 	}
 
+	return c.authenticate(envelope.ID, claims.UserID, claims.Username, request.ResumeFrom, func(ack models.AuthAck) {
+		c.ack(envelope.ID, "", ack)
+	})
+}
+
+// authenticate registers the client as a user. Connections bound to a room
+// by their URL then join it, resuming from resumeFrom; errors answer
+// requestID. reply sends the AuthAck once the client is set up. It returns
+// false if the connection must be closed.
+func (c *Client) authenticate(requestID string, userID uint, username string, resumeFrom *uint64, reply func(models.AuthAck)) bool {
 	// Set client authentication details
-	c.userID = claims.UserID
-	c.username = claims.Username
-	// c.chatRoomID = wsMsg.ChatRoomID
+	c.userID = userID
+	c.username = username
 	c.isAuthenticated = true
 
 	log.Printf("Client authenticated: user_id=%d, username=%s, chatroom_id=%d",
 		c.userID, c.username, c.chatRoomID)
 
 	// Register the client with the hub after successful authentication
-	c.hub.register <- c
+	c.hub.register(c)
 
-	// Send authentication success response
-	response := models.WSMessage{
-		Type:      "auth_success",
-		Content:   "Authentication successful",
-		Timestamp: time.Now(),
+	ack := models.AuthAck{UserID: c.userID, Username: c.username}
+	if c.chatRoomID == 0 {
+		reply(ack)
+		return true
 	}
 
-	if msgBytes, err := json.Marshal(response); err == nil {
-		select {
-		case c.send <- msgBytes:
-		default:
-			close(c.send)
+	ack.ChatRoomID = c.chatRoomID
+	joined := c.join(requestID, c.chatRoomID, resumeFrom, func(lastSeq uint64) {
+		ack.Seq = lastSeq
+		reply(ack)
+	})
+	if !joined {
+		// The connection exists only for this room
+		c.closeCode = CloseForbidden
+		c.closeReason = "Cannot join chat room"
+		return false
+	}
+	return true
+}
+
+// announceAuth tells a client authenticated at the handshake who it is, in
+// place of the ack to an "auth" frame
+func (c *Client) announceAuth(ack models.AuthAck) {
+	c.queue(encodeEvent(models.EventAuthenticated, ack))
+}
+
+// handleHeartbeat feeds idle detection; state "idle" means the tab is hidden
+func (c *Client) handleHeartbeat(envelope models.ClientEnvelope) {
+	var request models.HeartbeatRequest
+	if len(envelope.Data) > 0 {
+		if err := json.Unmarshal(envelope.Data, &request); err != nil {
+			c.sendError(envelope.ID, models.ErrCodeBadRequest, "Invalid heartbeat data")
+			return
 		}
 	}
+	c.hub.presenceService.Heartbeat(c.userID, c.id, request.State != "idle")
+	if envelope.ID != "" {
+		c.ack(envelope.ID, "", nil)
+	}
+}
 
-	return nil
+// handleSend persists a chat message or relays an ephemeral event
+func (c *Client) handleSend(envelope models.ClientEnvelope) {
+	eventType := envelope.Type
+	if eventType == "" {
+		eventType = models.EventMessage
+	}
+
+	var request models.SendRequest
+	if len(envelope.Data) > 0 {
+		if err := json.Unmarshal(envelope.Data, &request); err != nil {
+			c.sendError(envelope.ID, models.ErrCodeBadRequest, "Invalid send data")
+			return
+		}
+	}
+
+	if eventType != models.EventMessage && !models.IsEphemeralEvent(eventType) {
+		c.sendError(envelope.ID, models.ErrCodeBadRequest, "Unknown event type")
+		return
+	}
+
+	// Use chatRoomID from the frame if provided, otherwise the room from the connection URL
+	chatRoomID := request.ChatRoomID
+	if chatRoomID == 0 {
+		chatRoomID = c.chatRoomID
+	}
+	if chatRoomID == 0 {
+		c.sendError(envelope.ID, models.ErrCodeBadRequest, "chat_room_id is required")
+		return
+	}
+	if !c.subscriptions[chatRoomID] {
+		c.sendError(envelope.ID, models.ErrCodeForbidden, "Not subscribed to chat room")
+		return
+	}
+
+	// Ephemeral events are relayed to the room but never saved
+	if models.IsEphemeralEvent(eventType) {
+		c.hub.ephemeral.Handle(c, chatRoomID, eventType)
+		if envelope.ID != "" {
+			c.ack(envelope.ID, eventType, nil)
+		}
+		return
+	}
+
+	// Sending a message counts as activity for idle detection
+	c.hub.presenceService.Heartbeat(c.userID, c.id, true)
+
+	// Save message to database using service layer
+	message, created, err := c.hub.messageService.CreateMessage(request.Content, c.userID, chatRoomID, request.ClientNonce)
+	if err != nil {
+		c.sendError(envelope.ID, serviceErrorCode(err), err.Error())
+		return
+	}
+
+	c.ack(envelope.ID, eventType, models.SendAck{
+		MessageID:  message.ID,
+		ChatRoomID: message.ChatRoomID,
+		CreatedAt:  message.CreatedAt,
+		Duplicate:  !created,
+	})
+
+	if !created {
+		// The room already has it; only the resending client may have missed the echo
+		c.queue(encodeEvent(models.EventMessage, models.NewMessageEvent(message)))
+		return
+	}
+
+	// Broadcast to all clients in the message's chat room
+	c.hub.BroadcastMessage(message)
 }
 
 func (c *Client) writePump() {
-	ticker := time.NewTicker(54 * time.Second)
+	settings := c.hub.conn
+	ticker := time.NewTicker(settings.pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.connLimiter.release(c.ip)
+		c.hub.untrack(c)
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		case message := <-c.send:
+			if err := c.write(message); err != nil {
+				return
+			}
+			// Caught up: write what was held back meanwhile
+			if len(c.send) == 0 && c.flushPending() != nil {
 				return
 			}
 
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		case <-c.wake:
+			if len(c.send) == 0 && c.flushPending() != nil {
 				return
 			}
 
+		case <-c.quit:
+			closeWait := settings.writeDeadline
+			if c.drain {
+				if c.flush() != nil {
+					return
+				}
+			} else {
+				// The client is not reading; don't wait long on it
+				closeWait = time.Second
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(closeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage)
+			return
+
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			c.conn.SetWriteDeadline(time.Now().Add(settings.writeDeadline))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -272,41 +670,147 @@ func (c *Client) writePump() {
 	}
 }
 
+// write writes one frame to the connection in its codec, compressed if it is
+// large enough and the client negotiated compression
+func (c *Client) write(frame *wireFrame) error {
+	message, err := frame.encoded(c.codec)
+	if err != nil {
+		// The frame is lost, not the connection
+		return nil
+	}
+
+	if c.sink != nil {
+		if err := c.sink.writeFrame(message); err != nil {
+			return err
+		}
+		c.stats.written.Add(1)
+		return nil
+	}
+
+	c.conn.EnableWriteCompression(len(message) >= c.hub.conn.compressionThreshold)
+	c.conn.SetWriteDeadline(time.Now().Add(c.hub.conn.writeDeadline))
+	if err := c.conn.WriteMessage(c.codec.messageType(), message); err != nil {
+		return err
+	}
+	c.stats.written.Add(1)
+	return nil
+}
+
+// flush writes the frames still queued
+func (c *Client) flush() error {
+	for {
+		select {
+		case message := <-c.send:
+			if err := c.write(message); err != nil {
+				return err
+			}
+		default:
+			return c.flushPending()
+		}
+	}
+}
+
 // GlobalHub will be initialized in main.go with proper dependencies
 var GlobalHub *Hub
 
 // InitializeHub initializes the global hub with message service
-func InitializeHub(messageService service.MessageService) {
-	GlobalHub = NewHub(messageService)
+func InitializeHub(messageService service.MessageService, presenceService service.PresenceService, notificationService service.NotificationService, roomEventService service.RoomEventService, chatRoomService service.ChatRoomService, ticketService service.WSTicketService, eventBroker broker.Broker) {
+	GlobalHub = NewHub(messageService, presenceService, notificationService, roomEventService, chatRoomService, ticketService, eventBroker)
 }
 
+// HandleWebSocket serves a connection bound to the chat room in the URL
 func HandleWebSocket(c *gin.Context) {
+	GlobalHub.HandleWebSocket(c)
+}
+
+// HandleUserWebSocket serves a per-user connection that subscribes to any
+// number of chat rooms
+func HandleUserWebSocket(c *gin.Context) {
+	GlobalHub.HandleUserWebSocket(c)
+}
+
+// HandleWebSocket serves a connection bound to the chat room in the URL
+func (h *Hub) HandleWebSocket(c *gin.Context) {
 	chatRoomIDStr := c.Param("chatroom_id")
 	chatRoomID, err := strconv.ParseUint(chatRoomIDStr, 10, 32)
-	if err != nil {
+	if err != nil || chatRoomID == 0 {
 		utils.BadRequestResponse(c, "Invalid chat room ID")
 		return
 	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	h.serveWebSocket(c, uint(chatRoomID))
+}
+
+// HandleUserWebSocket serves a per-user connection that subscribes to any
+// number of chat rooms
+func (h *Hub) HandleUserWebSocket(c *gin.Context) {
+	h.serveWebSocket(c, 0)
+}
+
+func (h *Hub) serveWebSocket(c *gin.Context, chatRoomID uint) {
+	if h.isClosing() {
+		utils.ServiceUnavailableResponse(c, "Server is shutting down")
+		return
+	}
+
+	// Refuse cross-site handshakes before a ticket is spent on them
+	if !checkOrigin(c.Request) {
+		utils.ForbiddenResponse(c, "Origin not allowed")
+		return
+	}
+
+	ip := c.ClientIP()
+	if !h.connLimiter.acquire(ip) {
+		utils.TooManyRequestsResponse(c, "Too many connections")
+		return
+	}
+
+	auth, err := h.authenticateHandshake(c.Request)
+	if err != nil {
+		h.connLimiter.release(ip)
+		utils.UnauthorizedResponse(c, err.Error())
+		return
+	}
+
+	codec, responseHeader := selectCodec(c.Request)
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
 	if err != nil {
+		h.connLimiter.release(ip)
 		log.Println(err)
 		return
 	}
+	conn.SetCompressionLevel(h.conn.compressionLevel)
 
 	client := &Client{
-		hub:             GlobalHub,
+		id:              h.nextClientID.Add(1),
+		hub:             h,
 		conn:            conn,
-		send:            make(chan []byte, 256),
+		ip:              ip,
+		codec:           codec,
+		send:            make(chan *wireFrame, h.sendBufferSize),
 		userID:          0,  // Will be set during authentication
 		username:        "", // Will be set during authentication
-		chatRoomID:      uint(chatRoomID),
+		chatRoomID:      chatRoomID,
 		isAuthenticated: false,
+		subscriptions:   make(map[uint]bool),
+		seqs:            make(map[uint]uint64),
+		missedRooms:     make(map[uint]uint64),
+		pendingPresence: make(map[uint64]*wireFrame),
+		wake:            make(chan struct{}, 1),
+		quit:            make(chan struct{}),
+	}
+
+	// Shutdown may have begun during the upgrade
+	if !h.track(client, 2) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, shutdownCloseReason), time.Now().Add(time.Second))
+		conn.Close()
+		h.connLimiter.release(ip)
+		return
 	}
 
-	// Note: We don't register the client immediately anymore
-	// Registration will happen after successful authentication
+	// Registration happens once the client is authenticated, which the read
+	// pump does first if the handshake already was
 
 	go client.writePump()
-	go client.readPump()
+	go client.readPump(auth)
 }
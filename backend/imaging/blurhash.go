@@ -0,0 +1,121 @@
+package imaging
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// base83 is the alphabet of BlurHash strings
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Blurhash encodes the displayed image as a BlurHash (https://blurha.sh): a
+// short string clients decode into a blurred placeholder. xComponents and
+// yComponents (1-9) set how much detail it keeps; the image should already be
+// small, as every pixel is visited once per component.
+func (m *Image) Blurhash(xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", errors.New("blurhash components must be between 1 and 9")
+	}
+	pixels := m.Oriented()
+	bounds := pixels.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Linear RGB of every pixel, transparent ones blended over white
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, a := pixels.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			white := float64(0xffff - a)
+			linear[y*width+x] = [3]float64{
+				srgbToLinear((float64(r) + white) / 0xffff),
+				srgbToLinear((float64(g) + white) / 0xffff),
+				srgbToLinear((float64(b) + white) / 0xffff),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := normalisation * basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					pixel := linear[y*width+x]
+					factor[0] += basis * pixel[0]
+					factor[1] += basis * pixel[1]
+					factor[2] += basis * pixel[2]
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	encode83(&hash, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximum := 1.0
+	if len(ac) > 0 {
+		actual := 0.0
+		for _, factor := range ac {
+			actual = math.Max(actual, math.Max(math.Abs(factor[0]), math.Max(math.Abs(factor[1]), math.Abs(factor[2]))))
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		encode83(&hash, quantised, 1)
+	} else {
+		encode83(&hash, 0, 1)
+	}
+
+	encode83(&hash, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, factor := range ac {
+		quantise := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		encode83(&hash, quantise(factor[0])*19*19+quantise(factor[1])*19+quantise(factor[2]), 2)
+	}
+	return hash.String(), nil
+}
+
+// BlurhashComponents returns the components for an image of the given size:
+// four along the longer side and three along the shorter one
+func BlurhashComponents(width, height int) (int, int) {
+	if width >= height {
+		return 4, 3
+	}
+	return 3, 4
+}
+
+func encode83(hash *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		digit := value / int(math.Pow(83, float64(i))) % 83
+		hash.WriteByte(base83[digit])
+	}
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,132 @@
+// Package imaging decodes uploaded images and renders the smaller variants
+// and placeholders shown before the original is downloaded. Everything is
+// pure Go: JPEG, PNG and GIF come from the standard library, WebP, BMP and
+// TIFF from golang.org/x/image.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	// Formats Decode accepts
+	_ "image/gif"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+
+	"golang.org/x/image/draw"
+)
+
+// JPEGQuality is the quality opaque variants are encoded with
+const JPEGQuality = 82
+
+// ErrTooManyPixels is returned for images larger than Decode accepts, which
+// would take too much memory to decode
+var ErrTooManyPixels = errors.New("image has too many pixels")
+
+// Image is a decoded image with the orientation its metadata asks for. The
+// pixels are kept as stored; Oriented applies the orientation, which is
+// cheaper done after scaling down.
+type Image struct {
+	Pixels      image.Image
+	Format      string
+	Orientation int
+}
+
+// Width returns the displayed width
+func (m *Image) Width() int {
+	if m.Orientation >= 5 {
+		return m.Pixels.Bounds().Dy()
+	}
+	return m.Pixels.Bounds().Dx()
+}
+
+// Height returns the displayed height
+func (m *Image) Height() int {
+	if m.Orientation >= 5 {
+		return m.Pixels.Bounds().Dx()
+	}
+	return m.Pixels.Bounds().Dy()
+}
+
+// Decode decodes an image of a known format, refusing images of more than
+// maxPixels pixels before decoding them
+func Decode(data []byte, maxPixels int) (*Image, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, errors.New("image has no pixels")
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, ErrTooManyPixels
+	}
+
+	pixels, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	return &Image{Pixels: pixels, Format: format, Orientation: orientation}, nil
+}
+
+// Fit scales the image down to fit in a size×size box, keeping its aspect
+// ratio. Images that already fit are returned as they are.
+func (m *Image) Fit(size int) *Image {
+	bounds := m.Pixels.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return m
+	}
+	if width >= height {
+		height = max(1, height*size/width)
+		width = size
+	} else {
+		width = max(1, width*size/height)
+		height = size
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), m.Pixels, bounds, draw.Src, nil)
+	return &Image{Pixels: scaled, Format: m.Format, Orientation: m.Orientation}
+}
+
+// Oriented returns the pixels as they should be displayed
+func (m *Image) Oriented() image.Image {
+	return orient(m.Pixels, m.Orientation)
+}
+
+// Encode writes the displayed image as JPEG, or as PNG when it has
+// transparency, and returns its content type
+func (m *Image) Encode(w io.Writer) (string, error) {
+	pixels := m.Oriented()
+	if opaque(pixels) {
+		return "image/jpeg", jpeg.Encode(w, pixels, &jpeg.Options{Quality: JPEGQuality})
+	}
+	return "image/png", png.Encode(w, pixels)
+}
+
+// opaque reports whether every pixel of the image is fully opaque
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"image"
+)
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when it
+// has none. Cameras store photos as the sensor saw them and record how to
+// turn them for display.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		// Image data follows; metadata comes before it
+		if marker == 0xda || marker == 0xd9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xe1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of an EXIF
+// (TIFF) block
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		// Orientation is a single SHORT stored in the value field
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+				return value
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient turns and flips the pixels as EXIF orientation asks
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	outWidth, outHeight := width, height
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+	out := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+
+	for y := 0; y < outHeight; y++ {
+		for x := 0; x < outWidth; x++ {
+			// The stored pixel shown at (x, y)
+			var sx, sy int
+			switch orientation {
+			case 2: // flipped horizontally
+				sx, sy = width-1-x, y
+			case 3: // rotated 180°
+				sx, sy = width-1-x, height-1-y
+			case 4: // flipped vertically
+				sx, sy = x, height-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotated 90° clockwise
+				sx, sy = y, height-1-x
+			case 7: // transversed
+				sx, sy = width-1-y, height-1-x
+			case 8: // rotated 90° counterclockwise
+				sx, sy = width-1-y, x
+			}
+			out.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return out
+}
@@ -1,19 +1,27 @@
 package main
 
 import (
+	"chatapp/broker"
+	"chatapp/clamd"
 	"chatapp/config"
 	"chatapp/controllers"
 	"chatapp/handlers"
 	"chatapp/middleware"
 	"chatapp/repository"
 	"chatapp/service"
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 )
 
-func setupRoutes() *gin.Engine {
+func setupRoutes() (*gin.Engine, broker.Broker) {
 	// Set Gin mode based on config
 	if config.GlobalConfig.App.Debug {
 		gin.SetMode(gin.DebugMode)
@@ -28,8 +36,10 @@ func setupRoutes() *gin.Engine {
 		c.Header("Access-Control-Allow-Origin", strings.Join(config.GlobalConfig.CORS.AllowedOrigins, ","))
 		c.Header("Access-Control-Allow-Methods", strings.Join(config.GlobalConfig.CORS.AllowedMethods, ","))
 		c.Header("Access-Control-Allow-Headers", strings.Join(config.GlobalConfig.CORS.AllowedHeaders, ","))
+		c.Header("Access-Control-Expose-Headers", strings.Join(config.GlobalConfig.CORS.ExposedHeaders, ","))
 
-		if c.Request.Method == "OPTIONS" {
+		// Answer preflights here; other OPTIONS requests (tus discovery) reach their route
+		if c.Request.Method == "OPTIONS" && c.GetHeader("Access-Control-Request-Method") != "" {
 			c.AbortWithStatus(204)
 			return
 		}
@@ -37,30 +47,120 @@ func setupRoutes() *gin.Engine {
 		c.Next()
 	})
 
+	// Connect to the pub/sub backbone shared by all replicas
+	nodeID := broker.NodeID(config.GlobalConfig.Broker.NodeID)
+	eventBroker, err := broker.New(broker.Config{
+		Type:          config.GlobalConfig.Broker.Type,
+		Channel:       config.GlobalConfig.Broker.Channel,
+		PostgresDSN:   config.GlobalConfig.GetDatabaseDSN(),
+		RedisAddr:     config.GlobalConfig.Redis.Addr,
+		RedisPassword: config.GlobalConfig.Redis.Password,
+		RedisDB:       config.GlobalConfig.Redis.DB,
+	})
+	if err != nil {
+		log.Fatal("Failed to connect to broker:", err)
+	}
+	log.Printf("Using %s broker as node %s", config.GlobalConfig.Broker.Type, nodeID)
+
 	// Initialize repositories
 	userRepo := repository.NewUserRepository(config.DB)
 	chatRoomRepo := repository.NewChatRoomRepository(config.DB)
-	messageRepo := repository.NewMessageRepository(config.DB)
+	messageRepo := repository.NewMessageRepository(config.DB, config.GlobalConfig.Chat.DedupeWindow)
 	fileRepo := repository.NewFileRepository(config.DB)
+	pendingUploadRepo := repository.NewPendingUploadRepository(config.DB)
+	blobRepo := repository.NewBlobRepository(config.DB)
+	userStatusRepo := repository.NewUserStatusRepository(config.DB)
+	notificationRepo := repository.NewNotificationRepository(config.DB)
+	pinRepo := repository.NewPinRepository(config.DB)
+	roomEventRepo := repository.NewRoomEventRepository(config.DB)
+	ticketRepo := repository.NewWSTicketRepository(config.DB)
+	uploadRepo := repository.NewUploadRepository(config.DB)
+	previewRepo := repository.NewPreviewRepository(config.DB)
+	scanRepo := repository.NewScanRepository(config.DB)
 
 	// Initialize services
 	authService := service.NewAuthService(userRepo)
-	chatRoomService := service.NewChatRoomService(chatRoomRepo, userRepo)
-	messageService := service.NewMessageService(messageRepo, userRepo, chatRoomRepo)
-	fileService := service.NewFileService(fileRepo)
+	chatRoomService := service.NewChatRoomService(chatRoomRepo, userRepo, config.GlobalConfig.Upload.MaxRoomFileSize)
+	presenceService := service.NewPresenceService(userStatusRepo, eventBroker, nodeID,
+		config.GlobalConfig.Presence.IdleTimeout, config.GlobalConfig.Presence.SweepInterval)
+	notificationService := service.NewNotificationService(notificationRepo, userRepo, chatRoomRepo, presenceService)
+	fileService := service.NewFileService(fileRepo, chatRoomRepo, pendingUploadRepo, blobRepo, config.GlobalConfig.Upload.MaxFileSize)
+	messageService := service.NewMessageService(messageRepo, userRepo, chatRoomRepo, notificationService, fileService, config.GlobalConfig.WebSocket.MaxContentLength)
+	pinService := service.NewPinService(pinRepo, messageRepo, chatRoomRepo, config.GlobalConfig.Chat.MaxPinsPerRoom)
+	roomEventService := service.NewRoomEventService(roomEventRepo, config.GlobalConfig.WebSocket.ReplayRetention)
+	ticketService := service.NewWSTicketService(ticketRepo, config.GlobalConfig.WebSocket.TicketTTL)
+	uploadService, err := service.NewUploadService(uploadRepo, fileService, config.GlobalConfig.Upload.StagingDir,
+		config.GlobalConfig.Upload.PartSize, config.GlobalConfig.Upload.Expiry, config.GlobalConfig.Upload.MaxRoomFileSize)
+	if err != nil {
+		log.Fatal("Failed to initialize uploads:", err)
+	}
+
+	// Initialize WebSocket hub with its services (before the controllers, which
+	// broadcast REST changes through it)
+	handlers.InitializeHub(messageService, presenceService, notificationService, roomEventService, chatRoomService, ticketService, eventBroker)
+
+	// Image previews refresh the messages they belong to once generated
+	previewService := service.NewPreviewService(previewRepo, fileService.Storage(), config.GlobalConfig.Upload.PreviewWorkers, handlers.GlobalHub.RefreshMessages)
+
+	// Uploads are quarantined until clamd finds them clean, when configured
+	scanConfig := config.GlobalConfig.Scan
+	var scanner *clamd.Client
+	if scanConfig.Address != "" {
+		scanner = clamd.New(scanConfig.Address, scanConfig.Timeout)
+		if err := scanner.Ping(); err != nil {
+			log.Printf("Malware scanner is not answering yet: %v", err)
+		}
+		log.Printf("Scanning uploads with clamd at %s (%s)", scanConfig.Address, scanConfig.Policy)
+	}
+	scanService := service.NewScanService(scanRepo, fileService.Storage(), scanner, scanConfig.MaxSize, scanConfig.Workers,
+		scanConfig.Policy == "fail_open", notificationService, handlers.GlobalHub.RefreshMessages)
 
 	// Initialize controllers
 	authController := controllers.NewAuthController(authService)
 	chatRoomController := controllers.NewChatRoomController(chatRoomService, messageService)
-	fileController := controllers.NewFileController(fileService)
+	messageController := controllers.NewMessageController(messageService, fileService, pinService, handlers.GlobalHub)
+	fileController := controllers.NewFileController(fileService, messageService, handlers.GlobalHub)
+	uploadController := controllers.NewUploadController(uploadService, config.GlobalConfig.Server.ReadTimeout, config.GlobalConfig.Server.WriteTimeout)
+	presenceController := controllers.NewPresenceController(presenceService)
+	notificationController := controllers.NewNotificationController(notificationService)
+
+	// Start marking idle users as away and expiring status texts
+	go presenceService.Run()
+
+	// Start pruning room events past their replay retention
+	go roomEventService.Run()
+
+	// Start removing WebSocket tickets that expired unused
+	go ticketService.Run()
+
+	// Start removing resumable uploads that were abandoned
+	go uploadService.Run()
+
+	// Start deleting presigned uploads that were never confirmed
+	go fileService.Run()
+
+	// Start generating thumbnails and other sizes of uploaded images
+	go previewService.Run()
 
-	// Initialize WebSocket hub with message service
-	handlers.InitializeHub(messageService)
+	// Start scanning uploads for malware
+	go scanService.Run()
 
 	// Public routes
 	api := r.Group("/api")
 	{
 		api.POST("/login", authController.Login)
+
+		// Resumable upload (tus) discovery
+		api.OPTIONS("/files/uploads", uploadController.Options)
+		api.OPTIONS("/files/uploads/:id", uploadController.Options)
+	}
+
+	// Signed URLs of the local storage backend, authorized by their signature
+	if local := fileService.LocalStorage(); local != nil {
+		storageController := controllers.NewStorageController(local, config.GlobalConfig.Upload.MaxRoomFileSize)
+		api.GET("/storage/local/*path", storageController.ServeObject)
+		api.HEAD("/storage/local/*path", storageController.ServeObject)
+		api.PUT("/storage/local/*path", storageController.PutObject)
 	}
 
 	// Protected routes
@@ -76,6 +176,18 @@ func setupRoutes() *gin.Engine {
 		protected.POST("/chatrooms", chatRoomController.CreateChatRoom)
 		protected.GET("/chatrooms/:id", chatRoomController.GetChatRoom)
 		protected.GET("/chatrooms/:id/messages", chatRoomController.GetChatRoomMessages)
+		protected.POST("/chatrooms/:id/messages", messageController.SendMessage)
+		protected.POST("/chatrooms/:id/messages/attachments", messageController.PostWithAttachments)
+		protected.DELETE("/chatrooms/:id/messages/:message_id", messageController.DeleteMessage)
+		protected.GET("/chatrooms/:id/pins", messageController.GetPinnedMessages)
+		protected.PUT("/chatrooms/:id/messages/:message_id/pin", messageController.PinMessage)
+		protected.DELETE("/chatrooms/:id/messages/:message_id/pin", messageController.UnpinMessage)
+		protected.GET("/chatrooms/:id/moderators", chatRoomController.GetModerators)
+		protected.POST("/chatrooms/:id/moderators", chatRoomController.AddModerator)
+		protected.DELETE("/chatrooms/:id/moderators/:user_id", chatRoomController.RemoveModerator)
+		protected.PUT("/chatrooms/:id/max-file-size", chatRoomController.SetMaxFileSize)
+		protected.GET("/chatrooms/:id/notification-preference", notificationController.GetPreference)
+		protected.PUT("/chatrooms/:id/notification-preference", notificationController.SetPreference)
 
 		// File routes
 		protected.POST("/files/upload", fileController.UploadFile)
@@ -85,12 +197,40 @@ func setupRoutes() *gin.Engine {
 		protected.DELETE("/files/:id", fileController.DeleteFile)
 		protected.GET("/files/:id", fileController.GetFileInfo)
 		protected.GET("/files/upload-url", fileController.GetUploadURL)
+		protected.POST("/files/confirm", fileController.ConfirmUpload)
+
+		// Resumable upload routes (tus protocol)
+		protected.POST("/files/uploads", uploadController.CreateUpload)
+		protected.HEAD("/files/uploads/:id", uploadController.GetUpload)
+		protected.PATCH("/files/uploads/:id", uploadController.AppendUpload)
+		protected.DELETE("/files/uploads/:id", uploadController.DeleteUpload)
+
+		// Presence routes
+		protected.GET("/presence", presenceController.GetPresence)
+		protected.PUT("/presence/status", presenceController.SetStatus)
+		protected.DELETE("/presence/status", presenceController.ClearStatus)
+
+		// Notification routes
+		protected.GET("/notifications", notificationController.GetNotifications)
+		protected.GET("/notifications/unread-count", notificationController.GetUnreadCount)
+		protected.POST("/notifications/read-all", notificationController.MarkAllAsRead)
+		protected.POST("/notifications/:id/read", notificationController.MarkAsRead)
+
+		// WebSocket queue metrics and handshake tickets
+		protected.GET("/ws/stats", handlers.HandleWebSocketStats)
+		protected.POST("/ws/ticket", handlers.HandleWebSocketTicket)
+
+		// Realtime fallbacks for clients that cannot use WebSockets
+		protected.GET("/events", handlers.HandleEventStream)
+		protected.GET("/events/poll", handlers.HandleEventPoll)
 	}
 
-	// WebSocket route (no authentication middleware - auth handled via WebSocket messages)
+	// WebSocket routes (no authentication middleware - auth handled at the handshake or via WebSocket messages)
+	api.GET("/ws", handlers.HandleUserWebSocket)
 	api.GET("/ws/:chatroom_id", handlers.HandleWebSocket)
+	api.GET("/ws/schema", handlers.HandleWebSocketSchema)
 
-	return r
+	return r, eventBroker
 }
 
 func main() {
@@ -109,15 +249,50 @@ func main() {
 	config.MigrateDatabase()
 
 	// Setup routes (this initializes the hub)
-	r := setupRoutes()
+	r, eventBroker := setupRoutes()
 
-	// Start WebSocket hub after initialization
+	// Configure the WebSocket upgrader
 	handlers.InitWebSocketUpgrader()
-	go handlers.GlobalHub.Run()
 
 	// Start server
-	log.Printf("Server starting on %s", cfg.Server.Port)
-	if err := r.Run(cfg.Server.Port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	srv := &http.Server{
+		Addr:         cfg.Server.Port,
+		Handler:      r,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+	}
+	go func() {
+		log.Printf("Server starting on %s", cfg.Server.Port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	// Wait for a deploy or Ctrl+C
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("Shutting down server...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections, then close the WebSockets and streams the
+	// server does not track while in-flight requests drain
+	hubDone := make(chan error, 1)
+	srv.RegisterOnShutdown(func() {
+		hubDone <- handlers.GlobalHub.Shutdown(ctx)
+	})
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Requests still in flight at shutdown: %v", err)
+	}
+	if err := <-hubDone; err != nil {
+		log.Printf("Connections still open at shutdown: %v", err)
+	}
+
+	if err := eventBroker.Close(); err != nil {
+		log.Printf("Failed to close broker: %v", err)
 	}
+	config.CloseDatabase()
+	log.Println("Server stopped")
 }
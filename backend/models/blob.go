@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Blob is stored file content, identified by its SHA-256. Files with the same
+// content point at one blob and share its object; the object is deleted when
+// the last file referencing it goes.
+type Blob struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	SHA256      string    `json:"sha256" gorm:"column:sha256;type:char(64);not null;uniqueIndex"`
+	ObjectPath  string    `json:"object_path" gorm:"not null;size:500"`
+	Size        int64     `json:"size" gorm:"not null"`
+	ContentType string    `json:"content_type" gorm:"size:100"`
+	RefCount    int       `json:"ref_count" gorm:"not null;default:0"` // files pointing at the blob
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
@@ -12,6 +12,7 @@ type ChatRoom struct {
 	Description string         `json:"description"`
 	CreatedBy   uint           `json:"created_by"`
 	Creator     User           `json:"creator" gorm:"foreignKey:CreatedBy"`
+	MaxFileSize int64          `json:"max_file_size"` // bytes; 0 uses the configured default
 	CreatedAt   time.Time      `json:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at"`
 	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
@@ -8,21 +8,30 @@ import (
 
 // File represents a file uploaded to the system
 type File struct {
-	ID           uint      `json:"id" gorm:"primaryKey;autoIncrement"`
-	FileName     string    `json:"file_name" gorm:"not null;size:255"`           // 原始文件名
-	FilePath     string    `json:"file_path" gorm:"not null;size:500"`           // Minio中的对象路径
-	FileSize     int64     `json:"file_size" gorm:"not null"`                    // 文件大小（字节）
-	ContentType  string    `json:"content_type" gorm:"size:100"`                 // MIME类型
-	ChatRoomID   uint      `json:"chat_room_id" gorm:"column:chat_room_id;not null;index"`    // 所属聊天室ID
-	UploaderID   uint      `json:"uploader_id" gorm:"column:uploader_id;not null;index"`      // 上传用户ID
-	UploadedAt   time.Time `json:"uploaded_at" gorm:"autoCreateTime"`            // 上传时间
-	CreatedAt    time.Time `json:"created_at" gorm:"autoCreateTime"`
-	UpdatedAt    time.Time `json:"updated_at" gorm:"autoUpdateTime"`
-	DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
+	ID            uint           `json:"id" gorm:"primaryKey;autoIncrement"`
+	FileName      string         `json:"file_name" gorm:"not null;size:255"`                     // 原始文件名
+	FilePath      string         `json:"file_path" gorm:"not null;size:500"`                     // Minio中的对象路径
+	BlobID        *uint          `json:"-" gorm:"index"`                                         // 文件内容，相同内容的文件共享；回填前的旧文件为空
+	FileSize      int64          `json:"file_size" gorm:"not null"`                              // 文件大小（字节）
+	ContentType   string         `json:"content_type" gorm:"size:100"`                           // MIME类型
+	ChatRoomID    uint           `json:"chat_room_id" gorm:"column:chat_room_id;not null;index"` // 所属聊天室ID
+	UploaderID    uint           `json:"uploader_id" gorm:"column:uploader_id;not null;index"`   // 上传用户ID
+	Width         int            `json:"width,omitempty"`                                        // 图片宽度（像素，按显示方向）
+	Height        int            `json:"height,omitempty"`                                       // 图片高度（像素，按显示方向）
+	Blurhash      string         `json:"blurhash,omitempty" gorm:"size:64"`                      // 图片加载前显示的模糊占位图（BlurHash）
+	PreviewStatus string         `json:"preview_status,omitempty" gorm:"size:16;index"`          // 预览生成状态：pending、ready、failed，非图片为空
+	ScanStatus    string         `json:"scan_status,omitempty" gorm:"size:16;index"`             // 安全扫描状态：pending、clean、infected、error、unscanned，未启用扫描时为空
+	ScanResult    string         `json:"scan_result,omitempty" gorm:"size:255"`                  // 扫描发现的病毒名或扫描失败的原因
+	ScannedAt     *time.Time     `json:"scanned_at,omitempty"`                                   // 扫描完成时间
+	UploadedAt    time.Time      `json:"uploaded_at" gorm:"autoCreateTime"`                      // 上传时间
+	CreatedAt     time.Time      `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt     time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
+	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
 
 	// 关联关系
-	ChatRoom ChatRoom `json:"chatroom,omitempty" gorm:"foreignKey:ChatRoomID"`
-	Uploader User     `json:"uploader,omitempty" gorm:"foreignKey:UploaderID"`
+	ChatRoom ChatRoom      `json:"chatroom,omitempty" gorm:"foreignKey:ChatRoomID"`
+	Uploader User          `json:"uploader,omitempty" gorm:"foreignKey:UploaderID"`
+	Variants []FileVariant `json:"variants,omitempty" gorm:"foreignKey:FileID"` // 图片的缩略图和其他尺寸
 }
 
 // TableName 指定表名
@@ -34,4 +43,4 @@ func (File) TableName() string {
 func (f *File) BeforeCreate(tx *gorm.DB) error {
 	f.UploadedAt = time.Now()
 	return nil
-}
\ No newline at end of file
+}
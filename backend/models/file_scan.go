@@ -0,0 +1,23 @@
+package models
+
+// Scan states of a file. Files uploaded while scanning is off have none.
+const (
+	ScanPending  = "pending"
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	// ScanError is content the scanner refused or could not be reached for,
+	// kept from downloads as scanning fails closed
+	ScanError = "error"
+	// ScanUnscanned is the same, let through as scanning fails open
+	ScanUnscanned = "unscanned"
+)
+
+// Quarantined reports whether the file may not be downloaded: it is still
+// being scanned, was found infected, or could not be scanned
+func (f *File) Quarantined() bool {
+	switch f.ScanStatus {
+	case ScanPending, ScanInfected, ScanError:
+		return true
+	}
+	return false
+}
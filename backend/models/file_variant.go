@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Preview states of a file
+const (
+	PreviewPending = "pending"
+	PreviewReady   = "ready"
+	PreviewFailed  = "failed"
+)
+
+// FileVariant is a smaller rendering of an image file, such as its
+// thumbnail. Files with the same content share the stored variants.
+type FileVariant struct {
+	ID          uint      `json:"-" gorm:"primaryKey"`
+	FileID      uint      `json:"-" gorm:"not null;index"`
+	Name        string    `json:"name" gorm:"size:16;not null"`
+	ObjectPath  string    `json:"-" gorm:"size:500;not null"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type" gorm:"size:100"`
+	URL         string    `json:"url" gorm:"-"`
+	CreatedAt   time.Time `json:"-"`
+}
+
+// VariantURL returns a URL to download a stored variant. It is set once the
+// storage is ready; until then variants are loaded without URLs.
+var VariantURL func(objectPath string) (string, error)
+
+// AfterFind signs the URL of a loaded variant
+func (v *FileVariant) AfterFind(tx *gorm.DB) error {
+	if VariantURL == nil {
+		return nil
+	}
+	url, err := VariantURL(v.ObjectPath)
+	if err != nil {
+		// The file is still usable without its preview
+		return nil
+	}
+	v.URL = url
+	return nil
+}
@@ -7,26 +7,17 @@ import (
 )
 
 type Message struct {
-	ID         uint           `json:"id" gorm:"primaryKey"`
-	Content    string         `json:"content" gorm:"not null;type:text"`
-	UserID     uint           `json:"user_id"`
-	User       User           `json:"user" gorm:"foreignKey:UserID"`
-	ChatRoomID uint           `json:"chat_room_id" gorm:"column:chat_room_id"`
-	ChatRoom   ChatRoom       `json:"chatroom,omitempty" gorm:"foreignKey:ChatRoomID"`
-	Type       string         `json:"type" gorm:"type:varchar(20);default:'message';not null"`
-	CreatedAt  time.Time      `json:"created_at"`
-	UpdatedAt  time.Time      `json:"updated_at"`
-	DeletedAt  gorm.DeletedAt `json:"-" gorm:"index"`
-}
+	ID          uint           `json:"id" gorm:"primaryKey"`
+	Content     string         `json:"content" gorm:"not null;type:text"`
+	UserID      uint           `json:"user_id" gorm:"index:idx_messages_user_nonce,priority:1"`
+	User        User           `json:"user" gorm:"foreignKey:UserID"`
+	ChatRoomID  uint           `json:"chat_room_id" gorm:"column:chat_room_id"`
+	ChatRoom    ChatRoom       `json:"chatroom,omitempty" gorm:"foreignKey:ChatRoomID"`
+	Type        string         `json:"type" gorm:"type:varchar(20);default:'message';not null"`
+	ClientNonce string         `json:"client_nonce,omitempty" gorm:"type:varchar(64);index:idx_messages_user_nonce,priority:2"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
 
-// WebSocket message structure
-type WSMessage struct {
-	Type       string    `json:"type"`
-	Content    string    `json:"content"`
-	UserID     uint      `json:"user_id"`
-	Username   string    `json:"username"`
-	ChatRoomID uint      `json:"chat_room_id"`
-	Timestamp  time.Time `json:"timestamp"`
-	// Authentication fields
-	Token string `json:"token,omitempty"`
+	Attachments []MessageAttachment `json:"attachments,omitempty" gorm:"foreignKey:MessageID"`
 }
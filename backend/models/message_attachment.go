@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+)
+
+// MessageAttachment links an uploaded file to a message. A message can have
+// several attachments, ordered by Position.
+type MessageAttachment struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	MessageID uint      `json:"message_id" gorm:"not null;index"`
+	FileID    uint      `json:"file_id" gorm:"not null;index"`
+	Position  int       `json:"position" gorm:"not null;default:0"`
+	File      *File     `json:"file,omitempty" gorm:"foreignKey:FileID"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AttachmentInfo is the attachment metadata embedded in WebSocket payloads
+type AttachmentInfo struct {
+	FileID      uint   `json:"file_id"`
+	FileName    string `json:"file_name"`
+	FileSize    int64  `json:"file_size"`
+	ContentType string `json:"content_type"`
+	// Set while scanning is on; quarantined files cannot be downloaded
+	ScanStatus string `json:"scan_status,omitempty"`
+
+	// Image previews, once generated
+	Width    int           `json:"width,omitempty"`
+	Height   int           `json:"height,omitempty"`
+	Blurhash string        `json:"blurhash,omitempty"`
+	Variants []FileVariant `json:"variants,omitempty"`
+}
+
+// AttachmentInfos returns the metadata of the message's attachments
+func (m *Message) AttachmentInfos() []AttachmentInfo {
+	infos := make([]AttachmentInfo, 0, len(m.Attachments))
+	for _, attachment := range m.Attachments {
+		if attachment.File == nil {
+			continue
+		}
+		infos = append(infos, AttachmentInfo{
+			FileID:      attachment.File.ID,
+			FileName:    attachment.File.FileName,
+			FileSize:    attachment.File.FileSize,
+			ContentType: attachment.File.ContentType,
+			ScanStatus:  attachment.File.ScanStatus,
+			Width:       attachment.File.Width,
+			Height:      attachment.File.Height,
+			Blurhash:    attachment.File.Blurhash,
+			Variants:    attachment.File.Variants,
+		})
+	}
+	return infos
+}
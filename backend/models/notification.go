@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+)
+
+// Mention kinds
+const (
+	MentionUser = "user" // @username
+	MentionHere = "here" // @here, online room members
+	MentionRoom = "room" // @room, all room members
+)
+
+// Notification types
+const (
+	NotificationTypeMention      = "mention"
+	NotificationTypeMessage      = "message"
+	NotificationTypeFileInfected = "file_infected" // an upload of the user was quarantined
+)
+
+// Per-room notification levels
+const (
+	NotifyAll      = "all"
+	NotifyMentions = "mentions"
+	NotifyMute     = "mute"
+)
+
+// Mention records that a message mentioned a user
+type Mention struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	MessageID uint      `json:"message_id" gorm:"not null;index"`
+	UserID    uint      `json:"user_id" gorm:"not null;index"`
+	Kind      string    `json:"kind" gorm:"type:varchar(10);not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Notification is an entry in a user's notifications inbox. It is about a
+// message, or about a file for notifications of uploads.
+type Notification struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	UserID     uint       `json:"user_id" gorm:"not null;index:idx_notifications_user_read"`
+	Type       string     `json:"type" gorm:"type:varchar(20);not null"`
+	ChatRoomID uint       `json:"chat_room_id" gorm:"column:chat_room_id;not null"`
+	MessageID  *uint      `json:"message_id,omitempty" gorm:"index"`
+	Message    *Message   `json:"message,omitempty" gorm:"foreignKey:MessageID"`
+	FileID     *uint      `json:"file_id,omitempty" gorm:"index"`
+	File       *File      `json:"file,omitempty" gorm:"foreignKey:FileID"`
+	ActorID    uint       `json:"actor_id"`
+	Actor      User       `json:"actor" gorm:"foreignKey:ActorID"`
+	IsRead     bool       `json:"is_read" gorm:"not null;default:false;index:idx_notifications_user_read"`
+	ReadAt     *time.Time `json:"read_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// NotificationPreference is a user's notification level for one chat room
+type NotificationPreference struct {
+	UserID     uint      `json:"user_id" gorm:"primaryKey"`
+	ChatRoomID uint      `json:"chat_room_id" gorm:"column:chat_room_id;primaryKey;index"`
+	Level      string    `json:"level" gorm:"type:varchar(10);not null"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
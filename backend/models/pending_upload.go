@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// PendingUpload is a file being uploaded straight to the storage with a
+// presigned URL. It becomes a File once the uploader confirms the upload;
+// objects never confirmed are deleted when it expires.
+type PendingUpload struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	ObjectPath  string    `json:"object_path" gorm:"not null;uniqueIndex"`
+	FileName    string    `json:"file_name" gorm:"not null"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`     // declared size, 0 when not declared
+	Checksum    string    `json:"checksum"` // declared MD5 (hex), empty when not declared
+	ChatRoomID  uint      `json:"chatroom_id" gorm:"not null;index"`
+	UploaderID  uint      `json:"uploader_id" gorm:"not null;index"`
+	ExpiresAt   time.Time `json:"expires_at" gorm:"not null;index"`
+	CreatedAt   time.Time `json:"created_at"`
+}
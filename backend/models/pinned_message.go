@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// PinnedMessage is a message pinned to the top of its chat room
+type PinnedMessage struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	ChatRoomID   uint      `json:"chat_room_id" gorm:"column:chat_room_id;not null;index"`
+	MessageID    uint      `json:"message_id" gorm:"not null;uniqueIndex"`
+	Message      Message   `json:"message" gorm:"foreignKey:MessageID"`
+	PinnedBy     uint      `json:"pinned_by" gorm:"not null"`
+	PinnedByUser User      `json:"pinned_by_user" gorm:"foreignKey:PinnedBy"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// ChatRoomModerator grants a user moderation rights (such as pinning) in a
+// chat room. The room's creator is always a moderator.
+type ChatRoomModerator struct {
+	ChatRoomID uint      `json:"chat_room_id" gorm:"column:chat_room_id;primaryKey"`
+	UserID     uint      `json:"user_id" gorm:"primaryKey;index"`
+	User       User      `json:"user" gorm:"foreignKey:UserID"`
+	CreatedAt  time.Time `json:"created_at"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+)
+
+// Presence states derived from a user's WebSocket connections
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// UserStatus is a custom status text set by the user, optionally expiring
+type UserStatus struct {
+	UserID    uint       `json:"user_id" gorm:"primaryKey"`
+	Text      string     `json:"text" gorm:"size:140;not null"`
+	ExpiresAt *time.Time `json:"expires_at" gorm:"index"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Presence is the current presence of a user. It is computed, not stored.
+type Presence struct {
+	UserID          uint       `json:"user_id"`
+	Status          string     `json:"status"`
+	StatusText      string     `json:"status_text,omitempty"`
+	StatusExpiresAt *time.Time `json:"status_expires_at,omitempty"`
+	LastSeenAt      *time.Time `json:"last_seen_at,omitempty"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// RoomEvent is a room event kept for replay to clients resuming a WebSocket
+// session. Seq increases by one with every event of a room.
+type RoomEvent struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	ChatRoomID uint      `json:"chat_room_id" gorm:"column:chat_room_id;not null;uniqueIndex:idx_room_events_room_seq,priority:1"`
+	Seq        uint64    `json:"seq" gorm:"not null;uniqueIndex:idx_room_events_room_seq,priority:2"`
+	Type       string    `json:"type" gorm:"type:varchar(30);not null"`
+	Data       string    `json:"data" gorm:"type:text;not null"` // JSON event data
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+}
+
+// RoomSequence holds the last sequence number handed out in a chat room
+type RoomSequence struct {
+	ChatRoomID uint   `gorm:"column:chat_room_id;primaryKey;autoIncrement:false"`
+	LastSeq    uint64 `gorm:"not null"`
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Upload is a resumable upload (tus protocol) in progress. Received bytes are
+// sent to storage in parts as they arrive; the bytes past the last part wait
+// in a staging file named after the ID. Once complete the upload points at
+// the file it created and is kept until it expires, so clients can still
+// query its offset.
+type Upload struct {
+	ID          string    `gorm:"type:varchar(32);primaryKey"`
+	ChatRoomID  uint      `gorm:"not null;index"`
+	UploaderID  uint      `gorm:"not null;index"`
+	FileName    string    `gorm:"not null"`
+	ContentType string    `gorm:"not null"`
+	Length      int64     `gorm:"not null"`
+	Offset      int64     `gorm:"not null;default:0"`
+	ObjectPath  string    `gorm:"not null"`
+	MultipartID string    // multipart upload in the storage, empty until the first part is sent
+	Parts       string    `gorm:"type:text"` // parts sent to the storage, as JSON
+	PartsSize   int64     `gorm:"not null;default:0"`
+	HashState   []byte    // SHA-256 state over the bytes sent in parts
+	FileID      *uint     // file created when the upload completed
+	ExpiresAt   time.Time `gorm:"not null;index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Complete reports whether all bytes of the upload were received
+func (u *Upload) Complete() bool {
+	return u.FileID != nil
+}
@@ -0,0 +1,234 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WSProtocolVersion is the version of the WebSocket envelope protocol. Every
+// frame in either direction carries it in the "v" field.
+const WSProtocolVersion = 1
+
+// WSSubprotocol names the protocol in Sec-WebSocket-Protocol, with frames
+// as JSON text; WSSubprotocolMsgpack carries the same frames as binary
+// MessagePack. The server selects the first of them in the client's order
+// of preference, JSON if it offers neither. A browser client authenticating at the handshake also offers
+// its token as WSTokenSubprotocolPrefix + token, which is never selected.
+const (
+	WSSubprotocol            = "chatapp.v1"
+	WSSubprotocolMsgpack     = "chatapp.v1.msgpack"
+	WSTokenSubprotocolPrefix = "bearer."
+)
+
+// Envelope ops sent by clients
+const (
+	OpAuth        = "auth"
+	OpSend        = "send"
+	OpHeartbeat   = "heartbeat"
+	OpSubscribe   = "subscribe"
+	OpUnsubscribe = "unsubscribe"
+)
+
+// Envelope ops sent by the server
+const (
+	OpEvent = "event"
+	OpAck   = "ack"
+	OpError = "error"
+)
+
+// Event types, used as the "type" of "send" and "event" frames
+const (
+	EventMessage         = "message"
+	EventMessageUpdated  = "message_updated"
+	EventMessageDeleted  = "message_deleted"
+	EventMessagePinned   = "message_pinned"
+	EventMessageUnpinned = "message_unpinned"
+	EventPresence        = "presence"
+	EventNotification    = "notification"
+	EventResyncRequired  = "resync_required"
+	EventAuthenticated   = "authenticated"
+
+	// Ephemeral events are relayed to the room but never persisted
+	EventTypingStart    = "typing_start"
+	EventTypingStop     = "typing_stop"
+	EventRecordingStart = "recording_start"
+	EventRecordingStop  = "recording_stop"
+)
+
+// Error codes carried by "error" frames
+const (
+	ErrCodeBadRequest         = "bad_request"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnauthorized       = "unauthorized"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeValidation         = "validation_failed"
+	ErrCodeInternal           = "internal_error"
+)
+
+// IsEphemeralEvent reports whether an event type is ephemeral
+func IsEphemeralEvent(eventType string) bool {
+	switch eventType {
+	case EventTypingStart, EventTypingStop, EventRecordingStart, EventRecordingStop:
+		return true
+	}
+	return false
+}
+
+// ClientEnvelope is a frame sent by a client. ID is chosen by the client and
+// echoed back in the "ack" or "error" frame answering it.
+type ClientEnvelope struct {
+	V    int             `json:"v"`
+	Op   string          `json:"op"`
+	Type string          `json:"type,omitempty"`
+	ID   string          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// ServerEnvelope is a frame sent by the server. Seq is set on room events
+// that can be replayed, and increases by one per event within a room.
+type ServerEnvelope struct {
+	V     int         `json:"v"`
+	Op    string      `json:"op"`
+	Type  string      `json:"type,omitempty"`
+	ID    string      `json:"id,omitempty"`
+	Seq   uint64      `json:"seq,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+	Error *WSError    `json:"error,omitempty"`
+}
+
+// WSError describes why a client frame was rejected
+type WSError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// AuthRequest is the data of an "auth" frame. ResumeFrom is the seq of the
+// last room event the client received before reconnecting; the events after
+// it are replayed before live delivery starts. It only applies to connections
+// bound to a room by their URL; others pass it when subscribing.
+type AuthRequest struct {
+	Token      string  `json:"token"`
+	ResumeFrom *uint64 `json:"resume_from,omitempty"`
+}
+
+// AuthAck is the data of the "ack" answering a successful "auth", and of the
+// "authenticated" event opening connections authenticated at the handshake. On
+// connections bound to a room by their URL, ChatRoomID is that room and Seq
+// is the latest room event the client is caught up to once any replay is done.
+type AuthAck struct {
+	UserID     uint   `json:"user_id"`
+	Username   string `json:"username"`
+	ChatRoomID uint   `json:"chat_room_id,omitempty"`
+	Seq        uint64 `json:"seq,omitempty"`
+}
+
+// SubscribeRequest is the data of "subscribe" and "unsubscribe" frames.
+// ResumeFrom works as in AuthRequest.
+type SubscribeRequest struct {
+	ChatRoomID uint    `json:"chat_room_id"`
+	ResumeFrom *uint64 `json:"resume_from,omitempty"`
+}
+
+// SubscribeAck is the data of the "ack" answering "subscribe" and
+// "unsubscribe". Seq is set as in AuthAck when subscribing.
+type SubscribeAck struct {
+	ChatRoomID uint   `json:"chat_room_id"`
+	Seq        uint64 `json:"seq,omitempty"`
+}
+
+// SendRequest is the data of a "send" frame
+type SendRequest struct {
+	ChatRoomID  uint   `json:"chat_room_id,omitempty"`
+	Content     string `json:"content,omitempty"`
+	ClientNonce string `json:"client_nonce,omitempty"`
+}
+
+// SendAck is the data of the "ack" answering a persisted "send". Duplicate is
+// set when the client nonce matched an earlier message, which is the one
+// returned.
+type SendAck struct {
+	MessageID  uint      `json:"message_id"`
+	ChatRoomID uint      `json:"chat_room_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Duplicate  bool      `json:"duplicate,omitempty"`
+}
+
+// HeartbeatRequest is the data of a "heartbeat" frame
+type HeartbeatRequest struct {
+	State string `json:"state"` // "active" or "idle"
+}
+
+// MessageEvent is the data of "message" and "message_updated" events
+type MessageEvent struct {
+	ID          uint             `json:"id"`
+	ChatRoomID  uint             `json:"chat_room_id"`
+	UserID      uint             `json:"user_id"`
+	Username    string           `json:"username"`
+	Type        string           `json:"type"`
+	Content     string           `json:"content"`
+	ClientNonce string           `json:"client_nonce,omitempty"`
+	Attachments []AttachmentInfo `json:"attachments,omitempty"`
+	CreatedAt   time.Time        `json:"created_at"`
+}
+
+// NewMessageEvent builds the event data for a saved message
+func NewMessageEvent(message *Message) MessageEvent {
+	return MessageEvent{
+		ID:          message.ID,
+		ChatRoomID:  message.ChatRoomID,
+		UserID:      message.UserID,
+		Username:    message.User.Username,
+		Type:        message.Type,
+		Content:     message.Content,
+		ClientNonce: message.ClientNonce,
+		Attachments: message.AttachmentInfos(),
+		CreatedAt:   message.CreatedAt,
+	}
+}
+
+// MessageDeletedEvent is the data of "message_deleted" events
+type MessageDeletedEvent struct {
+	MessageID  uint `json:"message_id"`
+	ChatRoomID uint `json:"chat_room_id"`
+}
+
+// PinEvent is the data of "message_pinned" and "message_unpinned" events
+type PinEvent struct {
+	MessageID  uint           `json:"message_id"`
+	ChatRoomID uint           `json:"chat_room_id"`
+	UserID     uint           `json:"user_id"`
+	Username   string         `json:"username"`
+	Pin        *PinnedMessage `json:"pin,omitempty"`
+}
+
+// ActivityEvent is the data of ephemeral events such as "typing_start"
+type ActivityEvent struct {
+	ChatRoomID uint   `json:"chat_room_id"`
+	UserID     uint   `json:"user_id"`
+	Username   string `json:"username"`
+}
+
+// ResyncEvent is the data of "resync_required" events, sent instead of a
+// replay when the client is too far behind, or instead of the events it
+// could not keep up with. The client should refetch the room over REST; live
+// events continue after Seq. Notifications is set instead of a room when
+// notifications were missed.
+type ResyncEvent struct {
+	ChatRoomID    uint   `json:"chat_room_id"`
+	Seq           uint64 `json:"seq"`
+	Notifications bool   `json:"notifications,omitempty"`
+}
+
+// PresenceEvent is the data of "presence" events
+type PresenceEvent struct {
+	ChatRoomID uint `json:"chat_room_id"`
+	Presence
+}
+
+// EventBatch answers a long poll of GET /api/events/poll. Events are server
+// frames as sent over the WebSocket; Cursor is passed to the next poll.
+type EventBatch struct {
+	Events []json.RawMessage `json:"events"`
+	Cursor string            `json:"cursor"`
+}
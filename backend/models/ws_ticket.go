@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// WSTicket is a short-lived, single-use ticket authenticating a WebSocket
+// handshake, for clients that cannot send the token in a header. Only the
+// SHA-256 of the ticket is stored.
+type WSTicket struct {
+	ID        uint      `gorm:"primaryKey"`
+	TokenHash string    `gorm:"type:char(64);not null;uniqueIndex"`
+	UserID    uint      `gorm:"not null"`
+	Username  string    `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	CreatedAt time.Time
+}
+
+// WSTicketResponse is returned when a ticket is issued
+type WSTicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
@@ -0,0 +1,124 @@
+package repository
+
+import (
+	"chatapp/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// BlobRepository handles stored file content shared by files with the same
+// SHA-256, counting the files that reference each blob
+type BlobRepository interface {
+	GetBySHA256(sum string) (*models.Blob, error)
+	Acquire(blob *models.Blob) error
+	AddRef(id uint) (bool, error)
+	Release(id uint) (*models.Blob, bool, error)
+	GetOutside(prefix string, afterID uint, limit int) ([]models.Blob, error)
+	Move(id uint, from, to string) (bool, error)
+}
+
+type blobRepository struct {
+	db *gorm.DB
+}
+
+// NewBlobRepository creates a new blob repository
+func NewBlobRepository(db *gorm.DB) BlobRepository {
+	return &blobRepository{db: db}
+}
+
+func (r *blobRepository) GetBySHA256(sum string) (*models.Blob, error) {
+	var blob models.Blob
+	err := r.db.Where("sha256 = ?", sum).First(&blob).Error
+	if err != nil {
+		return nil, err
+	}
+	return &blob, nil
+}
+
+// Acquire records a reference to the content of blob. When a blob with the
+// same SHA-256 already exists its count goes up instead, and blob is replaced
+// with the stored one; callers compare object paths to tell the two apart.
+func (r *blobRepository) Acquire(blob *models.Blob) error {
+	blob.RefCount = 1
+	err := r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "sha256"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"ref_count": gorm.Expr("blobs.ref_count + 1")}),
+	}).Create(blob).Error
+	if err != nil {
+		return err
+	}
+
+	// The reference just taken keeps the row from being removed meanwhile
+	var stored models.Blob
+	if err := r.db.Where("sha256 = ?", blob.SHA256).First(&stored).Error; err != nil {
+		return err
+	}
+	*blob = stored
+	return nil
+}
+
+// AddRef records another reference to a blob and reports whether it was
+// still referenced. A blob whose last reference is being released cannot be
+// revived; the caller stores the content again instead.
+func (r *blobRepository) AddRef(id uint) (bool, error) {
+	result := r.db.Model(&models.Blob{}).
+		Where("id = ? AND ref_count > 0", id).
+		Update("ref_count", gorm.Expr("ref_count + 1"))
+	return result.RowsAffected > 0, result.Error
+}
+
+// Release drops a reference to a blob and removes it with the last one. It
+// returns the blob and whether it was removed, in which case the caller
+// deletes its object.
+func (r *blobRepository) Release(id uint) (*models.Blob, bool, error) {
+	var blob models.Blob
+	removed := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.Blob{}).
+			Where("id = ?", id).
+			Update("ref_count", gorm.Expr("ref_count - 1")).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.First(&blob, id).Error; err != nil {
+			return err
+		}
+		if blob.RefCount > 0 {
+			return nil
+		}
+		removed = true
+		return tx.Delete(&blob).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &blob, removed, nil
+}
+
+// GetOutside returns blobs whose objects are not under prefix, by ID
+func (r *blobRepository) GetOutside(prefix string, afterID uint, limit int) ([]models.Blob, error) {
+	var blobs []models.Blob
+	err := r.db.Where("id > ? AND object_path NOT LIKE ?", afterID, prefix+"%").
+		Order("id").
+		Limit(limit).
+		Find(&blobs).Error
+	return blobs, err
+}
+
+// Move points a blob and the files using it at another object and reports
+// whether it did; a blob removed or moved since it was loaded is left alone
+func (r *blobRepository) Move(id uint, from, to string) (bool, error) {
+	moved := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Blob{}).
+			Where("id = ? AND object_path = ?", id, from).
+			Update("object_path", to)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		moved = true
+		return tx.Unscoped().Model(&models.File{}).Where("blob_id = ?", id).Update("file_path", to).Error
+	})
+	return moved, err
+}
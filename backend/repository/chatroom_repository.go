@@ -4,6 +4,7 @@ import (
 	"chatapp/models"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // ChatRoomRepository handles chat room data operations
@@ -15,6 +16,11 @@ type ChatRoomRepository interface {
 	Update(chatRoom *models.ChatRoom) error
 	Delete(id uint) error
 	GetByCreatorID(creatorID uint) ([]models.ChatRoom, error)
+	GetMemberIDs(id uint) ([]uint, error)
+	IsModerator(id, userID uint) (bool, error)
+	AddModerator(moderator *models.ChatRoomModerator) error
+	RemoveModerator(id, userID uint) error
+	GetModerators(id uint) ([]models.ChatRoomModerator, error)
 }
 
 type chatRoomRepository struct {
@@ -67,3 +73,45 @@ func (r *chatRoomRepository) GetByCreatorID(creatorID uint) ([]models.ChatRoom,
 	err := r.db.Where("created_by = ?", creatorID).Preload("Creator").Find(&chatRooms).Error
 	return chatRooms, err
 }
+
+// GetMemberIDs returns the users taking part in a chat room: its creator,
+// everyone who has posted in it and everyone with a notification preference
+func (r *chatRoomRepository) GetMemberIDs(id uint) ([]uint, error) {
+	var memberIDs []uint
+	err := r.db.Raw(`
+		SELECT created_by FROM chat_rooms WHERE id = ? AND deleted_at IS NULL
+		UNION
+		SELECT DISTINCT user_id FROM messages WHERE chat_room_id = ? AND deleted_at IS NULL
+		UNION
+		SELECT user_id FROM notification_preferences WHERE chat_room_id = ?`,
+		id, id, id).Scan(&memberIDs).Error
+	return memberIDs, err
+}
+
+// IsModerator reports whether a user moderates a chat room. The creator
+// always does.
+func (r *chatRoomRepository) IsModerator(id, userID uint) (bool, error) {
+	var count int64
+	err := r.db.Raw(`
+		SELECT COUNT(*) FROM (
+			SELECT 1 FROM chat_rooms WHERE id = ? AND created_by = ? AND deleted_at IS NULL
+			UNION ALL
+			SELECT 1 FROM chat_room_moderators WHERE chat_room_id = ? AND user_id = ?
+		) AS moderators`,
+		id, userID, id, userID).Scan(&count).Error
+	return count > 0, err
+}
+
+func (r *chatRoomRepository) AddModerator(moderator *models.ChatRoomModerator) error {
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(moderator).Error
+}
+
+func (r *chatRoomRepository) RemoveModerator(id, userID uint) error {
+	return r.db.Where("chat_room_id = ? AND user_id = ?", id, userID).Delete(&models.ChatRoomModerator{}).Error
+}
+
+func (r *chatRoomRepository) GetModerators(id uint) ([]models.ChatRoomModerator, error) {
+	var moderators []models.ChatRoomModerator
+	err := r.db.Where("chat_room_id = ?", id).Preload("User").Order("created_at").Find(&moderators).Error
+	return moderators, err
+}
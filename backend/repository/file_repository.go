@@ -14,6 +14,11 @@ func NewFileRepository(db *gorm.DB) *FileRepository {
 	return &FileRepository{db: db}
 }
 
+// orderVariants 按尺寸从小到大加载图片的预览
+func orderVariants(db *gorm.DB) *gorm.DB {
+	return db.Order("width, id")
+}
+
 // Create 创建文件记录
 func (r *FileRepository) Create(file *models.File) error {
 	return r.db.Create(file).Error
@@ -22,7 +27,7 @@ func (r *FileRepository) Create(file *models.File) error {
 // GetByID 根据ID获取文件
 func (r *FileRepository) GetByID(id uint) (*models.File, error) {
 	var file models.File
-	err := r.db.Preload("ChatRoom").Preload("Uploader").First(&file, id).Error
+	err := r.db.Preload("ChatRoom").Preload("Uploader").Preload("Variants", orderVariants).First(&file, id).Error
 	if err != nil {
 		return nil, err
 	}
@@ -34,6 +39,7 @@ func (r *FileRepository) GetByChatRoomID(chatRoomID uint) ([]models.File, error)
 	var files []models.File
 	err := r.db.Where("chat_room_id = ?", chatRoomID).
 		Preload("Uploader").
+		Preload("Variants", orderVariants).
 		Order("uploaded_at DESC").
 		Find(&files).Error
 	return files, err
@@ -44,14 +50,44 @@ func (r *FileRepository) GetByUserID(userID uint) ([]models.File, error) {
 	var files []models.File
 	err := r.db.Where("uploader_id = ?", userID).
 		Preload("ChatRoom").
+		Preload("Variants", orderVariants).
 		Order("uploaded_at DESC").
 		Find(&files).Error
 	return files, err
 }
 
-// Delete 软删除文件记录
-func (r *FileRepository) Delete(id uint) error {
-	return r.db.Delete(&models.File{}, id).Error
+// Delete 软删除文件记录，同时解除与消息的关联
+// 返回受影响的消息ID；没有剩余附件且没有文字内容的文件消息会被一并删除
+func (r *FileRepository) Delete(id uint) ([]uint, error) {
+	var messageIDs []uint
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.MessageAttachment{}).Where("file_id = ?", id).Pluck("message_id", &messageIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", id).Delete(&models.MessageAttachment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&models.File{}, id).Error; err != nil {
+			return err
+		}
+		if len(messageIDs) == 0 {
+			return nil
+		}
+
+		var emptyIDs []uint
+		err := tx.Model(&models.Message{}).
+			Where("id IN ? AND type = ? AND content = ?", messageIDs, "file", "").
+			Where("NOT EXISTS (SELECT 1 FROM message_attachments WHERE message_attachments.message_id = messages.id)").
+			Pluck("id", &emptyIDs).Error
+		if err != nil || len(emptyIDs) == 0 {
+			return err
+		}
+		if err := tx.Where("message_id IN ?", emptyIDs).Delete(&models.PinnedMessage{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.Message{}, emptyIDs).Error
+	})
+	return messageIDs, err
 }
 
 // Update 更新文件信息
@@ -74,6 +110,7 @@ func (r *FileRepository) GetByChatRoomIDWithPagination(chatRoomID uint, page, pa
 	offset := (page - 1) * pageSize
 	err = r.db.Where("chat_room_id = ?", chatRoomID).
 		Preload("Uploader").
+		Preload("Variants", orderVariants).
 		Order("uploaded_at DESC").
 		Offset(offset).
 		Limit(pageSize).
@@ -90,4 +127,29 @@ func (r *FileRepository) GetByFilePath(filePath string) (*models.File, error) {
 		return nil, err
 	}
 	return &file, nil
+}
+
+// GetWithoutBlob 获取尚未登记内容的文件（内容去重之前上传的文件），按ID升序
+func (r *FileRepository) GetWithoutBlob(afterID uint, limit int) ([]models.File, error) {
+	var files []models.File
+	err := r.db.Where("id > ? AND blob_id IS NULL", afterID).
+		Order("id").
+		Limit(limit).
+		Find(&files).Error
+	return files, err
+}
+
+// SetBlob 将尚未登记内容的文件指向已登记的内容，返回文件是否仍未登记且未被删除
+func (r *FileRepository) SetBlob(id, blobID uint, filePath string) (bool, error) {
+	result := r.db.Model(&models.File{}).
+		Where("id = ? AND blob_id IS NULL", id).
+		Updates(map[string]interface{}{"blob_id": blobID, "file_path": filePath})
+	return result.RowsAffected > 0, result.Error
+}
+
+// CountWithoutBlobByFilePath 统计使用某个对象且尚未登记内容的文件数
+func (r *FileRepository) CountWithoutBlobByFilePath(filePath string) (int64, error) {
+	var count int64
+	err := r.db.Model(&models.File{}).Where("file_path = ? AND blob_id IS NULL", filePath).Count(&count).Error
+	return count, err
 }
\ No newline at end of file
@@ -2,38 +2,115 @@ package repository
 
 import (
 	"chatapp/models"
+	"errors"
+	"time"
 
 	"gorm.io/gorm"
 )
 
 // MessageRepository handles message data operations
 type MessageRepository interface {
-	Create(message *models.Message) error
+	Create(message *models.Message) (bool, error)
+	CreateWithAttachments(message *models.Message, files []*models.File) (bool, error)
 	GetByID(id uint) (*models.Message, error)
 	GetByChatRoomID(chatRoomID uint, limit, offset int) ([]models.Message, error)
 	GetByUserID(userID uint, limit, offset int) ([]models.Message, error)
 	Update(message *models.Message) error
-	Delete(id uint) error
+	Delete(id uint) ([]models.File, error)
 	GetRecentMessages(chatRoomID uint, limit int) ([]models.Message, error)
 	CountByChatRoomID(chatRoomID uint) (int64, error)
 }
 
 type messageRepository struct {
 	db *gorm.DB
+	// How long a client nonce identifies the message it was first sent with
+	dedupeWindow time.Duration
 }
 
 // NewMessageRepository creates a new message repository
-func NewMessageRepository(db *gorm.DB) MessageRepository {
-	return &messageRepository{db: db}
+func NewMessageRepository(db *gorm.DB, dedupeWindow time.Duration) MessageRepository {
+	return &messageRepository{db: db, dedupeWindow: dedupeWindow}
 }
 
-func (r *messageRepository) Create(message *models.Message) error {
-	return r.db.Create(message).Error
+// preloadAttachments loads a message's attachments with their files, in order
+func preloadAttachments(db *gorm.DB) *gorm.DB {
+	return db.Preload("Attachments", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).Preload("Attachments.File").Preload("Attachments.File.Variants", orderVariants)
+}
+
+// Create saves a message. If the user already sent a message with the same
+// client nonce within the dedupe window, nothing is saved, message.ID is set to
+// the original message and false is returned.
+func (r *messageRepository) Create(message *models.Message) (bool, error) {
+	return r.createOnce(message, func(tx *gorm.DB) error {
+		return tx.Create(message).Error
+	})
+}
+
+// CreateWithAttachments saves the file records, the message and the links
+// between them in one transaction. Duplicates are detected as in Create, in
+// which case the files are not saved.
+func (r *messageRepository) CreateWithAttachments(message *models.Message, files []*models.File) (bool, error) {
+	return r.createOnce(message, func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+
+		for position, file := range files {
+			if err := tx.Create(file).Error; err != nil {
+				return err
+			}
+			attachment := &models.MessageAttachment{
+				MessageID: message.ID,
+				FileID:    file.ID,
+				Position:  position,
+			}
+			if err := tx.Create(attachment).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// createOnce runs create in a transaction unless the message's client nonce
+// was already used by its author within the dedupe window
+func (r *messageRepository) createOnce(message *models.Message, create func(tx *gorm.DB) error) (bool, error) {
+	if message.ClientNonce == "" {
+		return true, r.db.Transaction(create)
+	}
+
+	created := true
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// Serialize concurrent sends of the same nonce, so a retry racing the
+		// original waits for it instead of inserting a second row
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtextextended(?, ?))", message.ClientNonce, message.UserID).Error; err != nil {
+			return err
+		}
+
+		var original models.Message
+		err := tx.Select("id").
+			Where("user_id = ? AND client_nonce = ? AND created_at > ?", message.UserID, message.ClientNonce, time.Now().Add(-r.dedupeWindow)).
+			Order("created_at DESC").
+			First(&original).Error
+		if err == nil {
+			created = false
+			message.ID = original.ID
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		return create(tx)
+	})
+	return created, err
 }
 
 func (r *messageRepository) GetByID(id uint) (*models.Message, error) {
 	var message models.Message
-	err := r.db.Preload("User").Preload("ChatRoom").First(&message, id).Error
+	err := preloadAttachments(r.db).Preload("User").Preload("ChatRoom").First(&message, id).Error
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +119,7 @@ func (r *messageRepository) GetByID(id uint) (*models.Message, error) {
 
 func (r *messageRepository) GetByChatRoomID(chatRoomID uint, limit, offset int) ([]models.Message, error) {
 	var messages []models.Message
-	err := r.db.Where("chat_room_id = ?", chatRoomID).
+	err := preloadAttachments(r.db).Where("chat_room_id = ?", chatRoomID).
 		Preload("User").
 		Order("created_at").
 		Limit(limit).
@@ -67,13 +144,43 @@ func (r *messageRepository) Update(message *models.Message) error {
 	return r.db.Save(message).Error
 }
 
-func (r *messageRepository) Delete(id uint) error {
-	return r.db.Delete(&models.Message{}, id).Error
+// Delete removes a message together with its pin and attachment links. Files that
+// are no longer attached to any message are deleted too and returned, so the
+// caller can remove their stored objects.
+func (r *messageRepository) Delete(id uint) ([]models.File, error) {
+	var orphaned []models.File
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var fileIDs []uint
+		if err := tx.Model(&models.MessageAttachment{}).Where("message_id = ?", id).Pluck("file_id", &fileIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", id).Delete(&models.MessageAttachment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", id).Delete(&models.PinnedMessage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&models.Message{}, id).Error; err != nil {
+			return err
+		}
+		if len(fileIDs) == 0 {
+			return nil
+		}
+
+		err := tx.Where("id IN ?", fileIDs).
+			Where("NOT EXISTS (SELECT 1 FROM message_attachments WHERE message_attachments.file_id = files.id)").
+			Find(&orphaned).Error
+		if err != nil || len(orphaned) == 0 {
+			return err
+		}
+		return tx.Delete(&orphaned).Error
+	})
+	return orphaned, err
 }
 
 func (r *messageRepository) GetRecentMessages(chatRoomID uint, limit int) ([]models.Message, error) {
 	var messages []models.Message
-	err := r.db.Where("chat_room_id = ?", chatRoomID).
+	err := preloadAttachments(r.db).Where("chat_room_id = ?", chatRoomID).
 		Preload("User").
 		Order("created_at DESC").
 		Limit(limit).
@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"chatapp/models"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB connects to the PostgreSQL server CHATAPP_TEST_POSTGRES_DSN points
+// at and migrates a schema of its own, dropped when the test ends. The test
+// is skipped without a server.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("CHATAPP_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CHATAPP_TEST_POSTGRES_DSN not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One connection, so that the search path set below applies to every query
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	schema := fmt.Sprintf("chatapp_test_%d", time.Now().UnixNano())
+	if err := db.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DROP SCHEMA " + schema + " CASCADE") })
+	if err := db.Exec("SET search_path TO " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&models.User{}, &models.ChatRoom{}, &models.Message{}, &models.File{}, &models.Blob{}, &models.FileVariant{},
+		&models.MessageAttachment{}, &models.PinnedMessage{}, &models.ChatRoomModerator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDeleteMessage(t *testing.T) {
+	db := testDB(t)
+	messages := NewMessageRepository(db, time.Minute)
+	pins := NewPinRepository(db)
+
+	author := &models.User{Username: "alice", Password: "x", Email: "alice@example.com"}
+	if err := db.Create(author).Error; err != nil {
+		t.Fatal(err)
+	}
+	room := &models.ChatRoom{Name: "general", CreatedBy: author.ID}
+	if err := db.Create(room).Error; err != nil {
+		t.Fatal(err)
+	}
+	post := func(t *testing.T, files ...*models.File) *models.Message {
+		t.Helper()
+		message := &models.Message{Content: "hello", UserID: author.ID, ChatRoomID: room.ID, Type: "file"}
+		if _, err := messages.CreateWithAttachments(message, files); err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+	newFile := func(name string) *models.File {
+		return &models.File{FileName: name, FilePath: "chatrooms/1/" + name, FileSize: 5, ContentType: "text/plain", ChatRoomID: room.ID, UploaderID: author.ID}
+	}
+
+	t.Run("deleting a message removes its pin", func(t *testing.T) {
+		message := post(t, newFile("a.txt"))
+		pin := &models.PinnedMessage{ChatRoomID: room.ID, MessageID: message.ID, PinnedBy: author.ID}
+		if err := pins.CreateWithLimit(pin, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := messages.Delete(message.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pins.GetByMessageID(message.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Fatalf("looking up the pin returned %v, want %v", err, gorm.ErrRecordNotFound)
+		}
+		listed, err := pins.GetByChatRoomID(room.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pin := range listed {
+			if pin.MessageID == message.ID {
+				t.Fatal("deleted message still listed as pinned")
+			}
+		}
+	})
+
+	t.Run("deleting a message keeps the pins of others", func(t *testing.T) {
+		deleted, kept := post(t, newFile("b.txt")), post(t, newFile("c.txt"))
+		for _, message := range []*models.Message{deleted, kept} {
+			if err := pins.CreateWithLimit(&models.PinnedMessage{ChatRoomID: room.ID, MessageID: message.ID, PinnedBy: author.ID}, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := messages.Delete(deleted.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pins.GetByMessageID(kept.ID); err != nil {
+			t.Fatalf("pin of another message: %v", err)
+		}
+	})
+
+	t.Run("deleting a message returns the files only it referenced", func(t *testing.T) {
+		message := post(t, newFile("d.txt"), newFile("e.txt"))
+		orphaned, err := messages.Delete(message.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orphaned) != 2 {
+			t.Fatalf("%d files orphaned, want 2", len(orphaned))
+		}
+		var count int64
+		db.Model(&models.MessageAttachment{}).Where("message_id = ?", message.ID).Count(&count)
+		if count != 0 {
+			t.Fatalf("%d attachment links left", count)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"chatapp/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// NotificationRepository handles mention, notification and notification
+// preference data operations
+type NotificationRepository interface {
+	CreateMentions(mentions []models.Mention) error
+	CreateNotifications(notifications []models.Notification) error
+	GetByUserID(userID uint, unreadOnly bool, limit, offset int) ([]models.Notification, error)
+	CountUnread(userID uint) (int64, error)
+	MarkRead(id, userID uint) error
+	MarkAllRead(userID uint) error
+	GetPreference(userID, chatRoomID uint) (*models.NotificationPreference, error)
+	GetPreferencesByChatRoomID(chatRoomID uint) ([]models.NotificationPreference, error)
+	UpsertPreference(preference *models.NotificationPreference) error
+}
+
+type notificationRepository struct {
+	db *gorm.DB
+}
+
+// NewNotificationRepository creates a new notification repository
+func NewNotificationRepository(db *gorm.DB) NotificationRepository {
+	return &notificationRepository{db: db}
+}
+
+func (r *notificationRepository) CreateMentions(mentions []models.Mention) error {
+	if len(mentions) == 0 {
+		return nil
+	}
+	return r.db.Create(&mentions).Error
+}
+
+func (r *notificationRepository) CreateNotifications(notifications []models.Notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+	// Message, File and Actor are set for the caller's convenience, don't
+	// upsert them
+	return r.db.Omit(clause.Associations).Create(&notifications).Error
+}
+
+func (r *notificationRepository) GetByUserID(userID uint, unreadOnly bool, limit, offset int) ([]models.Notification, error) {
+	var notifications []models.Notification
+	query := r.db.Where("user_id = ?", userID)
+	if unreadOnly {
+		query = query.Where("is_read = ?", false)
+	}
+	err := query.Preload("Actor").
+		Preload("Message.User").
+		Preload("File").
+		Order("created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&notifications).Error
+	return notifications, err
+}
+
+func (r *notificationRepository) CountUnread(userID uint) (int64, error) {
+	var count int64
+	err := r.db.Model(&models.Notification{}).
+		Where("user_id = ? AND is_read = ?", userID, false).
+		Count(&count).Error
+	return count, err
+}
+
+func (r *notificationRepository) MarkRead(id, userID uint) error {
+	result := r.db.Model(&models.Notification{}).
+		Where("id = ? AND user_id = ?", id, userID).
+		Updates(map[string]interface{}{"is_read": true, "read_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *notificationRepository) MarkAllRead(userID uint) error {
+	return r.db.Model(&models.Notification{}).
+		Where("user_id = ? AND is_read = ?", userID, false).
+		Updates(map[string]interface{}{"is_read": true, "read_at": time.Now()}).Error
+}
+
+func (r *notificationRepository) GetPreference(userID, chatRoomID uint) (*models.NotificationPreference, error) {
+	var preference models.NotificationPreference
+	err := r.db.Where("user_id = ? AND chat_room_id = ?", userID, chatRoomID).First(&preference).Error
+	if err != nil {
+		return nil, err
+	}
+	return &preference, nil
+}
+
+func (r *notificationRepository) GetPreferencesByChatRoomID(chatRoomID uint) ([]models.NotificationPreference, error) {
+	var preferences []models.NotificationPreference
+	err := r.db.Where("chat_room_id = ?", chatRoomID).Find(&preferences).Error
+	return preferences, err
+}
+
+func (r *notificationRepository) UpsertPreference(preference *models.NotificationPreference) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "chat_room_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"level", "updated_at"}),
+	}).Create(preference).Error
+}
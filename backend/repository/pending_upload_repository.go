@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"chatapp/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PendingUploadRepository handles uploads made with presigned URLs that are
+// not confirmed yet
+type PendingUploadRepository interface {
+	Create(upload *models.PendingUpload) error
+	GetByObjectPath(objectPath string) (*models.PendingUpload, error)
+	Delete(id uint) (bool, error)
+	GetExpired(now time.Time, limit int) ([]models.PendingUpload, error)
+}
+
+type pendingUploadRepository struct {
+	db *gorm.DB
+}
+
+// NewPendingUploadRepository creates a new pending upload repository
+func NewPendingUploadRepository(db *gorm.DB) PendingUploadRepository {
+	return &pendingUploadRepository{db: db}
+}
+
+func (r *pendingUploadRepository) Create(upload *models.PendingUpload) error {
+	return r.db.Create(upload).Error
+}
+
+func (r *pendingUploadRepository) GetByObjectPath(objectPath string) (*models.PendingUpload, error) {
+	var upload models.PendingUpload
+	err := r.db.Where("object_path = ?", objectPath).First(&upload).Error
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// Delete removes a pending upload and reports whether it was still there, so
+// that of a confirmation and the sweeper, on any server, only one claims it
+func (r *pendingUploadRepository) Delete(id uint) (bool, error) {
+	result := r.db.Delete(&models.PendingUpload{}, id)
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetExpired returns pending uploads past their expiry, oldest first
+func (r *pendingUploadRepository) GetExpired(now time.Time, limit int) ([]models.PendingUpload, error) {
+	var uploads []models.PendingUpload
+	err := r.db.Where("expires_at <= ?", now).
+		Order("expires_at").
+		Limit(limit).
+		Find(&uploads).Error
+	return uploads, err
+}
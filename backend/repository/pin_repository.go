@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"chatapp/models"
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrPinLimitReached is returned when a chat room already has the maximum
+// number of pinned messages
+var ErrPinLimitReached = errors.New("pin limit reached")
+
+// PinRepository handles pinned message data operations
+type PinRepository interface {
+	CreateWithLimit(pin *models.PinnedMessage, limit int) error
+	GetByMessageID(messageID uint) (*models.PinnedMessage, error)
+	GetByChatRoomID(chatRoomID uint) ([]models.PinnedMessage, error)
+	DeleteByMessageID(messageID uint) error
+}
+
+type pinRepository struct {
+	db *gorm.DB
+}
+
+// NewPinRepository creates a new pin repository
+func NewPinRepository(db *gorm.DB) PinRepository {
+	return &pinRepository{db: db}
+}
+
+// CreateWithLimit pins a message unless the room already has limit pins. The
+// chat room row is locked so concurrent pins can't overshoot the limit.
+func (r *pinRepository) CreateWithLimit(pin *models.PinnedMessage, limit int) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var chatRoom models.ChatRoom
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&chatRoom, pin.ChatRoomID).Error; err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&models.PinnedMessage{}).Where("chat_room_id = ?", pin.ChatRoomID).Count(&count).Error; err != nil {
+			return err
+		}
+		if limit > 0 && count >= int64(limit) {
+			return ErrPinLimitReached
+		}
+
+		return tx.Create(pin).Error
+	})
+}
+
+func (r *pinRepository) GetByMessageID(messageID uint) (*models.PinnedMessage, error) {
+	var pin models.PinnedMessage
+	err := r.db.Preload("Message.User").Preload("PinnedByUser").Where("message_id = ?", messageID).First(&pin).Error
+	if err != nil {
+		return nil, err
+	}
+	return &pin, nil
+}
+
+func (r *pinRepository) GetByChatRoomID(chatRoomID uint) ([]models.PinnedMessage, error) {
+	var pins []models.PinnedMessage
+	err := r.db.Where("chat_room_id = ?", chatRoomID).
+		Preload("Message.User").
+		Preload("Message.Attachments", func(db *gorm.DB) *gorm.DB {
+			return db.Order("position")
+		}).
+		Preload("Message.Attachments.File").
+		Preload("Message.Attachments.File.Variants", orderVariants).
+		Preload("PinnedByUser").
+		Order("created_at DESC").
+		Find(&pins).Error
+	return pins, err
+}
+
+func (r *pinRepository) DeleteByMessageID(messageID uint) error {
+	result := r.db.Where("message_id = ?", messageID).Delete(&models.PinnedMessage{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"chatapp/models"
+
+	"gorm.io/gorm"
+)
+
+// PreviewRepository handles the image previews of files: which files still
+// need them and the variants generated for them
+type PreviewRepository interface {
+	GetPending(limit int) ([]models.File, error)
+	GetReadyByBlobID(blobID uint) (*models.File, error)
+	Complete(file *models.File, variants []models.FileVariant) (bool, error)
+	Fail(fileID uint) error
+	GetMessageIDs(fileID uint) ([]uint, error)
+}
+
+type previewRepository struct {
+	db *gorm.DB
+}
+
+// NewPreviewRepository creates a new preview repository
+func NewPreviewRepository(db *gorm.DB) PreviewRepository {
+	return &previewRepository{db: db}
+}
+
+// GetPending returns files waiting for previews, oldest first. Files whose
+// content is not recorded yet wait until it is backfilled, and files waiting
+// for a malware scan until they are let through.
+func (r *previewRepository) GetPending(limit int) ([]models.File, error) {
+	var files []models.File
+	err := r.db.Where("preview_status = ? AND blob_id IS NOT NULL", models.PreviewPending).
+		Where("scan_status IS NULL OR scan_status IN ?", []string{"", models.ScanClean, models.ScanUnscanned}).
+		Order("id").
+		Limit(limit).
+		Find(&files).Error
+	return files, err
+}
+
+// GetReadyByBlobID returns a file with the given content whose previews are
+// generated, with its variants
+func (r *previewRepository) GetReadyByBlobID(blobID uint) (*models.File, error) {
+	var file models.File
+	err := r.db.Unscoped().
+		Preload("Variants").
+		Where("blob_id = ? AND preview_status = ?", blobID, models.PreviewReady).
+		First(&file).Error
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// Complete records the previews of a file still waiting for them and
+// reports whether it was; a file processed twice at once is recorded once
+func (r *previewRepository) Complete(file *models.File, variants []models.FileVariant) (bool, error) {
+	completed := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.File{}).
+			Where("id = ? AND preview_status = ?", file.ID, models.PreviewPending).
+			Updates(map[string]interface{}{
+				"width":          file.Width,
+				"height":         file.Height,
+				"blurhash":       file.Blurhash,
+				"preview_status": models.PreviewReady,
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		completed = true
+		if len(variants) == 0 {
+			return nil
+		}
+		for i := range variants {
+			variants[i].FileID = file.ID
+		}
+		return tx.Create(&variants).Error
+	})
+	return completed, err
+}
+
+// Fail marks a file whose previews cannot be generated
+func (r *previewRepository) Fail(fileID uint) error {
+	return r.db.Model(&models.File{}).
+		Where("id = ? AND preview_status = ?", fileID, models.PreviewPending).
+		Update("preview_status", models.PreviewFailed).Error
+}
+
+// GetMessageIDs returns the messages a file is attached to
+func (r *previewRepository) GetMessageIDs(fileID uint) ([]uint, error) {
+	var messageIDs []uint
+	err := r.db.Model(&models.MessageAttachment{}).Where("file_id = ?", fileID).Pluck("message_id", &messageIDs).Error
+	return messageIDs, err
+}
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"chatapp/models"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RoomEventRepository handles the per-room event log used for replay
+type RoomEventRepository interface {
+	Append(event *models.RoomEvent) error
+	GetAfter(chatRoomID uint, afterSeq uint64, limit int) ([]models.RoomEvent, error)
+	GetLastSeq(chatRoomID uint) (uint64, error)
+	DeleteOlderThan(before time.Time) (int64, error)
+}
+
+type roomEventRepository struct {
+	db *gorm.DB
+}
+
+// NewRoomEventRepository creates a new room event repository
+func NewRoomEventRepository(db *gorm.DB) RoomEventRepository {
+	return &roomEventRepository{db: db}
+}
+
+// Append assigns the next sequence number of the event's room and saves it.
+// The sequence row stays locked until the transaction commits, so concurrent
+// appends to a room get consecutive numbers.
+func (r *roomEventRepository) Append(event *models.RoomEvent) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var seq uint64
+		err := tx.Raw(`INSERT INTO room_sequences (chat_room_id, last_seq) VALUES (?, 1)
+			ON CONFLICT (chat_room_id) DO UPDATE SET last_seq = room_sequences.last_seq + 1
+			RETURNING last_seq`, event.ChatRoomID).Scan(&seq).Error
+		if err != nil {
+			return err
+		}
+
+		event.Seq = seq
+		return tx.Create(event).Error
+	})
+}
+
+// GetAfter returns the events of a room with a sequence number above afterSeq, oldest first
+func (r *roomEventRepository) GetAfter(chatRoomID uint, afterSeq uint64, limit int) ([]models.RoomEvent, error) {
+	var events []models.RoomEvent
+	err := r.db.Where("chat_room_id = ? AND seq > ?", chatRoomID, afterSeq).
+		Order("seq").
+		Limit(limit).
+		Find(&events).Error
+	return events, err
+}
+
+// GetLastSeq returns the sequence number of the latest event of a room, 0 if there is none
+func (r *roomEventRepository) GetLastSeq(chatRoomID uint) (uint64, error) {
+	var sequence models.RoomSequence
+	err := r.db.First(&sequence, "chat_room_id = ?", chatRoomID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return sequence.LastSeq, nil
+}
+
+// DeleteOlderThan prunes events past their retention. Sequence counters are
+// kept, so numbering never restarts.
+func (r *roomEventRepository) DeleteOlderThan(before time.Time) (int64, error) {
+	result := r.db.Where("created_at < ?", before).Delete(&models.RoomEvent{})
+	return result.RowsAffected, result.Error
+}
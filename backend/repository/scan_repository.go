@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"chatapp/models"
+
+	"gorm.io/gorm"
+)
+
+// ScanRepository handles the malware scanning of files: which files wait for
+// a scan and the verdicts on them
+type ScanRepository interface {
+	GetPending(limit int) ([]models.File, error)
+	GetScannedByBlobID(blobID uint) (*models.File, error)
+	Complete(file *models.File) (bool, error)
+	GetMessageIDs(fileID uint) ([]uint, error)
+}
+
+type scanRepository struct {
+	db *gorm.DB
+}
+
+// NewScanRepository creates a new scan repository
+func NewScanRepository(db *gorm.DB) ScanRepository {
+	return &scanRepository{db: db}
+}
+
+// GetPending returns files waiting for a scan, oldest first, with their
+// uploaders
+func (r *scanRepository) GetPending(limit int) ([]models.File, error) {
+	var files []models.File
+	err := r.db.Preload("Uploader").
+		Where("scan_status = ?", models.ScanPending).
+		Order("id").
+		Limit(limit).
+		Find(&files).Error
+	return files, err
+}
+
+// GetScannedByBlobID returns a file with the given content that the scanner
+// gave a verdict on
+func (r *scanRepository) GetScannedByBlobID(blobID uint) (*models.File, error) {
+	var file models.File
+	err := r.db.Unscoped().
+		Where("blob_id = ? AND scan_status IN ?", blobID, []string{models.ScanClean, models.ScanInfected}).
+		First(&file).Error
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// Complete records the scan of a file still waiting for it and reports
+// whether it was; a file scanned twice at once is recorded once
+func (r *scanRepository) Complete(file *models.File) (bool, error) {
+	result := r.db.Model(&models.File{}).
+		Where("id = ? AND scan_status = ?", file.ID, models.ScanPending).
+		Updates(map[string]interface{}{
+			"scan_status":    file.ScanStatus,
+			"scan_result":    file.ScanResult,
+			"scanned_at":     file.ScannedAt,
+			"preview_status": file.PreviewStatus,
+		})
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetMessageIDs returns the messages a file is attached to
+func (r *scanRepository) GetMessageIDs(fileID uint) ([]uint, error) {
+	var messageIDs []uint
+	err := r.db.Model(&models.MessageAttachment{}).Where("file_id = ?", fileID).Pluck("message_id", &messageIDs).Error
+	return messageIDs, err
+}
@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"chatapp/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UploadRepository handles resumable uploads
+type UploadRepository interface {
+	Create(upload *models.Upload) error
+	GetByID(id string) (*models.Upload, error)
+	Update(upload *models.Upload) error
+	Delete(id string) error
+	GetExpired(now time.Time, limit int) ([]models.Upload, error)
+}
+
+type uploadRepository struct {
+	db *gorm.DB
+}
+
+// NewUploadRepository creates a new upload repository
+func NewUploadRepository(db *gorm.DB) UploadRepository {
+	return &uploadRepository{db: db}
+}
+
+func (r *uploadRepository) Create(upload *models.Upload) error {
+	return r.db.Create(upload).Error
+}
+
+func (r *uploadRepository) GetByID(id string) (*models.Upload, error) {
+	var upload models.Upload
+	err := r.db.Where("id = ?", id).First(&upload).Error
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (r *uploadRepository) Update(upload *models.Upload) error {
+	return r.db.Save(upload).Error
+}
+
+func (r *uploadRepository) Delete(id string) error {
+	return r.db.Where("id = ?", id).Delete(&models.Upload{}).Error
+}
+
+// GetExpired returns uploads idle past their expiry, oldest first
+func (r *uploadRepository) GetExpired(now time.Time, limit int) ([]models.Upload, error) {
+	var uploads []models.Upload
+	err := r.db.Where("expires_at <= ?", now).
+		Order("expires_at").
+		Limit(limit).
+		Find(&uploads).Error
+	return uploads, err
+}
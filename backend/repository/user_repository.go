@@ -11,6 +11,7 @@ type UserRepository interface {
 	Create(user *models.User) error
 	GetByID(id uint) (*models.User, error)
 	GetByUsername(username string) (*models.User, error)
+	GetByUsernames(usernames []string) ([]models.User, error)
 	GetByEmail(email string) (*models.User, error)
 	Update(user *models.User) error
 	Delete(id uint) error
@@ -48,6 +49,12 @@ func (r *userRepository) GetByUsername(username string) (*models.User, error) {
 	return &user, nil
 }
 
+func (r *userRepository) GetByUsernames(usernames []string) ([]models.User, error) {
+	var users []models.User
+	err := r.db.Where("username IN ?", usernames).Find(&users).Error
+	return users, err
+}
+
 func (r *userRepository) GetByEmail(email string) (*models.User, error) {
 	var user models.User
 	err := r.db.Where("email = ?", email).First(&user).Error
@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"chatapp/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UserStatusRepository handles custom user status data operations
+type UserStatusRepository interface {
+	Upsert(status *models.UserStatus) error
+	GetByUserIDs(userIDs []uint) ([]models.UserStatus, error)
+	Delete(userID uint) error
+	DeleteExpired(now time.Time) ([]uint, error)
+}
+
+type userStatusRepository struct {
+	db *gorm.DB
+}
+
+// NewUserStatusRepository creates a new user status repository
+func NewUserStatusRepository(db *gorm.DB) UserStatusRepository {
+	return &userStatusRepository{db: db}
+}
+
+func (r *userStatusRepository) Upsert(status *models.UserStatus) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"text", "expires_at", "updated_at"}),
+	}).Create(status).Error
+}
+
+func (r *userStatusRepository) GetByUserIDs(userIDs []uint) ([]models.UserStatus, error) {
+	var statuses []models.UserStatus
+	err := r.db.Where("user_id IN ?", userIDs).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Find(&statuses).Error
+	return statuses, err
+}
+
+func (r *userStatusRepository) Delete(userID uint) error {
+	return r.db.Delete(&models.UserStatus{}, userID).Error
+}
+
+// DeleteExpired removes expired statuses and returns the affected user IDs
+func (r *userStatusRepository) DeleteExpired(now time.Time) ([]uint, error) {
+	var expired []models.UserStatus
+	err := r.db.Clauses(clause.Returning{Columns: []clause.Column{{Name: "user_id"}}}).
+		Where("expires_at IS NOT NULL AND expires_at <= ?", now).
+		Delete(&expired).Error
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs := make([]uint, 0, len(expired))
+	for _, status := range expired {
+		userIDs = append(userIDs, status.UserID)
+	}
+	return userIDs, nil
+}
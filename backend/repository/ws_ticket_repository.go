@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"chatapp/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// WSTicketRepository handles WebSocket handshake tickets
+type WSTicketRepository interface {
+	Create(ticket *models.WSTicket) error
+	Consume(tokenHash string) (*models.WSTicket, error)
+	DeleteExpired(now time.Time) (int64, error)
+}
+
+type wsTicketRepository struct {
+	db *gorm.DB
+}
+
+// NewWSTicketRepository creates a new WebSocket ticket repository
+func NewWSTicketRepository(db *gorm.DB) WSTicketRepository {
+	return &wsTicketRepository{db: db}
+}
+
+func (r *wsTicketRepository) Create(ticket *models.WSTicket) error {
+	return r.db.Create(ticket).Error
+}
+
+// Consume deletes a ticket and returns it, so that of several handshakes
+// presenting the same ticket, on any server, only one gets it
+func (r *wsTicketRepository) Consume(tokenHash string) (*models.WSTicket, error) {
+	var tickets []models.WSTicket
+	err := r.db.Clauses(clause.Returning{}).
+		Where("token_hash = ?", tokenHash).
+		Delete(&tickets).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(tickets) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &tickets[0], nil
+}
+
+// DeleteExpired removes tickets that were never used
+func (r *wsTicketRepository) DeleteExpired(now time.Time) (int64, error) {
+	result := r.db.Where("expires_at <= ?", now).Delete(&models.WSTicket{})
+	return result.RowsAffected, result.Error
+}
@@ -6,6 +6,10 @@ import (
 	"errors"
 )
 
+// ErrNotModerator is returned when a moderator-only action is attempted by
+// someone else
+var ErrNotModerator = errors.New("only moderators can do this")
+
 // ChatRoomService handles chat room business logic
 type ChatRoomService interface {
 	CreateChatRoom(name, description string, creatorID uint) (*models.ChatRoom, error)
@@ -13,20 +17,28 @@ type ChatRoomService interface {
 	GetChatRoomWithMessages(id uint) (*models.ChatRoom, error)
 	GetAllChatRooms() ([]models.ChatRoom, error)
 	UpdateChatRoom(id uint, name, description string, userID uint) (*models.ChatRoom, error)
+	SetMaxFileSize(id uint, size int64, userID uint) (*models.ChatRoom, error)
 	DeleteChatRoom(id uint, userID uint) error
 	GetUserChatRooms(userID uint) ([]models.ChatRoom, error)
+	GetModerators(id uint) ([]models.ChatRoomModerator, error)
+	AddModerator(id, moderatorID, userID uint) error
+	RemoveModerator(id, moderatorID, userID uint) error
+	CheckExists(id uint) error
 }
 
 type chatRoomService struct {
-	chatRoomRepo repository.ChatRoomRepository
-	userRepo     repository.UserRepository
+	chatRoomRepo    repository.ChatRoomRepository
+	userRepo        repository.UserRepository
+	maxRoomFileSize int64
 }
 
-// NewChatRoomService creates a new chat room service
-func NewChatRoomService(chatRoomRepo repository.ChatRoomRepository, userRepo repository.UserRepository) ChatRoomService {
+// NewChatRoomService creates a new chat room service. Room creators may raise
+// or lower their room's file size limit up to maxRoomFileSize bytes.
+func NewChatRoomService(chatRoomRepo repository.ChatRoomRepository, userRepo repository.UserRepository, maxRoomFileSize int64) ChatRoomService {
 	return &chatRoomService{
-		chatRoomRepo: chatRoomRepo,
-		userRepo:     userRepo,
+		chatRoomRepo:    chatRoomRepo,
+		userRepo:        userRepo,
+		maxRoomFileSize: maxRoomFileSize,
 	}
 }
 
@@ -103,6 +115,30 @@ func (s *chatRoomService) UpdateChatRoom(id uint, name, description string, user
 	return chatRoom, nil
 }
 
+// SetMaxFileSize sets the largest file that can be uploaded to the chat room,
+// creator only; 0 restores the configured default
+func (s *chatRoomService) SetMaxFileSize(id uint, size int64, userID uint) (*models.ChatRoom, error) {
+	chatRoom, err := s.chatRoomRepo.GetByID(id)
+	if err != nil {
+		return nil, errors.New("chat room not found")
+	}
+
+	if chatRoom.CreatedBy != userID {
+		return nil, errors.New("only the creator can change the file size limit")
+	}
+
+	if size < 0 || (s.maxRoomFileSize > 0 && size > s.maxRoomFileSize) {
+		return nil, errors.New("file size limit is out of range")
+	}
+
+	chatRoom.MaxFileSize = size
+	if err := s.chatRoomRepo.Update(chatRoom); err != nil {
+		return nil, errors.New("failed to update chat room")
+	}
+
+	return chatRoom, nil
+}
+
 func (s *chatRoomService) DeleteChatRoom(id uint, userID uint) error {
 	// Get existing chat room
 	chatRoom, err := s.chatRoomRepo.GetByID(id)
@@ -127,3 +163,60 @@ func (s *chatRoomService) GetUserChatRooms(userID uint) ([]models.ChatRoom, erro
 
 	return s.chatRoomRepo.GetByCreatorID(userID)
 }
+
+func (s *chatRoomService) GetModerators(id uint) ([]models.ChatRoomModerator, error) {
+	// Validate chat room exists
+	_, err := s.chatRoomRepo.GetByID(id)
+	if err != nil {
+		return nil, errors.New("chat room not found")
+	}
+
+	return s.chatRoomRepo.GetModerators(id)
+}
+
+func (s *chatRoomService) AddModerator(id, moderatorID, userID uint) error {
+	// Get existing chat room
+	chatRoom, err := s.chatRoomRepo.GetByID(id)
+	if err != nil {
+		return errors.New("chat room not found")
+	}
+
+	// Check if user is the creator
+	if chatRoom.CreatedBy != userID {
+		return errors.New("only the creator can manage moderators")
+	}
+
+	// Validate moderator exists
+	_, err = s.userRepo.GetByID(moderatorID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+
+	return s.chatRoomRepo.AddModerator(&models.ChatRoomModerator{ChatRoomID: id, UserID: moderatorID})
+}
+
+func (s *chatRoomService) RemoveModerator(id, moderatorID, userID uint) error {
+	// Get existing chat room
+	chatRoom, err := s.chatRoomRepo.GetByID(id)
+	if err != nil {
+		return errors.New("chat room not found")
+	}
+
+	// Check if user is the creator
+	if chatRoom.CreatedBy != userID {
+		return errors.New("only the creator can manage moderators")
+	}
+
+	return s.chatRoomRepo.RemoveModerator(id, moderatorID)
+}
+
+// CheckExists returns an error if the chat room does not exist. Chat rooms
+// are public: any authenticated user may read and post in any room, as the
+// room list and the REST message endpoints already allow, so existence is
+// all that subscribing to a room requires.
+func (s *chatRoomService) CheckExists(id uint) error {
+	if _, err := s.chatRoomRepo.GetByID(id); err != nil {
+		return errors.New("chat room not found")
+	}
+	return nil
+}
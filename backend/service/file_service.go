@@ -5,19 +5,39 @@ import (
 	"chatapp/models"
 	"chatapp/repository"
 	"chatapp/storage"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"mime"
 	"mime/multipart"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
+const (
+	// uploadURLTTL 预签名上传URL的有效期
+	uploadURLTTL = 15 * time.Minute
+	// pendingUploadTTL 通过预签名URL上传的文件须在此时间内确认，否则被删除
+	pendingUploadTTL = time.Hour
+)
+
 type FileService struct {
-	fileRepo *repository.FileRepository
-	storage  storage.Storage
+	fileRepo          *repository.FileRepository
+	chatRoomRepo      repository.ChatRoomRepository
+	pendingUploadRepo repository.PendingUploadRepository
+	blobRepo          repository.BlobRepository
+	storage           storage.Storage
+	maxFileSize       int64
 }
 
-func NewFileService(fileRepo *repository.FileRepository) *FileService {
+// NewFileService 创建文件服务，maxFileSize 为未单独设置限制的聊天室的文件大小上限（字节）
+func NewFileService(fileRepo *repository.FileRepository, chatRoomRepo repository.ChatRoomRepository, pendingUploadRepo repository.PendingUploadRepository, blobRepo repository.BlobRepository, maxFileSize int64) *FileService {
 	// 创建存储工厂
 	factory := storage.NewStorageFactory()
 
@@ -32,32 +52,14 @@ func NewFileService(fileRepo *repository.FileRepository) *FileService {
 		panic(fmt.Sprintf("Unsupported storage type: %s", storageType))
 	}
 
+	// 解码与存储类型同名的配置段并创建存储实例，各存储类型在 storage 包中注册
+	storageConfig, err := factory.NewConfig(storageType)
+	if err == nil {
+		err = config.UnmarshalSection(storageType, storageConfig)
+	}
 	var storageInstance storage.Storage
-	var err error
-
-	// 根据类型创建存储实例
-	switch storageType {
-	case storage.StorageTypeMinio:
-		minioConfig := storage.MinioConfig{
-			Endpoint:   config.GlobalConfig.Minio.Endpoint,
-			AccessKey:  config.GlobalConfig.Minio.AccessKey,
-			SecretKey:  config.GlobalConfig.Minio.SecretKey,
-			BucketName: config.GlobalConfig.Minio.BucketName,
-			UseSSL:     config.GlobalConfig.Minio.UseSSL,
-			Region:     config.GlobalConfig.Minio.Region,
-		}
-		storageInstance, err = factory.CreateStorage(storageType, minioConfig)
-
-	case storage.StorageTypeQiniu:
-		qiniuConfig := storage.QiniuStorageConfig{
-			AccessKey: config.GlobalConfig.Qiniu.AccessKey,
-			SecretKey: config.GlobalConfig.Qiniu.SecretKey,
-			Bucket:    config.GlobalConfig.Qiniu.Bucket,
-			Domain:    config.GlobalConfig.Qiniu.Domain,
-			Region:    config.GlobalConfig.Qiniu.Region,
-			UseHTTPS:  config.GlobalConfig.Qiniu.UseHTTPS,
-		}
-		storageInstance, err = factory.CreateStorage(storageType, qiniuConfig)
+	if err == nil {
+		storageInstance, err = factory.CreateStorage(storageType, storageConfig)
 	}
 
 	if err != nil {
@@ -65,51 +67,90 @@ func NewFileService(fileRepo *repository.FileRepository) *FileService {
 	}
 
 	return &FileService{
-		fileRepo: fileRepo,
-		storage:  storageInstance,
+		fileRepo:          fileRepo,
+		chatRoomRepo:      chatRoomRepo,
+		pendingUploadRepo: pendingUploadRepo,
+		blobRepo:          blobRepo,
+		storage:           storageInstance,
+		maxFileSize:       maxFileSize,
 	}
 }
 
-// UploadFile 上传文件
-func (s *FileService) UploadFile(file *multipart.FileHeader, chatRoomID, uploaderID uint) (*models.File, error) {
-	// 打开文件
-	src, err := file.Open()
+// Storage 返回存储实例
+func (s *FileService) Storage() storage.Storage {
+	return s.storage
+}
+
+// CreateFile 为已存入存储的对象创建文件记录
+func (s *FileService) CreateFile(record *models.File) error {
+	return s.fileRepo.Create(record)
+}
+
+// MaxFileSize 返回聊天室允许上传的最大文件大小（字节）
+func (s *FileService) MaxFileSize(chatRoomID uint) (int64, error) {
+	chatRoom, err := s.chatRoomRepo.GetByID(chatRoomID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return 0, fmt.Errorf("chat room not found")
 	}
-	defer src.Close()
+	if chatRoom.MaxFileSize > 0 {
+		return chatRoom.MaxFileSize, nil
+	}
+	return s.maxFileSize, nil
+}
 
-	// 生成唯一的文件路径，按聊天室分组
-	timestamp := time.Now().Unix()
-	fileExt := filepath.Ext(file.Filename)
-	fileName := strings.TrimSuffix(file.Filename, fileExt)
-	objectPath := fmt.Sprintf("chatroom-%d/%d-%s%s", chatRoomID, timestamp, fileName, fileExt)
+// objectPath 生成唯一的文件路径，按聊天室分组
+// 同一请求中可能有同名文件，使用纳秒时间戳避免路径冲突
+func objectPath(chatRoomID uint, fileName string) string {
+	fileExt := filepath.Ext(fileName)
+	baseName := strings.TrimSuffix(fileName, fileExt)
+	return fmt.Sprintf("chatroom-%d/%d-%s%s", chatRoomID, time.Now().UnixNano(), baseName, fileExt)
+}
 
-	// 上传到存储
-	uploadOptions := storage.UploadOptions{
-		ContentType: file.Header.Get("Content-Type"),
-		Size:        file.Size,
-	}
+// blobPathPrefix 是内容对象所在的目录。上传链接只指向 chatroom-* 下的路径，
+// 内容对象不会被客户端覆盖
+const blobPathPrefix = "blobs/"
 
-	uploadResult, err := s.storage.Upload(objectPath, src, uploadOptions)
-	if err != nil {
-		return nil, fmt.Errorf("failed to upload file: %w", err)
+// blobObjectPath 生成内容的存储路径，按 SHA-256 分组
+// 同一内容的最后一个引用释放后可能马上被再次存入，路径带纳秒时间戳，
+// 删除旧对象不会误删新存入的对象。路径保留 fileName 的扩展名，
+// 按扩展名推断类型的存储（如本地存储）因此能得出内容类型
+func blobObjectPath(sum, fileName string) string {
+	return fmt.Sprintf("%s%s/%s-%d%s", blobPathPrefix, sum[:2], sum, time.Now().UnixNano(), blobExt(fileName))
+}
+
+// blobExt 返回 fileName 的扩展名（小写），只由字母和数字组成且不超过 10 个字符，
+// 否则返回空字符串
+func blobExt(fileName string) string {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if len(ext) < 2 || len(ext) > 11 {
+		return ""
+	}
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return ""
+		}
 	}
+	return ext
+}
 
-	// 创建数据库记录
-	fileRecord := &models.File{
-		FileName:    file.Filename,
-		FilePath:    uploadResult.ObjectPath,
-		FileSize:    uploadResult.Size,
-		ContentType: file.Header.Get("Content-Type"),
-		ChatRoomID:  chatRoomID,
-		UploaderID:  uploaderID,
+// LocalStorage 返回本地存储实例，使用其他存储时返回 nil
+// 本地存储的签名URL由服务自身处理，路由据此注册
+func (s *FileService) LocalStorage() *storage.LocalStorage {
+	local, _ := s.storage.(*storage.LocalStorage)
+	return local
+}
+
+// UploadFile 上传文件
+func (s *FileService) UploadFile(file *multipart.FileHeader, chatRoomID, uploaderID uint) (*models.File, error) {
+	fileRecord, err := s.storeObject(file, chatRoomID, uploaderID)
+	if err != nil {
+		return nil, err
 	}
 
 	err = s.fileRepo.Create(fileRecord)
 	if err != nil {
-		// 如果数据库插入失败，尝试删除已上传的文件
-		s.storage.Delete(objectPath)
+		// 如果数据库插入失败，释放已上传的文件
+		s.RemoveObjects([]*models.File{fileRecord})
 		return nil, fmt.Errorf("failed to create file record: %w", err)
 	}
 
@@ -129,15 +170,35 @@ func (s *FileService) DownloadFile(fileID uint) (string, *models.File, error) {
 		return "", nil, fmt.Errorf("file not found: %w", err)
 	}
 
-	// 生成下载URL（有效期1小时）
-	downloadURL, err := s.storage.Download(fileRecord.FilePath, time.Hour)
+	// 扫描中、已感染或无法扫描的文件被隔离，不能下载
+	if fileRecord.Quarantined() {
+		if fileRecord.ScanStatus == models.ScanPending {
+			return "", nil, fmt.Errorf("file is being scanned")
+		}
+		return "", nil, fmt.Errorf("file is quarantined")
+	}
+
+	downloadURL, err := s.DownloadURL(fileRecord)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to generate download url: %w", err)
+		return "", nil, err
 	}
 
 	return downloadURL, fileRecord, nil
 }
 
+// DownloadURL 生成文件的下载URL（有效期1小时），以文件的原始名称和类型下载
+// 内容对象可能由多个文件共用，名称和类型取自文件记录而非对象路径
+func (s *FileService) DownloadURL(record *models.File) (string, error) {
+	downloadURL, err := storage.DownloadAs(s.storage, record.FilePath, time.Hour, storage.DownloadOptions{
+		FileName:    record.FileName,
+		ContentType: record.ContentType,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to generate download url: %w", err)
+	}
+	return downloadURL, nil
+}
+
 // GetFilesByRoom 获取聊天室文件列表
 func (s *FileService) GetFilesByRoom(chatRoomID uint) ([]models.File, error) {
 	return s.fileRepo.GetByChatRoomID(chatRoomID)
@@ -160,46 +221,504 @@ func (s *FileService) GetFilesByUser(userID uint) ([]models.File, error) {
 }
 
 // DeleteFile 删除文件
-func (s *FileService) DeleteFile(fileID, userID uint) error {
+// 返回引用了该文件的消息ID，调用方可据此通知客户端消息已变更
+func (s *FileService) DeleteFile(fileID, userID uint) ([]uint, error) {
 	// 获取文件记录
 	fileRecord, err := s.fileRepo.GetByID(fileID)
 	if err != nil {
-		return fmt.Errorf("file not found: %w", err)
+		return nil, fmt.Errorf("file not found: %w", err)
 	}
 
 	// 检查权限（只有上传者可以删除）
 	if fileRecord.UploaderID != userID {
-		return fmt.Errorf("permission denied: only uploader can delete the file")
+		return nil, fmt.Errorf("permission denied: only uploader can delete the file")
 	}
 
-	// 从存储删除文件
-	err = s.storage.Delete(fileRecord.FilePath)
+	// 从数据库删除记录（同时解除与消息的关联）
+	messageIDs, err := s.fileRepo.Delete(fileID)
 	if err != nil {
-		return fmt.Errorf("failed to delete file from storage: %w", err)
+		return nil, fmt.Errorf("failed to delete file record: %w", err)
 	}
 
-	// 从数据库删除记录
-	err = s.fileRepo.Delete(fileID)
+	// 从存储删除文件，其他文件仍使用相同内容时保留
+	if err := s.releaseObject(fileRecord); err != nil {
+		log.Printf("Failed to delete object %s: %v", fileRecord.FilePath, err)
+	}
+
+	return messageIDs, nil
+}
+
+// StoreAttachments 将多个文件上传到存储，返回尚未保存到数据库的文件记录
+// 任意一个文件上传失败时，已上传的文件会被删除
+func (s *FileService) StoreAttachments(files []*multipart.FileHeader, chatRoomID, uploaderID uint) ([]*models.File, error) {
+	records := make([]*models.File, 0, len(files))
+	for _, file := range files {
+		record, err := s.storeObject(file, chatRoomID, uploaderID)
+		if err != nil {
+			s.RemoveObjects(records)
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// storeObject 上传单个文件到存储，不创建数据库记录
+// 已存有相同内容（SHA-256 相同）时不再上传，记录指向已有的对象
+func (s *FileService) storeObject(file *multipart.FileHeader, chatRoomID, uploaderID uint) (*models.File, error) {
+	src, err := file.Open()
 	if err != nil {
-		return fmt.Errorf("failed to delete file record: %w", err)
+		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
+	defer src.Close()
 
+	hash := sha256.New()
+	if _, err := io.Copy(hash, src); err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", file.Filename, err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", file.Filename, err)
+	}
+
+	record := &models.File{
+		FileName:      file.Filename,
+		ContentType:   file.Header.Get("Content-Type"),
+		ChatRoomID:    chatRoomID,
+		UploaderID:    uploaderID,
+		PreviewStatus: previewStatus(file.Header.Get("Content-Type")),
+		ScanStatus:    scanStatus(),
+	}
+	if _, err := s.StoreContent(record, src, file.Size, sum); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// StoreContent 保存内容为 sum（SHA-256 十六进制）的文件，设置 record 的内容、对象和大小
+// 已存有相同内容时不再上传，记录指向已有的对象；否则上传到内容路径（见 blobObjectPath）并登记。
+// 返回是否使用了已有的内容
+func (s *FileService) StoreContent(record *models.File, content io.Reader, size int64, sum string) (bool, error) {
+	if blob := s.reuseBlob(sum); blob != nil {
+		record.BlobID = &blob.ID
+		record.FilePath = blob.ObjectPath
+		record.FileSize = blob.Size
+		return true, nil
+	}
+
+	uploadResult, err := s.storage.Upload(blobObjectPath(sum, record.FileName), content, storage.UploadOptions{
+		ContentType: record.ContentType,
+		Size:        size,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to upload file %s: %w", record.FileName, err)
+	}
+	record.FilePath = uploadResult.ObjectPath
+	record.FileSize = uploadResult.Size
+	if err := s.attachBlob(record, sum); err != nil {
+		return false, err
+	}
+	return record.FilePath != uploadResult.ObjectPath, nil
+}
+
+// reuseBlob 返回内容为 sum 的已存内容并增加其引用，没有时返回 nil
+func (s *FileService) reuseBlob(sum string) *models.Blob {
+	blob, err := s.blobRepo.GetBySHA256(sum)
+	if err != nil {
+		return nil
+	}
+	// 最后一个引用正被释放的内容不再使用
+	if ok, err := s.blobRepo.AddRef(blob.ID); err != nil || !ok {
+		return nil
+	}
+	return blob
+}
+
+// attachBlob 将 record 指向的、刚存入内容路径的对象登记为内容 sum（SHA-256 十六进制）
+// 同时存入了相同内容时删除该对象，record 改为指向已有的对象；登记失败时同样删除该对象
+func (s *FileService) attachBlob(record *models.File, sum string) error {
+	blob := &models.Blob{
+		SHA256:      sum,
+		ObjectPath:  record.FilePath,
+		Size:        record.FileSize,
+		ContentType: record.ContentType,
+	}
+	if err := s.blobRepo.Acquire(blob); err != nil {
+		s.storage.Delete(record.FilePath)
+		return fmt.Errorf("failed to record file content: %w", err)
+	}
+
+	if blob.ObjectPath != record.FilePath {
+		if err := s.storage.Delete(record.FilePath); err != nil {
+			log.Printf("Failed to delete duplicate object %s: %v", record.FilePath, err)
+		}
+		record.FilePath = blob.ObjectPath
+	}
+	record.BlobID = &blob.ID
 	return nil
 }
 
-// GetUploadURL 获取文件上传的预签名URL（可选功能，用于前端直接上传）
-func (s *FileService) GetUploadURL(fileName string, chatRoomID uint) (string, string, error) {
-	// 生成对象路径
-	timestamp := time.Now().Unix()
-	fileExt := filepath.Ext(fileName)
-	baseFileName := strings.TrimSuffix(fileName, fileExt)
-	objectPath := fmt.Sprintf("chatroom-%d/%d-%s%s", chatRoomID, timestamp, baseFileName, fileExt)
+// RemoveObjects 释放文件对其对象的引用（不处理数据库记录），
+// 对象不再被任何文件使用时从存储删除。
+// 用于清理上传成功但未能关联到消息的文件，以及随消息删除的附件
+func (s *FileService) RemoveObjects(files []*models.File) {
+	for _, file := range files {
+		if err := s.releaseObject(file); err != nil {
+			log.Printf("Failed to delete object %s: %v", file.FilePath, err)
+		}
+	}
+}
+
+// releaseObject 释放文件对其对象的引用，最后一个引用释放时删除对象
+func (s *FileService) releaseObject(file *models.File) error {
+	// 内容去重之前上传且尚未回填的文件独占其对象
+	if file.BlobID == nil {
+		return s.storage.Delete(file.FilePath)
+	}
+
+	blob, removed, err := s.blobRepo.Release(*file.BlobID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return nil
+	}
+
+	// 图片的预览随内容一起删除
+	for _, path := range previewObjectPaths(blob.ID) {
+		if err := s.storage.Delete(path); err != nil {
+			log.Printf("Failed to delete preview %s: %v", path, err)
+		}
+	}
+	return s.storage.Delete(blob.ObjectPath)
+}
 
-	// 生成预签名上传URL（有效期15分钟）
-	uploadURL, err := s.storage.GetUploadURL(objectPath, 15*time.Minute)
+// GetUploadURL 获取文件上传的预签名URL（用于前端直接上传）
+// 同时记录待确认的上传：文件上传后须调用 ConfirmUpload 才会创建文件记录，
+// 过期未确认的对象由 Run 删除。size、contentType、checksum（MD5 十六进制）可选，
+// 声明后确认时会与存储中的对象核对
+func (s *FileService) GetUploadURL(fileName string, chatRoomID, uploaderID uint, size int64, contentType, checksum string) (string, *models.PendingUpload, error) {
+	maxFileSize, err := s.MaxFileSize(chatRoomID)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to generate upload url: %w", err)
+		return "", nil, err
 	}
+	if size < 0 {
+		return "", nil, fmt.Errorf("invalid file size")
+	}
+	if size > maxFileSize {
+		return "", nil, fmt.Errorf("file is too large")
+	}
+	checksum = strings.ToLower(checksum)
+	if checksum != "" && !isMD5(checksum) {
+		return "", nil, fmt.Errorf("invalid checksum")
+	}
+
+	path := objectPath(chatRoomID, fileName)
+	uploadURL, err := s.storage.GetUploadURL(path, uploadURLTTL)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate upload url: %w", err)
+	}
+
+	pending := &models.PendingUpload{
+		ObjectPath:  path,
+		FileName:    fileName,
+		ContentType: contentType,
+		Size:        size,
+		Checksum:    checksum,
+		ChatRoomID:  chatRoomID,
+		UploaderID:  uploaderID,
+		ExpiresAt:   time.Now().Add(pendingUploadTTL),
+	}
+	if err := s.pendingUploadRepo.Create(pending); err != nil {
+		return "", nil, fmt.Errorf("failed to record pending upload: %w", err)
+	}
+
+	return uploadURL, pending, nil
+}
+
+// ConfirmUpload 确认通过预签名URL上传的文件：核对存储中对象的大小、类型和校验和，
+// 返回尚未保存到数据库的文件记录，由调用方单独保存或作为消息附件保存。
+// 核对不通过时待确认记录保留，客户端可以重新上传后再确认；超过聊天室上限的对象直接删除。
+// 预签名URL在有效期内可以反复写入，所以核对的是此刻读出的内容，文件保存为该内容在
+// 服务端新路径下的副本（与已存文件内容相同时指向已有的对象），预签名路径上的对象随后删除
+func (s *FileService) ConfirmUpload(objectPath string, userID uint, checksum string) (*models.File, error) {
+	pending, err := s.pendingUploadRepo.GetByObjectPath(objectPath)
+	if err != nil || pending.UploaderID != userID || !time.Now().Before(pending.ExpiresAt) {
+		return nil, fmt.Errorf("pending upload not found")
+	}
+
+	info, err := s.storage.GetFileInfo(objectPath)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, fmt.Errorf("file has not been uploaded")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	maxFileSize, err := s.MaxFileSize(pending.ChatRoomID)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size > maxFileSize {
+		s.discardPendingUpload(pending)
+		return nil, fmt.Errorf("file is too large")
+	}
+	if pending.Size > 0 && info.Size != pending.Size {
+		return nil, fmt.Errorf("file size mismatch")
+	}
+
+	// 存储未记录具体类型时（如本地存储按扩展名推断不出）以声明的类型为准
+	contentType := pending.ContentType
+	if !isGenericContentType(info.ContentType) {
+		if contentType != "" && baseContentType(contentType) != baseContentType(info.ContentType) {
+			return nil, fmt.Errorf("content type mismatch")
+		}
+		contentType = info.ContentType
+	}
+
+	// 对象在读出之前仍可能被覆盖，大小以读出的内容为准再核对一次
+	snapshot, err := s.snapshotObject(objectPath, maxFileSize)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Close()
+	if snapshot.size > maxFileSize {
+		s.discardPendingUpload(pending)
+		return nil, fmt.Errorf("file is too large")
+	}
+	if pending.Size > 0 && snapshot.size != pending.Size {
+		return nil, fmt.Errorf("file size mismatch")
+	}
+	if checksum == "" {
+		checksum = pending.Checksum
+	}
+	if checksum != "" && !strings.EqualFold(snapshot.md5, checksum) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+
+	// 与同时进行的确认或过期清理之间，只有删除了记录的一方继续处理该对象
+	claimed, err := s.pendingUploadRepo.Delete(pending.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to confirm upload: %w", err)
+	}
+	if !claimed {
+		return nil, fmt.Errorf("pending upload not found")
+	}
+	// 待确认记录已删除，过期清理不会再处理预签名路径上的对象
+	defer func() {
+		if err := s.storage.Delete(objectPath); err != nil {
+			log.Printf("Failed to delete confirmed upload %s: %v", objectPath, err)
+		}
+	}()
+
+	record := &models.File{
+		FileName:      pending.FileName,
+		ContentType:   contentType,
+		ChatRoomID:    pending.ChatRoomID,
+		UploaderID:    pending.UploaderID,
+		PreviewStatus: previewStatus(contentType),
+		ScanStatus:    scanStatus(),
+	}
+	if _, err := s.StoreContent(record, snapshot.file, snapshot.size, snapshot.sha256); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// objectSnapshot 是已存对象在某一时刻的内容，保存在临时文件中
+type objectSnapshot struct {
+	file   *os.File
+	size   int64
+	sha256 string
+	md5    string
+}
+
+// Close 关闭并删除临时文件
+func (s *objectSnapshot) Close() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// snapshotObject 将已存对象复制到临时文件，同时计算其内容的 SHA-256 和 MD5（十六进制）
+// maxSize 大于 0 时最多读取 maxSize+1 字节，对象更大时 size 超过 maxSize
+func (s *FileService) snapshotObject(objectPath string, maxSize int64) (*objectSnapshot, error) {
+	reader, err := storage.OpenObject(s.storage, objectPath)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, fmt.Errorf("file has not been uploaded")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	defer reader.Close()
+
+	file, err := os.CreateTemp("", "chatapp-confirm-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	snapshot := &objectSnapshot{file: file}
+
+	sha256Hash := sha256.New()
+	md5Hash := md5.New()
+	var content io.Reader = reader
+	if maxSize > 0 {
+		content = io.LimitReader(reader, maxSize+1)
+	}
+	snapshot.size, err = io.Copy(io.MultiWriter(file, sha256Hash, md5Hash), content)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		snapshot.Close()
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	snapshot.sha256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	snapshot.md5 = hex.EncodeToString(md5Hash.Sum(nil))
+	return snapshot, nil
+}
+
+// FilesWithoutBlob 返回内容去重之前上传、尚未登记内容的文件，按ID升序
+func (s *FileService) FilesWithoutBlob(afterID uint, limit int) ([]models.File, error) {
+	return s.fileRepo.GetWithoutBlob(afterID, limit)
+}
+
+// BackfillBlob 计算内容去重之前上传的文件的 SHA-256 并登记其内容
+// 内容复制到内容路径（已存有相同内容时文件改为指向已有的对象），原对象不再被其他文件使用时删除。
+// 返回文件是否与已有内容合并
+func (s *FileService) BackfillBlob(file *models.File) (bool, error) {
+	snapshot, err := s.snapshotObject(file.FilePath, 0)
+	if err != nil {
+		return false, err
+	}
+	defer snapshot.Close()
+
+	record := &models.File{FileName: file.FileName, ContentType: file.ContentType}
+	merged, err := s.StoreContent(record, snapshot.file, snapshot.size, snapshot.sha256)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := s.fileRepo.SetBlob(file.ID, *record.BlobID, record.FilePath)
+	if err != nil || !updated {
+		// 文件在此期间被删除或已登记，撤销刚增加的引用
+		if releaseErr := s.releaseObject(record); releaseErr != nil {
+			log.Printf("Failed to release content of file %d: %v", file.ID, releaseErr)
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to update file: %w", err)
+		}
+		return false, nil
+	}
+
+	// 旧文件可能因路径相同而共用一个对象，留给其中最后登记的一个删除
+	count, err := s.fileRepo.CountWithoutBlobByFilePath(file.FilePath)
+	if err != nil {
+		return merged, fmt.Errorf("failed to count files using %s: %w", file.FilePath, err)
+	}
+	if count == 0 {
+		if err := s.storage.Delete(file.FilePath); err != nil {
+			return merged, fmt.Errorf("failed to delete old object: %w", err)
+		}
+	}
+	return merged, nil
+}
+
+// MisplacedBlobs 返回对象不在内容路径下的内容，即内容路径启用之前登记的，按ID升序
+func (s *FileService) MisplacedBlobs(afterID uint, limit int) ([]models.Blob, error) {
+	return s.blobRepo.GetOutside(blobPathPrefix, afterID, limit)
+}
+
+// RelocateBlob 将内容的对象复制到内容路径，内容及使用它的文件改为指向新对象后删除原对象。
+// 原对象登记后被覆盖、与登记的 SHA-256 不符时返回错误，不做改动。
+// 迁移期间刚复用该内容、尚未保存的文件仍指向原对象，应在没有上传时运行
+func (s *FileService) RelocateBlob(blob *models.Blob) error {
+	snapshot, err := s.snapshotObject(blob.ObjectPath, 0)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	if snapshot.sha256 != blob.SHA256 {
+		return fmt.Errorf("content of %s no longer matches its sha256", blob.ObjectPath)
+	}
+
+	// 原对象路径带有首次上传时的文件名
+	uploadResult, err := s.storage.Upload(blobObjectPath(blob.SHA256, blob.ObjectPath), snapshot.file, storage.UploadOptions{
+		ContentType: blob.ContentType,
+		Size:        snapshot.size,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload content: %w", err)
+	}
+
+	moved, err := s.blobRepo.Move(blob.ID, blob.ObjectPath, uploadResult.ObjectPath)
+	if err != nil || !moved {
+		// 内容在此期间被删除或已迁移
+		if deleteErr := s.storage.Delete(uploadResult.ObjectPath); deleteErr != nil {
+			log.Printf("Failed to delete object %s: %v", uploadResult.ObjectPath, deleteErr)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update content: %w", err)
+		}
+		return nil
+	}
+	if err := s.storage.Delete(blob.ObjectPath); err != nil {
+		return fmt.Errorf("failed to delete old object: %w", err)
+	}
+	return nil
+}
+
+// discardPendingUpload 删除待确认的上传及其对象
+func (s *FileService) discardPendingUpload(pending *models.PendingUpload) {
+	claimed, err := s.pendingUploadRepo.Delete(pending.ID)
+	if err != nil {
+		log.Printf("Failed to delete pending upload %s: %v", pending.ObjectPath, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	if err := s.storage.Delete(pending.ObjectPath); err != nil {
+		log.Printf("Failed to delete unconfirmed object %s: %v", pending.ObjectPath, err)
+	}
+}
+
+// Run 定期删除过期未确认的上传及其对象
+func (s *FileService) Run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pending, err := s.pendingUploadRepo.GetExpired(time.Now(), 100)
+		if err != nil {
+			log.Printf("Failed to list expired pending uploads: %v", err)
+			continue
+		}
+		for i := range pending {
+			s.discardPendingUpload(&pending[i])
+		}
+	}
+}
+
+// isMD5 检查字符串是否为十六进制的 MD5
+func isMD5(s string) bool {
+	if len(s) != 2*md5.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// baseContentType 返回不含参数的小写内容类型
+func baseContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mediaType
+}
 
-	return uploadURL, objectPath, nil
+// isGenericContentType 检查内容类型是否未指明具体类型
+func isGenericContentType(contentType string) bool {
+	base := baseContentType(contentType)
+	return base == "" || base == "application/octet-stream" || base == "binary/octet-stream"
 }
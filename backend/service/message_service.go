@@ -4,12 +4,22 @@ import (
 	"chatapp/models"
 	"chatapp/repository"
 	"errors"
+	"log"
+	"unicode/utf8"
 )
 
+// maxClientNonceLength matches the size of the messages.client_nonce column
+const maxClientNonceLength = 64
+
+// defaultMaxContentLength is the longest message content accepted, in
+// characters, unless configured otherwise
+const defaultMaxContentLength = 4000
+
 // MessageService handles message business logic
 type MessageService interface {
-	CreateMessage(content string, userID, chatRoomID uint) (*models.Message, error)
+	CreateMessage(content string, userID, chatRoomID uint, clientNonce string) (*models.Message, bool, error)
 	CreateFileMessage(content string, userID, chatRoomID uint) (*models.Message, error)
+	CreateMessageWithAttachments(content string, userID, chatRoomID uint, files []*models.File, clientNonce string) (*models.Message, bool, error)
 	GetMessage(id uint) (*models.Message, error)
 	GetChatRoomMessages(chatRoomID uint, limit, offset int) ([]models.Message, error)
 	GetUserMessages(userID uint, limit, offset int) ([]models.Message, error)
@@ -20,52 +30,88 @@ type MessageService interface {
 }
 
 type messageService struct {
-	messageRepo  repository.MessageRepository
-	userRepo     repository.UserRepository
-	chatRoomRepo repository.ChatRoomRepository
+	messageRepo         repository.MessageRepository
+	userRepo            repository.UserRepository
+	chatRoomRepo        repository.ChatRoomRepository
+	notificationService NotificationService
+	fileService         *FileService
+	maxContentLength    int
 }
 
 // NewMessageService creates a new message service
-func NewMessageService(messageRepo repository.MessageRepository, userRepo repository.UserRepository, chatRoomRepo repository.ChatRoomRepository) MessageService {
+func NewMessageService(messageRepo repository.MessageRepository, userRepo repository.UserRepository, chatRoomRepo repository.ChatRoomRepository, notificationService NotificationService, fileService *FileService, maxContentLength int) MessageService {
+	if maxContentLength <= 0 {
+		maxContentLength = defaultMaxContentLength
+	}
+
 	return &messageService{
-		messageRepo:  messageRepo,
-		userRepo:     userRepo,
-		chatRoomRepo: chatRoomRepo,
+		messageRepo:         messageRepo,
+		userRepo:            userRepo,
+		chatRoomRepo:        chatRoomRepo,
+		notificationService: notificationService,
+		fileService:         fileService,
+		maxContentLength:    maxContentLength,
 	}
 }
 
-func (s *messageService) CreateMessage(content string, userID, chatRoomID uint) (*models.Message, error) {
+// contentTooLong reports whether message content exceeds the configured length
+func (s *messageService) contentTooLong(content string) bool {
+	return utf8.RuneCountInString(content) > s.maxContentLength
+}
+
+// CreateMessage saves a text message. A client nonce makes the call
+// idempotent: resending it returns the original message and false.
+func (s *messageService) CreateMessage(content string, userID, chatRoomID uint, clientNonce string) (*models.Message, bool, error) {
 	// Validate content
 	if content == "" {
-		return nil, errors.New("message content is required")
+		return nil, false, errors.New("message content is required")
+	}
+	if s.contentTooLong(content) {
+		return nil, false, errors.New("message content is too long")
+	}
+	if len(clientNonce) > maxClientNonceLength {
+		return nil, false, errors.New("client nonce is too long")
 	}
 
 	// Validate user exists
 	_, err := s.userRepo.GetByID(userID)
 	if err != nil {
-		return nil, errors.New("user not found")
+		return nil, false, errors.New("user not found")
 	}
 
 	// Validate chat room exists
 	_, err = s.chatRoomRepo.GetByID(chatRoomID)
 	if err != nil {
-		return nil, errors.New("chat room not found")
+		return nil, false, errors.New("chat room not found")
 	}
 
 	message := &models.Message{
-		Content:    content,
-		UserID:     userID,
-		ChatRoomID: chatRoomID,
-		Type:       "message", // Default type is message
+		Content:     content,
+		UserID:      userID,
+		ChatRoomID:  chatRoomID,
+		Type:        "message", // Default type is message
+		ClientNonce: clientNonce,
 	}
 
-	err = s.messageRepo.Create(message)
+	created, err := s.messageRepo.Create(message)
 	if err != nil {
-		return nil, errors.New("failed to create message")
+		return nil, false, errors.New("failed to create message")
 	}
 
 	// Return message with user and chat room information
-	return s.messageRepo.GetByID(message.ID)
+	message, err = s.messageRepo.GetByID(message.ID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The message is saved either way, a failure here only loses notifications
+	if created {
+		if err := s.notificationService.ProcessMessage(message); err != nil {
+			log.Printf("Failed to process mentions for message %d: %v", message.ID, err)
+		}
+	}
+
+	return message, created, nil
 }
 
 func (s *messageService) CreateFileMessage(content string, userID, chatRoomID uint) (*models.Message, error) {
@@ -93,7 +139,7 @@ func (s *messageService) CreateFileMessage(content string, userID, chatRoomID ui
 		Type:       "file",
 	}
 
-	err = s.messageRepo.Create(message)
+	_, err = s.messageRepo.Create(message)
 	if err != nil {
 		return nil, errors.New("failed to create file message")
 	}
@@ -102,6 +148,70 @@ func (s *messageService) CreateFileMessage(content string, userID, chatRoomID ui
 	return s.messageRepo.GetByID(message.ID)
 }
 
+// CreateMessageWithAttachments saves already stored files and a "file" message
+// referencing them atomically. The text content is optional. As with
+// CreateMessage, a resent client nonce returns the original message and false;
+// the files are then not saved and the caller should remove their objects.
+func (s *messageService) CreateMessageWithAttachments(content string, userID, chatRoomID uint, files []*models.File, clientNonce string) (*models.Message, bool, error) {
+	if len(files) == 0 {
+		return nil, false, errors.New("at least one attachment is required")
+	}
+	if s.contentTooLong(content) {
+		return nil, false, errors.New("message content is too long")
+	}
+	if len(clientNonce) > maxClientNonceLength {
+		return nil, false, errors.New("client nonce is too long")
+	}
+
+	// Only the uploader may post a file, and only to the room it was uploaded to
+	for _, file := range files {
+		if file.UploaderID != userID {
+			return nil, false, errors.New("attachment was uploaded by another user")
+		}
+		if file.ChatRoomID != chatRoomID {
+			return nil, false, errors.New("attachment belongs to another chat room")
+		}
+	}
+
+	// Validate user exists
+	_, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, false, errors.New("user not found")
+	}
+
+	// Validate chat room exists
+	_, err = s.chatRoomRepo.GetByID(chatRoomID)
+	if err != nil {
+		return nil, false, errors.New("chat room not found")
+	}
+
+	message := &models.Message{
+		Content:     content,
+		UserID:      userID,
+		ChatRoomID:  chatRoomID,
+		Type:        "file",
+		ClientNonce: clientNonce,
+	}
+
+	created, err := s.messageRepo.CreateWithAttachments(message, files)
+	if err != nil {
+		return nil, false, errors.New("failed to create file message")
+	}
+
+	message, err = s.messageRepo.GetByID(message.ID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if created && content != "" {
+		if err := s.notificationService.ProcessMessage(message); err != nil {
+			log.Printf("Failed to process mentions for message %d: %v", message.ID, err)
+		}
+	}
+
+	return message, created, nil
+}
+
 func (s *messageService) GetMessage(id uint) (*models.Message, error) {
 	message, err := s.messageRepo.GetByID(id)
 	if err != nil {
@@ -145,6 +255,9 @@ func (s *messageService) UpdateMessage(id uint, content string, userID uint) (*m
 	if content == "" {
 		return nil, errors.New("message content is required")
 	}
+	if s.contentTooLong(content) {
+		return nil, errors.New("message content is too long")
+	}
 
 	// Get existing message
 	message, err := s.messageRepo.GetByID(id)
@@ -178,7 +291,19 @@ func (s *messageService) DeleteMessage(id uint, userID uint) error {
 		return errors.New("only the author can delete this message")
 	}
 
-	return s.messageRepo.Delete(id)
+	orphaned, err := s.messageRepo.Delete(id)
+	if err != nil {
+		return errors.New("failed to delete message")
+	}
+
+	// Attachments that belonged only to this message go with it
+	files := make([]*models.File, len(orphaned))
+	for i := range orphaned {
+		files[i] = &orphaned[i]
+	}
+	s.fileService.RemoveObjects(files)
+
+	return nil
 }
 
 func (s *messageService) GetRecentMessages(chatRoomID uint, limit int) ([]models.Message, error) {
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"chatapp/models"
+	"chatapp/repository"
+	"errors"
+	"testing"
+)
+
+// messageTable keeps messages in memory, deduplicating client nonces
+type messageTable struct {
+	repository.MessageRepository
+	messages map[uint]*models.Message
+}
+
+func newMessageTable() *messageTable {
+	return &messageTable{messages: make(map[uint]*models.Message)}
+}
+
+func (r *messageTable) CreateWithAttachments(message *models.Message, files []*models.File) (bool, error) {
+	for _, existing := range r.messages {
+		if message.ClientNonce != "" && existing.ClientNonce == message.ClientNonce && existing.UserID == message.UserID {
+			*message = *existing
+			return false, nil
+		}
+	}
+	message.ID = uint(len(r.messages) + 1)
+	for i, file := range files {
+		file.ID = uint(100*message.ID) + uint(i)
+		message.Attachments = append(message.Attachments, models.MessageAttachment{MessageID: message.ID, FileID: file.ID, Position: i, File: file})
+	}
+	stored := *message
+	r.messages[message.ID] = &stored
+	return true, nil
+}
+
+func (r *messageTable) GetByID(id uint) (*models.Message, error) {
+	message, ok := r.messages[id]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+	found := *message
+	return &found, nil
+}
+
+// userTable knows the users it holds
+type userTable struct {
+	repository.UserRepository
+	ids map[uint]bool
+}
+
+func (r userTable) GetByID(id uint) (*models.User, error) {
+	if !r.ids[id] {
+		return nil, errors.New("record not found")
+	}
+	return &models.User{ID: id}, nil
+}
+
+// roomTable knows the chat rooms it holds and who moderates them
+type roomTable struct {
+	repository.ChatRoomRepository
+	ids        map[uint]bool
+	moderators map[uint][]uint
+}
+
+func (r roomTable) GetByID(id uint) (*models.ChatRoom, error) {
+	if !r.ids[id] {
+		return nil, errors.New("record not found")
+	}
+	return &models.ChatRoom{ID: id}, nil
+}
+
+func (r roomTable) IsModerator(id, userID uint) (bool, error) {
+	for _, moderator := range r.moderators[id] {
+		if moderator == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// processedMessages counts the messages handed over for notifications
+type processedMessages struct {
+	NotificationService
+	count int
+}
+
+func (n *processedMessages) ProcessMessage(message *models.Message) error {
+	n.count++
+	return nil
+}
+
+func TestCreateMessageWithAttachments(t *testing.T) {
+	const (
+		alice = 1
+		bob   = 2
+		room  = 7
+		other = 8
+	)
+	upload := func(uploaderID, chatRoomID uint, fileName string) *models.File {
+		return &models.File{FileName: fileName, ChatRoomID: chatRoomID, UploaderID: uploaderID, FileSize: 5, ContentType: "text/plain"}
+	}
+	newService := func() (MessageService, *messageTable, *processedMessages) {
+		messages := newMessageTable()
+		notifications := &processedMessages{}
+		users := userTable{ids: map[uint]bool{alice: true, bob: true}}
+		rooms := roomTable{ids: map[uint]bool{room: true, other: true}}
+		return NewMessageService(messages, users, rooms, notifications, nil, 0), messages, notifications
+	}
+
+	t.Run("the uploader posts files to the room they were uploaded to", func(t *testing.T) {
+		s, _, notifications := newService()
+		files := []*models.File{upload(alice, room, "a.txt"), upload(alice, room, "b.txt")}
+		message, created, err := s.CreateMessageWithAttachments("@bob files", alice, room, files, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !created || message.Type != "file" || message.ChatRoomID != room || message.UserID != alice {
+			t.Fatalf("created=%v, message %+v", created, message)
+		}
+		if len(message.Attachments) != 2 || message.Attachments[0].File.FileName != "a.txt" || message.Attachments[1].File.FileName != "b.txt" {
+			t.Fatalf("attachments %+v, want a.txt and b.txt in order", message.Attachments)
+		}
+		if notifications.count != 1 {
+			t.Fatalf("%d messages processed for mentions, want 1", notifications.count)
+		}
+	})
+
+	t.Run("files without text skip mention processing", func(t *testing.T) {
+		s, _, notifications := newService()
+		if _, _, err := s.CreateMessageWithAttachments("", alice, room, []*models.File{upload(alice, room, "a.txt")}, ""); err != nil {
+			t.Fatal(err)
+		}
+		if notifications.count != 0 {
+			t.Fatalf("%d messages processed for mentions, want 0", notifications.count)
+		}
+	})
+
+	t.Run("a resent nonce returns the original message", func(t *testing.T) {
+		s, messages, _ := newService()
+		first, _, err := s.CreateMessageWithAttachments("", alice, room, []*models.File{upload(alice, room, "a.txt")}, "nonce-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, created, err := s.CreateMessageWithAttachments("", alice, room, []*models.File{upload(alice, room, "a.txt")}, "nonce-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created || again.ID != first.ID || len(messages.messages) != 1 {
+			t.Fatalf("created=%v, message %d, want the original message %d", created, again.ID, first.ID)
+		}
+	})
+
+	rejected := []struct {
+		name   string
+		userID uint
+		room   uint
+		files  []*models.File
+		err    string
+	}{
+		{"no files", alice, room, nil, "at least one attachment is required"},
+		{"a file uploaded by another user", alice, room, []*models.File{upload(alice, room, "a.txt"), upload(bob, room, "b.txt")}, "attachment was uploaded by another user"},
+		{"a file uploaded to another room", alice, room, []*models.File{upload(alice, other, "a.txt")}, "attachment belongs to another chat room"},
+		{"an unknown user", 3, room, []*models.File{upload(3, room, "a.txt")}, "user not found"},
+		{"an unknown room", alice, 9, []*models.File{upload(alice, 9, "a.txt")}, "chat room not found"},
+	}
+	for _, tt := range rejected {
+		t.Run("rejects "+tt.name, func(t *testing.T) {
+			s, messages, _ := newService()
+			_, _, err := s.CreateMessageWithAttachments("", tt.userID, tt.room, tt.files, "")
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+			if len(messages.messages) != 0 {
+				t.Fatal("message saved anyway")
+			}
+		})
+	}
+}
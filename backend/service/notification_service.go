@@ -0,0 +1,282 @@
+package service
+
+import (
+	"chatapp/models"
+	"chatapp/repository"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// mentionPattern matches @username not preceded by a word character, so
+// e-mail addresses are not treated as mentions
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9_.\-]+)`)
+
+// NotificationService handles mentions and the per-user notifications inbox
+type NotificationService interface {
+	ProcessMessage(message *models.Message) error
+	GetNotifications(userID uint, unreadOnly bool, limit, offset int) ([]models.Notification, error)
+	GetUnreadCount(userID uint) (int64, error)
+	MarkAsRead(id, userID uint) error
+	MarkAllAsRead(userID uint) error
+	GetPreference(userID, chatRoomID uint) (*models.NotificationPreference, error)
+	SetPreference(userID, chatRoomID uint, level string) (*models.NotificationPreference, error)
+	NotifyFileInfected(file *models.File) error
+	OnNotify(handler func(models.Notification))
+}
+
+type notificationService struct {
+	notificationRepo repository.NotificationRepository
+	userRepo         repository.UserRepository
+	chatRoomRepo     repository.ChatRoomRepository
+	presenceService  PresenceService
+
+	mu       sync.RWMutex
+	handlers []func(models.Notification)
+}
+
+// NewNotificationService creates a new notification service
+func NewNotificationService(notificationRepo repository.NotificationRepository, userRepo repository.UserRepository, chatRoomRepo repository.ChatRoomRepository, presenceService PresenceService) NotificationService {
+	return &notificationService{
+		notificationRepo: notificationRepo,
+		userRepo:         userRepo,
+		chatRoomRepo:     chatRoomRepo,
+		presenceService:  presenceService,
+	}
+}
+
+// parseMentions extracts mentioned usernames and the @here/@room flags
+func parseMentions(content string) (usernames []string, here, room bool) {
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		// Trailing punctuation ("@alice.") is not part of the username
+		name := strings.TrimRight(match[1], ".-")
+		switch name {
+		case "":
+			continue
+		case models.MentionHere:
+			here = true
+		case models.MentionRoom:
+			room = true
+		default:
+			if !seen[name] {
+				seen[name] = true
+				usernames = append(usernames, name)
+			}
+		}
+	}
+	return usernames, here, room
+}
+
+// ProcessMessage records the mentions in a new message and creates
+// notifications according to each recipient's room preference
+func (s *notificationService) ProcessMessage(message *models.Message) error {
+	usernames, here, room := parseMentions(message.Content)
+
+	// Mentioned user -> how they were mentioned. A direct mention wins.
+	targets := make(map[uint]string)
+
+	if here || room {
+		memberIDs, err := s.chatRoomRepo.GetMemberIDs(message.ChatRoomID)
+		if err != nil {
+			return errors.New("failed to load chat room members")
+		}
+
+		online := make(map[uint]bool)
+		if here && !room {
+			presences, err := s.presenceService.GetPresence(memberIDs)
+			if err != nil {
+				return err
+			}
+			for _, presence := range presences {
+				if presence.Status == models.PresenceOnline {
+					online[presence.UserID] = true
+				}
+			}
+		}
+
+		for _, memberID := range memberIDs {
+			if room {
+				targets[memberID] = models.MentionRoom
+			} else if online[memberID] {
+				targets[memberID] = models.MentionHere
+			}
+		}
+	}
+
+	if len(usernames) > 0 {
+		users, err := s.userRepo.GetByUsernames(usernames)
+		if err != nil {
+			return errors.New("failed to resolve mentioned users")
+		}
+		for _, user := range users {
+			targets[user.ID] = models.MentionUser
+		}
+	}
+
+	// Never notify the author about their own message
+	delete(targets, message.UserID)
+
+	mentions := make([]models.Mention, 0, len(targets))
+	for userID, kind := range targets {
+		mentions = append(mentions, models.Mention{MessageID: message.ID, UserID: userID, Kind: kind})
+	}
+	if err := s.notificationRepo.CreateMentions(mentions); err != nil {
+		return errors.New("failed to save mentions")
+	}
+
+	preferences, err := s.notificationRepo.GetPreferencesByChatRoomID(message.ChatRoomID)
+	if err != nil {
+		return errors.New("failed to load notification preferences")
+	}
+	levels := make(map[uint]string, len(preferences))
+	for _, preference := range preferences {
+		levels[preference.UserID] = preference.Level
+	}
+
+	var notifications []models.Notification
+	for userID := range targets {
+		if levels[userID] == models.NotifyMute {
+			continue
+		}
+		notifications = append(notifications, s.newNotification(userID, models.NotificationTypeMention, message))
+	}
+
+	// Users following every message of the room get the rest
+	for userID, level := range levels {
+		if level != models.NotifyAll || userID == message.UserID {
+			continue
+		}
+		if _, mentioned := targets[userID]; mentioned {
+			continue
+		}
+		notifications = append(notifications, s.newNotification(userID, models.NotificationTypeMessage, message))
+	}
+
+	if err := s.notificationRepo.CreateNotifications(notifications); err != nil {
+		return errors.New("failed to save notifications")
+	}
+
+	for _, notification := range notifications {
+		s.notify(notification)
+	}
+	return nil
+}
+
+func (s *notificationService) newNotification(userID uint, notificationType string, message *models.Message) models.Notification {
+	return models.Notification{
+		UserID:     userID,
+		Type:       notificationType,
+		ChatRoomID: message.ChatRoomID,
+		MessageID:  &message.ID,
+		Message:    message,
+		ActorID:    message.UserID,
+		Actor:      message.User,
+	}
+}
+
+// NotifyFileInfected tells the uploader of a file that it was found infected
+// and quarantined
+func (s *notificationService) NotifyFileInfected(file *models.File) error {
+	notifications := []models.Notification{{
+		UserID:     file.UploaderID,
+		Type:       models.NotificationTypeFileInfected,
+		ChatRoomID: file.ChatRoomID,
+		FileID:     &file.ID,
+		File:       file,
+		ActorID:    file.UploaderID,
+		Actor:      file.Uploader,
+	}}
+	if err := s.notificationRepo.CreateNotifications(notifications); err != nil {
+		return errors.New("failed to save notifications")
+	}
+	s.notify(notifications[0])
+	return nil
+}
+
+func (s *notificationService) GetNotifications(userID uint, unreadOnly bool, limit, offset int) ([]models.Notification, error) {
+	// Set default limit if not provided
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	return s.notificationRepo.GetByUserID(userID, unreadOnly, limit, offset)
+}
+
+func (s *notificationService) GetUnreadCount(userID uint) (int64, error) {
+	return s.notificationRepo.CountUnread(userID)
+}
+
+func (s *notificationService) MarkAsRead(id, userID uint) error {
+	err := s.notificationRepo.MarkRead(id, userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errors.New("notification not found")
+	}
+	if err != nil {
+		return errors.New("failed to update notification")
+	}
+	return nil
+}
+
+func (s *notificationService) MarkAllAsRead(userID uint) error {
+	if err := s.notificationRepo.MarkAllRead(userID); err != nil {
+		return errors.New("failed to update notifications")
+	}
+	return nil
+}
+
+// GetPreference returns the user's level for a room, "mentions" by default
+func (s *notificationService) GetPreference(userID, chatRoomID uint) (*models.NotificationPreference, error) {
+	// Validate chat room exists
+	_, err := s.chatRoomRepo.GetByID(chatRoomID)
+	if err != nil {
+		return nil, errors.New("chat room not found")
+	}
+
+	preference, err := s.notificationRepo.GetPreference(userID, chatRoomID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &models.NotificationPreference{UserID: userID, ChatRoomID: chatRoomID, Level: models.NotifyMentions}, nil
+	}
+	if err != nil {
+		return nil, errors.New("failed to load notification preference")
+	}
+	return preference, nil
+}
+
+func (s *notificationService) SetPreference(userID, chatRoomID uint, level string) (*models.NotificationPreference, error) {
+	switch level {
+	case models.NotifyAll, models.NotifyMentions, models.NotifyMute:
+	default:
+		return nil, errors.New("invalid notification level")
+	}
+
+	// Validate chat room exists
+	_, err := s.chatRoomRepo.GetByID(chatRoomID)
+	if err != nil {
+		return nil, errors.New("chat room not found")
+	}
+
+	preference := &models.NotificationPreference{UserID: userID, ChatRoomID: chatRoomID, Level: level}
+	if err := s.notificationRepo.UpsertPreference(preference); err != nil {
+		return nil, errors.New("failed to save notification preference")
+	}
+	return preference, nil
+}
+
+// OnNotify registers a handler called for every new notification
+func (s *notificationService) OnNotify(handler func(models.Notification)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers = append(s.handlers, handler)
+}
+
+func (s *notificationService) notify(notification models.Notification) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, handler := range s.handlers {
+		handler(notification)
+	}
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"chatapp/models"
+	"chatapp/repository"
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		usernames []string
+		here      bool
+		room      bool
+	}{
+		{"plain mention", "hi @alice", []string{"alice"}, false, false},
+		{"trailing period", "thanks @alice.", []string{"alice"}, false, false},
+		{"trailing punctuation", "@alice-, @bob... and (@carol)", []string{"alice", "bob", "carol"}, false, false},
+		{"dots and underscores inside", "ping @alice.smith and @bob_jones", []string{"alice.smith", "bob_jones"}, false, false},
+		{"e-mail address", "write to a@b.c or alice@example.com", nil, false, false},
+		{"doubled at sign", "@@alice", nil, false, false},
+		{"duplicates", "@alice @bob @alice", []string{"alice", "bob"}, false, false},
+		{"at sign alone", "meet @ noon, @...", nil, false, false},
+		{"here", "@here standup", nil, true, false},
+		{"room", "@room release is out", nil, false, true},
+		{"here, room and a user", "@here @room @alice", []string{"alice"}, true, true},
+		{"start of line", "@alice\n@bob", []string{"alice", "bob"}, false, false},
+		{"no mentions", "nothing to see", nil, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usernames, here, room := parseMentions(tt.content)
+			if !reflect.DeepEqual(usernames, tt.usernames) || here != tt.here || room != tt.room {
+				t.Errorf("parseMentions(%q) = %q, here=%v, room=%v; want %q, here=%v, room=%v",
+					tt.content, usernames, here, room, tt.usernames, tt.here, tt.room)
+			}
+		})
+	}
+}
+
+// mentionStore records the mentions and notifications created, and serves
+// the room's notification preferences
+type mentionStore struct {
+	repository.NotificationRepository
+	mentions      []models.Mention
+	notifications []models.Notification
+	preferences   []models.NotificationPreference
+}
+
+func (r *mentionStore) CreateMentions(mentions []models.Mention) error {
+	r.mentions = append(r.mentions, mentions...)
+	return nil
+}
+
+func (r *mentionStore) CreateNotifications(notifications []models.Notification) error {
+	r.notifications = append(r.notifications, notifications...)
+	return nil
+}
+
+func (r *mentionStore) GetPreferencesByChatRoomID(chatRoomID uint) ([]models.NotificationPreference, error) {
+	return r.preferences, nil
+}
+
+// usernameDirectory resolves usernames of the users it knows
+type usernameDirectory struct {
+	repository.UserRepository
+	users []models.User
+}
+
+func (r usernameDirectory) GetByUsernames(usernames []string) ([]models.User, error) {
+	var users []models.User
+	for _, user := range r.users {
+		for _, username := range usernames {
+			if user.Username == username {
+				users = append(users, user)
+			}
+		}
+	}
+	return users, nil
+}
+
+// roomMembers serves the members of every chat room
+type roomMembers struct {
+	repository.ChatRoomRepository
+	memberIDs []uint
+}
+
+func (r roomMembers) GetMemberIDs(id uint) ([]uint, error) {
+	return r.memberIDs, nil
+}
+
+// onlineUsers reports the users it holds online and everyone else offline
+type onlineUsers struct {
+	PresenceService
+	online map[uint]bool
+}
+
+func (p onlineUsers) GetPresence(userIDs []uint) ([]models.Presence, error) {
+	presences := make([]models.Presence, 0, len(userIDs))
+	for _, userID := range userIDs {
+		status := models.PresenceOffline
+		if p.online[userID] {
+			status = models.PresenceOnline
+		}
+		presences = append(presences, models.Presence{UserID: userID, Status: status})
+	}
+	return presences, nil
+}
+
+func TestProcessMessage(t *testing.T) {
+	// alice (1) writes; bob (2), carol (3) and dave (4) are also members
+	users := []models.User{{ID: 1, Username: "alice"}, {ID: 2, Username: "bob"}, {ID: 3, Username: "carol"}, {ID: 4, Username: "dave"}}
+	members := []uint{1, 2, 3, 4}
+
+	tests := []struct {
+		name        string
+		content     string
+		online      map[uint]bool
+		preferences map[uint]string
+		// Mention kind and notification type by recipient
+		mentions      map[uint]string
+		notifications map[uint]string
+	}{
+		{
+			name:          "a direct mention notifies the user",
+			content:       "@bob look",
+			mentions:      map[uint]string{2: models.MentionUser},
+			notifications: map[uint]string{2: models.NotificationTypeMention},
+		},
+		{
+			name:          "the author is never notified of their own message",
+			content:       "@alice @room note to self",
+			mentions:      map[uint]string{2: models.MentionRoom, 3: models.MentionRoom, 4: models.MentionRoom},
+			notifications: map[uint]string{2: models.NotificationTypeMention, 3: models.NotificationTypeMention, 4: models.NotificationTypeMention},
+		},
+		{
+			name:          "@here reaches online members only",
+			content:       "@here standup",
+			online:        map[uint]bool{1: true, 3: true},
+			mentions:      map[uint]string{3: models.MentionHere},
+			notifications: map[uint]string{3: models.NotificationTypeMention},
+		},
+		{
+			name:          "a direct mention wins over @room",
+			content:       "@room and especially @carol",
+			mentions:      map[uint]string{2: models.MentionRoom, 3: models.MentionUser, 4: models.MentionRoom},
+			notifications: map[uint]string{2: models.NotificationTypeMention, 3: models.NotificationTypeMention, 4: models.NotificationTypeMention},
+		},
+		{
+			name:          "muting a room suppresses notifications but not mentions",
+			content:       "@bob @carol",
+			preferences:   map[uint]string{2: models.NotifyMute},
+			mentions:      map[uint]string{2: models.MentionUser, 3: models.MentionUser},
+			notifications: map[uint]string{3: models.NotificationTypeMention},
+		},
+		{
+			name:          "following every message gets the ones without a mention",
+			content:       "just chatting",
+			preferences:   map[uint]string{1: models.NotifyAll, 2: models.NotifyAll, 3: models.NotifyMentions},
+			mentions:      map[uint]string{},
+			notifications: map[uint]string{2: models.NotificationTypeMessage},
+		},
+		{
+			name:          "following every message and mentioned notifies once, as a mention",
+			content:       "@bob see this",
+			preferences:   map[uint]string{2: models.NotifyAll, 4: models.NotifyAll},
+			mentions:      map[uint]string{2: models.MentionUser},
+			notifications: map[uint]string{2: models.NotificationTypeMention, 4: models.NotificationTypeMessage},
+		},
+		{
+			name:          "unknown users and e-mail addresses notify no one",
+			content:       "@mallory mail bob@example.com",
+			mentions:      map[uint]string{},
+			notifications: map[uint]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &mentionStore{}
+			for userID, level := range tt.preferences {
+				store.preferences = append(store.preferences, models.NotificationPreference{UserID: userID, ChatRoomID: 7, Level: level})
+			}
+			s := NewNotificationService(store, usernameDirectory{users: users}, roomMembers{memberIDs: members}, onlineUsers{online: tt.online})
+			var delivered []models.Notification
+			s.OnNotify(func(notification models.Notification) { delivered = append(delivered, notification) })
+
+			message := &models.Message{ID: 42, Content: tt.content, UserID: 1, ChatRoomID: 7, User: users[0]}
+			if err := s.ProcessMessage(message); err != nil {
+				t.Fatal(err)
+			}
+
+			mentions := make(map[uint]string)
+			for _, mention := range store.mentions {
+				if mention.MessageID != message.ID {
+					t.Errorf("mention of message %d, want %d", mention.MessageID, message.ID)
+				}
+				mentions[mention.UserID] = mention.Kind
+			}
+			if len(store.mentions) != len(mentions) || !reflect.DeepEqual(mentions, tt.mentions) {
+				t.Errorf("mentions %v, want %v", store.mentions, tt.mentions)
+			}
+
+			notifications := make(map[uint]string)
+			for _, notification := range store.notifications {
+				if notification.ChatRoomID != 7 || notification.ActorID != 1 || notification.MessageID == nil || *notification.MessageID != message.ID {
+					t.Errorf("notification %+v does not point at the message", notification)
+				}
+				notifications[notification.UserID] = notification.Type
+			}
+			if len(store.notifications) != len(notifications) || !reflect.DeepEqual(notifications, tt.notifications) {
+				t.Errorf("notifications %v, want %v", store.notifications, tt.notifications)
+			}
+			if len(delivered) != len(store.notifications) {
+				t.Errorf("%d notifications delivered, %d saved", len(delivered), len(store.notifications))
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"chatapp/models"
+	"chatapp/repository"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// PinService handles pinning messages in chat rooms
+type PinService interface {
+	PinMessage(chatRoomID, messageID, userID uint) (*models.PinnedMessage, error)
+	UnpinMessage(chatRoomID, messageID, userID uint) error
+	GetPinnedMessages(chatRoomID uint) ([]models.PinnedMessage, error)
+}
+
+type pinService struct {
+	pinRepo        repository.PinRepository
+	messageRepo    repository.MessageRepository
+	chatRoomRepo   repository.ChatRoomRepository
+	maxPinsPerRoom int
+}
+
+// NewPinService creates a new pin service
+func NewPinService(pinRepo repository.PinRepository, messageRepo repository.MessageRepository, chatRoomRepo repository.ChatRoomRepository, maxPinsPerRoom int) PinService {
+	return &pinService{
+		pinRepo:        pinRepo,
+		messageRepo:    messageRepo,
+		chatRoomRepo:   chatRoomRepo,
+		maxPinsPerRoom: maxPinsPerRoom,
+	}
+}
+
+// checkModerator returns an error unless the user moderates the chat room
+func (s *pinService) checkModerator(chatRoomID, userID uint) error {
+	isModerator, err := s.chatRoomRepo.IsModerator(chatRoomID, userID)
+	if err != nil {
+		return errors.New("failed to check permissions")
+	}
+	if !isModerator {
+		return ErrNotModerator
+	}
+	return nil
+}
+
+func (s *pinService) PinMessage(chatRoomID, messageID, userID uint) (*models.PinnedMessage, error) {
+	if err := s.checkModerator(chatRoomID, userID); err != nil {
+		return nil, err
+	}
+
+	message, err := s.messageRepo.GetByID(messageID)
+	if err != nil || message.ChatRoomID != chatRoomID {
+		return nil, errors.New("message not found")
+	}
+
+	if _, err := s.pinRepo.GetByMessageID(messageID); err == nil {
+		return nil, errors.New("message is already pinned")
+	}
+
+	pin := &models.PinnedMessage{
+		ChatRoomID: chatRoomID,
+		MessageID:  messageID,
+		PinnedBy:   userID,
+	}
+
+	err = s.pinRepo.CreateWithLimit(pin, s.maxPinsPerRoom)
+	if errors.Is(err, repository.ErrPinLimitReached) {
+		return nil, fmt.Errorf("a chat room can have at most %d pinned messages", s.maxPinsPerRoom)
+	}
+	if err != nil {
+		return nil, errors.New("failed to pin message")
+	}
+
+	// Return pin with message and author information
+	return s.pinRepo.GetByMessageID(messageID)
+}
+
+func (s *pinService) UnpinMessage(chatRoomID, messageID, userID uint) error {
+	if err := s.checkModerator(chatRoomID, userID); err != nil {
+		return err
+	}
+
+	pin, err := s.pinRepo.GetByMessageID(messageID)
+	if err != nil || pin.ChatRoomID != chatRoomID {
+		return errors.New("message is not pinned")
+	}
+
+	err = s.pinRepo.DeleteByMessageID(messageID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errors.New("message is not pinned")
+	}
+	if err != nil {
+		return errors.New("failed to unpin message")
+	}
+	return nil
+}
+
+func (s *pinService) GetPinnedMessages(chatRoomID uint) ([]models.PinnedMessage, error) {
+	// Validate chat room exists
+	_, err := s.chatRoomRepo.GetByID(chatRoomID)
+	if err != nil {
+		return nil, errors.New("chat room not found")
+	}
+
+	return s.pinRepo.GetByChatRoomID(chatRoomID)
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"chatapp/models"
+	"chatapp/repository"
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// pinTable keeps pins in memory and enforces the limit per room
+type pinTable struct {
+	pins []models.PinnedMessage
+}
+
+func (r *pinTable) CreateWithLimit(pin *models.PinnedMessage, limit int) error {
+	count := 0
+	for _, existing := range r.pins {
+		if existing.ChatRoomID == pin.ChatRoomID {
+			count++
+		}
+	}
+	if limit > 0 && count >= limit {
+		return repository.ErrPinLimitReached
+	}
+	pin.ID = uint(len(r.pins) + 1)
+	r.pins = append(r.pins, *pin)
+	return nil
+}
+
+func (r *pinTable) GetByMessageID(messageID uint) (*models.PinnedMessage, error) {
+	for _, pin := range r.pins {
+		if pin.MessageID == messageID {
+			return &pin, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *pinTable) GetByChatRoomID(chatRoomID uint) ([]models.PinnedMessage, error) {
+	var pins []models.PinnedMessage
+	for _, pin := range r.pins {
+		if pin.ChatRoomID == chatRoomID {
+			pins = append(pins, pin)
+		}
+	}
+	return pins, nil
+}
+
+func (r *pinTable) DeleteByMessageID(messageID uint) error {
+	for i, pin := range r.pins {
+		if pin.MessageID == messageID {
+			r.pins = append(r.pins[:i], r.pins[i+1:]...)
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func TestPinService(t *testing.T) {
+	const (
+		moderator = 1
+		member    = 2
+		room      = 7
+		other     = 8
+		limit     = 2
+	)
+	newService := func() (PinService, *pinTable) {
+		messages := newMessageTable()
+		// Messages 1 to 3 are in the room, 4 in the other room
+		for id := uint(1); id <= 4; id++ {
+			chatRoomID := uint(room)
+			if id == 4 {
+				chatRoomID = other
+			}
+			messages.messages[id] = &models.Message{ID: id, Content: "pin me", UserID: member, ChatRoomID: chatRoomID}
+		}
+		rooms := roomTable{ids: map[uint]bool{room: true, other: true}, moderators: map[uint][]uint{room: {moderator}}}
+		pins := &pinTable{}
+		return NewPinService(pins, messages, rooms, limit), pins
+	}
+
+	t.Run("a moderator pins and unpins a message", func(t *testing.T) {
+		s, pins := newService()
+		pin, err := s.PinMessage(room, 1, moderator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pin.MessageID != 1 || pin.ChatRoomID != room || pin.PinnedBy != moderator {
+			t.Fatalf("pin %+v", pin)
+		}
+		listed, err := s.GetPinnedMessages(room)
+		if err != nil || len(listed) != 1 {
+			t.Fatalf("listed %d pins, err %v; want 1", len(listed), err)
+		}
+
+		if err := s.UnpinMessage(room, 1, moderator); err != nil {
+			t.Fatal(err)
+		}
+		if len(pins.pins) != 0 {
+			t.Fatalf("%d pins left", len(pins.pins))
+		}
+	})
+
+	t.Run("only moderators pin", func(t *testing.T) {
+		s, pins := newService()
+		if _, err := s.PinMessage(room, 1, member); !errors.Is(err, ErrNotModerator) {
+			t.Fatalf("pinning as a member returned %v, want %v", err, ErrNotModerator)
+		}
+		// Moderating one room gives no rights in another
+		if _, err := s.PinMessage(other, 4, moderator); !errors.Is(err, ErrNotModerator) {
+			t.Fatalf("pinning in another room returned %v, want %v", err, ErrNotModerator)
+		}
+		if len(pins.pins) != 0 {
+			t.Fatal("message pinned anyway")
+		}
+	})
+
+	t.Run("only moderators unpin", func(t *testing.T) {
+		s, pins := newService()
+		if _, err := s.PinMessage(room, 1, moderator); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UnpinMessage(room, 1, member); !errors.Is(err, ErrNotModerator) {
+			t.Fatalf("unpinning as a member returned %v, want %v", err, ErrNotModerator)
+		}
+		if len(pins.pins) != 1 {
+			t.Fatal("message unpinned anyway")
+		}
+	})
+
+	t.Run("a message of another room cannot be pinned", func(t *testing.T) {
+		s, _ := newService()
+		if _, err := s.PinMessage(room, 4, moderator); err == nil || err.Error() != "message not found" {
+			t.Fatalf("got error %v, want message not found", err)
+		}
+		if _, err := s.PinMessage(room, 99, moderator); err == nil || err.Error() != "message not found" {
+			t.Fatalf("got error %v, want message not found", err)
+		}
+	})
+
+	t.Run("a message is pinned once", func(t *testing.T) {
+		s, _ := newService()
+		if _, err := s.PinMessage(room, 1, moderator); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.PinMessage(room, 1, moderator); err == nil || err.Error() != "message is already pinned" {
+			t.Fatalf("got error %v, want message is already pinned", err)
+		}
+	})
+
+	t.Run("a room holds at most the pin limit", func(t *testing.T) {
+		s, pins := newService()
+		for id := uint(1); id <= limit; id++ {
+			if _, err := s.PinMessage(room, id, moderator); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.PinMessage(room, limit+1, moderator); err == nil || err.Error() != "a chat room can have at most 2 pinned messages" {
+			t.Fatalf("got error %v, want the pin limit", err)
+		}
+		if len(pins.pins) != limit {
+			t.Fatalf("%d pins, want %d", len(pins.pins), limit)
+		}
+	})
+
+	t.Run("unpinning a message that is not pinned fails", func(t *testing.T) {
+		s, _ := newService()
+		if err := s.UnpinMessage(room, 1, moderator); err == nil || err.Error() != "message is not pinned" {
+			t.Fatalf("got error %v, want message is not pinned", err)
+		}
+	})
+
+	t.Run("listing the pins of an unknown room fails", func(t *testing.T) {
+		s, _ := newService()
+		if _, err := s.GetPinnedMessages(9); err == nil || err.Error() != "chat room not found" {
+			t.Fatalf("got error %v, want chat room not found", err)
+		}
+	})
+}
@@ -0,0 +1,499 @@
+package service
+
+import (
+	"chatapp/broker"
+	"chatapp/models"
+	"chatapp/repository"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const maxStatusTextLength = 140
+
+// PresenceService tracks online/away/offline presence derived from a user's
+// WebSocket connections, plus an optional custom status text
+type PresenceService interface {
+	Connect(userID uint, connID uint64)
+	Disconnect(userID uint, connID uint64)
+	Heartbeat(userID uint, connID uint64, active bool)
+	SetStatusText(userID uint, text string, ttl time.Duration) (*models.Presence, error)
+	ClearStatusText(userID uint) (*models.Presence, error)
+	GetPresence(userIDs []uint) ([]models.Presence, error)
+	OnChange(handler func(models.Presence))
+	Run()
+}
+
+// presenceTopic is the broker topic on which nodes share the presence of
+// their users
+const presenceTopic = "presence"
+
+// connectionState is one tab/device of a user
+type connectionState struct {
+	lastActive time.Time
+	idle       bool
+}
+
+type userPresence struct {
+	connections map[uint64]*connectionState
+	status      string // last local status announced to other nodes
+	lastSeenAt  *time.Time
+}
+
+// nodeUserPresence is the presence of a user derived from the connections
+// one node holds
+type nodeUserPresence struct {
+	UserID     uint       `json:"user_id"`
+	Status     string     `json:"status"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+}
+
+// nodePresenceUpdate is what a node publishes about its users: the ones
+// whose status just changed, or in a snapshot every user it has online or away
+type nodePresenceUpdate struct {
+	Node     string             `json:"node"`
+	Snapshot bool               `json:"snapshot,omitempty"`
+	Users    []nodeUserPresence `json:"users"`
+}
+
+// remoteNode is the last known state of another node
+type remoteNode struct {
+	users   map[uint]nodeUserPresence
+	heardAt time.Time
+}
+
+type presenceService struct {
+	statusRepo    repository.UserStatusRepository
+	broker        broker.Broker
+	nodeID        string
+	idleTimeout   time.Duration
+	sweepInterval time.Duration
+
+	mu        sync.Mutex
+	users     map[uint]*userPresence
+	nodes     map[string]*remoteNode
+	announced map[uint]string // last status across all nodes announced to OnChange handlers
+	handlers  []func(models.Presence)
+}
+
+// NewPresenceService creates a new presence service. Nodes sharing the
+// broker combine the connections they each hold, so a user is online if
+// any node sees an active connection.
+func NewPresenceService(statusRepo repository.UserStatusRepository, eventBroker broker.Broker, nodeID string, idleTimeout, sweepInterval time.Duration) PresenceService {
+	if idleTimeout <= 0 {
+		idleTimeout = 5 * time.Minute
+	}
+	if sweepInterval <= 0 {
+		sweepInterval = 30 * time.Second
+	}
+
+	s := &presenceService{
+		statusRepo:    statusRepo,
+		broker:        eventBroker,
+		nodeID:        nodeID,
+		idleTimeout:   idleTimeout,
+		sweepInterval: sweepInterval,
+		users:         make(map[uint]*userPresence),
+		nodes:         make(map[string]*remoteNode),
+		announced:     make(map[uint]string),
+	}
+	eventBroker.Subscribe(s.receive)
+	return s
+}
+
+func (s *presenceService) Connect(userID uint, connID uint64) {
+	s.mu.Lock()
+	user, ok := s.users[userID]
+	if !ok {
+		user = &userPresence{connections: make(map[uint64]*connectionState), status: models.PresenceOffline}
+		s.users[userID] = user
+	}
+	user.connections[connID] = &connectionState{lastActive: time.Now()}
+	update, changed := s.refreshLocked(userID, user)
+	s.mu.Unlock()
+
+	s.announce(update, changed, userID)
+}
+
+func (s *presenceService) Disconnect(userID uint, connID uint64) {
+	s.mu.Lock()
+	user, ok := s.users[userID]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(user.connections, connID)
+	if len(user.connections) == 0 {
+		now := time.Now()
+		user.lastSeenAt = &now
+	}
+	update, changed := s.refreshLocked(userID, user)
+	s.mu.Unlock()
+
+	s.announce(update, changed, userID)
+}
+
+// Heartbeat records client activity. Clients send active=true while the user
+// interacts with the page and active=false when the tab is hidden.
+func (s *presenceService) Heartbeat(userID uint, connID uint64, active bool) {
+	s.mu.Lock()
+	user, ok := s.users[userID]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	conn, ok := user.connections[connID]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	conn.idle = !active
+	if active {
+		conn.lastActive = time.Now()
+	}
+	update, changed := s.refreshLocked(userID, user)
+	s.mu.Unlock()
+
+	s.announce(update, changed, userID)
+}
+
+func (s *presenceService) SetStatusText(userID uint, text string, ttl time.Duration) (*models.Presence, error) {
+	if text == "" {
+		return s.ClearStatusText(userID)
+	}
+	if len([]rune(text)) > maxStatusTextLength {
+		return nil, errors.New("status text is too long")
+	}
+
+	status := &models.UserStatus{UserID: userID, Text: text}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		status.ExpiresAt = &expiresAt
+	}
+
+	if err := s.statusRepo.Upsert(status); err != nil {
+		return nil, errors.New("failed to save status")
+	}
+
+	return s.publish(userID)
+}
+
+func (s *presenceService) ClearStatusText(userID uint) (*models.Presence, error) {
+	if err := s.statusRepo.Delete(userID); err != nil {
+		return nil, errors.New("failed to clear status")
+	}
+	return s.publish(userID)
+}
+
+func (s *presenceService) GetPresence(userIDs []uint) ([]models.Presence, error) {
+	if len(userIDs) == 0 {
+		return []models.Presence{}, nil
+	}
+
+	statuses, err := s.statusRepo.GetByUserIDs(userIDs)
+	if err != nil {
+		return nil, errors.New("failed to load statuses")
+	}
+	statusByUser := make(map[uint]models.UserStatus, len(statuses))
+	for _, status := range statuses {
+		statusByUser[status.UserID] = status
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	presences := make([]models.Presence, 0, len(userIDs))
+	for _, userID := range userIDs {
+		presence := s.presenceLocked(userID)
+		if status, ok := statusByUser[userID]; ok {
+			presence.StatusText = status.Text
+			presence.StatusExpiresAt = status.ExpiresAt
+		}
+		presences = append(presences, presence)
+	}
+	return presences, nil
+}
+
+// OnChange registers a handler called whenever a user's presence changes
+func (s *presenceService) OnChange(handler func(models.Presence)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers = append(s.handlers, handler)
+}
+
+// Run periodically marks idle connections as away, expires status texts and
+// shares a snapshot of this node's users with the other nodes
+func (s *presenceService) Run() {
+	ticker := time.NewTicker(s.sweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.sweepIdle()
+		s.sweepExpiredStatuses()
+		s.sweepNodes()
+	}
+}
+
+func (s *presenceService) sweepIdle() {
+	var updates []nodeUserPresence
+	var changed []uint
+
+	s.mu.Lock()
+	for userID, user := range s.users {
+		update, userChanged := s.refreshLocked(userID, user)
+		if update != nil {
+			updates = append(updates, *update)
+		}
+		if userChanged {
+			changed = append(changed, userID)
+		}
+	}
+	s.mu.Unlock()
+
+	s.publishNode(false, updates)
+	for _, userID := range changed {
+		s.publishLogged(userID)
+	}
+}
+
+func (s *presenceService) sweepExpiredStatuses() {
+	userIDs, err := s.statusRepo.DeleteExpired(time.Now())
+	if err != nil {
+		log.Printf("Failed to expire user statuses: %v", err)
+		return
+	}
+
+	for _, userID := range userIDs {
+		s.publishLogged(userID)
+	}
+}
+
+// sweepNodes publishes a snapshot of this node's users, which is how nodes
+// that started later learn about them, and forgets nodes that stopped
+// publishing theirs
+func (s *presenceService) sweepNodes() {
+	var snapshot []nodeUserPresence
+	var changed []uint
+
+	s.mu.Lock()
+	for userID, user := range s.users {
+		if user.status != models.PresenceOffline {
+			snapshot = append(snapshot, nodeUserPresence{UserID: userID, Status: user.status, LastSeenAt: user.lastSeenAt})
+		}
+	}
+
+	expiredBefore := time.Now().Add(-3 * s.sweepInterval)
+	for nodeID, node := range s.nodes {
+		if node.heardAt.After(expiredBefore) {
+			continue
+		}
+		log.Printf("Presence of node %s expired", nodeID)
+		delete(s.nodes, nodeID)
+		for userID := range node.users {
+			if s.announceLocked(userID) {
+				changed = append(changed, userID)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	s.publishNode(true, snapshot)
+	for _, userID := range changed {
+		s.publishLogged(userID)
+	}
+}
+
+// receive applies a presence update published by another node
+func (s *presenceService) receive(topic string, payload []byte) {
+	if topic != presenceTopic {
+		return
+	}
+	var update nodePresenceUpdate
+	if err := json.Unmarshal(payload, &update); err != nil {
+		log.Printf("Dropping malformed presence update: %v", err)
+		return
+	}
+	if update.Node == s.nodeID {
+		return
+	}
+
+	s.mu.Lock()
+	node, ok := s.nodes[update.Node]
+	if !ok {
+		node = &remoteNode{users: make(map[uint]nodeUserPresence)}
+		s.nodes[update.Node] = node
+	}
+	node.heardAt = time.Now()
+
+	affected := make(map[uint]bool, len(update.Users))
+	if update.Snapshot {
+		for userID := range node.users {
+			affected[userID] = true
+		}
+		node.users = make(map[uint]nodeUserPresence, len(update.Users))
+	}
+	for _, user := range update.Users {
+		node.users[user.UserID] = user
+		affected[user.UserID] = true
+	}
+
+	var changed []uint
+	for userID := range affected {
+		if s.announceLocked(userID) {
+			changed = append(changed, userID)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, userID := range changed {
+		s.publishLogged(userID)
+	}
+}
+
+// announce shares a local status change with the other nodes and notifies
+// handlers if the user's overall presence changed
+func (s *presenceService) announce(update *nodeUserPresence, changed bool, userID uint) {
+	if update != nil {
+		s.publishNode(false, []nodeUserPresence{*update})
+	}
+	if changed {
+		s.publishLogged(userID)
+	}
+}
+
+// publishNode sends this node's view of some users to the other nodes
+func (s *presenceService) publishNode(snapshot bool, users []nodeUserPresence) {
+	if !snapshot && len(users) == 0 {
+		return
+	}
+	if users == nil {
+		users = []nodeUserPresence{}
+	}
+
+	payload, err := json.Marshal(nodePresenceUpdate{Node: s.nodeID, Snapshot: snapshot, Users: users})
+	if err != nil {
+		log.Printf("Failed to encode presence update: %v", err)
+		return
+	}
+	if err := s.broker.Publish(presenceTopic, payload); err != nil {
+		log.Printf("Failed to publish presence update: %v", err)
+	}
+}
+
+// publish loads the full presence of a user and notifies handlers about it
+func (s *presenceService) publish(userID uint) (*models.Presence, error) {
+	presences, err := s.GetPresence([]uint{userID})
+	if err != nil {
+		return nil, err
+	}
+	s.notify(presences[0])
+	return &presences[0], nil
+}
+
+// publishLogged publishes and logs failures, for callers with no one to report to
+func (s *presenceService) publishLogged(userID uint) {
+	if _, err := s.publish(userID); err != nil {
+		log.Printf("Failed to publish presence for user %d: %v", userID, err)
+	}
+}
+
+// refreshLocked recomputes the local status of a user. It returns the update
+// to share with other nodes if that status changed, and whether the status
+// across all nodes differs from the last one announced.
+func (s *presenceService) refreshLocked(userID uint, user *userPresence) (*nodeUserPresence, bool) {
+	var update *nodeUserPresence
+	local := s.localPresenceLocked(userID)
+	if local.Status != user.status {
+		user.status = local.Status
+		update = &nodeUserPresence{UserID: userID, Status: local.Status, LastSeenAt: local.LastSeenAt}
+	}
+	return update, s.announceLocked(userID)
+}
+
+// announceLocked reports whether the status of a user across all nodes
+// differs from the last one announced, and records it as announced
+func (s *presenceService) announceLocked(userID uint) bool {
+	status := s.presenceLocked(userID).Status
+	announced, ok := s.announced[userID]
+	if !ok {
+		announced = models.PresenceOffline
+	}
+	if status == announced {
+		return false
+	}
+	if status == models.PresenceOffline {
+		delete(s.announced, userID)
+	} else {
+		s.announced[userID] = status
+	}
+	return true
+}
+
+// presenceLocked combines the presence of a user on every node: the most
+// present status wins, and the latest last-seen time
+func (s *presenceService) presenceLocked(userID uint) models.Presence {
+	presence := s.localPresenceLocked(userID)
+	for _, node := range s.nodes {
+		remote, ok := node.users[userID]
+		if !ok {
+			continue
+		}
+		if statusRank(remote.Status) > statusRank(presence.Status) {
+			presence.Status = remote.Status
+		}
+		if remote.LastSeenAt != nil && (presence.LastSeenAt == nil || remote.LastSeenAt.After(*presence.LastSeenAt)) {
+			presence.LastSeenAt = remote.LastSeenAt
+		}
+	}
+	return presence
+}
+
+// localPresenceLocked derives the presence of a user from this node's
+// connections
+func (s *presenceService) localPresenceLocked(userID uint) models.Presence {
+	presence := models.Presence{UserID: userID, Status: models.PresenceOffline}
+
+	user, ok := s.users[userID]
+	if !ok {
+		return presence
+	}
+	presence.LastSeenAt = user.lastSeenAt
+
+	if len(user.connections) == 0 {
+		return presence
+	}
+
+	// A user is online if any tab/device is active, away if all are idle
+	presence.Status = models.PresenceAway
+	idleSince := time.Now().Add(-s.idleTimeout)
+	for _, conn := range user.connections {
+		if !conn.idle && conn.lastActive.After(idleSince) {
+			presence.Status = models.PresenceOnline
+			break
+		}
+	}
+	return presence
+}
+
+func statusRank(status string) int {
+	switch status {
+	case models.PresenceOnline:
+		return 2
+	case models.PresenceAway:
+		return 1
+	}
+	return 0
+}
+
+func (s *presenceService) notify(presence models.Presence) {
+	s.mu.Lock()
+	handlers := make([]func(models.Presence), len(s.handlers))
+	copy(handlers, s.handlers)
+	s.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(presence)
+	}
+}
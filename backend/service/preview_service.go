@@ -0,0 +1,275 @@
+package service
+
+import (
+	"bytes"
+	"chatapp/imaging"
+	"chatapp/models"
+	"chatapp/repository"
+	"chatapp/storage"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// previewPollInterval is how often files waiting for previews are
+	// looked for
+	previewPollInterval = 2 * time.Second
+	// previewBatchSize is how many waiting files are loaded at once
+	previewBatchSize = 20
+	// maxPreviewSourceSize is the largest image previews are generated for
+	maxPreviewSourceSize = 64 << 20
+	// maxPreviewPixels bounds the memory a decoded image may take
+	maxPreviewPixels = 40_000_000
+	// previewURLTTL is how long the URLs of variants in payloads stay valid
+	previewURLTTL = 24 * time.Hour
+	// blurhashSize is the size images are scaled to before their BlurHash is
+	// computed; the placeholder is blurred anyway
+	blurhashSize = 32
+)
+
+// previewSizes are the variants generated for images, largest first. Each
+// is only generated for images larger than its box, so small images may
+// have no variants; clients then show the original.
+var previewSizes = []struct {
+	name string
+	size int
+}{
+	{"large", 1600},
+	{"small", 640},
+	{"thumb", 256},
+}
+
+// previewContentTypes are the image types previews are generated for
+var previewContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+	"image/tiff": true,
+}
+
+// previewStatus returns the preview status a new file starts with
+func previewStatus(contentType string) string {
+	if previewContentTypes[baseContentType(contentType)] {
+		return models.PreviewPending
+	}
+	return ""
+}
+
+// previewExtensions are the extensions of variant objects, by content type
+var previewExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// previewObjectPath returns where a variant of stored content is kept.
+// Variants belong to the content rather than to a file, so files sharing it
+// share them, and they are deleted along with it.
+func previewObjectPath(blobID uint, name, ext string) string {
+	return fmt.Sprintf("previews/blob-%d/%s%s", blobID, name, ext)
+}
+
+// previewObjectPaths returns every path a variant of stored content may be
+// kept at
+func previewObjectPaths(blobID uint) []string {
+	paths := make([]string, 0, len(previewSizes)*len(previewExtensions))
+	for _, size := range previewSizes {
+		for _, ext := range previewExtensions {
+			paths = append(paths, previewObjectPath(blobID, size.name, ext))
+		}
+	}
+	return paths
+}
+
+// PreviewService generates the previews of image files in the background:
+// their dimensions, a BlurHash placeholder, and smaller variants stored next
+// to the originals
+type PreviewService interface {
+	Run()
+}
+
+type previewService struct {
+	previewRepo repository.PreviewRepository
+	storage     storage.Storage
+	workers     int
+	refresh     func(chatRoomID uint, messageIDs []uint)
+}
+
+// NewPreviewService creates a new preview service running workers
+// generators at once. refresh is called with the messages a file is
+// attached to once its previews are ready, so clients can show them. Variant
+// URLs in payloads are signed by the storage from now on.
+func NewPreviewService(previewRepo repository.PreviewRepository, s storage.Storage, workers int, refresh func(chatRoomID uint, messageIDs []uint)) PreviewService {
+	models.VariantURL = func(objectPath string) (string, error) {
+		return s.Download(objectPath, previewURLTTL)
+	}
+	return &previewService{
+		previewRepo: previewRepo,
+		storage:     s,
+		workers:     workers,
+		refresh:     refresh,
+	}
+}
+
+// Run periodically generates the previews of waiting files. Replicas may
+// process a file at once; only the first to finish records it.
+func (s *previewService) Run() {
+	if s.workers <= 0 {
+		return
+	}
+	ticker := time.NewTicker(previewPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.processPending()
+	}
+}
+
+func (s *previewService) processPending() {
+	files, err := s.previewRepo.GetPending(previewBatchSize)
+	if err != nil {
+		log.Printf("Failed to list files waiting for previews: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, s.workers)
+	for i := range files {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(file *models.File) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			s.process(file)
+		}(&files[i])
+	}
+	wg.Wait()
+}
+
+// process generates and records the previews of a file
+func (s *previewService) process(file *models.File) {
+	variants, err := s.generate(file)
+	if err != nil {
+		// The original stays available; it just has no preview
+		log.Printf("Failed to generate previews of file %d: %v", file.ID, err)
+		if err := s.previewRepo.Fail(file.ID); err != nil {
+			log.Printf("Failed to mark previews of file %d as failed: %v", file.ID, err)
+		}
+		return
+	}
+
+	completed, err := s.previewRepo.Complete(file, variants)
+	if err != nil {
+		log.Printf("Failed to record previews of file %d: %v", file.ID, err)
+		return
+	}
+	if !completed || s.refresh == nil {
+		return
+	}
+
+	// Clients showing the file's messages get them again with the previews
+	messageIDs, err := s.previewRepo.GetMessageIDs(file.ID)
+	if err != nil {
+		log.Printf("Failed to list messages of file %d: %v", file.ID, err)
+		return
+	}
+	if len(messageIDs) > 0 {
+		s.refresh(file.ChatRoomID, messageIDs)
+	}
+}
+
+// generate fills in the dimensions and placeholder of an image file and
+// returns its variants, stored already
+func (s *previewService) generate(file *models.File) ([]models.FileVariant, error) {
+	// Content previewed for another file is not rendered again
+	if previewed, err := s.previewRepo.GetReadyByBlobID(*file.BlobID); err == nil {
+		file.Width, file.Height, file.Blurhash = previewed.Width, previewed.Height, previewed.Blurhash
+		variants := make([]models.FileVariant, len(previewed.Variants))
+		for i, variant := range previewed.Variants {
+			variants[i] = models.FileVariant{
+				Name:        variant.Name,
+				ObjectPath:  variant.ObjectPath,
+				Width:       variant.Width,
+				Height:      variant.Height,
+				Size:        variant.Size,
+				ContentType: variant.ContentType,
+			}
+		}
+		return variants, nil
+	}
+
+	reader, err := storage.OpenObject(s.storage, file.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, maxPreviewSourceSize+1))
+	reader.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	if len(data) > maxPreviewSourceSize {
+		return nil, errors.New("image is too large")
+	}
+
+	img, err := imaging.Decode(data, maxPreviewPixels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	file.Width, file.Height = img.Width(), img.Height()
+
+	// Each variant is scaled from the previous one, which is faster than
+	// scaling every one from the original
+	var variants []models.FileVariant
+	current := img
+	for _, size := range previewSizes {
+		if file.Width <= size.size && file.Height <= size.size {
+			continue
+		}
+		current = current.Fit(size.size)
+		variant, err := s.storeVariant(*file.BlobID, size.name, current)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, *variant)
+	}
+
+	x, y := imaging.BlurhashComponents(file.Width, file.Height)
+	file.Blurhash, err = current.Fit(blurhashSize).Blurhash(x, y)
+	if err != nil {
+		return nil, err
+	}
+	return variants, nil
+}
+
+// storeVariant encodes a variant and stores it
+func (s *previewService) storeVariant(blobID uint, name string, img *imaging.Image) (*models.FileVariant, error) {
+	var buf bytes.Buffer
+	contentType, err := img.Encode(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s variant: %w", name, err)
+	}
+
+	result, err := s.storage.Upload(previewObjectPath(blobID, name, previewExtensions[contentType]), bytes.NewReader(buf.Bytes()), storage.UploadOptions{
+		ContentType: contentType,
+		Size:        int64(buf.Len()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store %s variant: %w", name, err)
+	}
+
+	return &models.FileVariant{
+		Name:        name,
+		ObjectPath:  result.ObjectPath,
+		Width:       img.Width(),
+		Height:      img.Height(),
+		Size:        result.Size,
+		ContentType: contentType,
+	}, nil
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"chatapp/models"
+	"chatapp/repository"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// RoomEventService keeps a replayable log of room events so WebSocket clients
+// can resume a session without refetching history
+type RoomEventService interface {
+	Append(chatRoomID uint, eventType string, data interface{}) (*models.RoomEvent, error)
+	Replay(chatRoomID uint, afterSeq uint64, limit int) (events []models.RoomEvent, lastSeq uint64, complete bool, err error)
+	LastSeq(chatRoomID uint) (uint64, error)
+	Run()
+}
+
+type roomEventService struct {
+	eventRepo repository.RoomEventRepository
+	retention time.Duration
+}
+
+// NewRoomEventService creates a new room event service
+func NewRoomEventService(eventRepo repository.RoomEventRepository, retention time.Duration) RoomEventService {
+	if retention <= 0 {
+		retention = 24 * time.Hour
+	}
+
+	return &roomEventService{
+		eventRepo: eventRepo,
+		retention: retention,
+	}
+}
+
+func (s *roomEventService) Append(chatRoomID uint, eventType string, data interface{}) (*models.RoomEvent, error) {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &models.RoomEvent{ChatRoomID: chatRoomID, Type: eventType, Data: string(dataBytes)}
+	if err := s.eventRepo.Append(event); err != nil {
+		return nil, errors.New("failed to save room event")
+	}
+	return event, nil
+}
+
+// Replay returns the events of a room after afterSeq, up to limit. complete is
+// false when the client cannot catch up from the log, because events it missed
+// were pruned or there are more than limit of them; it must then refetch.
+func (s *roomEventService) Replay(chatRoomID uint, afterSeq uint64, limit int) ([]models.RoomEvent, uint64, bool, error) {
+	lastSeq, err := s.LastSeq(chatRoomID)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if afterSeq == lastSeq {
+		return nil, lastSeq, true, nil
+	}
+	if afterSeq > lastSeq {
+		// The client knows of events this server never handed out
+		return nil, lastSeq, false, nil
+	}
+
+	events, err := s.eventRepo.GetAfter(chatRoomID, afterSeq, limit+1)
+	if err != nil {
+		return nil, 0, false, errors.New("failed to load room events")
+	}
+	if len(events) == 0 || events[0].Seq != afterSeq+1 || len(events) > limit {
+		return nil, lastSeq, false, nil
+	}
+	return events, lastSeq, true, nil
+}
+
+func (s *roomEventService) LastSeq(chatRoomID uint) (uint64, error) {
+	lastSeq, err := s.eventRepo.GetLastSeq(chatRoomID)
+	if err != nil {
+		return 0, errors.New("failed to load room sequence")
+	}
+	return lastSeq, nil
+}
+
+// Run periodically prunes events older than the retention period
+func (s *roomEventService) Run() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := s.eventRepo.DeleteOlderThan(time.Now().Add(-s.retention)); err != nil {
+			log.Printf("Failed to prune room events: %v", err)
+		}
+	}
+}
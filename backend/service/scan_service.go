@@ -0,0 +1,221 @@
+package service
+
+import (
+	"chatapp/clamd"
+	"chatapp/config"
+	"chatapp/models"
+	"chatapp/repository"
+	"chatapp/storage"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// scanPollInterval is how often files waiting for a scan are looked for
+	scanPollInterval = 2 * time.Second
+	// scanBatchSize is how many waiting files are loaded at once
+	scanBatchSize = 20
+)
+
+// errScannerUnavailable stops a batch of scans while the scanner is down and
+// files are kept waiting for it
+var errScannerUnavailable = errors.New("scanner is unavailable")
+
+// scanStatus returns the scan status a new file starts with: waiting for a
+// scan, and so quarantined, while scanning is on
+func scanStatus() string {
+	if config.GlobalConfig != nil && config.GlobalConfig.Scan.Address != "" {
+		return models.ScanPending
+	}
+	return ""
+}
+
+// ScanService scans uploaded files for malware in the background. Files
+// cannot be downloaded until found clean; the uploaders of infected files
+// are notified.
+type ScanService interface {
+	Run()
+}
+
+type scanService struct {
+	scanRepo            repository.ScanRepository
+	storage             storage.Storage
+	scanner             *clamd.Client
+	maxSize             int64
+	workers             int
+	failOpen            bool
+	notificationService NotificationService
+	refresh             func(chatRoomID uint, messageIDs []uint)
+}
+
+// NewScanService creates a new scan service running workers scans at once;
+// a nil scanner turns scanning off. Files over maxSize bytes and files the
+// scanner refuses or cannot be reached for are let through unscanned if
+// failOpen is set, and otherwise kept quarantined. refresh is called with
+// the messages a file is attached to once it is scanned.
+func NewScanService(scanRepo repository.ScanRepository, s storage.Storage, scanner *clamd.Client, maxSize int64, workers int, failOpen bool, notificationService NotificationService, refresh func(chatRoomID uint, messageIDs []uint)) ScanService {
+	return &scanService{
+		scanRepo:            scanRepo,
+		storage:             s,
+		scanner:             scanner,
+		maxSize:             maxSize,
+		workers:             max(workers, 1),
+		failOpen:            failOpen,
+		notificationService: notificationService,
+		refresh:             refresh,
+	}
+}
+
+// Run periodically scans waiting files. Replicas may scan a file at once;
+// only the first to finish records it.
+func (s *scanService) Run() {
+	if s.scanner == nil {
+		return
+	}
+	ticker := time.NewTicker(scanPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.processPending()
+	}
+}
+
+func (s *scanService) processPending() {
+	files, err := s.scanRepo.GetPending(scanBatchSize)
+	if err != nil {
+		log.Printf("Failed to list files waiting for a scan: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	var unavailable atomic.Bool
+	slots := make(chan struct{}, s.workers)
+	for i := range files {
+		slots <- struct{}{}
+		// The rest waits for the next poll rather than for the scanner to
+		// time out on each
+		if unavailable.Load() {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func(file *models.File) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if errors.Is(s.process(file), errScannerUnavailable) {
+				unavailable.Store(true)
+			}
+		}(&files[i])
+	}
+	wg.Wait()
+
+	if unavailable.Load() {
+		log.Printf("Scanner is unavailable, files stay quarantined until it is back")
+	}
+}
+
+// process scans a file and records the verdict
+func (s *scanService) process(file *models.File) error {
+	if err := s.scan(file); err != nil {
+		if !errors.Is(err, errScannerUnavailable) {
+			log.Printf("Failed to scan file %d: %v", file.ID, err)
+		}
+		return err
+	}
+
+	now := time.Now()
+	file.ScannedAt = &now
+	// Quarantined images are not previewed
+	if file.Quarantined() && file.PreviewStatus == models.PreviewPending {
+		file.PreviewStatus = models.PreviewFailed
+	}
+	completed, err := s.scanRepo.Complete(file)
+	if err != nil {
+		log.Printf("Failed to record the scan of file %d: %v", file.ID, err)
+		return err
+	}
+	if !completed {
+		return nil
+	}
+
+	if file.ScanStatus == models.ScanInfected {
+		log.Printf("File %d is infected with %s and was quarantined", file.ID, file.ScanResult)
+		if err := s.notificationService.NotifyFileInfected(file); err != nil {
+			log.Printf("Failed to notify the uploader of file %d: %v", file.ID, err)
+		}
+	}
+
+	// Clients showing the file's messages learn whether it can be downloaded
+	if s.refresh == nil {
+		return nil
+	}
+	messageIDs, err := s.scanRepo.GetMessageIDs(file.ID)
+	if err != nil {
+		log.Printf("Failed to list messages of file %d: %v", file.ID, err)
+		return nil
+	}
+	if len(messageIDs) > 0 {
+		s.refresh(file.ChatRoomID, messageIDs)
+	}
+	return nil
+}
+
+// scan sets the scan status and result of a file. An error leaves the file
+// waiting, to be scanned again later.
+func (s *scanService) scan(file *models.File) error {
+	// Content scanned for another file is not scanned again
+	if file.BlobID != nil {
+		if scanned, err := s.scanRepo.GetScannedByBlobID(*file.BlobID); err == nil {
+			file.ScanStatus, file.ScanResult = scanned.ScanStatus, scanned.ScanResult
+			return nil
+		}
+	}
+
+	if s.maxSize > 0 && file.FileSize > s.maxSize {
+		s.unscannable(file, "file is too large to scan")
+		return nil
+	}
+
+	reader, err := storage.OpenObject(s.storage, file.FilePath)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		s.unscannable(file, "file is missing from storage")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	defer reader.Close()
+
+	result, err := s.scanner.Scan(reader)
+	switch {
+	case errors.Is(err, clamd.ErrUnavailable):
+		if !s.failOpen {
+			return errScannerUnavailable
+		}
+		s.unscannable(file, "scanner is unavailable")
+	case errors.Is(err, clamd.ErrReadContent):
+		return fmt.Errorf("failed to read file: %w", err)
+	case err != nil:
+		s.unscannable(file, err.Error())
+	case result.Infected:
+		file.ScanStatus, file.ScanResult = models.ScanInfected, result.Signature
+	default:
+		file.ScanStatus, file.ScanResult = models.ScanClean, ""
+	}
+	return nil
+}
+
+// unscannable sets the status of a file that cannot be scanned as the
+// policy asks
+func (s *scanService) unscannable(file *models.File, reason string) {
+	file.ScanStatus, file.ScanResult = models.ScanError, reason
+	if s.failOpen {
+		file.ScanStatus = models.ScanUnscanned
+	}
+}
@@ -0,0 +1,415 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"chatapp/clamd"
+	"chatapp/models"
+	"chatapp/repository"
+	"chatapp/storage"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// eicar is the standard antivirus test file, split so this source is not
+// flagged itself
+var eicar = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$` + `EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// maxTestStream is the stream limit of the fake daemon
+const maxTestStream = 1 << 20
+
+// fakeClamd answers PING and INSTREAM like clamd, finding the EICAR test
+// file anywhere in the stream. While down it drops connections unanswered.
+type fakeClamd struct {
+	listener  net.Listener
+	maxStream int
+	down      atomic.Bool
+	scans     atomic.Int64
+}
+
+// newFakeClamd starts a daemon listening on the address until the test ends
+func newFakeClamd(t *testing.T, network, address string) *fakeClamd {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	d := &fakeClamd{listener: listener, maxStream: maxTestStream}
+	go d.serve()
+	return d
+}
+
+func (d *fakeClamd) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		go d.handle(conn)
+	}
+}
+
+func (d *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	if d.down.Load() {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	command, err := reader.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch command {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		d.scans.Add(1)
+		var stream []byte
+		size := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(reader, size); err != nil {
+				return
+			}
+			n := int(binary.BigEndian.Uint32(size))
+			if n == 0 {
+				break
+			}
+			if len(stream)+n > d.maxStream {
+				// clamd answers and hangs up without reading the rest
+				conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				return
+			}
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(reader, chunk); err != nil {
+				return
+			}
+			stream = append(stream, chunk...)
+		}
+		if bytes.Contains(stream, eicar) {
+			conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			return
+		}
+		conn.Write([]byte("stream: OK\x00"))
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+func (d *fakeClamd) address() string {
+	return "tcp://" + d.listener.Addr().String()
+}
+
+// scanStore stands in for the files and message_attachments tables
+type scanStore struct {
+	mu       sync.Mutex
+	files    map[uint]*models.File
+	messages map[uint][]uint
+}
+
+var _ repository.ScanRepository = (*scanStore)(nil)
+
+func (r *scanStore) GetPending(limit int) ([]models.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var files []models.File
+	for id := uint(1); id <= uint(len(r.files)) && len(files) < limit; id++ {
+		if file := r.files[id]; file.ScanStatus == models.ScanPending {
+			files = append(files, *file)
+		}
+	}
+	return files, nil
+}
+
+func (r *scanStore) GetScannedByBlobID(blobID uint) (*models.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, file := range r.files {
+		if file.BlobID != nil && *file.BlobID == blobID &&
+			(file.ScanStatus == models.ScanClean || file.ScanStatus == models.ScanInfected) {
+			scanned := *file
+			return &scanned, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (r *scanStore) Complete(file *models.File) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := r.files[file.ID]
+	if stored.ScanStatus != models.ScanPending {
+		return false, nil
+	}
+	stored.ScanStatus, stored.ScanResult, stored.ScannedAt = file.ScanStatus, file.ScanResult, file.ScannedAt
+	stored.PreviewStatus = file.PreviewStatus
+	return true, nil
+}
+
+func (r *scanStore) GetMessageIDs(fileID uint) ([]uint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.messages[fileID], nil
+}
+
+func (r *scanStore) get(id uint) models.File {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return *r.files[id]
+}
+
+// infectedNotices records the notifications of infected files
+type infectedNotices struct {
+	NotificationService
+	mu    sync.Mutex
+	files []models.File
+}
+
+func (n *infectedNotices) NotifyFileInfected(file *models.File) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.files = append(n.files, *file)
+	return nil
+}
+
+func (n *infectedNotices) infected() []models.File {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]models.File(nil), n.files...)
+}
+
+// scanEnv is a scan service running against a daemon
+type scanEnv struct {
+	store         *scanStore
+	storage       *storage.MemoryStorage
+	notifications *infectedNotices
+	mu            sync.Mutex
+	refreshed     []uint
+}
+
+// newScanEnv starts a scan service against the daemon, failing open or closed
+func newScanEnv(daemon *fakeClamd, failOpen bool) *scanEnv {
+	e := &scanEnv{
+		store:         &scanStore{files: make(map[uint]*models.File), messages: make(map[uint][]uint)},
+		storage:       storage.NewMemoryStorage(),
+		notifications: &infectedNotices{},
+	}
+	scanner := clamd.New(daemon.address(), 5*time.Second)
+	go NewScanService(e.store, e.storage, scanner, maxTestStream, 2, failOpen, e.notifications, e.refresh).Run()
+	return e
+}
+
+func (e *scanEnv) refresh(chatRoomID uint, messageIDs []uint) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.refreshed = append(e.refreshed, messageIDs...)
+}
+
+// upload stores content and records a file waiting for its scan
+func (e *scanEnv) upload(t *testing.T, blobID uint, data []byte, messageIDs ...uint) uint {
+	t.Helper()
+	objectPath := fmt.Sprintf("files/blob-%d", blobID)
+	if _, err := e.storage.Upload(objectPath, bytes.NewReader(data), storage.UploadOptions{Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+	id := uint(len(e.store.files) + 1)
+	e.store.files[id] = &models.File{
+		ID:            id,
+		FilePath:      objectPath,
+		FileSize:      int64(len(data)),
+		ChatRoomID:    3,
+		UploaderID:    9,
+		BlobID:        &blobID,
+		ScanStatus:    models.ScanPending,
+		PreviewStatus: models.PreviewPending,
+	}
+	e.store.messages[id] = messageIDs
+	return id
+}
+
+// expect waits for the file's scan and checks its status
+func (e *scanEnv) expect(t *testing.T, id uint, status string, quarantined bool) models.File {
+	t.Helper()
+	var file models.File
+	deadline := time.Now().Add(10 * time.Second)
+	for file = e.store.get(id); file.ScanStatus == models.ScanPending; file = e.store.get(id) {
+		if time.Now().After(deadline) {
+			t.Fatalf("file %d still waiting for its scan", id)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if file.ScanStatus != status {
+		t.Fatalf("status %q (%s), want %q", file.ScanStatus, file.ScanResult, status)
+	}
+	if file.Quarantined() != quarantined {
+		t.Fatalf("quarantined is %v for status %q", file.Quarantined(), status)
+	}
+	if file.ScannedAt == nil {
+		t.Fatal("scan time not recorded")
+	}
+	return file
+}
+
+var (
+	cleanContent = bytes.Repeat([]byte("harmless content "), 10000)
+	// The test file straddles two chunks of the stream
+	infectedContent = append(bytes.Repeat([]byte{'a'}, clamd.ChunkSize-20), eicar...)
+)
+
+func TestClamdClient(t *testing.T) {
+	daemon := newFakeClamd(t, "tcp", "127.0.0.1:0")
+	client := clamd.New(daemon.address(), 5*time.Second)
+
+	t.Run("the daemon answers PING", func(t *testing.T) {
+		if err := client.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("clean content is reported clean", func(t *testing.T) {
+		result, err := client.Scan(bytes.NewReader(cleanContent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Infected {
+			t.Fatalf("reported infected with %s", result.Signature)
+		}
+	})
+
+	t.Run("infected content is reported with its signature", func(t *testing.T) {
+		result, err := client.Scan(bytes.NewReader(infectedContent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Infected || result.Signature != "Eicar-Test-Signature" {
+			t.Fatalf("result %+v", result)
+		}
+	})
+
+	t.Run("content over the stream limit is refused, not unavailable", func(t *testing.T) {
+		_, err := client.Scan(bytes.NewReader(make([]byte, 4*maxTestStream)))
+		if err == nil || errors.Is(err, clamd.ErrUnavailable) || !strings.Contains(err.Error(), "size limit exceeded") {
+			t.Fatalf("error %v", err)
+		}
+	})
+
+	t.Run("an unreachable daemon is unavailable", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := listener.Addr().String()
+		listener.Close()
+		if _, err := clamd.New(address, time.Second).Scan(bytes.NewReader(cleanContent)); !errors.Is(err, clamd.ErrUnavailable) {
+			t.Fatalf("error %v", err)
+		}
+	})
+
+	t.Run("the daemon is reached over a unix socket", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "clamd.sock")
+		newFakeClamd(t, "unix", socket)
+		result, err := clamd.New("unix://"+socket, time.Second).Scan(bytes.NewReader(infectedContent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Infected {
+			t.Fatal("infected content reported clean")
+		}
+	})
+}
+
+func TestScanServiceFailingClosed(t *testing.T) {
+	daemon := newFakeClamd(t, "tcp", "127.0.0.1:0")
+	closed := newScanEnv(daemon, false)
+
+	t.Run("clean files are let through and their messages refreshed", func(t *testing.T) {
+		id := closed.upload(t, 1, cleanContent, 21)
+		file := closed.expect(t, id, models.ScanClean, false)
+		if file.PreviewStatus != models.PreviewPending {
+			t.Fatalf("preview status %q", file.PreviewStatus)
+		}
+		closed.mu.Lock()
+		defer closed.mu.Unlock()
+		if len(closed.refreshed) != 1 || closed.refreshed[0] != 21 {
+			t.Fatalf("refreshed messages %v", closed.refreshed)
+		}
+	})
+
+	t.Run("infected files are quarantined and their uploader notified", func(t *testing.T) {
+		id := closed.upload(t, 2, infectedContent)
+		file := closed.expect(t, id, models.ScanInfected, true)
+		if file.ScanResult != "Eicar-Test-Signature" {
+			t.Fatalf("result %q", file.ScanResult)
+		}
+		if file.PreviewStatus != models.PreviewFailed {
+			t.Fatal("quarantined file still waits for previews")
+		}
+		notified := closed.notifications.infected()
+		if len(notified) != 1 || notified[0].ID != id || notified[0].UploaderID != 9 {
+			t.Fatalf("notified of %d files", len(notified))
+		}
+	})
+
+	t.Run("content scanned already is not scanned again", func(t *testing.T) {
+		before := daemon.scans.Load()
+		id := closed.upload(t, 2, infectedContent)
+		closed.expect(t, id, models.ScanInfected, true)
+		if scans := daemon.scans.Load() - before; scans != 0 {
+			t.Fatalf("scanned %d more times", scans)
+		}
+		if len(closed.notifications.infected()) != 2 {
+			t.Fatal("uploader of the second copy not notified")
+		}
+	})
+
+	t.Run("files that cannot be scanned stay quarantined", func(t *testing.T) {
+		id := closed.upload(t, 3, make([]byte, maxTestStream+1))
+		file := closed.expect(t, id, models.ScanError, true)
+		if !strings.Contains(file.ScanResult, "too large") {
+			t.Fatalf("result %q", file.ScanResult)
+		}
+	})
+
+	t.Run("files wait while the daemon is down", func(t *testing.T) {
+		daemon.down.Store(true)
+		id := closed.upload(t, 4, cleanContent[:100])
+		// Long enough for a couple of polls
+		time.Sleep(2*scanPollInterval + time.Second)
+		if file := closed.store.get(id); file.ScanStatus != models.ScanPending || !file.Quarantined() {
+			t.Fatalf("status %q while the daemon is down", file.ScanStatus)
+		}
+		daemon.down.Store(false)
+		closed.expect(t, id, models.ScanClean, false)
+	})
+}
+
+func TestScanServiceFailingOpen(t *testing.T) {
+	daemon := newFakeClamd(t, "tcp", "127.0.0.1:0")
+	open := newScanEnv(daemon, true)
+
+	t.Run("files that cannot be scanned are let through", func(t *testing.T) {
+		daemon.down.Store(true)
+		defer daemon.down.Store(false)
+		id := open.upload(t, 5, cleanContent[:200])
+		file := open.expect(t, id, models.ScanUnscanned, false)
+		if file.ScanResult != "scanner is unavailable" {
+			t.Fatalf("result %q", file.ScanResult)
+		}
+	})
+
+	t.Run("infected files are still quarantined", func(t *testing.T) {
+		id := open.upload(t, 6, infectedContent)
+		open.expect(t, id, models.ScanInfected, true)
+	})
+}
@@ -0,0 +1,517 @@
+package service
+
+import (
+	"chatapp/models"
+	"chatapp/repository"
+	"chatapp/storage"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultUploadExpiry is how long an unfinished upload is kept without
+	// receiving bytes
+	defaultUploadExpiry = 24 * time.Hour
+	// defaultPartSize is how many bytes are sent to the storage per part
+	defaultPartSize = 8 << 20
+)
+
+// UploadService handles resumable uploads (tus protocol). Bytes are streamed
+// to the storage in parts when it supports multipart uploads; otherwise the
+// upload is staged on disk and stored whole once complete.
+type UploadService interface {
+	Create(chatRoomID, uploaderID uint, fileName, contentType string, length int64) (*models.Upload, error)
+	Get(id string, userID uint) (*models.Upload, error)
+	Append(id string, userID uint, offset int64, body io.Reader) (*models.Upload, error)
+	Terminate(id string, userID uint) error
+	MaxSize() int64
+	Run()
+}
+
+// UploadFileService is what uploads need from the file service: where to
+// store them, how large they may be, and storing the files they create
+// along with their content, which files with the same content share
+type UploadFileService interface {
+	Storage() storage.Storage
+	MaxFileSize(chatRoomID uint) (int64, error)
+	StoreContent(record *models.File, content io.Reader, size int64, sum string) (bool, error)
+	CreateFile(record *models.File) error
+	RemoveObjects(files []*models.File)
+}
+
+type uploadService struct {
+	uploadRepo  repository.UploadRepository
+	files       UploadFileService
+	storage     storage.Storage
+	stagingDir  string
+	partSize    int64
+	expiry      time.Duration
+	maxSize     int64
+	locks       sync.Map // upload ID -> *sync.Mutex, held while bytes are appended
+	multipart   storage.MultipartStorage
+	multipartOK bool
+}
+
+// NewUploadService creates a new upload service. Unfinished uploads are kept
+// in stagingDir; no upload may be larger than maxSize bytes.
+func NewUploadService(uploadRepo repository.UploadRepository, files UploadFileService, stagingDir string, partSize int64, expiry time.Duration, maxSize int64) (UploadService, error) {
+	if stagingDir == "" {
+		stagingDir = filepath.Join(os.TempDir(), "chatapp-uploads")
+	}
+	if err := os.MkdirAll(stagingDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create upload staging dir: %w", err)
+	}
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	if expiry <= 0 {
+		expiry = defaultUploadExpiry
+	}
+
+	s := &uploadService{
+		uploadRepo: uploadRepo,
+		files:      files,
+		storage:    files.Storage(),
+		stagingDir: stagingDir,
+		partSize:   partSize,
+		expiry:     expiry,
+		maxSize:    maxSize,
+	}
+	s.multipart, s.multipartOK = s.storage.(storage.MultipartStorage)
+	if s.multipartOK && s.partSize < storage.MinPartSize {
+		s.partSize = storage.MinPartSize
+	}
+	return s, nil
+}
+
+// MaxSize returns the largest upload any chat room accepts
+func (s *uploadService) MaxSize() int64 {
+	return s.maxSize
+}
+
+// stagingPath returns the file holding the bytes of an upload not yet sent
+// to the storage
+func (s *uploadService) stagingPath(id string) string {
+	return filepath.Join(s.stagingDir, id)
+}
+
+// lock marks an upload as receiving bytes; a second request appending to the
+// same upload at once is refused rather than queued
+func (s *uploadService) lock(id string) (func(), bool) {
+	value, _ := s.locks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+func (s *uploadService) Create(chatRoomID, uploaderID uint, fileName, contentType string, length int64) (*models.Upload, error) {
+	if fileName == "" {
+		return nil, errors.New("file name is required")
+	}
+	if length < 0 {
+		return nil, errors.New("invalid upload length")
+	}
+
+	maxFileSize, err := s.files.MaxFileSize(chatRoomID)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxFileSize {
+		return nil, errors.New("file is too large")
+	}
+
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(fileName))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errors.New("failed to create upload")
+	}
+	upload := &models.Upload{
+		ID:          hex.EncodeToString(secret),
+		ChatRoomID:  chatRoomID,
+		UploaderID:  uploaderID,
+		FileName:    fileName,
+		ContentType: contentType,
+		Length:      length,
+		ObjectPath:  objectPath(chatRoomID, fileName),
+		ExpiresAt:   time.Now().Add(s.expiry),
+	}
+
+	if err := os.WriteFile(s.stagingPath(upload.ID), nil, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to create upload: %w", err)
+	}
+	if err := s.uploadRepo.Create(upload); err != nil {
+		os.Remove(s.stagingPath(upload.ID))
+		return nil, errors.New("failed to create upload")
+	}
+
+	// An empty file is complete as soon as it is announced
+	if length == 0 {
+		if err := s.complete(upload, nil); err != nil {
+			return nil, err
+		}
+	}
+	return upload, nil
+}
+
+func (s *uploadService) Get(id string, userID uint) (*models.Upload, error) {
+	upload, err := s.uploadRepo.GetByID(id)
+	if err != nil || upload.UploaderID != userID || !time.Now().Before(upload.ExpiresAt) {
+		return nil, errors.New("upload not found")
+	}
+	return upload, nil
+}
+
+// Append writes the bytes of body at offset, which must be where the upload
+// stopped. Bytes received before body fails are kept, so the client can ask
+// for the offset and resume.
+func (s *uploadService) Append(id string, userID uint, offset int64, body io.Reader) (*models.Upload, error) {
+	unlock, ok := s.lock(id)
+	if !ok {
+		return nil, errors.New("upload is locked")
+	}
+	defer unlock()
+
+	upload, err := s.Get(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if offset != upload.Offset {
+		return nil, errors.New("upload offset mismatch")
+	}
+	if upload.Complete() {
+		return upload, nil
+	}
+
+	file, err := os.OpenFile(s.stagingPath(id), os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.New("upload is no longer available")
+	}
+	defer file.Close()
+
+	// Drop bytes written by a request that failed before they were recorded
+	staged := upload.Offset - upload.PartsSize
+	info, err := file.Stat()
+	if err != nil || info.Size() < staged {
+		return nil, errors.New("upload is no longer available")
+	}
+	if err := file.Truncate(staged); err != nil {
+		return nil, fmt.Errorf("failed to prepare upload: %w", err)
+	}
+	if _, err := file.Seek(staged, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to prepare upload: %w", err)
+	}
+
+	parts, err := decodeParts(upload.Parts)
+	if err != nil {
+		return nil, err
+	}
+	upload.ExpiresAt = time.Now().Add(s.expiry)
+
+	// Stage bytes until a part is full, send it, and start over
+	reader := io.LimitReader(body, upload.Length-upload.Offset)
+	var readErr error
+	for {
+		space := upload.Length - upload.Offset
+		if s.multipartOK && s.partSize-staged < space {
+			space = s.partSize - staged
+		}
+		n, err := io.CopyN(file, reader, space)
+		staged += n
+		upload.Offset += n
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		if upload.Offset == upload.Length {
+			break
+		}
+
+		if parts, err = s.sendPart(upload, file, staged, parts); err != nil {
+			return nil, err
+		}
+		staged = 0
+	}
+
+	if readErr == nil && upload.Offset == upload.Length {
+		// The client may not send more than it announced
+		var extra [1]byte
+		if n, _ := body.Read(extra[:]); n > 0 {
+			readErr = errors.New("upload exceeds its length")
+		}
+	}
+
+	if upload.Offset == upload.Length && readErr == nil {
+		if err := s.complete(upload, parts); err != nil {
+			return nil, err
+		}
+		return upload, nil
+	}
+
+	if err := s.uploadRepo.Update(upload); err != nil {
+		return nil, errors.New("failed to save upload")
+	}
+	if readErr != nil {
+		if readErr.Error() == "upload exceeds its length" {
+			return nil, readErr
+		}
+		return nil, fmt.Errorf("upload interrupted: %w", readErr)
+	}
+	return upload, nil
+}
+
+// sendPart sends the staged bytes to the storage as the next part, records
+// it, and empties the staging file. The record is saved before the staging
+// file is emptied so that a crash in between loses no bytes.
+func (s *uploadService) sendPart(upload *models.Upload, file *os.File, size int64, parts []storage.UploadedPart) ([]storage.UploadedPart, error) {
+	if upload.MultipartID == "" {
+		uploadID, err := s.multipart.CreateMultipartUpload(upload.ObjectPath, storage.UploadOptions{ContentType: upload.ContentType})
+		if err != nil {
+			return nil, err
+		}
+		upload.MultipartID = uploadID
+	}
+
+	// The hash covers exactly the bytes of the recorded parts
+	digest, err := restoreHash(upload.HashState)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(digest, io.NewSectionReader(file, 0, size)); err != nil {
+		return nil, fmt.Errorf("failed to hash upload: %w", err)
+	}
+	state, err := digest.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash upload: %w", err)
+	}
+
+	number := len(parts) + 1
+	etag, err := s.multipart.UploadPart(upload.ObjectPath, upload.MultipartID, number, io.NewSectionReader(file, 0, size), size)
+	if err != nil {
+		return nil, err
+	}
+	parts = append(parts, storage.UploadedPart{Number: number, ETag: etag})
+	encoded, err := json.Marshal(parts)
+	if err != nil {
+		return nil, err
+	}
+	upload.Parts = string(encoded)
+	upload.PartsSize += size
+	upload.HashState = state
+
+	if err := s.uploadRepo.Update(upload); err != nil {
+		return nil, errors.New("failed to save upload")
+	}
+	if err := file.Truncate(0); err != nil {
+		return nil, fmt.Errorf("failed to reset upload staging: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to reset upload staging: %w", err)
+	}
+	return parts, nil
+}
+
+// complete stores the received bytes as an object and creates its file
+func (s *uploadService) complete(upload *models.Upload, parts []storage.UploadedPart) error {
+	stagingPath := s.stagingPath(upload.ID)
+	file, err := os.Open(stagingPath)
+	if err != nil {
+		return errors.New("upload is no longer available")
+	}
+	defer file.Close()
+	staged := upload.Length - upload.PartsSize
+
+	// Uploads whose parts were sent before their hash was kept get theirs
+	// when the stored files are backfilled
+	var sum string
+	if upload.PartsSize == 0 || len(upload.HashState) > 0 {
+		digest, err := restoreHash(upload.HashState)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(digest, io.NewSectionReader(file, 0, staged)); err != nil {
+			return fmt.Errorf("failed to hash upload: %w", err)
+		}
+		sum = hex.EncodeToString(digest.Sum(nil))
+	}
+
+	record := &models.File{
+		FileName:      upload.FileName,
+		ContentType:   upload.ContentType,
+		ChatRoomID:    upload.ChatRoomID,
+		UploaderID:    upload.UploaderID,
+		PreviewStatus: previewStatus(upload.ContentType),
+		ScanStatus:    scanStatus(),
+	}
+	if upload.MultipartID == "" {
+		// Staged whole, so stored straight at its content's path
+		if _, err := s.files.StoreContent(record, io.NewSectionReader(file, 0, staged), staged, sum); err != nil {
+			return fmt.Errorf("failed to store upload: %w", err)
+		}
+	} else if err := s.completeMultipart(upload, record, file, staged, parts, sum); err != nil {
+		return err
+	}
+	if err := s.files.CreateFile(record); err != nil {
+		s.files.RemoveObjects([]*models.File{record})
+		return fmt.Errorf("failed to create file record: %w", err)
+	}
+
+	upload.FileID = &record.ID
+	upload.Parts = ""
+	upload.PartsSize = upload.Length
+	upload.HashState = nil
+	if err := s.uploadRepo.Update(upload); err != nil {
+		return errors.New("failed to save upload")
+	}
+	os.Remove(stagingPath)
+	return nil
+}
+
+// completeMultipart assembles the parts of an upload into its object. The
+// storage cannot copy objects, so content with a known hash is then read back
+// into its content's path and the assembled object deleted; the rest stays
+// where it was assembled until the stored files are backfilled.
+func (s *uploadService) completeMultipart(upload *models.Upload, record *models.File, file *os.File, staged int64, parts []storage.UploadedPart, sum string) error {
+	// The last part may be smaller than the others
+	if staged > 0 {
+		etag, err := s.multipart.UploadPart(upload.ObjectPath, upload.MultipartID, len(parts)+1, io.NewSectionReader(file, 0, staged), staged)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, storage.UploadedPart{Number: len(parts) + 1, ETag: etag})
+	}
+	result, err := s.multipart.CompleteMultipartUpload(upload.ObjectPath, upload.MultipartID, parts)
+	if err != nil {
+		return fmt.Errorf("failed to store upload: %w", err)
+	}
+	if sum == "" {
+		record.FilePath = result.ObjectPath
+		record.FileSize = result.Size
+		return nil
+	}
+
+	reader, err := storage.OpenObject(s.storage, result.ObjectPath)
+	if err != nil {
+		return fmt.Errorf("failed to store upload: %w", err)
+	}
+	_, err = s.files.StoreContent(record, reader, result.Size, sum)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("failed to store upload: %w", err)
+	}
+	if err := s.storage.Delete(result.ObjectPath); err != nil {
+		log.Printf("Failed to delete assembled upload %s: %v", result.ObjectPath, err)
+	}
+	return nil
+}
+
+// Terminate abandons an unfinished upload. The file of a completed upload is
+// kept; only the upload is forgotten.
+func (s *uploadService) Terminate(id string, userID uint) error {
+	unlock, ok := s.lock(id)
+	if !ok {
+		return errors.New("upload is locked")
+	}
+	defer unlock()
+
+	upload, err := s.Get(id, userID)
+	if err != nil {
+		return err
+	}
+	s.discard(upload)
+	return nil
+}
+
+// discard removes an upload with its staged bytes and the parts sent to
+// the storage
+func (s *uploadService) discard(upload *models.Upload) {
+	if !upload.Complete() && upload.MultipartID != "" {
+		if err := s.multipart.AbortMultipartUpload(upload.ObjectPath, upload.MultipartID); err != nil {
+			log.Printf("Failed to abort multipart upload of %s: %v", upload.ID, err)
+		}
+	}
+	if err := os.Remove(s.stagingPath(upload.ID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove staged upload %s: %v", upload.ID, err)
+	}
+	if err := s.uploadRepo.Delete(upload.ID); err != nil {
+		log.Printf("Failed to delete upload %s: %v", upload.ID, err)
+	}
+	s.locks.Delete(upload.ID)
+}
+
+// Run periodically removes uploads idle past their expiry
+func (s *uploadService) Run() {
+	interval := time.Minute
+	if s.expiry/2 < interval {
+		interval = s.expiry / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.removeExpired()
+	}
+}
+
+func (s *uploadService) removeExpired() {
+	uploads, err := s.uploadRepo.GetExpired(time.Now(), 100)
+	if err != nil {
+		log.Printf("Failed to list expired uploads: %v", err)
+		return
+	}
+	for i := range uploads {
+		// Bytes still arriving keep an upload alive
+		unlock, ok := s.lock(uploads[i].ID)
+		if !ok {
+			continue
+		}
+		s.discard(&uploads[i])
+		unlock()
+	}
+}
+
+// decodeParts decodes the parts recorded for an upload
+func decodeParts(encoded string) ([]storage.UploadedPart, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	var parts []storage.UploadedPart
+	if err := json.Unmarshal([]byte(encoded), &parts); err != nil {
+		return nil, fmt.Errorf("invalid upload parts: %w", err)
+	}
+	return parts, nil
+}
+
+// restoreHash resumes the SHA-256 of an upload from its saved state
+func restoreHash(state []byte) (hash.Hash, error) {
+	digest := sha256.New()
+	if len(state) == 0 {
+		return digest, nil
+	}
+	if err := digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, fmt.Errorf("invalid upload hash state: %w", err)
+	}
+	return digest, nil
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"chatapp/models"
+	"chatapp/repository"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+)
+
+// defaultTicketTTL is how long a WebSocket ticket can be redeemed for
+const defaultTicketTTL = 30 * time.Second
+
+// WSTicketService issues and redeems single-use WebSocket handshake tickets
+type WSTicketService interface {
+	Issue(userID uint, username string) (*models.WSTicketResponse, error)
+	Redeem(ticket string) (*models.WSTicket, error)
+	Run()
+}
+
+type wsTicketService struct {
+	ticketRepo repository.WSTicketRepository
+	ttl        time.Duration
+}
+
+// NewWSTicketService creates a new WebSocket ticket service
+func NewWSTicketService(ticketRepo repository.WSTicketRepository, ttl time.Duration) WSTicketService {
+	if ttl <= 0 {
+		ttl = defaultTicketTTL
+	}
+
+	return &wsTicketService{
+		ticketRepo: ticketRepo,
+		ttl:        ttl,
+	}
+}
+
+// hashTicket returns the form a ticket is stored in
+func hashTicket(ticket string) string {
+	sum := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *wsTicketService) Issue(userID uint, username string) (*models.WSTicketResponse, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errors.New("failed to issue ticket")
+	}
+	ticket := hex.EncodeToString(secret)
+
+	record := &models.WSTicket{
+		TokenHash: hashTicket(ticket),
+		UserID:    userID,
+		Username:  username,
+		ExpiresAt: time.Now().Add(s.ttl),
+	}
+	if err := s.ticketRepo.Create(record); err != nil {
+		return nil, errors.New("failed to issue ticket")
+	}
+	return &models.WSTicketResponse{Ticket: ticket, ExpiresAt: record.ExpiresAt}, nil
+}
+
+// Redeem uses up a ticket, returning who it was issued to
+func (s *wsTicketService) Redeem(ticket string) (*models.WSTicket, error) {
+	record, err := s.ticketRepo.Consume(hashTicket(ticket))
+	if err != nil || !time.Now().Before(record.ExpiresAt) {
+		return nil, errors.New("invalid or expired ticket")
+	}
+	return record, nil
+}
+
+// Run periodically removes tickets that expired unused
+func (s *wsTicketService) Run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := s.ticketRepo.DeleteExpired(time.Now()); err != nil {
+			log.Printf("Failed to prune WebSocket tickets: %v", err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DownloadOptions 下载选项
+// 去重后的内容对象由多个文件共用，对象路径不含各文件的名称，下载时由链接指定
+type DownloadOptions struct {
+	FileName    string // 保存时使用的文件名
+	ContentType string // 响应的内容类型，为空时由存储决定
+}
+
+// NamedDownloader 可生成指定文件名和内容类型的下载URL的存储（可选实现）
+type NamedDownloader interface {
+	// DownloadAs 获取以 options 中的文件名和内容类型返回对象的下载URL
+	DownloadAs(objectPath string, expiry time.Duration, options DownloadOptions) (string, error)
+}
+
+// DownloadAs 获取以 options 中的文件名和内容类型返回对象的下载URL
+// 存储未实现 NamedDownloader 时返回普通的下载URL
+func DownloadAs(s Storage, objectPath string, expiry time.Duration, options DownloadOptions) (string, error) {
+	if downloader, ok := s.(NamedDownloader); ok {
+		return downloader.DownloadAs(objectPath, expiry, options)
+	}
+	return s.Download(objectPath, expiry)
+}
+
+// DownloadAs 获取MinIO对象的下载URL，由 response-content-* 参数指定响应头
+// 浏览器仍可内联显示，保存时使用原始文件名
+func (m *MinioStorage) DownloadAs(objectPath string, expiry time.Duration, options DownloadOptions) (string, error) {
+	params := url.Values{}
+	if options.FileName != "" {
+		params.Set("response-content-disposition", mime.FormatMediaType("inline", map[string]string{"filename": options.FileName}))
+	}
+	if options.ContentType != "" {
+		params.Set("response-content-type", options.ContentType)
+	}
+	presignedURL, err := m.client.PresignedGetObject(context.Background(), m.bucketName, objectPath, expiry, params)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate download url: %w", err)
+	}
+	return presignedURL.String(), nil
+}
+
+// DownloadAs 获取本地存储对象的签名URL，文件名和内容类型作为参数一同签名，
+// 由 StorageController 用于响应头
+func (l *LocalStorage) DownloadAs(objectPath string, expiry time.Duration, options DownloadOptions) (string, error) {
+	return l.signedURL(http.MethodGet, objectPath, expiry, options)
+}
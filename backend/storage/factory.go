@@ -2,14 +2,61 @@ package storage
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 )
 
 // StorageType 存储类型常量
 const (
 	StorageTypeMinio = "minio"
 	StorageTypeQiniu = "qiniu"
+	StorageTypeLocal = "local"
+	StorageTypeS3    = "s3"
 )
 
+// driver 已注册的存储类型
+type driver struct {
+	newConfig func() interface{}
+	open      func(config interface{}) (Storage, error)
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]driver)
+)
+
+// Register 注册存储类型，C 为其配置类型
+// 各存储实现在 init 中注册自己，新增存储提供商无需修改工厂或 FileService；
+// 配置文件中与存储类型同名的配置段会被解码为 C 传给 open
+func Register[C any](storageType string, open func(config C) (Storage, error)) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if _, exists := drivers[storageType]; exists {
+		panic(fmt.Sprintf("storage type %s registered twice", storageType))
+	}
+	drivers[storageType] = driver{
+		newConfig: func() interface{} { return new(C) },
+		open: func(config interface{}) (Storage, error) {
+			switch c := config.(type) {
+			case C:
+				return open(c)
+			case *C:
+				return open(*c)
+			}
+			return nil, fmt.Errorf("invalid %s config type", storageType)
+		},
+	}
+}
+
+// lookup 查找已注册的存储类型
+func lookup(storageType string) (driver, bool) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	d, ok := drivers[storageType]
+	return d, ok
+}
+
 // StorageFactory 存储工厂
 type StorageFactory struct{}
 
@@ -18,40 +65,39 @@ func NewStorageFactory() *StorageFactory {
 	return &StorageFactory{}
 }
 
-// CreateStorage 根据配置创建存储实例
+// NewConfig 返回存储类型的空配置（指针），用于从配置文件解码
+func (f *StorageFactory) NewConfig(storageType string) (interface{}, error) {
+	d, ok := lookup(storageType)
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage type: %s", storageType)
+	}
+	return d.newConfig(), nil
+}
+
+// CreateStorage 根据配置创建存储实例，config 为存储类型的配置或其指针
 func (f *StorageFactory) CreateStorage(storageType string, config interface{}) (Storage, error) {
-	switch storageType {
-	case StorageTypeMinio:
-		minioConfig, ok := config.(MinioConfig)
-		if !ok {
-			return nil, fmt.Errorf("invalid minio config type")
-		}
-		return NewMinioStorage(minioConfig)
-
-	case StorageTypeQiniu:
-		qiniuConfig, ok := config.(QiniuStorageConfig)
-		if !ok {
-			return nil, fmt.Errorf("invalid qiniu config type")
-		}
-		return NewQiniuStorage(qiniuConfig)
-
-	default:
+	d, ok := lookup(storageType)
+	if !ok {
 		return nil, fmt.Errorf("unsupported storage type: %s", storageType)
 	}
+	return d.open(config)
 }
 
 // GetSupportedStorageTypes 获取支持的存储类型列表
 func (f *StorageFactory) GetSupportedStorageTypes() []string {
-	return []string{StorageTypeMinio, StorageTypeQiniu}
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	types := make([]string, 0, len(drivers))
+	for t := range drivers {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
 }
 
 // IsValidStorageType 检查存储类型是否有效
 func (f *StorageFactory) IsValidStorageType(storageType string) bool {
-	supportedTypes := f.GetSupportedStorageTypes()
-	for _, t := range supportedTypes {
-		if t == storageType {
-			return true
-		}
-	}
-	return false
+	_, ok := lookup(storageType)
+	return ok
 }
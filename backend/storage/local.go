@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalRoutePrefix 本地存储对象的访问路径，由 Go 服务自身处理
+const LocalRoutePrefix = "/api/storage/local/"
+
+// 本地存储的错误，控制器据此返回对应的状态码
+var (
+	ErrInvalidObjectPath = errors.New("invalid object path")
+	ErrSignatureInvalid  = errors.New("invalid signature")
+	ErrSignatureExpired  = errors.New("signature expired")
+)
+
+// LocalStorage 本地文件系统存储实现
+// 对象保存在根目录下，下载和上传通过带 HMAC 签名、会过期的 URL 由服务自身处理
+type LocalStorage struct {
+	root       string
+	baseURL    string
+	signingKey []byte
+}
+
+// LocalStorageConfig 本地存储配置
+type LocalStorageConfig struct {
+	Dir        string `mapstructure:"dir"`         // 对象保存的根目录
+	BaseURL    string `mapstructure:"base_url"`    // 服务对外的地址，用于生成下载和上传URL，如 "http://localhost:8080"
+	SigningKey string `mapstructure:"signing_key"` // 签名URL使用的密钥
+}
+
+func init() {
+	Register(StorageTypeLocal, func(config LocalStorageConfig) (Storage, error) {
+		return NewLocalStorage(config)
+	})
+}
+
+// NewLocalStorage 创建本地存储实例
+func NewLocalStorage(config LocalStorageConfig) (*LocalStorage, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("local storage dir is required")
+	}
+	if config.SigningKey == "" {
+		return nil, fmt.Errorf("local storage signing key is required")
+	}
+
+	root, err := filepath.Abs(config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve local storage dir: %w", err)
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create local storage dir: %w", err)
+	}
+
+	return &LocalStorage{
+		root:       root,
+		baseURL:    strings.TrimSuffix(config.BaseURL, "/"),
+		signingKey: []byte(config.SigningKey),
+	}, nil
+}
+
+// resolve 将对象路径转换为根目录下的文件路径
+// 只接受规范的相对路径：不能为绝对路径，不能包含 ".."、空段或以 "." 开头的段
+// （上传中的临时文件以 "." 开头，不会被当作对象访问）
+func (l *LocalStorage) resolve(objectPath string) (string, error) {
+	if objectPath == "" || strings.ContainsAny(objectPath, "\\\x00") || path.Clean(objectPath) != objectPath {
+		return "", ErrInvalidObjectPath
+	}
+	for _, segment := range strings.Split(objectPath, "/") {
+		if segment == "" || strings.HasPrefix(segment, ".") {
+			return "", ErrInvalidObjectPath
+		}
+	}
+
+	filePath := filepath.Join(l.root, filepath.FromSlash(objectPath))
+	rel, err := filepath.Rel(l.root, filePath)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", ErrInvalidObjectPath
+	}
+	return filePath, nil
+}
+
+// Upload 上传文件
+// 先写入同目录下的临时文件再重命名，读取方不会看到写了一半的对象
+func (l *LocalStorage) Upload(objectPath string, reader io.Reader, options UploadOptions) (*UploadResult, error) {
+	filePath, err := l.resolve(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create object dir: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create object file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, reader)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write object file: %w", err)
+	}
+	if options.Size > 0 && size != options.Size {
+		return nil, fmt.Errorf("object size %d does not match expected size %d", size, options.Size)
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return nil, fmt.Errorf("failed to store object file: %w", err)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat object file: %w", err)
+	}
+	return &UploadResult{
+		ObjectPath: objectPath,
+		Size:       size,
+		ETag:       localETag(info),
+	}, nil
+}
+
+// Download 获取文件下载URL
+func (l *LocalStorage) Download(objectPath string, expiry time.Duration) (string, error) {
+	return l.signedURL(http.MethodGet, objectPath, expiry, DownloadOptions{})
+}
+
+// Delete 删除文件，文件不存在时不报错
+func (l *LocalStorage) Delete(objectPath string) error {
+	filePath, err := l.resolve(objectPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete object file: %w", err)
+	}
+	return nil
+}
+
+// GetFileInfo 获取文件信息
+// 本地存储不保存元数据，内容类型由扩展名推断
+func (l *LocalStorage) GetFileInfo(objectPath string) (*FileInfo, error) {
+	filePath, err := l.resolve(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to stat object file: %w", err)
+	}
+	if info.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+
+	return &FileInfo{
+		Key:          objectPath,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		ContentType:  mime.TypeByExtension(path.Ext(objectPath)),
+		ETag:         localETag(info),
+	}, nil
+}
+
+// GetUploadURL 获取预签名上传URL，客户端以 PUT 请求上传文件内容
+func (l *LocalStorage) GetUploadURL(objectPath string, expiry time.Duration) (string, error) {
+	return l.signedURL(http.MethodPut, objectPath, expiry, DownloadOptions{})
+}
+
+// Exists 检查文件是否存在
+func (l *LocalStorage) Exists(objectPath string) (bool, error) {
+	_, err := l.GetFileInfo(objectPath)
+	if err == ErrObjectNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetStorageType 获取存储类型
+func (l *LocalStorage) GetStorageType() string {
+	return StorageTypeLocal
+}
+
+// Open 打开对象文件用于下载，调用方负责关闭
+func (l *LocalStorage) Open(objectPath string) (*os.File, os.FileInfo, error) {
+	filePath, err := l.resolve(objectPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, ErrObjectNotFound
+		}
+		return nil, nil, fmt.Errorf("failed to open object file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to stat object file: %w", err)
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, nil, ErrObjectNotFound
+	}
+	return file, info, nil
+}
+
+// Verify 校验签名URL的查询参数：签名针对请求方法、对象路径、过期时间以及下载选项，
+// 返回经过签名的下载选项
+func (l *LocalStorage) Verify(method, objectPath string, query url.Values) (DownloadOptions, error) {
+	options := DownloadOptions{FileName: query.Get("name"), ContentType: query.Get("type")}
+	if _, err := l.resolve(objectPath); err != nil {
+		return options, err
+	}
+	expiresAt, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return options, ErrSignatureInvalid
+	}
+	given, err := hex.DecodeString(query.Get("signature"))
+	if err != nil || !hmac.Equal(given, l.sign(method, objectPath, expiresAt, options)) {
+		return options, ErrSignatureInvalid
+	}
+	if time.Now().Unix() > expiresAt {
+		return options, ErrSignatureExpired
+	}
+	return options, nil
+}
+
+// signedURL 生成在 expiry 后过期的签名URL，下载选项不为空时作为 name、type 参数
+func (l *LocalStorage) signedURL(method, objectPath string, expiry time.Duration, options DownloadOptions) (string, error) {
+	if _, err := l.resolve(objectPath); err != nil {
+		return "", err
+	}
+	expiresAt := time.Now().Add(expiry).Unix()
+
+	segments := strings.Split(objectPath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	query := downloadParams(options)
+	query.Set("expires", strconv.FormatInt(expiresAt, 10))
+	query.Set("signature", hex.EncodeToString(l.sign(method, objectPath, expiresAt, options)))
+	return l.baseURL + LocalRoutePrefix + strings.Join(segments, "/") + "?" + query.Encode(), nil
+}
+
+// downloadParams 返回下载选项对应的查询参数，选项为空时没有参数
+func downloadParams(options DownloadOptions) url.Values {
+	params := url.Values{}
+	if options.FileName != "" {
+		params.Set("name", options.FileName)
+	}
+	if options.ContentType != "" {
+		params.Set("type", options.ContentType)
+	}
+	return params
+}
+
+// sign 计算签名：HMAC-SHA256(方法 + "\n" + 对象路径 + "\n" + 过期时间)，
+// 有下载选项时再加上 "\n" + 编码后的 name、type 参数
+func (l *LocalStorage) sign(method, objectPath string, expiresAt int64, options DownloadOptions) []byte {
+	mac := hmac.New(sha256.New, l.signingKey)
+	fmt.Fprintf(mac, "%s\n%s\n%d", method, objectPath, expiresAt)
+	if params := downloadParams(options); len(params) > 0 {
+		fmt.Fprintf(mac, "\n%s", params.Encode())
+	}
+	return mac.Sum(nil)
+}
+
+// localETag 由修改时间和大小生成ETag，内容替换后随之变化
+func localETag(info os.FileInfo) string {
+	return fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())
+}
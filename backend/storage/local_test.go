@@ -0,0 +1,36 @@
+package storage_test
+
+import (
+	"chatapp/controllers"
+	"chatapp/storage"
+	"chatapp/storage/storagetest"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newLocalStorage 在临时目录中创建本地存储，并像服务端一样提供其签名URL
+func newLocalStorage(t *testing.T) storage.Storage {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	server := httptest.NewServer(engine)
+	t.Cleanup(server.Close)
+
+	local, err := storage.NewLocalStorage(storage.LocalStorageConfig{
+		Dir:        t.TempDir(),
+		BaseURL:    server.URL,
+		SigningKey: "storage-conformance",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageController := controllers.NewStorageController(local, 50<<20)
+	engine.GET("/api/storage/local/*path", storageController.ServeObject)
+	engine.PUT("/api/storage/local/*path", storageController.PutObject)
+	return local
+}
+
+func TestLocalStorage(t *testing.T) {
+	storagetest.Run(t, newLocalStorage, storagetest.Options{PresignedPut: true})
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StorageTypeMemory 内存存储的类型名，仅用于测试，不能通过配置选择
+const StorageTypeMemory = "memory"
+
+// MemoryStorage 内存存储实现，进程退出后数据即丢失
+// 用于测试和一致性检查；下载和上传URL使用 memory:// 协议，无法通过 HTTP 访问，
+// 内容通过 Read 读取
+type MemoryStorage struct {
+	mu        sync.RWMutex
+	objects   map[string]*memoryObject
+	multipart memoryMultipart
+}
+
+// memoryObject 内存中的对象
+type memoryObject struct {
+	data         []byte
+	contentType  string
+	lastModified time.Time
+	etag         string
+}
+
+// NewMemoryStorage 创建内存存储实例
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		objects: make(map[string]*memoryObject),
+	}
+}
+
+// Upload 上传文件
+func (m *MemoryStorage) Upload(objectPath string, reader io.Reader, options UploadOptions) (*UploadResult, error) {
+	if objectPath == "" {
+		return nil, fmt.Errorf("object path is required")
+	}
+
+	var buf bytes.Buffer
+	size, err := io.Copy(&buf, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file content: %w", err)
+	}
+	if options.Size > 0 && size != options.Size {
+		return nil, fmt.Errorf("object size %d does not match expected size %d", size, options.Size)
+	}
+
+	sum := md5.Sum(buf.Bytes())
+	object := &memoryObject{
+		data:         buf.Bytes(),
+		contentType:  options.ContentType,
+		lastModified: time.Now(),
+		etag:         hex.EncodeToString(sum[:]),
+	}
+
+	m.mu.Lock()
+	m.objects[objectPath] = object
+	m.mu.Unlock()
+
+	return &UploadResult{
+		ObjectPath: objectPath,
+		Size:       size,
+		ETag:       object.etag,
+	}, nil
+}
+
+// Download 获取文件下载URL
+func (m *MemoryStorage) Download(objectPath string, expiry time.Duration) (string, error) {
+	return memoryURL("GET", objectPath, expiry), nil
+}
+
+// Delete 删除文件，文件不存在时不报错
+func (m *MemoryStorage) Delete(objectPath string) error {
+	m.mu.Lock()
+	delete(m.objects, objectPath)
+	m.mu.Unlock()
+	return nil
+}
+
+// GetFileInfo 获取文件信息
+func (m *MemoryStorage) GetFileInfo(objectPath string) (*FileInfo, error) {
+	m.mu.RLock()
+	object, ok := m.objects[objectPath]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+
+	return &FileInfo{
+		Key:          objectPath,
+		Size:         int64(len(object.data)),
+		LastModified: object.lastModified,
+		ContentType:  object.contentType,
+		ETag:         object.etag,
+	}, nil
+}
+
+// GetUploadURL 获取预签名上传URL
+func (m *MemoryStorage) GetUploadURL(objectPath string, expiry time.Duration) (string, error) {
+	return memoryURL("PUT", objectPath, expiry), nil
+}
+
+// Exists 检查文件是否存在
+func (m *MemoryStorage) Exists(objectPath string) (bool, error) {
+	m.mu.RLock()
+	_, ok := m.objects[objectPath]
+	m.mu.RUnlock()
+	return ok, nil
+}
+
+// GetStorageType 获取存储类型
+func (m *MemoryStorage) GetStorageType() string {
+	return StorageTypeMemory
+}
+
+// Read 读取文件内容，文件不存在时返回 ErrObjectNotFound
+func (m *MemoryStorage) Read(objectPath string) ([]byte, error) {
+	m.mu.RLock()
+	object, ok := m.objects[objectPath]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return bytes.Clone(object.data), nil
+}
+
+// memoryURL 生成 memory:// 形式的URL，记录方法和过期时间
+func memoryURL(method, objectPath string, expiry time.Duration) string {
+	u := url.URL{
+		Scheme: StorageTypeMemory,
+		Path:   "/" + objectPath,
+		RawQuery: url.Values{
+			"method":  {method},
+			"expires": {strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)},
+		}.Encode(),
+	}
+	return u.String()
+}
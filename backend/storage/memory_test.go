@@ -0,0 +1,14 @@
+package storage_test
+
+import (
+	"chatapp/storage"
+	"chatapp/storage/storagetest"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	// 内存存储的URL无法请求，直接读取对象
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewMemoryStorage()
+	}, storagetest.Options{ReadDirect: true})
+}
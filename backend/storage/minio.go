@@ -18,12 +18,18 @@ type MinioStorage struct {
 
 // MinioConfig MinIO配置
 type MinioConfig struct {
-	Endpoint   string
-	AccessKey  string
-	SecretKey  string
-	BucketName string
-	UseSSL     bool
-	Region     string
+	Endpoint   string `mapstructure:"endpoint"`
+	AccessKey  string `mapstructure:"access_key"`
+	SecretKey  string `mapstructure:"secret_key"`
+	BucketName string `mapstructure:"bucket_name"`
+	UseSSL     bool   `mapstructure:"use_ssl"`
+	Region     string `mapstructure:"region"`
+}
+
+func init() {
+	Register(StorageTypeMinio, func(config MinioConfig) (Storage, error) {
+		return NewMinioStorage(config)
+	})
 }
 
 // NewMinioStorage 创建MinIO存储实例
@@ -98,6 +104,9 @@ func (m *MinioStorage) GetFileInfo(objectPath string) (*FileInfo, error) {
 	ctx := context.Background()
 	objInfo, err := m.client.StatObject(ctx, m.bucketName, objectPath, minio.StatObjectOptions{})
 	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrObjectNotFound
+		}
 		return nil, fmt.Errorf("failed to get file info from minio: %w", err)
 	}
 
@@ -135,5 +144,5 @@ func (m *MinioStorage) Exists(objectPath string) (bool, error) {
 
 // GetStorageType 获取存储类型
 func (m *MinioStorage) GetStorageType() string {
-	return "minio"
+	return StorageTypeMinio
 }
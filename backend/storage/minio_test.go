@@ -0,0 +1,69 @@
+package storage_test
+
+import (
+	"chatapp/storage"
+	"chatapp/storage/storagetest"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// minioConfig 读取测试用 MinIO 服务器的配置，未设置 CHATAPP_TEST_MINIO_ENDPOINT 时跳过测试
+func minioConfig(t *testing.T) storage.MinioConfig {
+	endpoint := os.Getenv("CHATAPP_TEST_MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("CHATAPP_TEST_MINIO_ENDPOINT not set")
+	}
+	config := storage.MinioConfig{
+		Endpoint:   endpoint,
+		AccessKey:  os.Getenv("CHATAPP_TEST_MINIO_ACCESS_KEY"),
+		SecretKey:  os.Getenv("CHATAPP_TEST_MINIO_SECRET_KEY"),
+		BucketName: os.Getenv("CHATAPP_TEST_MINIO_BUCKET"),
+	}
+	if config.AccessKey == "" {
+		config.AccessKey, config.SecretKey = "minioadmin", "minioadmin"
+	}
+	if config.BucketName == "" {
+		config.BucketName = "chatapp-test"
+	}
+	return config
+}
+
+// conformancePrefix 返回共享存储桶中本次测试使用的对象路径前缀
+func conformancePrefix() string {
+	return fmt.Sprintf("conformance-%d", time.Now().UnixNano())
+}
+
+func TestMinioStorage(t *testing.T) {
+	config := minioConfig(t)
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		minio, err := storage.NewMinioStorage(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return minio
+	}, storagetest.Options{Prefix: conformancePrefix(), PresignedPut: true})
+}
+
+func TestS3Storage(t *testing.T) {
+	config := minioConfig(t)
+	// 以路径形式寻址，普通主机上的 S3 兼容服务器需要如此
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s3, err := storage.NewS3Storage(storage.S3Config{
+			Endpoint:        config.Endpoint,
+			Region:          config.Region,
+			Bucket:          config.BucketName,
+			UseSSL:          config.UseSSL,
+			AddressingStyle: "path",
+			CreateBucket:    true,
+			AccessKey:       config.AccessKey,
+			SecretKey:       config.SecretKey,
+			SSE:             os.Getenv("CHATAPP_TEST_S3_SSE"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s3
+	}, storagetest.Options{Prefix: conformancePrefix(), PresignedPut: true})
+}
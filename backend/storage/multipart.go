@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// MinPartSize 分片上传中除最后一片外每片的最小大小（S3 的限制）
+const MinPartSize = 5 << 20
+
+// ErrMultipartUploadNotFound 分片上传不存在（已完成、已取消或从未创建）
+var ErrMultipartUploadNotFound = errors.New("multipart upload not found")
+
+// UploadedPart 已上传的分片
+type UploadedPart struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// MultipartStorage 支持分片上传的存储（可选实现）
+// 大文件可以边接收边按分片写入存储，不必先在本地拼装完整文件；
+// 分片编号从 1 开始，除最后一片外每片至少 MinPartSize
+type MultipartStorage interface {
+	Storage
+
+	// CreateMultipartUpload 开始分片上传，返回上传ID
+	CreateMultipartUpload(objectPath string, options UploadOptions) (string, error)
+
+	// UploadPart 上传一个分片，返回其ETag
+	UploadPart(objectPath, uploadID string, partNumber int, reader io.Reader, size int64) (string, error)
+
+	// CompleteMultipartUpload 按编号顺序拼接分片，生成对象
+	CompleteMultipartUpload(objectPath, uploadID string, parts []UploadedPart) (*UploadResult, error)
+
+	// AbortMultipartUpload 取消分片上传并丢弃已上传的分片
+	AbortMultipartUpload(objectPath, uploadID string) error
+}
+
+// CreateMultipartUpload 开始分片上传
+func (m *MinioStorage) CreateMultipartUpload(objectPath string, options UploadOptions) (string, error) {
+	return m.createMultipartUpload(objectPath, minio.PutObjectOptions{ContentType: options.ContentType})
+}
+
+func (m *MinioStorage) createMultipartUpload(objectPath string, options minio.PutObjectOptions) (string, error) {
+	core := minio.Core{Client: m.client}
+	uploadID, err := core.NewMultipartUpload(context.Background(), m.bucketName, objectPath, options)
+	if err != nil {
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	return uploadID, nil
+}
+
+// UploadPart 上传一个分片
+func (m *MinioStorage) UploadPart(objectPath, uploadID string, partNumber int, reader io.Reader, size int64) (string, error) {
+	core := minio.Core{Client: m.client}
+	part, err := core.PutObjectPart(context.Background(), m.bucketName, objectPath, uploadID, partNumber, reader, size, minio.PutObjectPartOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchUpload" {
+			return "", ErrMultipartUploadNotFound
+		}
+		return "", fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+	}
+	return part.ETag, nil
+}
+
+// CompleteMultipartUpload 拼接分片生成对象
+func (m *MinioStorage) CompleteMultipartUpload(objectPath, uploadID string, parts []UploadedPart) (*UploadResult, error) {
+	completeParts := make([]minio.CompletePart, len(parts))
+	for i, part := range parts {
+		completeParts[i] = minio.CompletePart{PartNumber: part.Number, ETag: part.ETag}
+	}
+
+	ctx := context.Background()
+	core := minio.Core{Client: m.client}
+	if _, err := core.CompleteMultipartUpload(ctx, m.bucketName, objectPath, uploadID, completeParts, minio.PutObjectOptions{}); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchUpload" {
+			return nil, ErrMultipartUploadNotFound
+		}
+		return nil, fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	// 分片上传的结果不含大小，从对象信息读取
+	info, err := m.GetFileInfo(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadResult{
+		ObjectPath: objectPath,
+		Size:       info.Size,
+		ETag:       info.ETag,
+	}, nil
+}
+
+// AbortMultipartUpload 取消分片上传
+func (m *MinioStorage) AbortMultipartUpload(objectPath, uploadID string) error {
+	core := minio.Core{Client: m.client}
+	err := core.AbortMultipartUpload(context.Background(), m.bucketName, objectPath, uploadID)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchUpload" {
+		return fmt.Errorf("failed to abort multipart upload: %w", err)
+	}
+	return nil
+}
+
+// CreateMultipartUpload 开始分片上传，附加服务端加密选项
+func (s *S3Storage) CreateMultipartUpload(objectPath string, options UploadOptions) (string, error) {
+	return s.createMultipartUpload(objectPath, minio.PutObjectOptions{
+		ContentType:          options.ContentType,
+		ServerSideEncryption: s.sse,
+	})
+}
+
+// memoryMultipartUpload 内存中进行的分片上传
+type memoryMultipartUpload struct {
+	objectPath  string
+	contentType string
+	parts       map[int][]byte
+}
+
+// memoryMultipart 内存存储的分片上传，与 S3 一样限制分片大小
+type memoryMultipart struct {
+	mu      sync.Mutex
+	uploads map[string]*memoryMultipartUpload
+	nextID  int
+}
+
+// CreateMultipartUpload 开始分片上传
+func (m *MemoryStorage) CreateMultipartUpload(objectPath string, options UploadOptions) (string, error) {
+	if objectPath == "" {
+		return "", fmt.Errorf("object path is required")
+	}
+
+	m.multipart.mu.Lock()
+	defer m.multipart.mu.Unlock()
+	if m.multipart.uploads == nil {
+		m.multipart.uploads = make(map[string]*memoryMultipartUpload)
+	}
+	m.multipart.nextID++
+	uploadID := strconv.Itoa(m.multipart.nextID)
+	m.multipart.uploads[uploadID] = &memoryMultipartUpload{
+		objectPath:  objectPath,
+		contentType: options.ContentType,
+		parts:       make(map[int][]byte),
+	}
+	return uploadID, nil
+}
+
+// UploadPart 上传一个分片
+func (m *MemoryStorage) UploadPart(objectPath, uploadID string, partNumber int, reader io.Reader, size int64) (string, error) {
+	if partNumber < 1 {
+		return "", fmt.Errorf("invalid part number %d", partNumber)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to read part content: %w", err)
+	}
+	if int64(len(data)) != size {
+		return "", fmt.Errorf("part size %d does not match expected size %d", len(data), size)
+	}
+
+	m.multipart.mu.Lock()
+	defer m.multipart.mu.Unlock()
+	upload, ok := m.multipart.uploads[uploadID]
+	if !ok || upload.objectPath != objectPath {
+		return "", ErrMultipartUploadNotFound
+	}
+	upload.parts[partNumber] = data
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CompleteMultipartUpload 拼接分片生成对象
+func (m *MemoryStorage) CompleteMultipartUpload(objectPath, uploadID string, parts []UploadedPart) (*UploadResult, error) {
+	m.multipart.mu.Lock()
+	upload, ok := m.multipart.uploads[uploadID]
+	if !ok || upload.objectPath != objectPath {
+		m.multipart.mu.Unlock()
+		return nil, ErrMultipartUploadNotFound
+	}
+	if !sort.SliceIsSorted(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number }) {
+		m.multipart.mu.Unlock()
+		return nil, fmt.Errorf("parts must be in ascending order")
+	}
+
+	var buf bytes.Buffer
+	for i, part := range parts {
+		data, ok := upload.parts[part.Number]
+		if !ok {
+			m.multipart.mu.Unlock()
+			return nil, fmt.Errorf("part %d was not uploaded", part.Number)
+		}
+		sum := md5.Sum(data)
+		if hex.EncodeToString(sum[:]) != part.ETag {
+			m.multipart.mu.Unlock()
+			return nil, fmt.Errorf("etag of part %d does not match", part.Number)
+		}
+		if i < len(parts)-1 && len(data) < MinPartSize {
+			m.multipart.mu.Unlock()
+			return nil, fmt.Errorf("part %d is smaller than the minimum part size", part.Number)
+		}
+		buf.Write(data)
+	}
+	delete(m.multipart.uploads, uploadID)
+	m.multipart.mu.Unlock()
+
+	// 与 S3 相同，分片上传对象的ETag为各分片ETag拼接后的MD5加分片数
+	etags := make([]byte, 0, len(parts)*md5.Size)
+	for _, part := range parts {
+		etag, _ := hex.DecodeString(part.ETag)
+		etags = append(etags, etag...)
+	}
+	sum := md5.Sum(etags)
+	object := &memoryObject{
+		data:         buf.Bytes(),
+		contentType:  upload.contentType,
+		lastModified: time.Now(),
+		etag:         fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(parts)),
+	}
+
+	m.mu.Lock()
+	m.objects[objectPath] = object
+	m.mu.Unlock()
+
+	return &UploadResult{
+		ObjectPath: objectPath,
+		Size:       int64(len(object.data)),
+		ETag:       object.etag,
+	}, nil
+}
+
+// AbortMultipartUpload 取消分片上传
+func (m *MemoryStorage) AbortMultipartUpload(objectPath, uploadID string) error {
+	m.multipart.mu.Lock()
+	delete(m.multipart.uploads, uploadID)
+	m.multipart.mu.Unlock()
+	return nil
+}
+
+// MultipartUploads 返回进行中的分片上传数，用于检查上传是否都已完成或取消
+func (m *MemoryStorage) MultipartUploads() int {
+	m.multipart.mu.Lock()
+	defer m.multipart.mu.Unlock()
+	return len(m.multipart.uploads)
+}
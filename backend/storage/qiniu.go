@@ -26,12 +26,18 @@ type QiniuStorage struct {
 
 // QiniuStorageConfig 七牛云配置
 type QiniuStorageConfig struct {
-	AccessKey string
-	SecretKey string
-	Bucket    string
-	Domain    string
-	Region    string // "south-china", "east-china", "north-china", "north-america", "southeast-asia"
-	UseHTTPS  bool
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	Bucket    string `mapstructure:"bucket"`
+	Domain    string `mapstructure:"domain"`
+	Region    string `mapstructure:"region"` // "south-china", "east-china", "north-china", "north-america", "southeast-asia"
+	UseHTTPS  bool   `mapstructure:"use_https"`
+}
+
+func init() {
+	Register(StorageTypeQiniu, func(config QiniuStorageConfig) (Storage, error) {
+		return NewQiniuStorage(config)
+	})
 }
 
 // NewQiniuStorage 创建七牛云存储实例
@@ -147,6 +153,9 @@ func (q *QiniuStorage) Download(objectPath string, expiry time.Duration) (string
 func (q *QiniuStorage) Delete(objectPath string) error {
 	err := q.bucketMgr.Delete(q.bucket, objectPath)
 	if err != nil {
+		if isQiniuNotFound(err) {
+			return nil
+		}
 		return fmt.Errorf("failed to delete file from qiniu: %w", err)
 	}
 	return nil
@@ -156,6 +165,9 @@ func (q *QiniuStorage) Delete(objectPath string) error {
 func (q *QiniuStorage) GetFileInfo(objectPath string) (*FileInfo, error) {
 	fileInfo, err := q.bucketMgr.Stat(q.bucket, objectPath)
 	if err != nil {
+		if isQiniuNotFound(err) {
+			return nil, ErrObjectNotFound
+		}
 		return nil, fmt.Errorf("failed to get file info from qiniu: %w", err)
 	}
 
@@ -199,8 +211,7 @@ func (q *QiniuStorage) GetUploadURL(objectPath string, expiry time.Duration) (st
 func (q *QiniuStorage) Exists(objectPath string) (bool, error) {
 	_, err := q.bucketMgr.Stat(q.bucket, objectPath)
 	if err != nil {
-		if strings.Contains(err.Error(), "no such file or directory") ||
-			strings.Contains(err.Error(), "612") { // 七牛云文件不存在错误码
+		if isQiniuNotFound(err) {
 			return false, nil
 		}
 		return false, fmt.Errorf("failed to check file existence: %w", err)
@@ -208,7 +219,13 @@ func (q *QiniuStorage) Exists(objectPath string) (bool, error) {
 	return true, nil
 }
 
+// isQiniuNotFound 判断七牛云返回的错误是否表示文件不存在
+func isQiniuNotFound(err error) bool {
+	return strings.Contains(err.Error(), "no such file or directory") ||
+		strings.Contains(err.Error(), "612") // 七牛云文件不存在错误码
+}
+
 // GetStorageType 获取存储类型
 func (q *QiniuStorage) GetStorageType() string {
-	return "qiniu"
+	return StorageTypeQiniu
 }
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ObjectReader 可直接读取对象内容的存储（可选实现）
+// 用于服务端计算已存对象的校验和，未实现的存储通过下载URL读取
+type ObjectReader interface {
+	// GetObject 打开对象内容，调用方负责关闭；对象不存在时返回 ErrObjectNotFound
+	GetObject(objectPath string) (io.ReadCloser, error)
+}
+
+// OpenObject 读取对象内容，调用方负责关闭
+// 存储实现了 ObjectReader 时直接读取，否则请求对象的下载URL
+func OpenObject(s Storage, objectPath string) (io.ReadCloser, error) {
+	if reader, ok := s.(ObjectReader); ok {
+		return reader.GetObject(objectPath)
+	}
+
+	downloadURL, err := s.Download(objectPath, 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Get(downloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download object: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrObjectNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download object: status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// GetObject 读取MinIO中的对象
+func (m *MinioStorage) GetObject(objectPath string) (io.ReadCloser, error) {
+	object, err := m.client.GetObject(context.Background(), m.bucketName, objectPath, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object from minio: %w", err)
+	}
+	// GetObject 不访问服务器，先获取信息以便对象不存在时立即报错
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to get object from minio: %w", err)
+	}
+	return object, nil
+}
+
+// GetObject 读取本地存储中的对象
+func (l *LocalStorage) GetObject(objectPath string) (io.ReadCloser, error) {
+	file, _, err := l.Open(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// GetObject 读取内存中的对象
+func (m *MemoryStorage) GetObject(objectPath string) (io.ReadCloser, error) {
+	data, err := m.Read(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// S3Storage 通用 S3 兼容存储实现（AWS S3、阿里云 OSS、腾讯云 COS、Ceph 等）
+// 读取、删除和签名URL与 MinIO 相同，上传时附加服务端加密选项
+type S3Storage struct {
+	*MinioStorage
+	sse encrypt.ServerSide
+}
+
+// S3Config S3 兼容存储配置
+type S3Config struct {
+	Endpoint        string `mapstructure:"endpoint"` // 如 "s3.amazonaws.com"、"oss-cn-hangzhou.aliyuncs.com"
+	Region          string `mapstructure:"region"`
+	Bucket          string `mapstructure:"bucket"`
+	UseSSL          bool   `mapstructure:"use_ssl"`
+	AddressingStyle string `mapstructure:"addressing_style"` // "auto"、"path" 或 "virtual"
+	CreateBucket    bool   `mapstructure:"create_bucket"`    // bucket 不存在时创建，默认要求 bucket 已存在
+
+	// Credentials 凭证来源：
+	// "static" 使用 access_key/secret_key/session_token；
+	// "env" 读取 AWS_ACCESS_KEY_ID 等环境变量；
+	// "iam" 使用实例角色（EC2/ECS，以及设置了 AWS_WEB_IDENTITY_TOKEN_FILE 的 EKS）；
+	// "assume_role" 以 access_key/secret_key 调用 STS AssumeRole 获取临时凭证；
+	// "web_identity" 以 web_identity_token_file 中的令牌调用 STS AssumeRoleWithWebIdentity
+	Credentials          string `mapstructure:"credentials"`
+	AccessKey            string `mapstructure:"access_key"`
+	SecretKey            string `mapstructure:"secret_key"`
+	SessionToken         string `mapstructure:"session_token"`
+	STSEndpoint          string `mapstructure:"sts_endpoint"` // 如 "https://sts.amazonaws.com"
+	RoleARN              string `mapstructure:"role_arn"`
+	RoleSessionName      string `mapstructure:"role_session_name"`
+	WebIdentityTokenFile string `mapstructure:"web_identity_token_file"`
+
+	// SSE 服务端加密："" 不指定（使用 bucket 默认加密）、"sse-s3" 或 "sse-kms"
+	SSE      string `mapstructure:"sse"`
+	KMSKeyID string `mapstructure:"kms_key_id"` // sse-kms 使用的密钥，留空时使用账户默认密钥
+}
+
+func init() {
+	Register(StorageTypeS3, func(config S3Config) (Storage, error) {
+		return NewS3Storage(config)
+	})
+}
+
+// NewS3Storage 创建 S3 兼容存储实例
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("s3 endpoint is required")
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+
+	creds, err := s3Credentials(config)
+	if err != nil {
+		return nil, err
+	}
+	lookup, err := s3BucketLookup(config.AddressingStyle)
+	if err != nil {
+		return nil, err
+	}
+	sse, err := s3ServerSideEncryption(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       config.UseSSL,
+		Region:       config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize s3 client: %w", err)
+	}
+
+	// 共享的对象存储通常不允许应用创建 bucket，默认只检查是否存在
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket existence: %w", err)
+	}
+	if !exists {
+		if !config.CreateBucket {
+			return nil, fmt.Errorf("s3 bucket %s does not exist", config.Bucket)
+		}
+		err = client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create bucket: %w", err)
+		}
+	}
+
+	return &S3Storage{
+		MinioStorage: &MinioStorage{
+			client:     client,
+			bucketName: config.Bucket,
+		},
+		sse: sse,
+	}, nil
+}
+
+// s3Credentials 根据配置的凭证来源创建凭证
+func s3Credentials(config S3Config) (*credentials.Credentials, error) {
+	switch config.Credentials {
+	case "", "static":
+		if config.AccessKey == "" || config.SecretKey == "" {
+			return nil, fmt.Errorf("s3 access key and secret key are required")
+		}
+		return credentials.NewStaticV4(config.AccessKey, config.SecretKey, config.SessionToken), nil
+
+	case "env":
+		return credentials.NewEnvAWS(), nil
+
+	case "iam":
+		return credentials.NewIAM(""), nil
+
+	case "assume_role":
+		if config.STSEndpoint == "" {
+			return nil, fmt.Errorf("s3 sts endpoint is required for assume_role credentials")
+		}
+		return credentials.NewSTSAssumeRole(config.STSEndpoint, credentials.STSAssumeRoleOptions{
+			AccessKey:       config.AccessKey,
+			SecretKey:       config.SecretKey,
+			SessionToken:    config.SessionToken,
+			Location:        config.Region,
+			RoleARN:         config.RoleARN,
+			RoleSessionName: config.RoleSessionName,
+		})
+
+	case "web_identity":
+		if config.STSEndpoint == "" || config.WebIdentityTokenFile == "" {
+			return nil, fmt.Errorf("s3 sts endpoint and web identity token file are required for web_identity credentials")
+		}
+		// 令牌文件会被轮换，每次刷新凭证时重新读取
+		tokenFile := config.WebIdentityTokenFile
+		return credentials.NewSTSWebIdentity(config.STSEndpoint, func() (*credentials.WebIdentityToken, error) {
+			token, err := os.ReadFile(tokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read web identity token: %w", err)
+			}
+			return &credentials.WebIdentityToken{Token: strings.TrimSpace(string(token))}, nil
+		}, func(i *credentials.STSWebIdentity) {
+			i.RoleARN = config.RoleARN
+		})
+
+	default:
+		return nil, fmt.Errorf("unsupported s3 credentials: %s", config.Credentials)
+	}
+}
+
+// s3BucketLookup 将寻址方式转换为 bucket 查找方式
+// path: endpoint/bucket/key；virtual: bucket.endpoint/key
+func s3BucketLookup(style string) (minio.BucketLookupType, error) {
+	switch style {
+	case "", "auto":
+		return minio.BucketLookupAuto, nil
+	case "path":
+		return minio.BucketLookupPath, nil
+	case "virtual":
+		return minio.BucketLookupDNS, nil
+	default:
+		return minio.BucketLookupAuto, fmt.Errorf("unsupported s3 addressing style: %s", style)
+	}
+}
+
+// s3ServerSideEncryption 创建上传时使用的服务端加密选项
+// 不支持 SSE-C：客户提供的密钥必须随每次下载请求发送，无法用于签名下载URL
+func s3ServerSideEncryption(config S3Config) (encrypt.ServerSide, error) {
+	switch strings.ToLower(config.SSE) {
+	case "":
+		return nil, nil
+	case "sse-s3":
+		return encrypt.NewSSE(), nil
+	case "sse-kms":
+		sse, err := encrypt.NewSSEKMS(config.KMSKeyID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 sse-kms options: %w", err)
+		}
+		return sse, nil
+	default:
+		return nil, fmt.Errorf("unsupported s3 sse: %s", config.SSE)
+	}
+}
+
+// Upload 上传文件
+func (s *S3Storage) Upload(objectPath string, reader io.Reader, options UploadOptions) (*UploadResult, error) {
+	ctx := context.Background()
+	uploadInfo, err := s.client.PutObject(ctx, s.bucketName, objectPath, reader, options.Size, minio.PutObjectOptions{
+		ContentType:          options.ContentType,
+		ServerSideEncryption: s.sse,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file to s3: %w", err)
+	}
+
+	return &UploadResult{
+		ObjectPath: objectPath,
+		Size:       uploadInfo.Size,
+		ETag:       uploadInfo.ETag,
+	}, nil
+}
+
+// GetStorageType 获取存储类型
+func (s *S3Storage) GetStorageType() string {
+	return StorageTypeS3
+}
@@ -1,10 +1,14 @@
 package storage
 
 import (
+	"errors"
 	"io"
 	"time"
 )
 
+// ErrObjectNotFound 对象不存在，所有存储实现的 GetFileInfo 都返回该错误
+var ErrObjectNotFound = errors.New("object not found")
+
 // UploadOptions 上传选项
 type UploadOptions struct {
 	ContentType string
@@ -28,17 +32,18 @@ type FileInfo struct {
 }
 
 // Storage 存储接口，定义文件存储的统一抽象
+// 各实现的行为约定见 storagetest 包中的一致性检查
 type Storage interface {
-	// Upload 上传文件
+	// Upload 上传文件，已存在的对象会被覆盖
 	Upload(objectPath string, reader io.Reader, options UploadOptions) (*UploadResult, error)
 
 	// Download 获取文件下载URL
 	Download(objectPath string, expiry time.Duration) (string, error)
 
-	// Delete 删除文件
+	// Delete 删除文件，文件不存在时不报错
 	Delete(objectPath string) error
 
-	// GetFileInfo 获取文件信息
+	// GetFileInfo 获取文件信息，文件不存在时返回 ErrObjectNotFound
 	GetFileInfo(objectPath string) (*FileInfo, error)
 
 	// GetUploadURL 获取预签名上传URL（可选实现）
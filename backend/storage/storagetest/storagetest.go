@@ -0,0 +1,554 @@
+// Package storagetest 提供 storage.Storage 的一致性测试，任何存储实现都应通过。
+// 测试只依赖接口本身，可以对内存、本地存储离线运行，也可以对真实的 MinIO 运行
+// （见 storage/minio_test.go）。
+package storagetest
+
+import (
+	"bytes"
+	"chatapp/storage"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Options 描述被检查的存储实现
+type Options struct {
+	// Prefix 检查所用对象路径的前缀，避免与已有对象冲突
+	Prefix string
+	// ReadDirect 通过 storage.OpenObject 读取对象内容；为 false 时以 HTTP GET 请求下载URL
+	ReadDirect bool
+	// PresignedPut 上传URL是否接受以 HTTP PUT 请求体上传（MinIO、本地存储）
+	PresignedPut bool
+	// LargeObjectSize 大对象检查使用的大小，默认 16MB
+	LargeObjectSize int64
+}
+
+// errUnsupported 存储未实现检查所针对的可选接口，检查被跳过
+var errUnsupported = errors.New("storage does not implement the interface under test")
+
+// check 一项一致性检查
+type check struct {
+	name string
+	run  func(t *suite) error
+}
+
+// suite 对一个存储实现运行的检查
+type suite struct {
+	storage storage.Storage
+	options Options
+	read    func(objectPath string) ([]byte, error)
+}
+
+// Run 以子测试运行对存储实现的全部检查，每项检查使用 newStorage 新建的存储，
+// 结束时删除自己创建的对象
+func Run(t *testing.T, newStorage func(t *testing.T) storage.Storage, options Options) {
+	if options.Prefix == "" {
+		options.Prefix = "conformance"
+	}
+	if options.LargeObjectSize <= 0 {
+		options.LargeObjectSize = 16 << 20
+	}
+
+	checks := []check{
+		{"upload reports the object and its info matches", (*suite).uploadInfo},
+		{"uploading again replaces the object", (*suite).overwrite},
+		{"uploads of unknown size and empty objects", (*suite).sizes},
+		{"missing objects are not found", (*suite).missing},
+		{"deleted objects are gone", (*suite).deleted},
+		{"download URLs address their object", (*suite).downloadURLs},
+		{"download URLs carry the file name and content type", (*suite).namedDownload},
+		{"presigned upload URLs", (*suite).presignedUpload},
+		{"object paths with spaces and unicode", (*suite).unusualPaths},
+		{"large objects", (*suite).largeObject},
+		{"objects can be read back directly", (*suite).objectReader},
+		{"multipart uploads assemble their parts", (*suite).multipartUpload},
+		{"aborted multipart uploads leave no object", (*suite).multipartAbort},
+	}
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			s := &suite{storage: newStorage(t), options: options}
+			s.read = s.readURL
+			if options.ReadDirect {
+				s.read = s.readObject
+			}
+			if err := c.run(s); errors.Is(err, errUnsupported) {
+				t.Skip(err)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// path 返回检查使用的对象路径
+func (t *suite) path(name string) string {
+	return t.options.Prefix + "/" + name
+}
+
+// upload 上传内容，大小已知
+func (t *suite) upload(objectPath string, content []byte, contentType string) (*storage.UploadResult, error) {
+	return t.storage.Upload(objectPath, bytes.NewReader(content), storage.UploadOptions{
+		ContentType: contentType,
+		Size:        int64(len(content)),
+	})
+}
+
+// expectContent 读取对象并与期望的内容比较
+func (t *suite) expectContent(objectPath string, want []byte) error {
+	got, err := t.read(objectPath)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", objectPath, err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%s has %d bytes, want %d", objectPath, len(got), len(want))
+	}
+	return nil
+}
+
+// expectMissing 检查对象不存在
+func (t *suite) expectMissing(objectPath string) error {
+	exists, err := t.storage.Exists(objectPath)
+	if err != nil {
+		return fmt.Errorf("exists: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("%s exists", objectPath)
+	}
+	if _, err := t.storage.GetFileInfo(objectPath); !errors.Is(err, storage.ErrObjectNotFound) {
+		return fmt.Errorf("file info of %s returned %v, want %v", objectPath, err, storage.ErrObjectNotFound)
+	}
+	return nil
+}
+
+// readObject 通过 storage.OpenObject 读取对象内容
+func (t *suite) readObject(objectPath string) ([]byte, error) {
+	reader, err := storage.OpenObject(t.storage, objectPath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// readURL 以 HTTP GET 请求对象的下载URL
+func (t *suite) readURL(objectPath string) ([]byte, error) {
+	downloadURL, err := t.storage.Download(objectPath, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Get(downloadURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download returned %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (t *suite) uploadInfo() error {
+	objectPath := t.path("info/hello.txt")
+	defer t.storage.Delete(objectPath)
+	content := []byte("hello, storage")
+
+	started := time.Now()
+	result, err := t.upload(objectPath, content, "text/plain; charset=utf-8")
+	if err != nil {
+		return err
+	}
+	if result.ObjectPath != objectPath || result.Size != int64(len(content)) || result.ETag == "" {
+		return fmt.Errorf("upload returned %+v", result)
+	}
+
+	exists, err := t.storage.Exists(objectPath)
+	if err != nil || !exists {
+		return fmt.Errorf("exists=%v err=%v after upload", exists, err)
+	}
+	info, err := t.storage.GetFileInfo(objectPath)
+	if err != nil {
+		return err
+	}
+	if info.Key != objectPath || info.Size != result.Size || info.ETag != result.ETag {
+		return fmt.Errorf("file info %+v does not match upload %+v", info, result)
+	}
+	if !strings.HasPrefix(info.ContentType, "text/plain") {
+		return fmt.Errorf("content type %q, want text/plain", info.ContentType)
+	}
+	// 服务端时钟可能略有偏差
+	if d := info.LastModified.Sub(started); d < -5*time.Minute || d > 5*time.Minute {
+		return fmt.Errorf("last modified %v, uploaded at %v", info.LastModified, started)
+	}
+	return t.expectContent(objectPath, content)
+}
+
+func (t *suite) overwrite() error {
+	objectPath := t.path("overwrite/data.bin")
+	defer t.storage.Delete(objectPath)
+
+	first, err := t.upload(objectPath, []byte("first version"), "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	content := []byte("second, longer version")
+	second, err := t.upload(objectPath, content, "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	if second.ETag == first.ETag {
+		return fmt.Errorf("etag %q unchanged by new content", second.ETag)
+	}
+	info, err := t.storage.GetFileInfo(objectPath)
+	if err != nil {
+		return err
+	}
+	if info.Size != int64(len(content)) || info.ETag != second.ETag {
+		return fmt.Errorf("file info %+v after overwrite, want size %d etag %q", info, len(content), second.ETag)
+	}
+	return t.expectContent(objectPath, content)
+}
+
+func (t *suite) sizes() error {
+	unknown := t.path("sizes/unknown.bin")
+	empty := t.path("sizes/empty.bin")
+	defer t.storage.Delete(unknown)
+	defer t.storage.Delete(empty)
+
+	content := []byte(strings.Repeat("unknown size ", 100))
+	result, err := t.storage.Upload(unknown, bytes.NewReader(content), storage.UploadOptions{
+		ContentType: "application/octet-stream",
+		Size:        -1,
+	})
+	if err != nil {
+		return fmt.Errorf("upload of unknown size: %w", err)
+	}
+	if result.Size != int64(len(content)) {
+		return fmt.Errorf("upload of unknown size reported %d bytes, want %d", result.Size, len(content))
+	}
+	if err := t.expectContent(unknown, content); err != nil {
+		return err
+	}
+
+	if _, err := t.upload(empty, nil, "application/octet-stream"); err != nil {
+		return fmt.Errorf("empty upload: %w", err)
+	}
+	info, err := t.storage.GetFileInfo(empty)
+	if err != nil {
+		return err
+	}
+	if info.Size != 0 {
+		return fmt.Errorf("empty object has size %d", info.Size)
+	}
+	return t.expectContent(empty, []byte{})
+}
+
+func (t *suite) missing() error {
+	objectPath := t.path("missing/never-uploaded.txt")
+	if err := t.expectMissing(objectPath); err != nil {
+		return err
+	}
+	if err := t.storage.Delete(objectPath); err != nil {
+		return fmt.Errorf("deleting a missing object: %w", err)
+	}
+	return nil
+}
+
+func (t *suite) deleted() error {
+	objectPath := t.path("deleted/gone.txt")
+	if _, err := t.upload(objectPath, []byte("soon gone"), "text/plain"); err != nil {
+		return err
+	}
+	if err := t.storage.Delete(objectPath); err != nil {
+		return err
+	}
+	if err := t.expectMissing(objectPath); err != nil {
+		return err
+	}
+	if _, err := t.read(objectPath); err == nil {
+		return fmt.Errorf("deleted object still readable")
+	}
+	return nil
+}
+
+func (t *suite) downloadURLs() error {
+	first := t.path("urls/first.txt")
+	second := t.path("urls/second.txt")
+	defer t.storage.Delete(first)
+	defer t.storage.Delete(second)
+	for _, objectPath := range []string{first, second} {
+		if _, err := t.upload(objectPath, []byte(objectPath), "text/plain"); err != nil {
+			return err
+		}
+	}
+
+	firstURL, err := expectObjectURL(t.storage.Download, first)
+	if err != nil {
+		return err
+	}
+	secondURL, err := expectObjectURL(t.storage.Download, second)
+	if err != nil {
+		return err
+	}
+	if firstURL == secondURL {
+		return fmt.Errorf("two objects share the download URL %s", firstURL)
+	}
+	if err := t.expectContent(first, []byte(first)); err != nil {
+		return err
+	}
+	return t.expectContent(second, []byte(second))
+}
+
+func (t *suite) namedDownload() error {
+	if _, ok := t.storage.(storage.NamedDownloader); !ok || t.options.ReadDirect {
+		return errUnsupported
+	}
+	// 与去重后的内容对象一样，路径中没有文件名和扩展名
+	objectPath := t.path("named/content")
+	defer t.storage.Delete(objectPath)
+	content := []byte("\x89PNG\r\n\x1a\nnot really an image")
+	if _, err := t.upload(objectPath, content, "application/octet-stream"); err != nil {
+		return err
+	}
+
+	downloadURL, err := storage.DownloadAs(t.storage, objectPath, time.Minute, storage.DownloadOptions{
+		FileName:    "holiday photo.png",
+		ContentType: "image/png",
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Get(downloadURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download returned %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "image/png" {
+		return fmt.Errorf("Content-Type %q, want image/png", contentType)
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] != "holiday photo.png" {
+		return fmt.Errorf("Content-Disposition %q, want the file name", resp.Header.Get("Content-Disposition"))
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, content) {
+		return fmt.Errorf("downloaded %d bytes, want %d", len(got), len(content))
+	}
+	return nil
+}
+
+func (t *suite) presignedUpload() error {
+	objectPath := t.path("presigned/upload.txt")
+	defer t.storage.Delete(objectPath)
+
+	// 上传URL的形式因实现而异（七牛云为表单上传凭证），只要求是绝对URL
+	uploadURL, err := t.storage.GetUploadURL(objectPath, time.Minute)
+	if err != nil {
+		return err
+	}
+	if u, err := url.Parse(uploadURL); err != nil || !u.IsAbs() {
+		return fmt.Errorf("invalid upload URL %q", uploadURL)
+	}
+	if !t.options.PresignedPut {
+		return nil
+	}
+
+	content := []byte("uploaded with a presigned URL")
+	req, err := http.NewRequest(http.MethodPut, uploadURL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("presigned upload returned %d", resp.StatusCode)
+	}
+
+	info, err := t.storage.GetFileInfo(objectPath)
+	if err != nil {
+		return err
+	}
+	if info.Size != int64(len(content)) {
+		return fmt.Errorf("presigned upload stored %d bytes, want %d", info.Size, len(content))
+	}
+	return t.expectContent(objectPath, content)
+}
+
+func (t *suite) unusualPaths() error {
+	objectPath := t.path("unusual/报告 final (1)+draft.txt")
+	defer t.storage.Delete(objectPath)
+
+	content := []byte("spaces, unicode and reserved characters")
+	if _, err := t.upload(objectPath, content, "text/plain"); err != nil {
+		return err
+	}
+	if _, err := expectObjectURL(t.storage.Download, objectPath); err != nil {
+		return err
+	}
+	return t.expectContent(objectPath, content)
+}
+
+func (t *suite) largeObject() error {
+	objectPath := t.path("large/object.bin")
+	defer t.storage.Delete(objectPath)
+
+	size := t.options.LargeObjectSize
+	hash := sha256.New()
+	reader := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(size)), size), hash)
+	result, err := t.storage.Upload(objectPath, reader, storage.UploadOptions{
+		ContentType: "application/octet-stream",
+		Size:        size,
+	})
+	if err != nil {
+		return err
+	}
+	if result.Size != size {
+		return fmt.Errorf("upload reported %d bytes, want %d", result.Size, size)
+	}
+	want := hash.Sum(nil)
+
+	content, err := t.read(objectPath)
+	if err != nil {
+		return err
+	}
+	if got := sha256.Sum256(content); int64(len(content)) != size || !bytes.Equal(got[:], want) {
+		return fmt.Errorf("read back %d bytes with a different hash", len(content))
+	}
+	return nil
+}
+
+func (t *suite) multipartUpload() error {
+	s, ok := t.storage.(storage.MultipartStorage)
+	if !ok {
+		return errUnsupported
+	}
+	objectPath := t.path("multipart/assembled.bin")
+	defer s.Delete(objectPath)
+
+	uploadID, err := s.CreateMultipartUpload(objectPath, storage.UploadOptions{ContentType: "application/octet-stream"})
+	if err != nil {
+		return err
+	}
+	// 第一片为最小分片大小，最后一片可以更小
+	first := bytes.Repeat([]byte("a"), storage.MinPartSize)
+	last := []byte("the last part")
+	var parts []storage.UploadedPart
+	for i, content := range [][]byte{first, last} {
+		etag, err := s.UploadPart(objectPath, uploadID, i+1, bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			s.AbortMultipartUpload(objectPath, uploadID)
+			return fmt.Errorf("part %d: %w", i+1, err)
+		}
+		parts = append(parts, storage.UploadedPart{Number: i + 1, ETag: etag})
+	}
+	result, err := s.CompleteMultipartUpload(objectPath, uploadID, parts)
+	if err != nil {
+		s.AbortMultipartUpload(objectPath, uploadID)
+		return err
+	}
+
+	want := append(append([]byte{}, first...), last...)
+	if result.ObjectPath != objectPath || result.Size != int64(len(want)) || result.ETag == "" {
+		return fmt.Errorf("complete returned %+v", result)
+	}
+	info, err := s.GetFileInfo(objectPath)
+	if err != nil {
+		return err
+	}
+	if info.Size != result.Size || info.ETag != result.ETag {
+		return fmt.Errorf("file info %+v does not match upload %+v", info, result)
+	}
+	return t.expectContent(objectPath, want)
+}
+
+func (t *suite) multipartAbort() error {
+	s, ok := t.storage.(storage.MultipartStorage)
+	if !ok {
+		return errUnsupported
+	}
+	objectPath := t.path("multipart/aborted.bin")
+
+	uploadID, err := s.CreateMultipartUpload(objectPath, storage.UploadOptions{ContentType: "application/octet-stream"})
+	if err != nil {
+		return err
+	}
+	content := []byte("never completed")
+	if _, err := s.UploadPart(objectPath, uploadID, 1, bytes.NewReader(content), int64(len(content))); err != nil {
+		s.AbortMultipartUpload(objectPath, uploadID)
+		return err
+	}
+	if err := s.AbortMultipartUpload(objectPath, uploadID); err != nil {
+		return err
+	}
+	if _, err := s.CompleteMultipartUpload(objectPath, uploadID, []storage.UploadedPart{{Number: 1}}); err == nil {
+		return fmt.Errorf("aborted upload could still be completed")
+	}
+	return t.expectMissing(objectPath)
+}
+
+func (t *suite) objectReader() error {
+	if _, ok := t.storage.(storage.ObjectReader); !ok {
+		return errUnsupported
+	}
+	objectPath := t.path("reader/object.bin")
+	want := make([]byte, 1<<20+17)
+	rand.New(rand.NewSource(int64(len(want)))).Read(want)
+	if _, err := t.upload(objectPath, want, "application/octet-stream"); err != nil {
+		return err
+	}
+	defer t.storage.Delete(objectPath)
+
+	reader, err := storage.OpenObject(t.storage, objectPath)
+	if err != nil {
+		return err
+	}
+	got, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("read %d bytes, want %d", len(got), len(want))
+	}
+
+	if _, err := storage.OpenObject(t.storage, t.path("reader/missing.bin")); !errors.Is(err, storage.ErrObjectNotFound) {
+		return fmt.Errorf("reading a missing object returned %v, want %v", err, storage.ErrObjectNotFound)
+	}
+	return nil
+}
+
+// expectObjectURL 生成对象的URL，检查它是绝对URL且路径以对象路径结尾
+func expectObjectURL(generate func(string, time.Duration) (string, error), objectPath string) (string, error) {
+	rawURL, err := generate(objectPath, time.Minute)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+	if !u.IsAbs() {
+		return "", fmt.Errorf("URL %q is not absolute", rawURL)
+	}
+	if !strings.HasSuffix(u.Path, "/"+objectPath) {
+		return "", fmt.Errorf("URL %q does not address %s", rawURL, objectPath)
+	}
+	return rawURL, nil
+}
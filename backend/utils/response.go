@@ -17,24 +17,28 @@ const (
 	CODE_FORBIDDEN         = 4003 // 无权限
 	CODE_NOT_FOUND         = 4004 // 资源不存在
 	CODE_VALIDATION_ERROR  = 4005 // 数据验证失败
+	CODE_TOO_MANY_REQUESTS = 4029 // 请求过多
 
 	// 服务端错误 (5xxx)
-	CODE_INTERNAL_ERROR    = 5000 // 服务器内部错误
-	CODE_DATABASE_ERROR    = 5001 // 数据库错误
-	CODE_THIRD_PARTY_ERROR = 5002 // 第三方服务错误
+	CODE_INTERNAL_ERROR      = 5000 // 服务器内部错误
+	CODE_DATABASE_ERROR      = 5001 // 数据库错误
+	CODE_THIRD_PARTY_ERROR   = 5002 // 第三方服务错误
+	CODE_SERVICE_UNAVAILABLE = 5003 // 服务暂不可用
 )
 
 // 响应码对应的默认消息
 var codeMessages = map[int]string{
-	CODE_SUCCESS:           "成功",
-	CODE_BAD_REQUEST:       "请求参数错误",
-	CODE_UNAUTHORIZED:      "未认证或认证失败",
-	CODE_FORBIDDEN:         "无权限访问",
-	CODE_NOT_FOUND:         "资源不存在",
-	CODE_VALIDATION_ERROR:  "数据验证失败",
-	CODE_INTERNAL_ERROR:    "服务器内部错误",
-	CODE_DATABASE_ERROR:    "数据库操作失败",
-	CODE_THIRD_PARTY_ERROR: "第三方服务异常",
+	CODE_SUCCESS:             "成功",
+	CODE_BAD_REQUEST:         "请求参数错误",
+	CODE_UNAUTHORIZED:        "未认证或认证失败",
+	CODE_FORBIDDEN:           "无权限访问",
+	CODE_NOT_FOUND:           "资源不存在",
+	CODE_VALIDATION_ERROR:    "数据验证失败",
+	CODE_TOO_MANY_REQUESTS:   "请求过多",
+	CODE_INTERNAL_ERROR:      "服务器内部错误",
+	CODE_DATABASE_ERROR:      "数据库操作失败",
+	CODE_THIRD_PARTY_ERROR:   "第三方服务异常",
+	CODE_SERVICE_UNAVAILABLE: "服务暂不可用",
 }
 
 // ApiResponse 统一API响应结构
@@ -107,6 +111,11 @@ func ValidationErrorResponse(c *gin.Context, message string) {
 	ErrorResponse(c, http.StatusBadRequest, CODE_VALIDATION_ERROR, message)
 }
 
+// TooManyRequestsResponse 429错误响应
+func TooManyRequestsResponse(c *gin.Context, message string) {
+	ErrorResponse(c, http.StatusTooManyRequests, CODE_TOO_MANY_REQUESTS, message)
+}
+
 // InternalErrorResponse 500错误响应
 func InternalErrorResponse(c *gin.Context, message string) {
 	ErrorResponse(c, http.StatusInternalServerError, CODE_INTERNAL_ERROR, message)
@@ -115,4 +124,9 @@ func InternalErrorResponse(c *gin.Context, message string) {
 // DatabaseErrorResponse 数据库错误响应
 func DatabaseErrorResponse(c *gin.Context, message string) {
 	ErrorResponse(c, http.StatusInternalServerError, CODE_DATABASE_ERROR, message)
-}
\ No newline at end of file
+}
+
+// ServiceUnavailableResponse 503错误响应
+func ServiceUnavailableResponse(c *gin.Context, message string) {
+	ErrorResponse(c, http.StatusServiceUnavailable, CODE_SERVICE_UNAVAILABLE, message)
+}